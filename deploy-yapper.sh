@@ -7,17 +7,36 @@ TOOL_PROD="/data/project/yapping-sodium/prod"
 mkdir -p "$TOOL_PROD/frs"
 mkdir -p "$TOOL_PROD/pruner"
 
-cp -r "$STAGING_DIR/frs" "$TOOL_PROD/frs/frs"
-cp -r "$STAGING_DIR/pruner" "$TOOL_PROD/pruner/pruner"
+cp "$STAGING_DIR/yapperbot" "$TOOL_PROD/yapperbot"
+rm -f "$TOOL_PROD/frs/frs" "$TOOL_PROD/pruner/pruner"
 cp "$STAGING_DIR/config-frs.yml" "$TOOL_PROD/frs/config-frs.yml"
 cp "$STAGING_DIR/config-global.yml" "$TOOL_PROD/config-global.yml"
 DB_USER=$(awk -F' *= *' '/user *=/ {print $2}' /data/project/yapping-sodium/replica.my.cnf)
 DB_PASS=$(awk -F' *= *' '/password *=/ {print $2}' /data/project/yapping-sodium/replica.my.cnf)
-sed -E "s#dsn: [^@]+@#dsn: ${DB_USER}:${DB_PASS}@#" "$STAGING_DIR/config-pruner.yml" > "$TOOL_PROD/pruner/config-pruner.yml"
-chmod 600 "$TOOL_PROD/pruner/config-pruner.yml"
-cp "$STAGING_DIR/jobs.yaml" "$TOOL_PROD/jobs.yaml"
+cp "$STAGING_DIR/config-pruner.yml" "$TOOL_PROD/pruner/config-pruner.yml"
+
+# wiki_names prints the name of each wiki under wikis in the given config files, which is its dbname
+wiki_names() {
+    awk '/^wikis:/ { inwikis = 1; next } /^[^ #]/ { inwikis = 0 } inwikis && /^  [A-Za-z0-9_]+:/ { sub(/^  /, ""); sub(/:.*/, ""); print }' "$@" | sort -u
+}
+
+# write_dsn writes the DSN for a wiki's replica, named after its dbname, into a file. The DSN has the
+# replica password in it, so it lives in its own file that only the tool can read.
+write_dsn() {
+    (umask 077 && echo "${DB_USER}:${DB_PASS}@tcp($1.analytics.db.svc.eqiad.wmflabs:3306)/$1_p" > "$2")
+    chmod 600 "$2"
+}
 
-chmod 600 "$TOOL_PROD/pruner/config-pruner.yml"
+# the shared dsn is for configs without any wikis, which run on enwiki; every wiki in wikis gets its
+# own dsn-<wiki>, so that the Pruner doesn't look users up in the wrong wiki's replica
+rm -f "$TOOL_PROD/pruner"/dsn-*
+write_dsn enwiki "$TOOL_PROD/pruner/dsn"
+for WIKI in $(wiki_names "$STAGING_DIR/config-global.yml" "$STAGING_DIR/config-pruner.yml"); do
+    write_dsn "$WIKI" "$TOOL_PROD/pruner/dsn-$WIKI"
+done
+
+cp "$STAGING_DIR/jobs.yaml" "$TOOL_PROD/jobs.yaml"
+cp "$STAGING_DIR/daemon.yml" "$TOOL_PROD/daemon.yml"
 
 if [ -f "$STAGING_DIR/botpassword" ]; then
     cp "$STAGING_DIR/botpassword" "$TOOL_PROD/botpassword"
@@ -1,4 +1,4 @@
-package main
+package frs
 
 //
 // Yapperbot-FRS, the Feedback Request Service bot for Wikipedia
@@ -22,21 +22,21 @@ import (
 	"errors"
 	"log"
 	"math/rand"
-	"strings"
 
 	"github.com/sohomdatta1/yapperbot-services/frs/src/frslist"
 	"github.com/sohomdatta1/yapperbot-services/frs/src/messages"
 	"github.com/sohomdatta1/yapperbot-services/frs/src/rfc"
 
-	"cgt.name/pkg/go-mwclient"
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
 )
 
 const maxMsgsToSend int = 15
 const minMsgsToSend int = 5
 
-// requestFeedbackFor takes an object that implements frsRequesting and a mwclient instance,
+// requestFeedbackFor takes an object that implements frsRequesting and the bot,
 // and processes the feedback request for the frsRequesting object.
-func requestFeedbackFor(requester frsRequesting, w *mwclient.Client) (err error) {
+func requestFeedbackFor(requester frsRequesting, bot *ybtools.Bot) (err error) {
 	// msgsToSend is a randomly-selected number of messages we want to send out.
 	// it evaluates out to any number between max and min
 	var msgsToSend int = (rand.Intn(maxMsgsToSend-minMsgsToSend) + minMsgsToSend)
@@ -66,12 +66,16 @@ func requestFeedbackFor(requester frsRequesting, w *mwclient.Client) (err error)
 
 	// Early return if the page is in userspace, prevent
 	// https://en.wikipedia.org/wiki/Wikipedia:Bots/Noticeboard#c-Dw31415-20260109145700-Dw31415_-_DwAlphaBot_-_SodiumBot_conflict_on_RfCHistory
-	if strings.HasPrefix(requester.PageTitle(), "User:") {
+	site, err := bot.Site()
+	if err != nil {
+		return err
+	}
+	if page, err := site.Parse(requester.PageTitle()); err == nil && page.Namespace == title.NamespaceUser {
 		return nil
 	}
 
 	if len(headersToSendTo) > 0 {
-		users := frslist.GetUsersFromHeaders(headersToSendTo, allHeader, msgsToSend)
+		users := frslist.GetUsersFromHeaders(bot, headersToSendTo, allHeader, msgsToSend)
 		for _, user := range users {
 			messages.QueueMessage(&messages.Message{
 				User:  user,
@@ -1,4 +1,4 @@
-package main
+package frs
 
 //
 // Yapperbot-FRS, the Feedback Request Service bot for Wikipedia
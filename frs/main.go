@@ -1,4 +1,4 @@
-package main
+package frs
 
 //
 // Yapperbot-FRS, the Feedback Request Service bot for Wikipedia
@@ -36,33 +36,44 @@ import (
 	"cgt.name/pkg/go-mwclient/params"
 	"github.com/metal3d/go-slugify"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
 )
 
 var wikiErrors map[string]string = make(map[string]string, 0)
 
-func init() {
-	ybtools.SetupBot(ybtools.BotSettings{TaskName: "FRS", BotUser: "SodiumBot", ToolforgeAccount: "yapping-sodium"})
-	ybtools.ParseTaskConfig(&yapperconfig.Config)
-}
-
-func main() {
-	w := ybtools.CreateAndAuthenticateClient(ybtools.DefaultMaxlag)
+// Run runs the Feedback Request Service, sending out invitations for every new RfC
+// and GA nomination since the last run, with the given options, or the defaults if opts is nil.
+// It returns an error if the bot couldn't be set up.
+func Run(opts *ybtools.Options) error {
+	bot, err := ybtools.New(ybtools.BotSettings{TaskName: "FRS", BotUser: "SodiumBot", ToolforgeAccount: "yapping-sodium", OptOut: []string{"frs"}, Config: &yapperconfig.Config, Options: opts})
+	if err != nil {
+		return err
+	}
+	defer bot.SaveRunReport()
+	if _, err := bot.Connect(ybtools.DefaultMaxlag); err != nil {
+		bot.PanicErr("Failed to connect to the wiki with error ", err)
+	}
 
-	frslist.Populate()
-	rfc.LoadRfcsDone(w)
-	defer ybtools.SaveEditLimit()
+	// a run may not be the first in the process, as in the daemon, so start everything afresh
+	wikiErrors = map[string]string{}
+	messages.ClearQueue()
+	frslist.Populate(bot)
+	rfc.LoadRfcsDone(bot)
+	defer bot.SaveEditLimit()
 
-	ga.FetchGATopics()
+	ga.FetchGATopics(bot)
 
-	processCategory(w, "Category:Wikipedia requests for comment", true)
-	processCategory(w, "Category:Good article nominees", false)
-	finishRun(w)
+	processCategory(bot, "Category:Wikipedia requests for comment", true)
+	processCategory(bot, "Category:Good article nominees", false)
+	finishRun(bot)
+	return nil
 }
 
-// processCategory takes a mwclient instance, a category name, and a bool indicating if the category contains RfCs.
+// processCategory takes the bot, a category name, and a bool indicating if the category contains RfCs.
 // it then iterates through the pages in the category, checking whether they've already been processed; if they've not,
 // and they're applicable, they'll be sent for a feedback request. This is the main program loop.
-func processCategory(w *mwclient.Client, category string, rfcCat bool) {
+func processCategory(bot *ybtools.Bot, category string, rfcCat bool) {
+	w := bot.Client()
 	var startStamp, startID string
 	var newRunfile bool
 	var parameters params.Values
@@ -78,9 +89,9 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 			"rvslots":   "main",
 		}
 	} else {
-		startStamp, startID = loadFromRunfile(category)
+		startStamp, startID = loadFromRunfile(bot, category)
 		if startStamp == "" {
-			startStamp = time.Now().Format(time.RFC3339)
+			startStamp = bot.Now().Format(time.RFC3339)
 			// Set our runfile to store this now, as there's potentially going to be nothing in the queue
 			newRunfile = true
 		}
@@ -96,8 +107,8 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 			"clprop":       "timestamp",
 			"clcategories": category,
 			"gcmdir":       "descending",
-			"gcmstart":     time.Now().Add(-time.Hour).Format(time.RFC3339), // give it at least an hour of tranquility before invites go out
-			"gcmend":       startStamp,                                      // this is gcmend not gcmstart as it's going down from the most recent
+			"gcmstart":     bot.Now().Add(-time.Hour).Format(time.RFC3339), // give it at least an hour of tranquility before invites go out
+			"gcmend":       startStamp,                                     // this is gcmend not gcmstart as it's going down from the most recent
 		}
 	}
 
@@ -105,7 +116,10 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 	query := w.NewQuery(parameters)
 
 	for query.Next() {
-		pages := ybtools.GetPagesFromQuery(query.Resp())
+		pages, err := ybtools.PagesFromQuery(query.Resp())
+		if err != nil {
+			bot.PanicErr("Failed to decode pages in category ", category, " with error ", err)
+		}
 		// There seems to be no guarantee that the value of pages will be ordered, in any way.
 		if len(pages) > 0 {
 			if !rfcCat {
@@ -118,51 +132,50 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 					firstItemParams["gcmlimit"] = "1"
 					firstItemResp, err := w.Get(firstItemParams)
 					if err != nil {
-						ybtools.PanicErr("Failed to get firstItemResp with err ", err)
+						bot.PanicErr("Failed to get firstItemResp with err ", err)
 					}
 
-					firstItemRespPages := ybtools.GetPagesFromQuery(firstItemResp)
+					firstItemRespPages, err := ybtools.PagesFromQuery(firstItemResp)
+					if err != nil {
+						bot.PanicErr("Failed to decode firstItemResp with err ", err)
+					}
 					if len(firstItemRespPages) != 1 {
-						ybtools.PanicErr("firstItemRespPages returned more than one page! Dying.")
+						bot.PanicErr("firstItemRespPages returned more than one page! Dying.")
 					}
 
 					var runfileBuilder strings.Builder
-					runfileBuilder.WriteString(ybtools.GetCategorisationTimestampFromPage(firstItemRespPages[0], category))
+					runfileBuilder.WriteString(categorisationTimestamp(bot, firstItemRespPages[0], category))
 					runfileBuilder.WriteString(";")
 
-					firstItemPageID, err := firstItemRespPages[0].GetInt64("pageid")
-					if err != nil {
-						ybtools.PanicErr("Failed to get pageid from the first item in the queue with error message ", err)
-					}
 					// Remember to do this! Golang by default turns integers just into the
 					// corresponding unicode sequence with string(n) - e.g. string(5)
 					// returns "\x05"
-					runfileBuilder.WriteString(strconv.FormatInt(firstItemPageID, 10))
+					runfileBuilder.WriteString(strconv.FormatInt(firstItemRespPages[0].PageID, 10))
 					firstItem = runfileBuilder.String()
 				}
 			}
 
 		PAGELOOP:
 			for index, page := range pages {
-				pageIDInt, err := page.GetInt64("pageid")
-				if err != nil {
-					ybtools.PanicErr("Failed to get pageid from page in category ", category, " with index ", index, ", error was: ", err)
+				bot.ReportScanned()
+				if page.PageID == 0 {
+					bot.PanicErr("Failed to get pageid from page in category ", category, " with index ", index)
 				}
-				pageID := strconv.FormatInt(pageIDInt, 10) // format it into a string integer
+				pageID := strconv.FormatInt(page.PageID, 10) // format it into a string integer
 
-				pageTitle, err := page.GetString("title")
-				if err != nil {
+				pageTitle := page.Title
+				if pageTitle == "" {
 					log.Println("Failed to get title from page ID", pageID, "so skipping it")
 					continue
 				}
 
-				if strings.HasPrefix(strings.ToLower(pageTitle), "category:") {
+				if page.Namespace == title.NamespaceCategory {
 					log.Println("Category", pageTitle, "inside master category so skipping it")
 				}
 
-				pageContent, err := ybtools.GetContentFromPage(page)
+				pageContent, err := page.Content()
 				if err != nil {
-					log.Println("getContentFromPage failed on page ID", pageID, "so skipping it")
+					log.Println("Failed to get content from page ID", pageID, "so skipping it. Error was", err)
 					continue
 				}
 
@@ -170,7 +183,10 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 					// (content, title, excludeDone)
 					rfcsToProcess, err := extractRfcs(pageContent, pageTitle, false)
 					if err != nil {
-						ybtools.PanicErr("extractRfcs errored with ", err)
+						// only this page's RfCs are affected, so the rest can still go ahead
+						bot.ReportErr("extractRfcs errored on page ", pageTitle, " with ", err)
+						wikiErrors[pageTitle] = err.Error()
+						continue PAGELOOP
 					}
 					rfcsDone := make([]rfc.RfC, 0, len(rfcsToProcess))
 
@@ -184,7 +200,7 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 							log.Println("RfC feedback already done for an RfC on", pageTitle, "so skipping that RfC")
 						} else {
 							log.Println("Requesting feedback for an RfC on", pageTitle)
-							err = requestFeedbackFor(rfc, w)
+							err = requestFeedbackFor(rfc, bot)
 							if err != nil {
 								wikiErrors[rfc.PageTitle()] = err.Error()
 							}
@@ -198,7 +214,7 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 					// Because each article can only have one GA nomination at a time, it's not necessary to do the full gamut of RfC checks here
 					// we can instead just pass it on to requestFeedbackFor after checking that it's not the same page we did first last time
 					// to do that check, we check whether the page ID and timestamp are the same (both stored in the runfile) - if they are, it's the same page
-					if (pageID == startID) && (ybtools.GetCategorisationTimestampFromPage(page, category) == startStamp) {
+					if (pageID == startID) && (categorisationTimestamp(bot, page, category) == startStamp) {
 						// it's the first page from last time, we're probably at the end - skip over it
 						continue PAGELOOP
 					} else {
@@ -207,7 +223,7 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 							wikiErrors[pageTitle] = err.Error()
 							continue PAGELOOP
 						}
-						err = requestFeedbackFor(ganom, w)
+						err = requestFeedbackFor(ganom, bot)
 						if err != nil {
 							wikiErrors[ganom.PageTitle()] = err.Error()
 						}
@@ -223,7 +239,7 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 	if query.Err() == nil {
 		log.Println("Finished the queue for category", category, "so ending here")
 	} else {
-		ybtools.PanicErr("Errored while querying for relevant new pages with error: ", query.Err())
+		bot.PanicErr("Errored while querying for relevant new pages with error: ", query.Err())
 	}
 
 	// If it uses a runfile, and there actually is something to write
@@ -231,39 +247,69 @@ func processCategory(w *mwclient.Client, category string, rfcCat bool) {
 		// Store the done timestamp and page id into the runfile for next use
 		err := os.WriteFile(slugify.Marshal(category)+".frsrunfile", []byte(firstItem), 0644)
 		if err != nil {
-			ybtools.PanicErr("Failed to write timestamp and id to runfile")
+			bot.PanicErr("Failed to write timestamp and id to runfile")
 		}
 	}
 }
 
+// categorisationTimestamp takes a page and the category it's in, and gets the timestamp at which the page was categorised.
+// All the errors in this function are fatal, because frankly, if something's gone wrong with the timestamp reading,
+// we're not really going to be able to run the algorithm correctly anyway.
+func categorisationTimestamp(bot *ybtools.Bot, page ybtools.Page, category string) string {
+	// the category is named in English if the wiki's own names for namespaces can't be looked up
+	site, _ := bot.Site()
+	membership, ok := page.Category(site, category)
+	if !ok {
+		bot.PanicErr("Failed to get membership of ", category, " for page ", page.Title)
+	}
+	if membership.Timestamp.IsZero() {
+		bot.PanicErr("Failed to get categorisation timestamp in ", category, " for page ", page.Title)
+	}
+	return membership.Timestamp.Format(time.RFC3339)
+}
+
 // finishRun is called at the end of the FRS run, once everything has completed successfully.
 // The invocation of finishRun is what starts the message queue processing. This is only a
 // separate function really so that we can scope the frslist FinishRun and rfc SaveRfcsDone
 // defers into here; this means that if something goes awfully wrong somewhere else in the
 // program, we don't end up saving rubbish data after having sent nothing at all, but
 // it also means if something goes wrong in the actual sending, the lists are kept up to date.
-func finishRun(w *mwclient.Client) {
-	defer frslist.FinishRun(w)
-	defer rfc.SaveRfcsDone(w)
+func finishRun(bot *ybtools.Bot) {
+	defer frslist.FinishRun(bot)
+	defer rfc.SaveRfcsDone(bot)
 
 	// this below line is critical to run, because without it nothing will actually be sent;
 	// however, we do NOT want to defer it, because if we do, it would still run on panicks.
 	// if something has gone wrong, we don't want to send messages, so we oughtn't run this.
-	messages.SendMessageQueue(w)
-	logErrors(w)
+	messages.SendMessageQueue(bot)
+	logErrors(bot)
 }
 
-// Log all recoverable errors onwiki on a page that can be watchlisted
-func logErrors(w *mwclient.Client) {
+// Log all recoverable errors onwiki on a page that can be watchlisted,
+// and in the run report
+func logErrors(bot *ybtools.Bot) {
 	numErrs := len(wikiErrors)
+	for pageTitle, wikiError := range wikiErrors {
+		bot.ReportError(pageTitle, wikiError)
+	}
+
+	if yapperconfig.Config.ErrorsPageID == "" {
+		log.Println("No errorspageid configured, so only reporting the", numErrs, "errors in the run report")
+		return
+	}
 
 	errTable := buildErrorTable(wikiErrors)
 
-	w.Edit(params.Values{
-		"pageid":   yapperconfig.Config.ErrorsPageID,
-		"summary":  fmt.Sprintf("FRS run finished with %d errors, updating errors page", numErrs),
-		"notminor": "true",
-		"bot":      "true",
-		"text":     errTable,
+	err := bot.Do(func() error {
+		return bot.Client().Edit(params.Values{
+			"pageid":   yapperconfig.Config.ErrorsPageID,
+			"summary":  fmt.Sprintf("FRS run finished with %d errors, updating errors page", numErrs),
+			"notminor": "true",
+			"bot":      "true",
+			"text":     errTable,
+		})
 	})
+	if err != nil && err != mwclient.ErrEditNoChange {
+		bot.ReportErr("Failed to update the errors page with error ", err)
+	}
 }
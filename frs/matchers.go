@@ -1,4 +1,4 @@
-package main
+package frs
 
 //
 // Yapperbot-FRS, the Feedback Request Service bot for Wikipedia
@@ -20,75 +20,37 @@ package main
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 
 	"github.com/sohomdatta1/yapperbot-services/frs/src/ga"
 	"github.com/sohomdatta1/yapperbot-services/frs/src/rfc"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/wikitext"
 )
 
-// rfcMatcher is a regex that matches {{rfc}} templates on pages.
-// Its contents are documented in matchers.go:init().
-var rfcMatcher *regexp.Regexp
-
-// gaMatcher is a regex that matches {{GA nominee}} templates on pages.
-// Its contents are documented in matchers.go:init().
-var gaMatcher *regexp.Regexp
-
-// namedParamMatcher is a regex that matches against named parameters in
-// a template parameter list; e.g. {{template|name=param}}, matching name=param.
-// Its contents are documented in matchers.go:init().
-var namedParamMatcher *regexp.Regexp
-
-const rfcIDParam string = "rfcid="
-
-func init() {
-	// RfC matching regex.
-	// First capture group is all the params of the rfc template
-	// (all non-named params are to be treated as categories)
-	// second capture group is the actual content of the RfC
-	rfcMatcher = regexp.MustCompile(`(?i){{rfc\|(.*?)}}(.|\n)*?\(UTC\)`)
-
-	// GA nom matching regex.
-	// First capture group is the topic. Second capture group is the subtopic.
-	// IMPORTANT: If the subtopic is empty, the first capture group will be empty string, and likewise for the topic.
-	// This regex will always prefer a topic to a subtopic, but will settle for a subtopic if no topic is available.
-	// Great thanks go to Ouims from #regex on Freenode for the help with debugging and correcting this regex!
-	gaMatcher = regexp.MustCompile(`(?i){{GA nominee(?:\s*\|(?:[^|}]*?\|)*(?:[\t\f\v ]*?(?:subtopic=([^|}]+).*?)|topic=([^|}]+))|.*?)*\s*}}`)
-
-	// Matches against named parameters in the parameter list.
-	// Ensures the equals is after a named param specifically.
-	// The [\w\d\s] set means it won't trigger on {{=}} and the like.
-	namedParamMatcher = regexp.MustCompile(`(?m)^[\w\d\s]*?=`)
-}
-
 // extractRfcs takes a string of content containing rfcs, and the page title,
 // and returns a slice of rfcs. It can optionally be passed excludeDone, which prevents
 // already-done RfCs from being included in the generated list.
 // extractRfcs output should be checked for RfCs with no ID string, as those haven't
 // yet been assigned an ID by Legobot.
 func extractRfcs(content string, title string, excludeDone bool) (rfcs []rfc.RfC, err error) {
-	matchedRfcTags := rfcMatcher.FindAllStringSubmatch(content, -1)
-	for _, tag := range matchedRfcTags {
-		// group 1 contains all the parameters; split on | to find the individual params
-		params := strings.Split(tag[1], "|")
+	for _, tag := range wikitext.Parse(content).TemplatesNamed("Rfc") {
+		// an RfC isn't open until it's been signed, so ignore any template without a signature after it
+		if !strings.Contains(content[tag.Span().End:], "(UTC)") {
+			continue
+		}
 
-		rfcID, categories, feedbackDone := func(pr []string) (id string, cats map[string]bool, done bool) {
-			cats = make(map[string]bool)
-			for _, p := range pr {
-				if strings.Contains(p, rfcIDParam) {
-					id = strings.TrimPrefix(p, rfcIDParam)
-				} else if !namedParamMatcher.MatchString(p) {
-					// it's not a named param, we can assume it's a category
-					// for more on why this is like this, see frsRequesting
-					cats[p] = true
-				}
-			}
-			if id != "" && rfc.AlreadyDone(id) {
-				done = true
+		var rfcID string
+		categories := make(map[string]bool)
+		for _, p := range tag.Params() {
+			if p.Positional() {
+				// all the positional params are categories
+				// for more on why this is like this, see frsRequesting
+				categories[strings.TrimSpace(p.Value())] = true
+			} else if p.Name() == "rfcid" {
+				rfcID = p.Value()
 			}
-			return
-		}(params)
+		}
+		feedbackDone := rfcID != "" && rfc.AlreadyDone(rfcID)
 
 		if feedbackDone && excludeDone {
 			continue
@@ -102,29 +64,20 @@ func extractRfcs(content string, title string, excludeDone bool) (rfcs []rfc.RfC
 // extractGANom takes a page name and content that's been nominated for GA,
 // and returns the GA nom object.
 func extractGANom(content string, title string) (ga.Nom, error) {
-	matches := gaMatcher.FindStringSubmatch(content)
-	if matches == nil {
+	templates := wikitext.Parse(content).TemplatesNamed("GA nominee")
+	if len(templates) == 0 {
 		return ga.Nom{}, fmt.Errorf(
 			"no GA nomination template found in article %q",
 			title,
 		)
 	}
 
-	// Defensive: ensure we actually have the capture groups we expect
-	// matches[0] is the full match, so we need at least 3 entries
-	if len(matches) < 3 {
-		return ga.Nom{}, fmt.Errorf(
-			"GA matcher returned %d groups for article %q (expected >= 3)",
-			len(matches),
-			title,
-		)
+	nom := ga.Nom{Article: title}
+	if topic := templates[0].Param("topic"); topic != nil {
+		nom.Topic = topic.Value()
 	}
-
-	nom := ga.Nom{
-		Topic:    matches[2],
-		Subtopic: matches[1],
-		Article:  title,
+	if subtopic := templates[0].Param("subtopic"); subtopic != nil {
+		nom.Subtopic = subtopic.Value()
 	}
-
 	return nom, nil
 }
@@ -1,4 +1,4 @@
-package main
+package frs
 
 //
 // Yapperbot-FRS, the Feedback Request Service bot for Wikipedia
@@ -31,7 +31,7 @@ import (
 // This is used to track our progress through the category, and prevent us from sending messages about the
 // same page twice.
 // The function returns the timestamp and the page ID, both as strings.
-func loadFromRunfile(category string) (timestamp, pageID string) {
+func loadFromRunfile(bot *ybtools.Bot, category string) (timestamp, pageID string) {
 	var startRunfile []byte
 	// runfile stores the last categorisation timestamp
 	runfileName := slugify.Marshal(category) + ".frsrunfile"
@@ -40,7 +40,7 @@ func loadFromRunfile(category string) (timestamp, pageID string) {
 		// the runfile doesn't exist probably, try creating it
 		err := os.WriteFile(runfileName, []byte(""), 0644)
 		if err != nil {
-			ybtools.PanicErr("Failed to create runfile with error ", err)
+			bot.PanicErr("Failed to create runfile with error ", err)
 		}
 		return "", ""
 	}
@@ -52,7 +52,7 @@ func loadFromRunfile(category string) (timestamp, pageID string) {
 	case 2:
 		break
 	default:
-		ybtools.PanicErr("Corrupt runfile for category ", category)
+		bot.PanicErr("Corrupt runfile for category ", category)
 	}
 
 	return splitStartRunfile[0], splitStartRunfile[1]
@@ -24,14 +24,12 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/sohomdatta1/yapperbot-services/frs/src/yapperconfig"
 
 	"cgt.name/pkg/go-mwclient"
-	"cgt.name/pkg/go-mwclient/params"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
 )
 
@@ -101,9 +99,12 @@ func init() {
 }
 
 // Populate sets up the FRSList list as appropriate for the start of the program.
-func Populate() {
-	populateFrsList()
-	populateSentCount()
+func Populate(bot *ybtools.Bot) {
+	// in the daemon, the counts from the run before are still here; they're loaded again below
+	sentCount = map[string]map[string]uint16{}
+
+	populateFrsList(bot)
+	populateSentCount(bot)
 }
 
 // GetListHeaders is a simple getter for listHeaders
@@ -114,7 +115,7 @@ func GetListHeaders() []string {
 // GetUsersFromHeaders takes a list of headers and an integer number of users n, and returns a randomly selected portion of the users
 // from the headers, with a total size of maximum n. It won't pick the same user twice, and weights the users based on how far through their limit
 // they are, in an attempt to spread things out a bit. It may pick less than n if there are less users available.
-func GetUsersFromHeaders(headers []string, allHeader string, n int) (returnedUsers []*FRSUser) {
+func GetUsersFromHeaders(bot *ybtools.Bot, headers []string, allHeader string, n int) (returnedUsers []*FRSUser) {
 	var weightedUsers []*frsWeightedUser
 	// used to check in o(1) time whether we've already
 	// selected this user, just on another header
@@ -219,7 +220,7 @@ func GetUsersFromHeaders(headers []string, allHeader string, n int) (returnedUse
 
 	// Reseed to avoid getting the same or similar sequences every time
 	// when we have large batches
-	randomGenerator.Seed(time.Now().UnixNano())
+	randomGenerator.Seed(bot.RandomSeed())
 
 	// Select a random user each time based on our weights
 	var i = 0
@@ -265,19 +266,21 @@ func GetUsersFromHeaders(headers []string, allHeader string, n int) (returnedUse
 }
 
 // FinishRun for now just calls saveSentCounts, but could do something else too in future
-func FinishRun(w *mwclient.Client) {
-	saveSentCounts(w)
+func FinishRun(bot *ybtools.Bot) {
+	saveSentCounts(bot)
 }
 
 // populateFrsList fetches the wikitext of the FRS subscriptions page, and processes the page against
 // the listParserRegex and userParserRegex. Together, those parse the headers in the file, along with
 // the users that are subscribed, turning them into FRSUser objects and storing them in `list`.
-func populateFrsList() string {
-	text, err := ybtools.FetchWikitext(yapperconfig.Config.FRSPageID)
+func populateFrsList(bot *ybtools.Bot) string {
+	text, err := bot.FetchWikitext(yapperconfig.Config.FRSPageID)
 	if err != nil {
-		ybtools.PanicErr("Failed to fetch and parse FRS page with error ", err)
+		bot.PanicErr("Failed to fetch and parse FRS page with error ", err)
 	}
 
+	list = map[string][]*FRSUser{}
+
 	for _, match := range listParserRegex.FindAllStringSubmatch(text, -1) {
 		// match is [entire match, header, contents]
 		var users []*FRSUser
@@ -313,60 +316,111 @@ func populateFrsList() string {
 	return text
 }
 
+// sentCountJSON is the format of the JSON on the SentCount page, mapping headers
+// to usernames and usernames to numbers of messages sent in the month.
+type sentCountJSON struct {
+	Month   string                       `json:"month"`
+	Headers map[string]map[string]uint16 `json:"headers"`
+}
+
+// sentCountState is the SentCount page as it was loaded, to save the new counts back to.
+var sentCountState *ybtools.State[sentCountJSON]
+
+// sentCountStore returns the state store for the SentCount page.
+func sentCountStore() *ybtools.StateStore[sentCountJSON] {
+	return &ybtools.StateStore[sentCountJSON]{
+		PageID:     yapperconfig.Config.SentCountPageID,
+		Notice:     yapperconfig.StateNotice,
+		Version:    yapperconfig.StateVersion,
+		Migrations: yapperconfig.StateMigrations,
+		Merge:      mergeSentCounts,
+	}
+}
+
 // populateSentCount fetches the SentCount page, and checks it's of the right month.
-// If it's a previous month, then it just leaves the `sentCount` map blank; if it's
+// If it's a previous month, then it starts the `sentCount` map again blank; if it's
 // the same month listed on the JSON file, it will parse the JSON and load it into `sentCount`.
-func populateSentCount() {
+func populateSentCount(bot *ybtools.Bot) {
 	// This is stored on the page with ID sentCountPageID.
 	// It is made up of something that looks like this:
 	// {"month": "2020-05", "headers": {"category": {"username": 8}}}
 	// where username had been sent 8 messages in the month of May 2020 and the header "category".
-	parsedJSON := ybtools.LoadJSONFromPageID(yapperconfig.Config.SentCountPageID)
+	var err error
+	sentCountState, err = sentCountStore().Load(bot)
+	if err != nil {
+		bot.PanicErr("Failed to load sent counts with error ", err)
+	}
 
-	contentMonth, _ := parsedJSON.GetString("month")
 	// yes, really, you have to specify time formats with a specific time in Go
 	// *rolls eyes*
 	// https://golang.org/pkg/time/#Time.Format
-	if contentMonth != time.Now().Format("2006-01") {
+	if sentCountState.Data.Month != bot.Now().Format("2006-01") {
 		log.Println("contentMonth is not the current month, so data resets!")
+		sentCount = map[string]map[string]uint16{}
+	} else if sentCountState.Data.Headers == nil {
+		bot.PanicErr("Failed to deserialize sent count headers, is the JSON invalid?")
 	} else {
-		sentCount = deserializeSentCount(parsedJSON)
+		sentCount = sentCountState.Data.Headers
 	}
 }
 
-// saveSentCounts serializes our `sentCount` map into JSON, so we can save it on-wiki
-// and load it again when we need to for the next run.
-func saveSentCounts(w *mwclient.Client) {
-	var sentCountJSONBuilder strings.Builder
-	sentCountJSONBuilder.WriteString(yapperconfig.OpeningJSON)
-	sentCountJSONBuilder.WriteString(`"month":"`)
-	sentCountJSONBuilder.WriteString(time.Now().Format("2006-01"))
-	sentCountJSONBuilder.WriteString(`","headers":`)
-	sentCountJSONBuilder.WriteString(ybtools.SerializeToJSON(sentCount))
-	sentCountJSONBuilder.WriteString(yapperconfig.ClosingJSON)
+// saveSentCounts saves our `sentCount` map on-wiki, so we can load it again
+// when we need to for the next run.
+func saveSentCounts(bot *ybtools.Bot) {
+	sentCountState.Data = sentCountJSON{Month: bot.Now().Format("2006-01"), Headers: sentCount}
 
 	// this is in userspace, and it's really desperately necessary - do not count this for edit limiting
 	// for the same reason, we have no maxlag wait - we need this to run under all circumstances, to ensure
 	// that people's limits are respected
-	ybtools.NoMaxlagDo(func() (err error) {
-		err = w.Edit(params.Values{
-			"pageid":   yapperconfig.Config.SentCountPageID,
-			"summary":  "FRS run complete, updating sentcounts",
-			"notminor": "true",
-			"bot":      "true",
-			"text":     sentCountJSONBuilder.String(),
+	bot.NoMaxlagDo(func() (err error) {
+		err = bot.Do(func() error {
+			return sentCountStore().Save(bot, sentCountState, "FRS run complete, updating sentcounts")
 		})
 		if err == nil {
 			log.Println("Successfully updated sentcounts")
 		} else {
-			if err.Error() == "edit successful, but did not change page" {
+			if err == mwclient.ErrEditNoChange {
 				log.Println("WARNING: Successfully updated sentcounts, but they didn't change - if anything was done this session, something is wrong!")
 			} else {
-				ybtools.PanicErr("Failed to update sentcounts with error ", err)
+				bot.PanicErr("Failed to update sentcounts with error ", err)
 			}
 		}
 		return
-	}, w)
+	})
+}
+
+// mergeSentCounts merges the counts from this run into ones that have been saved in the mean time,
+// by adding on however many more (or fewer) messages have been sent since the counts were loaded.
+func mergeSentCounts(base, ours, theirs sentCountJSON) sentCountJSON {
+	if theirs.Month != ours.Month {
+		// theirs are from another month, so they don't count any more
+		return ours
+	}
+	if base.Month != ours.Month {
+		// the month changed since we loaded them, so all of ours were sent this month
+		base = sentCountJSON{}
+	}
+
+	merged := sentCountJSON{Month: ours.Month, Headers: map[string]map[string]uint16{}}
+	for header, users := range theirs.Headers {
+		merged.Headers[header] = map[string]uint16{}
+		for user, count := range users {
+			merged.Headers[header][user] = count
+		}
+	}
+	for header, users := range ours.Headers {
+		if merged.Headers[header] == nil {
+			merged.Headers[header] = map[string]uint16{}
+		}
+		for user, count := range users {
+			count := int(merged.Headers[header][user]) + int(count) - int(base.Headers[header][user])
+			if count < 0 {
+				count = 0
+			}
+			merged.Headers[header][user] = uint16(count)
+		}
+	}
+	return merged
 }
 
 // calculateMedian takes a slice of float64s and returns the median if there is one, and a bool indicating if a median
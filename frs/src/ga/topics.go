@@ -48,10 +48,10 @@ func init() {
 }
 
 // FetchGATopics fetches the latest GA topics from the Good Article noms page.
-func FetchGATopics() {
-	text, err := ybtools.FetchWikitext(yapperconfig.Config.GAGuidelinesHeaderPageID)
+func FetchGATopics(bot *ybtools.Bot) {
+	text, err := bot.FetchWikitext(yapperconfig.Config.GAGuidelinesHeaderPageID)
 	if err != nil {
-		ybtools.PanicErr("Failed to fetch Good Articles topics with error ", err)
+		bot.PanicErr("Failed to fetch Good Articles topics with error ", err)
 	}
 	matches := gaTopicsRegex.FindAllStringSubmatch(text, -1)
 	for _, match := range matches {
@@ -72,6 +72,9 @@ const editSummaryMessagesComponent string = `%s "%s" %s%s`
 // Sprintf is run over it with the first param as the used amount, and the second as the limit.
 const limitInEditSummary string = ` (%d/%d this month)`
 
+// messagesSentMetric counts the feedback requests sent, by the (cleaned) header they were sent for.
+var messagesSentMetric = ybtools.NewCounter("yapperbot_frs_messages_total", "Feedback requests sent, by FRS list header.", "header")
+
 // messagesToSend is our username-indexed list of messages that we have queued.
 // Each username key maps to a list of messages we have stored up to send them this run.
 var messagesToSend = map[string][]*Message{}
@@ -103,10 +106,31 @@ func QueueMessage(m *Message) {
 	m.User.MarkMessageSent()
 }
 
-// SendMessageQueue takes a pointer to an mwclient instance, and sends all the queued
+// ClearQueue empties the queue of messages, ready for a new run.
+func ClearQueue() {
+	messagesToSend = map[string][]*Message{}
+}
+
+// SendMessageQueue takes the bot, and sends all the queued
 // messages from the FRS run.
-func SendMessageQueue(w *mwclient.Client) {
+func SendMessageQueue(bot *ybtools.Bot) {
+	w := bot.Client()
 	for user, messages := range messagesToSend {
+		// check the user hasn't excluded us, or opted out of FRS messages, before going any further
+		talkPage, err := bot.FetchWikitextFromTitle("User talk:" + user)
+		if err != nil && err != mwclient.ErrPageNotFound {
+			log.Println("Failed to fetch talk page for", user, "so not notifying them. The error was", err)
+			bot.ReportSkipped("User talk:"+user, "failed to fetch talk page: "+err.Error())
+			markMessagesUnsent(messages)
+			continue
+		}
+		if allowed, reason := bot.ExclusionCheck(talkPage, true); !allowed {
+			log.Println("Not allowed to notify", user, "so skipping:", reason)
+			bot.ReportSkipped("User talk:"+user, reason)
+			markMessagesUnsent(messages)
+			continue
+		}
+
 		var textBuilder strings.Builder
 
 		// headersInSummary is just used to make sure our edit summary only has each header once.
@@ -155,7 +179,7 @@ func SendMessageQueue(w *mwclient.Client) {
 		}
 
 		// Drop a note on each user's talk page inviting them to participate
-		if ybtools.CanEdit() {
+		if bot.CanEditTitle("User talk:" + user) {
 			var summarySentListBuilder strings.Builder
 			var index int
 			for headerName, header := range headersInSummary {
@@ -194,41 +218,57 @@ func SendMessageQueue(w *mwclient.Client) {
 			// the redirect param here automatically resolves redirects,
 			// for instance if a user changes their username but forgets
 			// to update the FRS user tag
-			err := w.Edit(params.Values{
-				"title":        "User talk:" + user,
-				"section":      "new",
-				"sectiontitle": sectiontitle,
-				"summary":      editsummary,
-				"notminor":     "true",
-				"bot":          "true",
-				"text":         notificationText,
-				"redirect":     "true",
+			requested := make([]string, len(messages))
+			for index, message := range messages {
+				requested[index] = message.Title
+			}
+			err := bot.DoUnrepeatable(func() error {
+				bot.SetEditReason("User talk:"+user, "subscribed to feedback requests for "+strings.Join(requested, ", "))
+				return w.Edit(params.Values{
+					"title":        "User talk:" + user,
+					"section":      "new",
+					"sectiontitle": sectiontitle,
+					"summary":      editsummary,
+					"notminor":     "true",
+					"bot":          "true",
+					"text":         notificationText,
+					"redirect":     "true",
+				})
 			})
 			if err == nil {
 				log.Println("Successfully invited", user, "to give feedback on", len(messages), "requesting items")
+				bot.ReportCount("users messaged", 1)
+				bot.ReportCount("feedback requests sent", len(messages))
+				for headerName, header := range headersInSummary {
+					messagesSentMetric.Add(float64(header.countThisRun), strings.TrimSpace(headerName))
+				}
 				time.Sleep(5 * time.Second)
 			} else {
-				switch err.(type) {
-				case mwclient.APIError:
-					switch err.(mwclient.APIError).Code {
-					case "noedit", "writeapidenied", "blocked":
-						ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
-					case "pagedeleted":
-						log.Println("Looks like the user", user, "talk page was deleted while we were updating it... huh. Going for a new one!")
-					default:
-						log.Println("Error editing user talk for", user, "meant they couldn't be notified and were ignored. The error was", err)
-					}
-				default:
-					ybtools.PanicErr("Non-API error returned when trying to notify user ", user, " so dying. Error was ", err)
-				}
-				for _, message := range messages {
-					message.User.MarkMessageUnsent()
+				// DoUnrepeatable has already stopped the run if the bot can't edit at all, and retried anything the wiki refused,
+				// so whatever's left only stops this user being notified
+				if apiErr, ok := err.(mwclient.APIError); ok && apiErr.Code == "pagedeleted" {
+					log.Println("Looks like the user", user, "talk page was deleted while we were updating it... huh. Going for a new one!")
+				} else {
+					log.Println("Error editing user talk for", user, "meant they couldn't be notified and were ignored. The error was", err)
 				}
+				bot.ReportError("User talk:"+user, "failed to send feedback request: "+err.Error())
+				markMessagesUnsent(messages)
 			}
+		} else {
+			// edit limited or paused; either way, the sent counts that get saved shouldn't include these
+			markMessagesUnsent(messages)
 		}
 	}
 }
 
+// markMessagesUnsent marks all of the messages as not having been sent after all,
+// so they don't count towards the users' limits.
+func markMessagesUnsent(messages []*Message) {
+	for _, message := range messages {
+		message.User.MarkMessageUnsent()
+	}
+}
+
 // CleanHeader takes a "dirty" header (a header with HTML comments in) as a string,
 // cleans it up, and saves it into our processed headers in cleanedHeaders. This is
 // used so that we don't end up sending HTML comments to users, which aren't very pretty!
@@ -20,12 +20,11 @@ package rfc
 
 import (
 	"reflect"
-	"strings"
+	"sort"
 
 	"github.com/sohomdatta1/yapperbot-services/frs/src/yapperconfig"
 
 	"cgt.name/pkg/go-mwclient"
-	"cgt.name/pkg/go-mwclient/params"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
 )
 
@@ -46,15 +45,39 @@ func MarkRfcsDone(rfcsDone []RfC) {
 	}
 }
 
+// rfcsDoneJSON is the format of the JSON on the RfCs done page.
+type rfcsDoneJSON struct {
+	RfcsDone []string `json:"rfcsdone"`
+}
+
+// rfcsDoneState is the RfCs done page as it was loaded, to save the new list back to.
+var rfcsDoneState *ybtools.State[rfcsDoneJSON]
+
+// rfcsDoneStore returns the state store for the RfCs done page.
+func rfcsDoneStore() *ybtools.StateStore[rfcsDoneJSON] {
+	return &ybtools.StateStore[rfcsDoneJSON]{
+		PageID:     yapperconfig.Config.RFCsDonePageID,
+		Notice:     yapperconfig.StateNotice,
+		Version:    yapperconfig.StateVersion,
+		Migrations: yapperconfig.StateMigrations,
+		Merge:      mergeRfcsDone,
+	}
+}
+
 // LoadRfcsDone loads the RFCs that have already been marked as done into loadedRfcs.
 // It needs to be called before the start of each session that includes an RfC lookup.
-func LoadRfcsDone(w *mwclient.Client) {
-	rfcsDoneJSON := ybtools.LoadJSONFromPageID(yapperconfig.Config.RFCsDonePageID)
-	rfcsDoneList, err := rfcsDoneJSON.GetStringArray("rfcsdone")
+func LoadRfcsDone(bot *ybtools.Bot) {
+	var err error
+	rfcsDoneState, err = rfcsDoneStore().Load(bot)
 	if err != nil {
-		ybtools.PanicErr("rfcsdone not found in rfcsDoneJSON! the JSON looks corrupt.")
+		bot.PanicErr("Failed to load rfcsDoneJSON with error ", err)
 	}
-	for _, rfcID := range rfcsDoneList {
+	if rfcsDoneState.Data.RfcsDone == nil {
+		bot.PanicErr("rfcsdone not found in rfcsDoneJSON! the JSON looks corrupt.")
+	}
+	doneRfcs = map[string]bool{}
+	loadedRfcs = map[string]bool{}
+	for _, rfcID := range rfcsDoneState.Data.RfcsDone {
 		loadedRfcs[rfcID] = true
 	}
 }
@@ -68,39 +91,67 @@ func AlreadyDone(rfcID string) bool {
 	return doneRfcs[rfcID]
 }
 
-// SaveRfcsDone takes an mwclient, and serializes
+// SaveRfcsDone takes the bot, and serializes
 // the doneRfcs map, before saving it on-wiki.
-func SaveRfcsDone(w *mwclient.Client) {
+func SaveRfcsDone(bot *ybtools.Bot) {
 	// Only update the list of RfCs done if it's actually changed -
 	// i.e. if the list of doneRfcs is not deeply equal to the list of
 	// loadedRfcs (bigger, smaller, changed in any way).
 	if !reflect.DeepEqual(doneRfcs, loadedRfcs) {
-		var rfcsDoneJSONBuilder strings.Builder
 		var rfcsDoneSlice []string = []string{}
 
 		for rfcid := range doneRfcs {
 			rfcsDoneSlice = append(rfcsDoneSlice, rfcid)
 		}
-
-		rfcsDoneJSONBuilder.WriteString(yapperconfig.OpeningJSON)
-		rfcsDoneJSONBuilder.WriteString(`"rfcsdone":`)
-		rfcsDoneJSONBuilder.WriteString(ybtools.SerializeToJSON(rfcsDoneSlice))
-		rfcsDoneJSONBuilder.WriteString(yapperconfig.ClosingJSON)
+		// keep the list in a stable order, so the diffs only show what's changed
+		sort.Strings(rfcsDoneSlice)
+		rfcsDoneState.Data.RfcsDone = rfcsDoneSlice
 
 		// Updating this list must be done under all circumstances; we cannot
 		// wait for maxlag here, it's important that this is kept valid and correct
 		// to prevent us sending multiple messages.
-		ybtools.NoMaxlagDo(func() (err error) {
-			err = w.Edit(params.Values{
-				"pageid":  yapperconfig.Config.RFCsDonePageID,
-				"summary": "Updating list of completed RfCs",
-				"bot":     "true",
-				"text":    rfcsDoneJSONBuilder.String(),
+		bot.NoMaxlagDo(func() (err error) {
+			err = bot.Do(func() error {
+				return rfcsDoneStore().Save(bot, rfcsDoneState, "Updating list of completed RfCs")
 			})
-			if err != nil {
-				ybtools.PanicErr("Failed to update RfC page ", yapperconfig.Config.RFCsDonePageID, " to list completed RfCs, with error ", err)
+			if err != nil && err != mwclient.ErrEditNoChange {
+				bot.PanicErr("Failed to update RfC page ", yapperconfig.Config.RFCsDonePageID, " to list completed RfCs, with error ", err)
 			}
 			return
-		}, w)
+		})
+	}
+}
+
+// mergeRfcsDone merges the list of RfCs done this run into one that has been saved in the mean time,
+// adding the RfCs that have been done, and taking away those that have dropped out of the category.
+func mergeRfcsDone(base, ours, theirs rfcsDoneJSON) rfcsDoneJSON {
+	inBase := map[string]bool{}
+	for _, rfcID := range base.RfcsDone {
+		inBase[rfcID] = true
+	}
+	inOurs := map[string]bool{}
+	for _, rfcID := range ours.RfcsDone {
+		inOurs[rfcID] = true
+	}
+
+	merged := map[string]bool{}
+	for _, rfcID := range theirs.RfcsDone {
+		// drop any we've taken out since loading
+		if !inBase[rfcID] || inOurs[rfcID] {
+			merged[rfcID] = true
+		}
+	}
+	for rfcID := range inOurs {
+		// and add any we've done since loading
+		if !inBase[rfcID] {
+			merged[rfcID] = true
+		}
+	}
+
+	mergedSlice := make([]string, 0, len(merged))
+	for rfcID := range merged {
+		mergedSlice = append(mergedSlice, rfcID)
 	}
+	sort.Strings(mergedSlice)
+	return rfcsDoneJSON{RfcsDone: mergedSlice}
 }
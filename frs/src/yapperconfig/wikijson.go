@@ -18,6 +18,20 @@ package yapperconfig
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
-// OpeningJSON and ClosingJSON are the first and last lines of any JSON object generated by Yapperbot to store on-wiki.
-const OpeningJSON string = `{"DO NOT TOUCH THIS PAGE":"This page is used internally by Sodiumbot to make the Feedback Request Service work.",`
-const ClosingJSON string = `}`
+import (
+	"encoding/json"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+)
+
+// StateNotice is put on every JSON page Yapperbot keeps its state on, so that nobody edits it by hand.
+const StateNotice string = "This page is used internally by Sodiumbot to make the Feedback Request Service work."
+
+// StateVersion is the schema version of the JSON pages Yapperbot keeps its state on.
+const StateVersion int = 1
+
+// StateMigrations upgrade the JSON pages from older schema versions. The pages from before
+// they had a schema version on them, at version 0, already have all the version 1 fields.
+var StateMigrations = map[int]ybtools.StateMigration{
+	0: func(map[string]json.RawMessage) error { return nil },
+}
@@ -23,11 +23,12 @@ package yapperconfig
 // in the application directory by ybtools.
 // this doesn't include EditLimit, which is handled by ybtools directly
 type configObject struct {
-	FRSPageID                string
-	SentCountPageID          string
-	GAGuidelinesHeaderPageID string
-	RFCsDonePageID           string
-	ErrorsPageID             string
+	FRSPageID                string `config:"required"`
+	SentCountPageID          string `config:"required"`
+	GAGuidelinesHeaderPageID string `config:"required"`
+	RFCsDonePageID           string `config:"required"`
+	// ErrorsPageID is optional; without it, errors only go in the run report
+	ErrorsPageID string
 }
 
 // Config is the global configuration object. This should only really ever be read from.
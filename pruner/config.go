@@ -1,4 +1,4 @@
-package main
+package pruner
 
 //
 // Yapperbot-Pruner, the user pruning bot for Wikipedia
@@ -18,14 +18,32 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
+import (
+	"github.com/go-sql-driver/mysql"
+)
+
 // Config holds the configuration pulled from the standard
-// ybtools task-specific config file.
+// ybtools task-specific config file. The DSN has the replica password in it,
+// so it's a secret, read from a dsn file or YAPPERBOT_DSN rather than the config file.
 type Config struct {
-	DSN                       string
-	ConfigTemplate            string
-	FormatsJSONPageID         string
-	DefaultExpiredMsgTemplate string
-	DefaultTalkMsgHeader      string
+	DSN                       string `config:"required,secret"`
+	ConfigTemplate            string `config:"required"`
+	FormatsJSONPageID         string `config:"required"`
+	DefaultExpiredMsgTemplate string `config:"required"`
+	DefaultTalkMsgHeader      string `config:"required"`
 }
 
 var config Config
+
+// ValidateConfig checks that the DSN can actually be used to connect to the database,
+// so that a broken one is reported along with any other config problems.
+func (c Config) ValidateConfig() []string {
+	if c.DSN == "" {
+		// already reported as missing
+		return nil
+	}
+	if _, err := mysql.ParseDSN(c.DSN); err != nil {
+		return []string{"dsn is invalid: " + err.Error()}
+	}
+	return nil
+}
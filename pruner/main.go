@@ -1,19 +1,25 @@
-package main
+package pruner
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
 	"github.com/karrick/tparse"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/wikitext"
 )
 
 //
@@ -34,56 +40,99 @@ import (
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
-const templateExpression string = `\s*?((?:\|.*\s*?)*)`
 const editSummaryOpening string = `Pruning users as configured on page: processed `
 const editSummaryUsersExpired string = `%d inactive user(s)`
 const editSummaryUsersIndeffed string = `%d indeffed user(s)`
 const editSummaryUsersRenamed string = `%d renamed user(s)`
 
-var templateRegex *regexp.Regexp
+// notificationInterval is how long to wait after notifying a user, so that notices aren't
+// posted faster than a person could post them.
+var notificationInterval time.Duration = 5 * time.Second
+
+// notificationMutex is held while a notice is posted and for notificationInterval after it,
+// so that notices are still posted one at a time when several workers are pruning lists.
+var notificationMutex sync.Mutex
+
 var formats = map[string]*regexp.Regexp{}
 
-func init() {
-	ybtools.SetupBot(ybtools.BotSettings{
+// removalsMetric counts the users pruned from lists, by why: expired, indeffed or renamed.
+var removalsMetric = ybtools.NewCounter("yapperbot_pruner_removals_total", "Users pruned from lists, by reason: expired, indeffed or renamed.", "reason")
+
+// Run runs the Pruner, removing inactive, blocked and renamed users from every list
+// that uses the config template, on each wiki, with the given options, or the defaults if opts
+// is nil. It returns an error if the bot couldn't be set up.
+func Run(opts *ybtools.Options) error {
+	bot, err := ybtools.New(ybtools.BotSettings{
 		TaskName:         "Pruner",
 		BotUser:          "SodiumBot",
 		ToolforgeAccount: "yapping-sodium",
+		OptOut:           []string{"pruner"},
+		Config:           &config,
+		Options:          opts,
 	})
-	ybtools.ParseTaskConfig(&config)
+	if err != nil {
+		return err
+	}
+
+	// lists are independent of one another, so can be processed side by side, with the
+	// database lookups for each running at the same time; a stop signal lets those
+	// already started finish, so that the report and edit limits are still saved,
+	// and stops any wikis that haven't been started yet from running at all
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	bot.ForEachWiki(func(wiki string) {
+		if ctx.Err() == nil {
+			pruneWiki(ctx, bot)
+		}
+	})
+	return nil
 }
 
-func main() {
-	defer ybtools.SaveEditLimit()
+// pruneWiki prunes every list using the config template on the wiki the bot is set up for.
+func pruneWiki(ctx context.Context, bot *ybtools.Bot) {
+	defer bot.SaveRunReport()
+	defer bot.SaveEditLimit()
 
-	templateRegex = regexp.MustCompile("{{" + regexp.QuoteMeta(config.ConfigTemplate) + templateExpression + "}}")
+	formats = map[string]*regexp.Regexp{}
 
-	w := ybtools.CreateAndAuthenticateClient(ybtools.DefaultMaxlag)
+	w, err := bot.Connect(ybtools.DefaultMaxlag)
+	if err != nil {
+		bot.PanicErr("Failed to connect to the wiki with error ", err)
+	}
 
-	formatsJSON := ybtools.LoadJSONFromPageID(config.FormatsJSONPageID)
+	formatsJSON, err := ybtools.LoadJSONFromPageID[map[string]interface{}](bot, config.FormatsJSONPageID)
+	if err != nil {
+		bot.PanicErr("Failed to load formatsJSON with error ", err)
+	}
 
-	for name, regex := range formatsJSON.Map() {
-		rString, err := regex.String()
-		if err != nil {
-			ybtools.PanicErr("Failed to decode regex from formatsJSON with error", err)
+	for name, regex := range formatsJSON {
+		// a broken format only affects the lists using it, so carry on without it;
+		// those lists will be reported as having an invalid format
+		rString, ok := regex.(string)
+		if !ok {
+			bot.ReportErr("Failed to decode regex for format ", name, " from formatsJSON, as it isn't a string")
+			continue
 		}
 		// all these regexes should be case-insensitive and multiline; set this flag on them all
 		rCompiled, err := regexp.Compile("(?im)" + rString)
 		if err != nil {
-			ybtools.PanicErr("Failed to compile regex", rString, "from formatsJSON with error", err)
+			bot.ReportErr("Failed to compile regex ", rString, " for format ", name, " from formatsJSON with error ", err)
+			continue
 		}
 		formats[name] = rCompiled
 	}
 
-	// processArticleInitial just serves as a wrapper around processArticle;
-	// the only reason it is here is to set retry to false on the first run,
-	// so we can use ybtools ForPageInQuery easily.
-	var processArticleInitial = func(pageTitle, pageContent, pageContentModel, revTS, curTS string) {
+	// processArticleInitial just serves as a wrapper around processArticle,
+	// so we can use ybtools ForPageInQueryConcurrently easily.
+	var processArticleInitial = func(ctx context.Context, pageTitle, pageContent, pageContentModel, revTS, curTS string) error {
 		log.Println("Processing page", pageTitle)
-		processArticle(w, pageTitle, pageContent, pageContentModel, revTS, curTS, false)
+		processArticle(bot, w, pageTitle, pageContent, pageContentModel, revTS, curTS)
+		return nil
 	}
 
-	withDatabaseConnection(func() {
-		ybtools.ForPageInQuery(params.Values{
+	withDatabaseConnection(bot, func() {
+		bot.ForPageInQueryConcurrently(ctx, params.Values{
 			"action":         "query",
 			"prop":           "revisions",
 			"generator":      "embeddedin",
@@ -92,25 +141,23 @@ func main() {
 			"rvprop":         "timestamp|content|contentmodel",
 			"rvslots":        "main",
 			"curtimestamp":   "1",
-		}, processArticleInitial)
+		}, bot.Workers(), processArticleInitial)
 	})
 }
 
-func enumeratePagePrunerConfig(pageTitle string, pageContent string) (time.Time, time.Time, string, map[string]string, error) {
-	match := templateRegex.FindStringSubmatch(pageContent)
+func enumeratePagePrunerConfig(bot *ybtools.Bot, site *title.Site, pageTitle string, pageContent string) (time.Time, time.Time, string, map[string]string, error) {
+	templates := wikitext.Parse(pageContent).TemplatesNamedBy(site.TemplateName, config.ConfigTemplate)
 
-	if len(match) == 0 {
-		log.Println(pageTitle, "included in transclusions of template, but didn't match regex!")
+	if len(templates) == 0 {
+		log.Println(pageTitle, "included in transclusions of template, but the template wasn't found on the page!")
 		return time.Time{}, time.Time{}, "none", map[string]string{}, errors.New("Does not have a valid template configuration")
 	}
 
 	var parameters = map[string]string{}
-	// only one capture group; zero is the entire match
-	// we trim off the first character, as it's a useless pipe always, by definition
-	paramStrings := strings.Split(match[1][1:], "|")
-	for _, paramString := range paramStrings {
-		paramComponents := strings.Split(paramString, "=")
-		parameters[strings.TrimSpace(paramComponents[0])] = strings.TrimSpace(paramComponents[1])
+	for _, param := range templates[0].Params() {
+		if !param.Positional() {
+			parameters[param.Name()] = param.Value()
+		}
 	}
 
 	// check required parameters
@@ -122,7 +169,7 @@ func enumeratePagePrunerConfig(pageTitle string, pageContent string) (time.Time,
 	}
 
 	// tparse is totally fine with processing things like "year" and "years", but wants "1year" not "1 year" for some reason...
-	inactivityTimestamp, err := tparse.AddDuration(time.Now(), "-"+strings.ReplaceAll(parameters["inactivity"], " ", ""))
+	inactivityTimestamp, err := tparse.AddDuration(bot.Now(), "-"+strings.ReplaceAll(parameters["inactivity"], " ", ""))
 	if err != nil {
 		log.Println(pageTitle, "has an invalid inactivity timeout value, of", parameters["inactivity"], "- error was", err)
 		return time.Time{}, time.Time{}, "none", map[string]string{}, errors.New("Does not have a valid template configuration")
@@ -135,9 +182,9 @@ func enumeratePagePrunerConfig(pageTitle string, pageContent string) (time.Time,
 			// special case: immediately.
 			// this is a special case because tparse doesn't currently support unitless zero as a duration
 			// https://github.com/karrick/tparse/issues/2
-			blockTimestamp = time.Now()
+			blockTimestamp = bot.Now()
 		} else {
-			blockTimestamp, err = tparse.AddDuration(time.Now(), "-"+strings.ReplaceAll(parameters["indeffed"], " ", ""))
+			blockTimestamp, err = tparse.AddDuration(bot.Now(), "-"+strings.ReplaceAll(parameters["indeffed"], " ", ""))
 			if err != nil {
 				log.Println(pageTitle, "has an invalid indeffed time value of", parameters["indeffed"], "so using default")
 			}
@@ -146,60 +193,67 @@ func enumeratePagePrunerConfig(pageTitle string, pageContent string) (time.Time,
 
 	if blockTimestamp.Equal((time.Time{})) {
 		// Otherwise, default to removing blocked users after two months
-		blockTimestamp = time.Now().AddDate(0, -2, 0)
+		blockTimestamp = bot.Now().AddDate(0, -2, 0)
 	}
 
 	return blockTimestamp, inactivityTimestamp, parameters["format"], parameters, nil
 }
 
-func processArticle(w *mwclient.Client, pageTitle, pageContent, pageContentModel, revTS, curTS string, retry bool) {
+// pruneList prunes the users from the list in content, according to the configuration on it, and
+// returns the new content, how many users were pruned for each reason, those pruned for inactivity,
+// and the configuration.
+func pruneList(bot *ybtools.Bot, pageTitle, content, contentModel string) (newContent string, numExpired, numIndeffed, numRenamed int, expiredUsers []string, parameters map[string]string, err error) {
 	var (
-		blockTimestamp                      time.Time
-		inactivityTimestamp                 time.Time
-		format                              string
-		err                                 error
-		numExpired, numIndeffed, numRenamed int
-		newPageContent                      string
-		expiredUsers                        []string
-		parameters                          map[string]string
+		blockTimestamp      time.Time
+		inactivityTimestamp time.Time
+		format              string
 	)
 
-	switch pageContentModel {
-	case "wikitext":
-		blockTimestamp, inactivityTimestamp, format, parameters, err = enumeratePagePrunerConfig(pageTitle, pageContent)
+	// the wiki's own namespace names and case rules, so that users are recognised however they're written
+	site, err := bot.Site()
+	if err != nil {
+		return
+	}
 
+	switch contentModel {
+	case "wikitext":
+		blockTimestamp, inactivityTimestamp, format, parameters, err = enumeratePagePrunerConfig(bot, site, pageTitle, content)
 		if err != nil {
-			log.Printf("Unable to proceed further with `%s` due to the following error `%s`", pageTitle, pageContent)
+			log.Printf("Unable to proceed further with `%s` due to the following error `%s`", pageTitle, err)
 			return
 		}
 
 		formatRegex, ok := formats[format]
 		if !ok {
 			log.Println(pageTitle, "has an invalid format value, of", format)
+			err = errors.New("invalid format value " + format)
 			return
 		}
 
-		newPageContent, numExpired, numIndeffed, numRenamed, expiredUsers, _ = pruneUsersFromWikitextList(pageTitle, pageContent, formatRegex, inactivityTimestamp, blockTimestamp)
+		newContent, numExpired, numIndeffed, numRenamed, expiredUsers, _ = pruneUsersFromWikitextList(bot, site, pageTitle, content, formatRegex, inactivityTimestamp, blockTimestamp)
 	case "MassMessageListContent":
 		var parsedPageContent MassMessageContent
-		err := json.Unmarshal([]byte(pageContent), &parsedPageContent)
-
-		if err != nil {
+		if err = json.Unmarshal([]byte(content), &parsedPageContent); err != nil {
 			log.Printf("Unable to correctly parse the contentmodel of the mass message list `%s`, the error is: %s", pageTitle, err)
+			err = fmt.Errorf("failed to parse mass message list: %w", err)
+			return
 		}
 
-		blockTimestamp, inactivityTimestamp, format, parameters, err = enumeratePagePrunerConfig(pageTitle, parsedPageContent.Description)
+		blockTimestamp, inactivityTimestamp, format, parameters, err = enumeratePagePrunerConfig(bot, site, pageTitle, parsedPageContent.Description)
+		if err != nil {
+			return
+		}
 
-		newPageContent, numExpired, numIndeffed, numRenamed, expiredUsers, _ = pruneUsersFromMMList(pageTitle, parsedPageContent, inactivityTimestamp, blockTimestamp)
+		newContent, numExpired, numIndeffed, numRenamed, expiredUsers, _ = pruneUsersFromMMList(bot, site, pageTitle, parsedPageContent, inactivityTimestamp, blockTimestamp)
 	default:
 		log.Printf("Incorrect contentmodel, unable to proceed further on `%s`", pageTitle)
+		err = errors.New("unsupported content model " + contentModel)
 	}
+	return
+}
 
-	if newPageContent == pageContent {
-		log.Println("newPageContent was the same as pageContent on page", pageTitle, "so ignoring")
-		return
-	}
-
+// editSummary returns the summary for an edit pruning the given numbers of users.
+func editSummary(numExpired, numIndeffed, numRenamed int) string {
 	var editSummaryBuilder strings.Builder
 
 	editSummaryBuilder.WriteString(editSummaryOpening)
@@ -216,24 +270,45 @@ func processArticle(w *mwclient.Client, pageTitle, pageContent, pageContentModel
 	}
 
 	editSummaryBuilder.WriteString(strings.Join(summaryActionsTaken, "; "))
+	return editSummaryBuilder.String()
+}
 
-	if !ybtools.CanEdit() {
-		return
-	}
+// processArticle prunes the users from the list on a page, given as it was fetched by the query,
+// and then lets those who were pruned for inactivity know.
+func processArticle(bot *ybtools.Bot, w *mwclient.Client, pageTitle, pageContent, pageContentModel, revTS, curTS string) {
+	var (
+		numExpired, numIndeffed, numRenamed int
+		expiredUsers                        []string
+		parameters                          map[string]string
+	)
 
-	err = w.Edit(params.Values{
-		"title":          pageTitle,
-		"text":           newPageContent,
-		"md5":            fmt.Sprintf("%x", md5.Sum([]byte(newPageContent))),
-		"summary":        editSummaryBuilder.String(),
-		"notminor":       "true",
-		"bot":            "true",
-		"basetimestamp":  revTS,
-		"starttimestamp": curTS,
+	edit := &ybtools.PageEdit{
+		Title:        pageTitle,
+		Params:       params.Values{"notminor": "true"},
+		Content:      pageContent,
+		RevTimestamp: revTS,
+		CurTimestamp: curTS,
+	}
+	// the list is pruned afresh if somebody else's edit to it can't be merged, so the
+	// counts and the summary are always for the list as it was finally saved
+	err := bot.SafeEdit(edit, func(content string) (newPageContent string, err error) {
+		newPageContent, numExpired, numIndeffed, numRenamed, expiredUsers, parameters, err = pruneList(bot, pageTitle, content, pageContentModel)
+		edit.Summary = editSummary(numExpired, numIndeffed, numRenamed)
+		edit.Reason = ""
+		if len(expiredUsers) > 0 {
+			edit.Reason = "removed for inactivity: " + strings.Join(expiredUsers, ", ")
+		}
+		return
 	})
 
 	if err == nil {
 		log.Println("Pruned users on", pageTitle, "so starting notifications")
+		bot.ReportCount("expired users", numExpired)
+		bot.ReportCount("indeffed users", numIndeffed)
+		bot.ReportCount("renamed users", numRenamed)
+		removalsMetric.Add(float64(numExpired), "expired")
+		removalsMetric.Add(float64(numIndeffed), "indeffed")
+		removalsMetric.Add(float64(numRenamed), "renamed")
 		var userMessages = map[string]string{}
 
 		expiredMsg, ok := parameters["expiredmsg"]
@@ -252,67 +327,67 @@ func processArticle(w *mwclient.Client, pageTitle, pageContent, pageContentModel
 			}
 
 			for user, message := range userMessages {
-				userPage, err := ybtools.FetchWikitextFromTitle("User talk:" + user)
-				if ybtools.BotAllowed(userPage) && ybtools.CanEdit() && err == nil {
-					err := w.Edit(params.Values{
-						"title":        "User talk:" + user,
-						"section":      "new",
-						"sectiontitle": talkMessageHeader,
-						"summary":      "[[User:Yapperbot/Pruner|Pruner]]: " + talkMessageHeader,
-						"notminor":     "true",
-						"bot":          "true",
-						"text":         message,
-						"redirect":     "true",
-					})
-					if err == nil {
-						log.Println("Successfully notified", user, "of their pruning from", pageTitle)
-						time.Sleep(5 * time.Second)
-					} else {
-						switch err := err.(type) {
-						case mwclient.APIError:
-							switch err.Code {
-							case "noedit", "writeapidenied", "blocked":
-								ybtools.PanicErr("noedit/writeapidenied/blocked code returned, the bot may have been blocked. Dying")
-							default:
-								log.Println("Error editing user talk for", user, "meant they couldn't be notified. The error was", err)
-							}
-						default:
-							ybtools.PanicErr("Non-API error returned when trying to notify user ", user, " so dying. Error was ", err)
-						}
-					}
+				userPage, err := bot.FetchWikitextFromTitle("User talk:" + user)
+				if err == mwclient.ErrPageNotFound {
+					// as it always has, the Pruner doesn't start talk pages just to leave a notice on them
+					log.Println(user, "has no talk page, so not notifying them")
+					bot.ReportSkipped("User talk:"+user, "no talk page")
+					continue
+				} else if err != nil {
+					log.Println("Failed to fetch talk page for", user, "so not notifying them. The error was", err)
+					bot.ReportSkipped("User talk:"+user, "failed to fetch talk page: "+err.Error())
+					continue
 				}
-			}
-		}
-	} else {
-		switch err := err.(type) {
-		case mwclient.APIError:
-			if err.Code == "editconflict" {
-				if retry {
-					log.Println("Edit conflicted twice on page", pageTitle, "so skipping")
-					return
+				if allowed, reason := bot.ExclusionCheck(userPage, true); !allowed {
+					log.Println("Not allowed to notify", user, "so skipping:", reason)
+					bot.ReportSkipped("User talk:"+user, reason)
+					continue
 				}
-
-				log.Println("Edit conflicted on page", pageTitle, "so refetching")
-				fetchedContent, revTS, curTS, err := ybtools.FetchWikitextFromTitleWithTimestamps(pageTitle)
-				if err != nil {
-					log.Println("Returned an error when trying to refetch article, skipping:", err)
-					return
+				if bot.CanEditTitle("User talk:" + user) {
+					notifyUser(bot, w, user, pageTitle, talkMessageHeader, message)
 				}
-
-				processArticle(w, pageTitle, fetchedContent, pageContentModel, revTS, curTS, true)
-				return
-			}
-
-			ybtools.PanicErr("API error raised, can't handle, so failing. Error was ", err)
-		default:
-			if err == mwclient.ErrEditNoChange {
-				// Normally this would only happen if two instances ran at the same time or very close to one another.
-				// It may also happen in the case of a very long-running process, that misses an update to a page in the mean time.
-				// It's very rare, but theoretically possible.
-				log.Println("No change made to page", pageTitle, "so assuming something already fixed it and ignoring")
-				return
 			}
-			ybtools.PanicErr("Non-API error raised, can't handle, so failing. Error was ", err)
 		}
+	} else if err == mwclient.ErrEditNoChange {
+		log.Println("No users to prune on page", pageTitle, "so ignoring")
+		bot.ReportSkipped(pageTitle, "no users to prune")
+	} else if errors.Is(err, ybtools.ErrEditConflict) {
+		log.Println("Edit conflicted on page", pageTitle, "every time, so skipping")
+		bot.ReportSkipped(pageTitle, "edit conflicted")
+	} else if err != ybtools.ErrEditNotAllowed {
+		// anything that would stop the whole run has already done so in ybtools.Do
+		log.Println("Failed to prune", pageTitle, "so skipping it. Error was", err)
+		bot.ReportError(pageTitle, "failed to prune: "+err.Error())
+	}
+}
+
+// notifyUser leaves a notice for a user on their talk page, in a new section, that they've been
+// pruned from pageTitle. Only one notice is posted at a time, with notificationInterval between them.
+func notifyUser(bot *ybtools.Bot, w *mwclient.Client, user, pageTitle, talkMessageHeader, message string) {
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+
+	err := bot.DoUnrepeatable(func() error {
+		bot.SetEditReason("User talk:"+user, "removed from "+pageTitle+" for inactivity")
+		return w.Edit(params.Values{
+			"title":        "User talk:" + user,
+			"section":      "new",
+			"sectiontitle": talkMessageHeader,
+			"summary":      "[[User:Yapperbot/Pruner|Pruner]]: " + talkMessageHeader,
+			"notminor":     "true",
+			"bot":          "true",
+			"text":         message,
+			"redirect":     "true",
+		})
+	})
+	if err == nil {
+		log.Println("Successfully notified", user, "of their pruning from", pageTitle)
+		bot.ReportCount("users notified", 1)
+		time.Sleep(notificationInterval)
+	} else {
+		// DoUnrepeatable has already stopped the run if the bot can't edit at all; other errors aren't retried
+		// unless the wiki refused the edit, so that a notice that was saved isn't posted twice
+		log.Println("Error editing user talk for", user, "meant they couldn't be notified. The error was", err)
+		bot.ReportError("User talk:"+user, "failed to notify of pruning from "+pageTitle+": "+err.Error())
 	}
 }
@@ -0,0 +1,357 @@
+package pruner
+
+//
+// Yapperbot-Pruner, the user pruning bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+// fakeReplicaDriver is the name the fake replica is registered under with database/sql.
+const fakeReplicaDriver string = "prunertest"
+
+// fakeReplica stands in for the wiki replica database, answering the Pruner's queries
+// from what's been set on it, rather than from tables.
+type fakeReplica struct {
+	sync.Mutex
+	// lastEdits are the MediaWiki timestamps of each user's last edit
+	lastEdits map[string]string
+	// indefBlocks are the MediaWiki timestamps each indefinitely blocked user was blocked at
+	indefBlocks map[string]string
+	// redirects are where user talk pages redirect to, by title, with underscores for spaces
+	redirects map[string]string
+}
+
+var replica = &fakeReplica{}
+
+func init() {
+	sql.Register(fakeReplicaDriver, replica)
+}
+
+// set replaces everything the replica knows.
+func (r *fakeReplica) set(lastEdits, indefBlocks, redirects map[string]string) {
+	r.Lock()
+	defer r.Unlock()
+	r.lastEdits, r.indefBlocks, r.redirects = lastEdits, indefBlocks, redirects
+}
+
+// query answers one of the Pruner's queries, returning the single value it selects, if any.
+func (r *fakeReplica) query(query string, args []driver.Value) (string, bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	name, _ := args[0].(string)
+	switch query {
+	case lastEditQueryTemplate:
+		since, _ := args[1].(string)
+		edited, ok := r.lastEdits[name]
+		return name, ok && edited > since, nil
+	case blockQueryTemplate:
+		before, _ := args[1].(string)
+		blocked, ok := r.indefBlocks[name]
+		return "1", ok && blocked < before, nil
+	case userRedirectQueryTemplate:
+		target, ok := r.redirects[name]
+		return target, ok, nil
+	}
+	return "", false, errors.New("unexpected query " + query)
+}
+
+func (r *fakeReplica) Open(name string) (driver.Conn, error) {
+	return fakeReplicaConn{r}, nil
+}
+
+type fakeReplicaConn struct {
+	replica *fakeReplica
+}
+
+func (c fakeReplicaConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeReplicaStmt{c.replica, query}, nil
+}
+
+func (c fakeReplicaConn) Close() error {
+	return nil
+}
+
+func (c fakeReplicaConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("the fake replica is read only")
+}
+
+type fakeReplicaStmt struct {
+	replica *fakeReplica
+	query   string
+}
+
+func (s fakeReplicaStmt) Close() error {
+	return nil
+}
+
+func (s fakeReplicaStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s fakeReplicaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("the fake replica is read only")
+}
+
+func (s fakeReplicaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	value, found, err := s.replica.query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	rows := &fakeReplicaRows{}
+	if found {
+		rows.values = []string{value}
+	}
+	return rows, nil
+}
+
+type fakeReplicaRows struct {
+	values []string
+}
+
+func (r *fakeReplicaRows) Columns() []string {
+	return []string{"value"}
+}
+
+func (r *fakeReplicaRows) Close() error {
+	return nil
+}
+
+func (r *fakeReplicaRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+// mediaWikiTimestampAgo returns the MediaWiki timestamp of the given time before now.
+func mediaWikiTimestampAgo(ago time.Duration) string {
+	return time.Now().Add(-ago).UTC().Format(mediaWikiTimestampFormat)
+}
+
+func TestRun(t *testing.T) {
+	databaseDriver = fakeReplicaDriver
+	notificationInterval = 0
+	t.Cleanup(func() {
+		databaseDriver = "mysql"
+		notificationInterval = 5 * time.Second
+	})
+
+	const day time.Duration = 24 * time.Hour
+	replica.set(
+		map[string]string{
+			"Active":    mediaWikiTimestampAgo(day),
+			"Blocked":   mediaWikiTimestampAgo(day),
+			"New name":  mediaWikiTimestampAgo(day),
+			"Suspended": mediaWikiTimestampAgo(day),
+		},
+		map[string]string{
+			"Blocked": mediaWikiTimestampAgo(60 * day),
+			// blocked too recently to be pruned for it yet
+			"Suspended": mediaWikiTimestampAgo(day),
+		},
+		map[string]string{"Old_name": "New_name"},
+	)
+
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: "Template:Pruner config", Content: "Pruned by the bot."})
+	formatsID := wiki.AddPage(mwtest.PageSpec{
+		Title:        "User:SodiumBot/Pruner formats.json",
+		Content:      `{"user": "^\\* \\{\\{user\\|([^}]*)\\}\\}", "broken": 5}`,
+		ContentModel: "json",
+	})
+	wiki.AddPage(mwtest.PageSpec{Title: "User talk:Quiet", Content: "{{nobots}}"})
+	wiki.AddPage(mwtest.PageSpec{Title: "User talk:Inactive", Content: "Welcome!\n"})
+
+	const list string = "{{Pruner config|inactivity=3 months|indeffed=1 month|format=user}}\n" +
+		"* {{user|Active}}\n" +
+		"* {{user|Inactive}}\n" +
+		"* {{user|Dormant}}\n" +
+		"* {{user|Blocked}}\n" +
+		"* {{user|Suspended}}\n" +
+		"* {{user|Old name}}\n" +
+		"* {{user|Quiet}}\n"
+	wiki.AddPage(mwtest.PageSpec{Title: "Wikipedia:WikiProject Example/Members", Content: list})
+	wiki.AddPage(mwtest.PageSpec{
+		Title:        "Wikipedia:WikiProject Example/Newsletter",
+		Content:      `{"description": "{{Pruner config|inactivity=3 months|format=user|expiredmsg=none}}", "targets": [{"title": "User talk:Active"}, {"title": "User talk:Inactive"}, {"title": "User talk:Old name/Archive"}, {"title": "Wikipedia:WikiProject Example"}]}`,
+		ContentModel: "MassMessageListContent",
+	})
+	const unchanged string = "{{Pruner config|inactivity=3 months|format=user}}\n* {{user|Active}}\n"
+	wiki.AddPage(mwtest.PageSpec{Title: "Wikipedia:Unchanged", Content: unchanged})
+	const invalid string = "{{Pruner config|inactivity=3 months|format=broken}}\n* {{user|Inactive}}\n"
+	wiki.AddPage(mwtest.PageSpec{Title: "Wikipedia:Invalid", Content: invalid})
+
+	server := mwtest.NewServer(wiki)
+	defer server.Close()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	files := map[string]string{
+		"config-global.yml": "apiendpoint: " + server.Endpoint() + "\nbotusername: SodiumBot@test\n" +
+			"alerts:\n  - type: file\n    path: alerts.jsonl\n",
+		"config-pruner.yml": "configtemplate: Template:Pruner config\n" +
+			"formatsjsonpageid: \"" + strconv.FormatInt(formatsID, 10) + "\"\n" +
+			"defaultexpiredmsgtemplate: User:SodiumBot/Pruned\n" +
+			"defaulttalkmsgheader: You've been pruned\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("YAPPERBOT_BOTPASSWORD", "test-bot-password")
+	t.Setenv("YAPPERBOT_DSN", "replica:replica-password@tcp(localhost:3306)/enwiki_p")
+
+	opts := ybtools.DefaultOptions()
+	opts.ConfigDir = dir
+	opts.AuditLog = ""
+	if err := Run(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := []struct {
+		title string
+		want  string
+	}{
+		{"Wikipedia:WikiProject Example/Members", "{{Pruner config|inactivity=3 months|indeffed=1 month|format=user}}\n" +
+			"* {{user|Active}}\n" +
+			"* {{user|Suspended}}\n" +
+			"* {{user|New name}}\n"},
+		{"Wikipedia:WikiProject Example/Newsletter", `{"description":"{{Pruner config|inactivity=3 months|format=user|expiredmsg=none}}","targets":[{"title":"User talk:Active"},{"title":"User talk:New name/Archive"},{"title":"Wikipedia:WikiProject Example"}]}`},
+		{"Wikipedia:Unchanged", unchanged},
+		{"Wikipedia:Invalid", invalid},
+		{"User talk:Quiet", "{{nobots}}"},
+	}
+	for _, page := range pages {
+		if got, _ := wiki.Content(page.title); got != page.want {
+			t.Errorf("%s is %q, want %q", page.title, got, page.want)
+		}
+	}
+
+	// only those pruned for inactivity from the list that sends messages are notified
+	notice, _ := wiki.Content("User talk:Inactive")
+	if !strings.HasPrefix(notice, "Welcome!\n") || !strings.Contains(notice, "== You've been pruned ==") || !strings.Contains(notice, "{{subst:User:SodiumBot/Pruned|Inactive|Wikipedia:WikiProject Example/Members|3 months}}") {
+		t.Errorf("User talk:Inactive is %q, want a notice of pruning from the members list", notice)
+	}
+	for _, user := range []string{"Blocked", "Old name", "Active"} {
+		if _, exists := wiki.Page("User talk:" + user); exists {
+			t.Errorf("User talk:%s was edited, but they weren't pruned for inactivity", user)
+		}
+	}
+	// talk pages aren't started just to leave a notice on them
+	if _, exists := wiki.Page("User talk:Dormant"); exists {
+		t.Error("User talk:Dormant was created to notify them")
+	}
+
+	var summaries []string
+	for _, edit := range wiki.Edits() {
+		if strings.HasPrefix(edit.Title, "Wikipedia:") {
+			summaries = append(summaries, edit.Title+": "+edit.Summary)
+		}
+	}
+	wantSummaries := []string{
+		"Wikipedia:WikiProject Example/Members: " + editSummaryOpening + "3 inactive user(s); 1 indeffed user(s); 1 renamed user(s)",
+		"Wikipedia:WikiProject Example/Newsletter: " + editSummaryOpening + "1 inactive user(s); 1 renamed user(s)",
+	}
+	if strings.Join(summaries, "\n") != strings.Join(wantSummaries, "\n") {
+		t.Errorf("edits were\n%s\nwant\n%s", strings.Join(summaries, "\n"), strings.Join(wantSummaries, "\n"))
+	}
+
+	report := runReport(t, opts.ReportDir)
+	wantCounts := map[string]int{"expired users": 4, "indeffed users": 1, "renamed users": 2, "users notified": 1}
+	for name, want := range wantCounts {
+		if got := report.Counts[name]; got != want {
+			t.Errorf("report counts %d %s, want %d", got, name, want)
+		}
+	}
+	skipped := map[string]string{}
+	for _, page := range report.Skipped {
+		skipped[page.Title] = page.Reason
+	}
+	if reason := skipped["User talk:Dormant"]; reason != "no talk page" {
+		t.Errorf("User talk:Dormant was skipped for %q, want no talk page", reason)
+	}
+	var errored []string
+	for _, page := range report.Errors {
+		errored = append(errored, page.Title)
+	}
+	if len(errored) != 2 || errored[1] != "Wikipedia:Invalid" {
+		t.Errorf("report has errors for %v, want the broken format and Wikipedia:Invalid", errored)
+	}
+	// database errors can mention the password without the rest of the DSN
+	if got := ybtools.Redact("replica-password"); got != "[redacted]" {
+		t.Errorf("the replica password wasn't registered as a secret: Redact gave %q", got)
+	}
+	if alerts, err := os.ReadFile("alerts.jsonl"); err != nil || !strings.Contains(string(alerts), "format broken") {
+		t.Errorf("alerts sent were %q, want one about the broken format: %v", alerts, err)
+	}
+}
+
+// runReport reads the only run report written into dir.
+func runReport(t *testing.T, dir string) ybtools.RunReport {
+	t.Helper()
+	reports, err := filepath.Glob(filepath.Join(dir, "pruner-*.json"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("found run reports %v, want one: %v", reports, err)
+	}
+	contents, err := os.ReadFile(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ybtools.RunReport
+	if err := json.Unmarshal(contents, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		dsn          string
+		wantProblems int
+	}{
+		{"", 0},
+		{"checker:checked-password@tcp(localhost:3306)/enwiki_p", 0},
+		{"not a dsn", 1},
+	}
+	for _, test := range tests {
+		if problems := (Config{DSN: test.dsn}).ValidateConfig(); len(problems) != test.wantProblems {
+			t.Errorf("ValidateConfig with DSN %q gave %v, want %d problems", test.dsn, problems, test.wantProblems)
+		}
+	}
+	// a config check only looks at the config, so it leaves the secrets alone
+	if got := ybtools.Redact("checked-password"); got != "checked-password" {
+		t.Errorf("checking the config registered the password as a secret: Redact gave %q", got)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package pruner
 
 import (
 	"database/sql"
@@ -7,12 +7,10 @@ import (
 	"regexp"
 	"strings"
 	"time"
-	"unicode"
-	"unicode/utf8"
 
-	// needs to be blank-imported to make the driver work
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
 )
 
 //
@@ -75,36 +73,45 @@ var regexReplaceCaptureGroup *regexp.Regexp
 var lastEditQuery, blockQuery, userRedirectQuery *sql.Stmt
 var conn *sql.DB
 
+// databaseDriver is the database/sql driver the replica is opened with; tests use a fake one.
+var databaseDriver string = "mysql"
+
 func init() {
 	regexReplaceCaptureGroup = regexp.MustCompile(regexReplaceCaptureGroupExpression)
 }
 
-func withDatabaseConnection(cb preppedStatementsCallback) {
-	var err error
+func withDatabaseConnection(bot *ybtools.Bot, cb preppedStatementsCallback) {
+	// the password is registered as a secret on its own, as database errors can mention it without the rest of the DSN
+	dsn, err := mysql.ParseDSN(config.DSN)
+	if err != nil {
+		bot.PanicErr("DSN invalid with error ", err)
+	}
+	ybtools.RegisterSecret(dsn.Passwd)
 
-	conn, err = sql.Open("mysql", config.DSN)
+	conn, err = sql.Open(databaseDriver, config.DSN)
 	if err != nil {
-		ybtools.PanicErr("DSN invalid with error ", err)
+		bot.PanicErr("DSN invalid with error ", err)
 	}
+	defer conn.Close()
 	if err := conn.Ping(); err != nil {
-		ybtools.PanicErr(err)
+		bot.PanicErr(err)
 	}
 
 	lastEditQuery, err = conn.Prepare(lastEditQueryTemplate)
 	if err != nil {
-		ybtools.PanicErr("lastEditQuery preparation failed with error ", err)
+		bot.PanicErr("lastEditQuery preparation failed with error ", err)
 	}
 	defer lastEditQuery.Close()
 
 	blockQuery, err = conn.Prepare(blockQueryTemplate)
 	if err != nil {
-		ybtools.PanicErr("blockQuery preparation failed with error ", err)
+		bot.PanicErr("blockQuery preparation failed with error ", err)
 	}
 	defer blockQuery.Close()
 
 	userRedirectQuery, err = conn.Prepare(userRedirectQueryTemplate)
 	if err != nil {
-		ybtools.PanicErr("userRedirectQuery preparation failed with error ", err)
+		bot.PanicErr("userRedirectQuery preparation failed with error ", err)
 	}
 	defer userRedirectQuery.Close()
 
@@ -112,9 +119,9 @@ func withDatabaseConnection(cb preppedStatementsCallback) {
 }
 
 func checkUser(
-	username string, pageTitle string, editsSinceStamp string, blockStamp string, usersToReplace map[string]string, usersToRemove map[int8][]string) {
+	bot *ybtools.Bot, site *title.Site, username string, pageTitle string, editsSinceStamp string, blockStamp string, usersToReplace map[string]string, usersToRemove map[int8][]string) {
 	var outputFromQueryRow string
-	var dbUsername string = usernameCase(username)
+	var dbUsername string = site.Username(username)
 	// We have no use whatsoever for the output of this, we just want to see if it errors.
 	// That being said, Scan() doesn't let us just pass nothing, so we have to have the
 	// slight pain of having a stupid additional variable.
@@ -133,17 +140,17 @@ func checkUser(
 				usersToRemove[inactiveUsers] = append(usersToRemove[inactiveUsers], username)
 				return
 			} else if err != nil {
-				ybtools.PanicErr("Failed when querying DB for redirects with error ", err)
+				bot.PanicErr("Failed when querying DB for redirects with error ", err)
 			}
-			// A redirect was found! Replace underscores with spaces, and if it redirects to a subpage,
+			// A redirect was found! Normalise it, and if it redirects to a subpage,
 			// get the corresponding root page, before a /, for the user (which is, after all, their username).
-			outputFromQueryRow = strings.SplitN(strings.ReplaceAll(outputFromQueryRow, "_", " "), "/", 2)[0]
+			outputFromQueryRow = site.Username(outputFromQueryRow)
 			log.Println("Found a redirect for", username, "so replacing them on", pageTitle, "with", outputFromQueryRow)
 			usersToReplace[username] = outputFromQueryRow
 			// this is here to make sure that the redirect target is also checked for indefs
 			dbUsername = outputFromQueryRow
 		} else {
-			ybtools.PanicErr("Failed when querying DB for last edits with error ", err)
+			bot.PanicErr("Failed when querying DB for last edits with error ", err)
 		}
 	}
 
@@ -155,11 +162,13 @@ func checkUser(
 		usersToRemove[indeffedUsers] = append(usersToRemove[indeffedUsers], username)
 		return
 	} else if err != sql.ErrNoRows {
-		log.Fatal("Failed when querying DB for blocks with error ", err)
+		bot.PanicErr("Failed when querying DB for blocks with error ", err)
 	}
 }
 
 func pruneUsersFromMMList(
+	bot *ybtools.Bot,
+	site *title.Site,
 	pageTitle string,
 	pageContent MassMessageContent,
 	inactivityTs time.Time,
@@ -182,35 +191,18 @@ func pruneUsersFromMMList(
 		Targets:     make([]MassMessageContentTarget, 0, len(pageContent.Targets)),
 	}
 
-	prefixes := []string{"User:", "User talk:"}
-
 	// First pass: decide what to remove/replace
 	for _, target := range pageContent.Targets {
-		title := target.Title
-
-		var (
-			username string
-			isUser   bool
-		)
-
-		for _, p := range prefixes {
-			if strings.HasPrefix(title, p) {
-				username = strings.TrimPrefix(title, p)
-				isUser = true
-				break
-			}
-		}
+		username, isUser := site.UserFromTitle(target.Title)
 		if !isUser {
 			continue
 		}
 
-		username = strings.Split(username, "/")[0]
-
 		if checkedUsers[username] {
 			continue
 		}
 
-		checkUser(username, pageTitle, editsSinceStamp, blockStamp, usersToReplace, usersToRemove)
+		checkUser(bot, site, username, pageTitle, editsSinceStamp, blockStamp, usersToReplace, usersToRemove)
 		checkedUsers[username] = true
 	}
 
@@ -225,29 +217,11 @@ func pruneUsersFromMMList(
 
 	// Second pass: actually prune/replace targets
 	for _, target := range pageContent.Targets {
-		title := target.Title
-
-		var username string
-		var isUser bool
-		for _, p := range prefixes {
-			if after, ok := strings.CutPrefix(title, p); ok {
-				username = after
-				isUser = true
-				break
-			}
-		}
-
-		parts := strings.SplitN(username, "/", 2)
-
-		username = parts[0]
-
-		var subpage string
-		if len(parts) == 2 {
-			subpage = parts[1]
-		}
+		targetTitle, err := site.Parse(target.Title)
+		username, isUser := targetTitle.Username()
 
 		// Non-user targets are preserved
-		if !isUser {
+		if err != nil || !isUser {
 			newPageContent.Targets = append(newPageContent.Targets, target)
 			continue
 		}
@@ -257,9 +231,13 @@ func pruneUsersFromMMList(
 			continue
 		}
 
-		// Apply replacement if present
+		// Apply replacement if present, keeping the namespace and any subpage
 		if repl, ok := usersToReplace[username]; ok {
-			target.Title = "User talk:" + repl + subpage
+			text := repl
+			if _, subpage, isSubpage := strings.Cut(targetTitle.Text, "/"); isSubpage {
+				text += "/" + subpage
+			}
+			target.Title = site.NewTitle(targetTitle.Namespace, text).String()
 		}
 
 		newPageContent.Targets = append(newPageContent.Targets, target)
@@ -282,7 +260,7 @@ func pruneUsersFromMMList(
 // number of indeffed users, number of renamed users, an array of the expired users,
 // and a map of the renamed users (with their old name as the key, and their new name as the value).
 func pruneUsersFromWikitextList(
-	pageTitle string, pageContent string, formatRegex *regexp.Regexp, inactivityTs time.Time, blockTs time.Time) (
+	bot *ybtools.Bot, site *title.Site, pageTitle string, pageContent string, formatRegex *regexp.Regexp, inactivityTs time.Time, blockTs time.Time) (
 	string, int, int, int, []string, map[string]string) {
 	var regexBuilder strings.Builder
 	var checkedUsers = map[string]bool{}
@@ -302,7 +280,7 @@ func pruneUsersFromWikitextList(
 
 		// the first regex capture group should always be the username
 		if len(match) != 2 {
-			ybtools.PanicErr("Match doesn't have exactly one capture group for regex", formatRegex, "- matched:", match)
+			bot.PanicErr("Match doesn't have exactly one capture group for regex", formatRegex, "- matched:", match)
 		}
 		var username string = match[1]
 
@@ -313,7 +291,7 @@ func pruneUsersFromWikitextList(
 		}
 
 		checkedUsers[username] = true
-		checkUser(username, pageTitle, editsSinceStamp, blockStamp, usersToReplace, usersToRemove)
+		checkUser(bot, site, username, pageTitle, editsSinceStamp, blockStamp, usersToReplace, usersToRemove)
 	}
 
 	/*
@@ -359,7 +337,7 @@ func pruneUsersFromWikitextList(
 
 		builtRegexForRemoval, err := regexp.Compile(regexBuilder.String())
 		if err != nil {
-			ybtools.PanicErr("Failed to build builtRegexForRemoval from regexBuilder with error ", err)
+			bot.PanicErr("Failed to build builtRegexForRemoval from regexBuilder with error ", err)
 		}
 
 		pageContent = builtRegexForRemoval.ReplaceAllString(pageContent, "")
@@ -384,7 +362,7 @@ func pruneUsersFromWikitextList(
 
 			builtRegexForRename, err := regexp.Compile(regexRenameBuilder.String())
 			if err != nil {
-				ybtools.PanicErr("Failed to build builtRegexForRename from regexRenameBuilder with error ", err)
+				bot.PanicErr("Failed to build builtRegexForRename from regexRenameBuilder with error ", err)
 			}
 
 			// Generate the replacement that we want to use
@@ -413,23 +391,3 @@ func pruneUsersFromWikitextList(
 	return pageContent, len(usersToRemove[inactiveUsers]), len(usersToRemove[indeffedUsers]), len(usersToReplace),
 		usersToRemove[inactiveUsers], usersToReplace
 }
-
-// Takes a string, s, and converts the first rune to uppercase
-// by using the unicode functions in golang's stdlib
-// Returns the converted string
-func usernameCase(s string) string {
-	firstRune, size := utf8.DecodeRuneInString(s)
-	if firstRune != utf8.RuneError || size > 1 {
-		var upcase rune
-
-		if replacement, exists := charReplaceUpcase[firstRune]; exists {
-			upcase = replacement
-		} else {
-			upcase = unicode.ToUpper(firstRune)
-		}
-		if upcase != firstRune {
-			s = string(upcase) + s[size:]
-		}
-	}
-	return strings.ReplaceAll(s, "_", " ")
-}
@@ -0,0 +1,33 @@
+package uncurrenter
+
+//
+// Uncurrenter, the {{current}} tag removal bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Config holds the configuration pulled from the standard
+// ybtools task-specific config file. The defaults are for the English Wikipedia;
+// other wikis set their own template and summary under wikis in the config.
+type Config struct {
+	// Template is the full title of the {{current}} template, namespace and all
+	Template string
+	Summary  string
+}
+
+var config = Config{
+	Template: "Template:Current",
+	Summary:  "Auto-removing {{current}} - no edits in 5hrs+. The event may still be current, but [[Template:Current|the {{current}} template is designed only for articles which many editors are editing, and is usually up for less than a day]].",
+}
@@ -1,4 +1,4 @@
-package main
+package uncurrenter
 
 //
 // Uncurrenter, the {{current}} tag removal bot for Wikipedia
@@ -19,63 +19,90 @@ package main
 //
 
 import (
-	"crypto/md5"
-	"fmt"
+	"errors"
 	"log"
-	"regexp"
-	"strings"
 	"time"
 
 	"cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
 	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/wikitext"
 )
 
-var currentTemplateRegex *regexp.Regexp
+// Run runs the Uncurrenter, removing {{current}} from articles that haven't been
+// edited for five hours, on each wiki, with the given options, or the defaults if opts is nil.
+// It returns an error if the bot couldn't be set up.
+func Run(opts *ybtools.Options) error {
+	bot, err := ybtools.New(ybtools.BotSettings{TaskName: "Uncurrenter", BotUser: "Yapperbot", ToolforgeAccount: "yapping-sodium", Config: &config, Options: opts})
+	if err != nil {
+		return err
+	}
+	bot.ForEachWiki(func(wiki string) {
+		uncurrentWiki(bot)
+	})
+	return nil
+}
+
+// uncurrentWiki removes the template from every article on the wiki the bot is set up for
+// that hasn't been edited for five hours.
+func uncurrentWiki(bot *ybtools.Bot) {
+	defer bot.SaveRunReport()
+	defer bot.SaveEditLimit()
 
-func main() {
-	ybtools.SetupBot(ybtools.BotSettings{TaskName: "Uncurrenter", BotUser: "Yapperbot", ToolforgeAccount: "yapping-sodium"})
-	defer ybtools.SaveEditLimit()
+	w, err := bot.Connect(ybtools.DefaultMaxlag)
+	if err != nil {
+		bot.PanicErr("Failed to connect to the wiki with error ", err)
+	}
 
-	w := ybtools.CreateAndAuthenticateClient(ybtools.DefaultMaxlag)
+	site, err := bot.Site()
+	if err != nil {
+		bot.PanicErr("Failed to look up the wiki's namespaces with error ", err)
+	}
+	currentTemplate, err := site.ParseIn(config.Template, title.NamespaceTemplate)
+	if err != nil {
+		bot.PanicErr("Configured template ", config.Template, " isn't a valid title: ", err)
+	}
 
 	// Check for every redirect to the {{current}} template, and include all of those - these will show
 	// as transclusions of the template, and are covered under the BRFA as they are the same template
 	queryRedirects := w.NewQuery(params.Values{
 		"action":       "query",
 		"generator":    "linkshere",
-		"titles":       "Template:Current",
+		"titles":       currentTemplate.String(),
 		"glhprop":      "title",
 		"glhnamespace": "10",
 		"glhshow":      "redirect",
 	})
 
-	var regexBuilder strings.Builder
-	regexBuilder.WriteString(`(?i){{(?:current`)
+	// titles of redirects come back in the wiki's own name for the namespace,
+	// which the site knows to take off
+	templateNames := []string{currentTemplate.Text}
 
 	for queryRedirects.Next() {
-		pages := ybtools.GetPagesFromQuery(queryRedirects.Resp())
-		if len(pages) > 0 {
-			for _, page := range pages {
-				pageTitle, err := page.GetString("title")
-				if err != nil {
-					log.Println("Failed to get title from redirect page for template, so skipping it. Error was", err)
-					continue
-				}
-				regexBuilder.WriteString("|")
-				regexBuilder.WriteString(regexp.QuoteMeta(strings.TrimPrefix(pageTitle, "Template:")))
+		pages, err := ybtools.PagesFromQuery(queryRedirects.Resp())
+		if err != nil {
+			bot.PanicErr("Failed to decode redirects to the template with error ", err)
+		}
+		for _, page := range pages {
+			if page.Title == "" {
+				log.Println("Failed to get title from redirect page for template, so skipping it")
+				continue
+			}
+			redirect, err := site.ParseIn(page.Title, title.NamespaceTemplate)
+			if err != nil {
+				log.Println("Redirect", page.Title, "to the template isn't a valid title, so skipping it")
+				continue
 			}
+			templateNames = append(templateNames, redirect.Text)
 		}
 	}
-	regexBuilder.WriteString(`) *(?:\|(?:{{[^}{]*}}|[^}{]*)*|)}}\n?`)
 
-	currentTemplateRegex = regexp.MustCompile(regexBuilder.String())
-
-	ybtools.ForPageInQuery(params.Values{
+	bot.ForPageInQuery(params.Values{
 		"action":         "query",
 		"prop":           "revisions",
 		"generator":      "embeddedin",
-		"geititle":       "Template:Current",
+		"geititle":       currentTemplate.String(),
 		"geinamespace":   "0",
 		"geifilterredir": "nonredirects",
 		"rvprop":         "timestamp|content|contentmodel",
@@ -85,42 +112,52 @@ func main() {
 		revTSProcessed, err := time.Parse(time.RFC3339, revTS)
 		if err != nil {
 			log.Println("Failed to parse last revision timestamp, so skipping the page. Error was", err)
+			bot.ReportError(pageTitle, "failed to parse last revision timestamp: "+err.Error())
 			return
 		}
 
-		// if it's been more than five hours since the last edit, and we can edit it
-		if time.Since(revTSProcessed).Hours() > 5 && ybtools.BotAllowed(pageContent) && ybtools.CanEdit() {
-			newPageContent := currentTemplateRegex.ReplaceAllString(pageContent, "")
-			if newPageContent == pageContent {
-				log.Println("newPageContent was the same as pageContent on page", pageTitle, "so ignoring")
-				return
-			}
+		if bot.Now().Sub(revTSProcessed).Hours() <= 5 {
+			bot.ReportSkipped(pageTitle, "edited in the last five hours")
+			return
+		}
+		if allowed, reason := bot.ExclusionCheck(pageContent, false); !allowed {
+			log.Println("Not allowed to edit", pageTitle, "so skipping:", reason)
+			bot.ReportSkipped(pageTitle, reason)
+			return
+		}
 
-			err = w.Edit(params.Values{
-				"title":          pageTitle,
-				"text":           newPageContent,
-				"md5":            fmt.Sprintf("%x", md5.Sum([]byte(newPageContent))),
-				"summary":        "Auto-removing {{current}} - no edits in 5hrs+. The event may still be current, but [[Template:Current|the {{current}} template is designed only for articles which many editors are editing, and is usually up for less than a day]].",
-				"notminor":       "true",
-				"bot":            "true",
-				"basetimestamp":  revTS,
-				"starttimestamp": curTS,
-			})
-			if err == nil {
-				log.Println("Successfully removed current template from", pageTitle)
-			} else {
-				switch err := err.(type) {
-				case mwclient.APIError:
-					if err.Code == "editconflict" {
-						log.Println("Edit conflicted on page", pageTitle, "assuming it's still active and skipping")
-						return
-					}
-
-					ybtools.PanicErr("API error raised, can't handle, so failing. Error was ", err)
-				default:
-					ybtools.PanicErr("Non-API error raised, can't handle, so failing. Error was ", err)
-				}
+		// it's been more than five hours since the last edit, so remove the template; if somebody
+		// edits the page in the mean time, it's clearly still current, so it's left alone
+		err = bot.SafeEdit(&ybtools.PageEdit{
+			Title:            pageTitle,
+			Summary:          config.Summary,
+			Params:           params.Values{"notminor": "true"},
+			Content:          pageContent,
+			RevTimestamp:     revTS,
+			CurTimestamp:     curTS,
+			Reason:           "last edited " + revTS + ", more than five hours ago",
+			GiveUpOnConflict: true,
+		}, func(content string) (string, error) {
+			parsed := wikitext.Parse(content)
+			for _, template := range parsed.TemplatesNamedBy(site.TemplateName, templateNames...) {
+				template.Remove()
 			}
+			return parsed.String(), nil
+		})
+		switch {
+		case err == nil:
+			log.Println("Successfully removed current template from", pageTitle)
+			bot.ReportCount("current templates removed", 1)
+		case err == mwclient.ErrEditNoChange:
+			log.Println("newPageContent was the same as pageContent on page", pageTitle, "so ignoring")
+			bot.ReportSkipped(pageTitle, "template not matched")
+		case errors.Is(err, ybtools.ErrEditConflict):
+			log.Println("Edit conflicted on page", pageTitle, "assuming it's still active and skipping")
+			bot.ReportSkipped(pageTitle, "edit conflict, assuming still active")
+		case err != ybtools.ErrEditNotAllowed:
+			// anything that would stop the whole run has already done so in ybtools.Do
+			log.Println("Failed to remove current template from", pageTitle, "so skipping it. Error was", err)
+			bot.ReportError(pageTitle, "failed to remove current template: "+err.Error())
 		}
 	})
 }
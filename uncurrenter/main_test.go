@@ -0,0 +1,157 @@
+package uncurrenter
+
+//
+// Uncurrenter, the {{current}} tag removal bot for Wikipedia
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+// runAgainst runs the Uncurrenter against a fake wiki, from a config directory of its own,
+// which is also the working directory, so that reports and diffs are written there. It returns
+// the run report.
+func runAgainst(t *testing.T, wiki *mwtest.Wiki, opts ybtools.Options) ybtools.RunReport {
+	t.Helper()
+	server := mwtest.NewServer(wiki)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	global := "apiendpoint: " + server.Endpoint() + "\nbotusername: Yapperbot@test\n" +
+		"alerts:\n  - type: file\n    path: alerts.jsonl\n"
+	if err := os.WriteFile("config-global.yml", []byte(global), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("YAPPERBOT_BOTPASSWORD", "test-bot-password")
+
+	opts.ConfigDir = dir
+	opts.AuditLog = ""
+	if err := Run(&opts); err != nil {
+		t.Fatal(err)
+	}
+
+	reports, err := filepath.Glob(filepath.Join(opts.ReportDir, "uncurrenter-*.json"))
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("found run reports %v, want one: %v", reports, err)
+	}
+	contents, err := os.ReadFile(reports[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ybtools.RunReport
+	if err := json.Unmarshal(contents, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestRun(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-6 * time.Hour)
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: "Template:Current", Content: "This article is about a current event."})
+	wiki.AddPage(mwtest.PageSpec{Title: "Template:Current event", Content: "#REDIRECT [[Template:Current]]"})
+	// not an article, so left alone
+	wiki.AddPage(mwtest.PageSpec{Title: "Talk:Stale", Content: "{{Current}}", Timestamp: old})
+
+	pages := []struct {
+		title   string
+		content string
+		edited  time.Time
+		want    string
+	}{
+		{"Stale", "{{Current}}\nSomething happened.", old, "Something happened."},
+		{"Stale lower case", "{{current|date=today}}\nSomething happened.", old, "Something happened."},
+		{"Stale redirect", "{{Current event}}\nSomething happened.", old, "Something happened."},
+		{"Stale namespaced", "Something {{Template:Current}} happened.", old, "Something  happened."},
+		{"Stale after a comment", "<!-- {{Current}} -->{{Current}}\nSomething happened.", old, "<!-- {{Current}} -->\nSomething happened."},
+		{"Recent", "{{Current}}\nSomething is happening.", now.Add(-time.Hour), "{{Current}}\nSomething is happening."},
+		{"Nobots", "{{nobots}}{{Current}}\nSomething happened.", old, "{{nobots}}{{Current}}\nSomething happened."},
+	}
+	for _, page := range pages {
+		wiki.AddPage(mwtest.PageSpec{Title: page.title, Content: page.content, Timestamp: page.edited})
+	}
+
+	report := runAgainst(t, wiki, ybtools.DefaultOptions())
+
+	for _, page := range pages {
+		if got, _ := wiki.Content(page.title); got != page.want {
+			t.Errorf("%s is %q, want %q", page.title, got, page.want)
+		}
+	}
+	if got, _ := wiki.Content("Talk:Stale"); got != "{{Current}}" {
+		t.Errorf("Talk:Stale is %q, want it left alone", got)
+	}
+
+	var edited []string
+	for _, edit := range wiki.Edits() {
+		edited = append(edited, edit.Title)
+		if edit.User != "Yapperbot" || edit.Summary != config.Summary {
+			t.Errorf("%s was edited by %s with summary %q", edit.Title, edit.User, edit.Summary)
+		}
+	}
+	sort.Strings(edited)
+	want := []string{"Stale", "Stale after a comment", "Stale lower case", "Stale namespaced", "Stale redirect"}
+	if !reflect.DeepEqual(edited, want) {
+		t.Errorf("edited %v, want %v", edited, want)
+	}
+
+	if got := report.Counts["current templates removed"]; got != len(want) {
+		t.Errorf("report counts %d templates removed, want %d", got, len(want))
+	}
+	skipped := map[string]string{}
+	for _, page := range report.Skipped {
+		skipped[page.Title] = page.Reason
+	}
+	if skipped["Recent"] != "edited in the last five hours" || skipped["Nobots"] == "" {
+		t.Errorf("report skipped %v, want Recent and Nobots", skipped)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("report has errors %v", report.Errors)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: "Template:Current", Content: "This article is about a current event."})
+	wiki.AddPage(mwtest.PageSpec{Title: "Stale", Content: "{{Current}}\nSomething happened.", Timestamp: time.Now().Add(-6 * time.Hour)})
+
+	opts := ybtools.DefaultOptions()
+	opts.DryRun = true
+	report := runAgainst(t, wiki, opts)
+
+	if edits := wiki.Edits(); len(edits) != 0 {
+		t.Errorf("%d edits made in a dry run, want none", len(edits))
+	}
+	if !report.DryRun || len(report.Edits) != 1 || report.Edits[0].Title != "Stale" {
+		t.Errorf("report has dry run %v and edits %v, want the edit to Stale", report.DryRun, report.Edits)
+	}
+	diffs, err := filepath.Glob(filepath.Join(opts.DryRunDir, "*", "*.diff"))
+	if err != nil || len(diffs) != 1 {
+		t.Errorf("dry-run diffs written are %v, want one: %v", diffs, err)
+	}
+}
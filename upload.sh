@@ -9,23 +9,24 @@ STAGING_DIR="/home/$USER/tmp/tmp-deploy-$$"
 if [ -z "$1" ]; then
     echo "🐶 BARK! You forgot to provide your Toolforge username."
     echo "Usage: $0 <TOOLFORGE_USERNAME> [--upload-botpassword]"
+    echo "(--upload-botpassword is only needed when not authenticating with OAuth)"
     exit 1
 fi
 
-# Build your binaries
+# Build the binary
 make
 
 # Prepare remote staging dir (clean first)
 ssh "$USER@login.toolforge.org" "rm -rf $STAGING_DIR && mkdir -p $STAGING_DIR"
 
-# Upload binaries, configs, and the deploy script
-scp ./frs/frs "$USER@login.toolforge.org:$STAGING_DIR/frs"
-scp ./pruner/pruner "$USER@login.toolforge.org:$STAGING_DIR/pruner"
+# Upload the binary, configs, and the deploy script
+scp ./yapperbot/yapperbot "$USER@login.toolforge.org:$STAGING_DIR/yapperbot"
 scp ./frs/config-frs.yml "$USER@login.toolforge.org:$STAGING_DIR/config-frs.yml"
 scp ./config.yml "$USER@login.toolforge.org:$STAGING_DIR/config-global.yml"
 scp ./pruner/config-pruner.yml "$USER@login.toolforge.org:$STAGING_DIR/config-pruner.yml"
 scp ./deploy-yapper.sh "$USER@login.toolforge.org:$STAGING_DIR/deploy-yapper.sh"
 scp ./jobs.yaml "$USER@login.toolforge.org:$STAGING_DIR/jobs.yaml"
+scp ./daemon.yml "$USER@login.toolforge.org:$STAGING_DIR/daemon.yml"
 # Upload botpassword if flag is passed and file exists
 if [ "$UPLOAD_BOTPASSWORD" == "--upload-botpassword" ] && [ -f botpassword ]; then
     scp botpassword "$USER@login.toolforge.org:$STAGING_DIR/botpassword"
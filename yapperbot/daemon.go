@@ -0,0 +1,344 @@
+package main
+
+//
+// Yapperbot, the single binary every Yapperbot task runs from
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultDaemonConfig string = "daemon.yml"
+const defaultDaemonStatus string = "daemon-status.json"
+
+// daemonConfig is the daemon's config file, which says which tasks it runs, and when.
+type daemonConfig struct {
+	Tasks map[string]struct {
+		// Schedule is when the task runs, as a cron schedule, like those in jobs.yaml
+		Schedule string
+		// Dir is the directory the task runs in, relative to the config file, which is the
+		// directory named after the task next to it if it isn't set
+		Dir string
+	}
+}
+
+// scheduledTask is a task the daemon runs, along with how its runs have gone, as it's
+// written to the status file.
+type scheduledTask struct {
+	Name         string     `json:"task"`
+	Schedule     string     `json:"schedule"`
+	Dir          string     `json:"dir"`
+	Next         time.Time  `json:"next"`
+	Running      bool       `json:"running"`
+	LastStarted  *time.Time `json:"lastStarted,omitempty"`
+	LastFinished *time.Time `json:"lastFinished,omitempty"`
+	// LastStatus is succeeded or failed, with LastError saying why it failed
+	LastStatus string `json:"lastStatus,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+	// Skipped counts the runs that came due while a run was still going, so never happened
+	Skipped int `json:"skipped"`
+
+	task     task
+	schedule *schedule
+}
+
+// daemonStatus is what's written to the status file, whenever a run starts or finishes.
+type daemonStatus struct {
+	Started time.Time        `json:"started"`
+	PID     int              `json:"pid"`
+	Version string           `json:"version"`
+	Tasks   []*scheduledTask `json:"tasks"`
+}
+
+// daemon runs tasks on their schedules in a single process, which stays logged in to the wiki
+// between runs. Each run has a bot of its own, but metrics and what's cached about the wiki are
+// kept for the whole process, as is the directory the task runs in, so tasks are run one at
+// a time: a task that comes due while another is running waits for it to finish, and runs of a
+// task that come due while it's still running are skipped, rather than piling up.
+type daemon struct {
+	// dir is the directory the daemon was started in, which it goes back to after each run
+	dir        string
+	statusPath string
+	status     daemonStatus
+	// options are the options shared by the tasks, which apply to every run
+	options ybtools.Options
+}
+
+// runDaemon is the daemon subcommand: yapperbot daemon [flags], or yapperbot daemon status.
+func runDaemon(args []string) {
+	if len(args) > 0 && args[0] == "status" {
+		daemonStatusCommand(args[1:])
+		return
+	}
+
+	// the daemon's own flags, and all those shared by the tasks, which apply to every run
+	daemonFlags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := daemonFlags.String("daemon-config", defaultDaemonConfig, "YAML file listing the tasks to run, with the schedule and directory for each")
+	statusPath := daemonFlags.String("status-file", defaultDaemonStatus, "JSON file to keep the daemon's status in, with when each task will next run; yapperbot daemon status prints it")
+	once := daemonFlags.Bool("once", false, "run every task once, one after the other, and then exit, rather than running them on their schedules")
+	options := ybtools.DefaultOptions()
+	options.RegisterFlags(daemonFlags)
+	daemonFlags.Parse(args)
+	if daemonFlags.NArg() > 0 {
+		fail(fmt.Sprintf("unexpected arguments %q", daemonFlags.Args()))
+	}
+	if options.ConfigCheck {
+		fail("-config-check can't be used with the daemon; use yapperbot config check <task> for each task")
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		fail(err.Error())
+	}
+	d := &daemon{dir: dir, statusPath: absPath(dir, *statusPath), options: options}
+	d.status = daemonStatus{Started: time.Now().UTC(), PID: os.Getpid(), Version: ybtools.Version()}
+	if d.status.Tasks, err = loadDaemonConfig(absPath(dir, *configPath)); err != nil {
+		fail(err.Error())
+	}
+
+	if *once {
+		failed := false
+		for _, t := range d.status.Tasks {
+			if !d.runTask(t) {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+	d.loop()
+}
+
+// loadDaemonConfig reads the daemon's config file, returning the tasks in it, in name order.
+func loadDaemonConfig(path string) ([]*scheduledTask, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daemon config: %w", err)
+	}
+	var config daemonConfig
+	if err := yaml.UnmarshalStrict(contents, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse daemon config %s: %w", path, err)
+	}
+	if len(config.Tasks) == 0 {
+		return nil, fmt.Errorf("daemon config %s has no tasks", path)
+	}
+
+	var scheduled []*scheduledTask
+	for name, taskConfig := range config.Tasks {
+		t, ok := tasks[name]
+		if !ok {
+			return nil, fmt.Errorf("daemon config %s has a task called %q, which isn't one of the tasks", path, name)
+		}
+		s, err := parseSchedule(taskConfig.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("daemon config %s, task %s: %w", path, name, err)
+		}
+		dir := taskConfig.Dir
+		if dir == "" {
+			dir = name
+		}
+		dir = absPath(filepath.Dir(path), dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("daemon config %s, task %s: %s isn't a directory", path, name, dir)
+		}
+		scheduled = append(scheduled, &scheduledTask{Name: name, Schedule: s.String(), Dir: dir, task: t, schedule: s})
+	}
+	sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Name < scheduled[j].Name })
+	return scheduled, nil
+}
+
+// loop runs each task whenever it's next due, until the daemon is interrupted. A run that's
+// going when it's interrupted is left to finish, or stop itself, first.
+func (d *daemon) loop() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	now := time.Now()
+	for _, t := range d.status.Tasks {
+		t.Next = t.schedule.next(now)
+		log.Println("Scheduled", t.Name, "to run at", t.Next.Format(time.RFC3339))
+	}
+	d.saveStatus()
+
+	for {
+		due := d.status.Tasks[0]
+		for _, t := range d.status.Tasks[1:] {
+			if t.Next.Before(due.Next) {
+				due = t
+			}
+		}
+
+		timer := time.NewTimer(time.Until(due.Next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Println("Daemon stopped")
+			return
+		case <-timer.C:
+		}
+
+		d.runTask(due)
+		if ctx.Err() != nil {
+			log.Println("Daemon stopped")
+			return
+		}
+
+		// runs that came due while this one, or another task's, was going are skipped
+		finished := time.Now()
+		skipped := 0
+		for due.Next = due.schedule.next(due.Next); !due.Next.After(finished); due.Next = due.schedule.next(due.Next) {
+			skipped++
+		}
+		if skipped > 0 {
+			log.Println("Skipped", skipped, "run(s) of", due.Name, "that came due while a run was still going")
+			due.Skipped += skipped
+		}
+		log.Println("Scheduled", due.Name, "to run next at", due.Next.Format(time.RFC3339))
+		d.saveStatus()
+	}
+}
+
+// runTask runs a task in its directory, returning whether it succeeded. Tasks stop with a
+// panic when something goes badly wrong, having already sent an alert through PanicErr, so
+// the panic is recovered, and the run recorded as failed, rather than stopping the daemon;
+// so is a task that couldn't be set up.
+func (d *daemon) runTask(t *scheduledTask) (succeeded bool) {
+	started := time.Now().UTC()
+	t.Running, t.LastStarted = true, &started
+	d.saveStatus()
+	log.Println("Starting scheduled run of", t.Name, "in", t.Dir)
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		// config files and state are looked for in the directory the task runs from
+		if err := os.Chdir(t.Dir); err != nil {
+			return err
+		}
+		defer os.Chdir(d.dir)
+		return run(t.task, &d.options)
+	}()
+
+	finished := time.Now().UTC()
+	t.Running, t.LastFinished = false, &finished
+	if err != nil {
+		log.Println("Scheduled run of", t.Name, "failed with", err)
+		t.LastStatus, t.LastError = "failed", err.Error()
+	} else {
+		log.Println("Scheduled run of", t.Name, "finished")
+		t.LastStatus, t.LastError = "succeeded", ""
+	}
+	d.saveStatus()
+	return err == nil
+}
+
+// saveStatus writes the daemon's status to the status file. It's written to a temporary file
+// first, so that anything reading it never sees half of it. Failing to write it is logged,
+// but doesn't stop the daemon.
+func (d *daemon) saveStatus() {
+	encoded, err := json.MarshalIndent(d.status, "", "\t")
+	if err != nil {
+		log.Println("Failed to encode daemon status with error", err)
+		return
+	}
+	temporary := d.statusPath + ".tmp"
+	if err := os.WriteFile(temporary, append(encoded, '\n'), 0644); err != nil {
+		log.Println("Failed to write daemon status to", temporary, "with error", err)
+		return
+	}
+	if err := os.Rename(temporary, d.statusPath); err != nil {
+		log.Println("Failed to save daemon status to", d.statusPath, "with error", err)
+	}
+}
+
+// daemonStatusCommand prints the status file of a running daemon: when each task last ran,
+// how that went, and when it'll next run.
+func daemonStatusCommand(args []string) {
+	statusFlags := flag.NewFlagSet("daemon status", flag.ExitOnError)
+	statusPath := statusFlags.String("status-file", defaultDaemonStatus, "status file the daemon was started with")
+	asJSON := statusFlags.Bool("json", false, "print the status file as it is")
+	statusFlags.Parse(args)
+	if statusFlags.NArg() > 0 {
+		fail(fmt.Sprintf("unexpected arguments %q", statusFlags.Args()))
+	}
+
+	contents, err := os.ReadFile(*statusPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "yapperbot:", err)
+		os.Exit(1)
+	}
+	if *asJSON {
+		os.Stdout.Write(contents)
+		return
+	}
+	var status daemonStatus
+	if err := json.Unmarshal(contents, &status); err != nil {
+		fmt.Fprintln(os.Stderr, "yapperbot:", *statusPath, "isn't a daemon status file:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Daemon started %s, pid %d, version %s\n\n", status.Started.Format(time.RFC3339), status.PID, status.Version)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TASK\tSCHEDULE\tNEXT\tLAST STARTED\tLAST STATUS\tSKIPPED")
+	for _, t := range status.Tasks {
+		next := "-"
+		if !t.Next.IsZero() {
+			next = t.Next.Format(time.RFC3339)
+		}
+		lastStarted, lastStatus := "-", t.LastStatus
+		if t.LastStarted != nil {
+			lastStarted = t.LastStarted.Format(time.RFC3339)
+		}
+		switch {
+		case t.Running:
+			lastStatus = "running"
+		case lastStatus == "":
+			lastStatus = "-"
+		case t.LastError != "":
+			lastStatus += ": " + t.LastError
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\n", t.Name, t.Schedule, next, lastStarted, lastStatus, t.Skipped)
+	}
+	table.Flush()
+}
+
+// absPath returns path, relative to dir if it isn't absolute already.
+func absPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
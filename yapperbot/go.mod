@@ -0,0 +1,30 @@
+module github.com/sohomdatta1/yapperbot-services/yapperbot
+
+go 1.24
+
+require (
+	github.com/sohomdatta1/yapperbot-services/frs v0.0.0
+	github.com/sohomdatta1/yapperbot-services/pruner v0.0.0
+	github.com/sohomdatta1/yapperbot-services/uncurrenter v0.0.0
+	github.com/sohomdatta1/yapperbot-services/ybtools v0.0.0-20250625115635-267444604fbe
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	cgt.name/pkg/go-mwclient v1.3.0 // indirect
+	github.com/antonholmquist/jason v1.0.1-0.20180605105355-426ade25b261 // indirect
+	github.com/gertd/go-pluralize v0.1.7 // indirect
+	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/karrick/tparse v2.4.2+incompatible // indirect
+	github.com/metal3d/go-slugify v0.0.0-20160607203414-7ac2014b2f23 // indirect
+	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
+	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
+	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df // indirect
+)
+
+replace (
+	github.com/sohomdatta1/yapperbot-services/frs => ../frs
+	github.com/sohomdatta1/yapperbot-services/pruner => ../pruner
+	github.com/sohomdatta1/yapperbot-services/uncurrenter => ../uncurrenter
+	github.com/sohomdatta1/yapperbot-services/ybtools => ../ybtools
+)
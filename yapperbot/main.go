@@ -0,0 +1,195 @@
+package main
+
+//
+// Yapperbot, the single binary every Yapperbot task runs from
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/frs"
+	"github.com/sohomdatta1/yapperbot-services/pruner"
+	"github.com/sohomdatta1/yapperbot-services/uncurrenter"
+	"github.com/sohomdatta1/yapperbot-services/ybtools"
+)
+
+// task is a subcommand that runs one of the bot's tasks.
+type task struct {
+	run         func(opts *ybtools.Options) error
+	description string
+}
+
+var tasks = map[string]task{
+	"frs":         {frs.Run, "send Feedback Request Service invitations for new RfCs and GA nominations"},
+	"pruner":      {pruner.Run, "remove inactive, blocked and renamed users from lists"},
+	"uncurrenter": {uncurrenter.Run, "remove {{current}} from articles that are no longer being edited"},
+}
+
+func main() {
+	// the flags shared by every task are only registered here, so that the daemon and the
+	// other subcommands can have flag sets of their own
+	options := ybtools.DefaultOptions()
+	options.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch command := os.Args[1]; command {
+	case "help", "-h", "-help", "--help":
+		usage()
+	case "version":
+		fmt.Println("yapperbot", ybtools.Version())
+	case "audit":
+		audit(os.Args[2:])
+	case "daemon":
+		runDaemon(os.Args[2:])
+	case "config":
+		if len(os.Args) < 4 || os.Args[2] != "check" {
+			fail("usage: yapperbot config check <task> [flags]")
+		}
+		t := taskNamed(os.Args[3])
+		parseFlags(os.Args[4:])
+		options.ConfigCheck = true
+		exitIfFailed(run(t, &options))
+	default:
+		t := taskNamed(command)
+		parseFlags(os.Args[2:])
+		exitIfFailed(run(t, &options))
+	}
+}
+
+// run runs a task with the given options, returning an error if it couldn't be set up, which
+// ybtools.New has already sent an alert about. -config-check stops the task as soon as the
+// config has been checked, which is only an error if the config had problems.
+func run(t task, options *ybtools.Options) error {
+	err := t.run(options)
+	if err == ybtools.ErrConfigChecked {
+		return nil
+	}
+	return err
+}
+
+// exitIfFailed exits non-zero with the error if there is one.
+func exitIfFailed(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "yapperbot:", err)
+		os.Exit(1)
+	}
+}
+
+// taskNamed returns the task with the given name, exiting if there isn't one.
+func taskNamed(name string) task {
+	t, ok := tasks[name]
+	if !ok {
+		fail(fmt.Sprintf("unknown task or command %q; run yapperbot help to list them", name))
+	}
+	return t
+}
+
+// parseFlags parses the flags after the subcommand, which are shared between every task,
+// before the task starts, so that ybtools.New sees them as already parsed.
+func parseFlags(args []string) {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() > 0 {
+		fail(fmt.Sprintf("unexpected arguments %q; flags go after the task name", flag.Args()))
+	}
+}
+
+// audit lists the edits in an audit log that match the filters given as flags, as a table,
+// or as JSON lines with -json, so that they can be piped into something else.
+func audit(args []string) {
+	auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+	path := auditFlags.String("log", ybtools.DefaultAuditLog, "audit log to read")
+	taskName := auditFlags.String("task", "", "only list edits made by this task")
+	wiki := auditFlags.String("wiki", "", "only list edits made on this wiki")
+	page := auditFlags.String("page", "", "only list edits to this page")
+	runID := auditFlags.String("run", "", "only list edits made in this run")
+	since := auditFlags.Duration("since", 0, "only list edits made within this long, like 24h")
+	asJSON := auditFlags.Bool("json", false, "print the records as JSON lines, as they are in the log")
+	auditFlags.Parse(args)
+	if auditFlags.NArg() > 0 {
+		fail(fmt.Sprintf("unexpected arguments %q", auditFlags.Args()))
+	}
+
+	filter := ybtools.AuditFilter{Task: *taskName, Wiki: *wiki, Title: *page, RunID: *runID}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	records, err := ybtools.ReadAuditLog(*path, filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "yapperbot:", err)
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, record := range records {
+			encoder.Encode(record)
+		}
+		return
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TIME\tRUN\tWIKI\tPAGE\tOLD\tNEW\tBYTES\tREASON\tSUMMARY")
+	for _, r := range records {
+		bytes := "?"
+		if r.Bytes != nil {
+			bytes = fmt.Sprintf("%+d", *r.Bytes)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.RunID, r.Wiki,
+			r.Title, r.OldRevID, r.RevID, bytes, r.Reason, r.Summary)
+	}
+	table.Flush()
+}
+
+func fail(message string) {
+	fmt.Fprintln(os.Stderr, "yapperbot:", message)
+	os.Exit(2)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage:")
+	fmt.Fprintln(out, "  yapperbot <task> [flags]               run a task")
+	fmt.Fprintln(out, "  yapperbot config check <task> [flags]  print a task's effective config and any problems with it")
+	fmt.Fprintln(out, "  yapperbot daemon [flags]               run the tasks in daemon.yml on their schedules; yapperbot daemon -h for its flags")
+	fmt.Fprintln(out, "  yapperbot daemon status [flags]        print when each task the daemon runs last ran, and will next run")
+	fmt.Fprintln(out, "  yapperbot audit [flags]                list edits from the audit log; yapperbot audit -h for its flags")
+	fmt.Fprintln(out, "  yapperbot version                      print the version")
+	fmt.Fprintln(out, "  yapperbot help                         print this help")
+	fmt.Fprintln(out, "\nTasks:")
+
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-12s %s\n", name, tasks[name].description)
+	}
+
+	fmt.Fprintln(out, "\nFlags, shared by every task:")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,177 @@
+package main
+
+//
+// Yapperbot, the single binary every Yapperbot task runs from
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleMacros are the shorthands cron understands for common schedules.
+var scheduleMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// scheduleField is one of the five fields of a cron schedule, with the values it can take.
+type scheduleField struct {
+	name     string
+	min, max int
+}
+
+var scheduleFields = []scheduleField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// schedule is when a task runs, written as a cron schedule, like the ones in jobs.yaml: minute,
+// hour, day of month, month and day of week, in UTC, as Toolforge's cron jobs are. As in cron,
+// if both the day of month and the day of week are restricted, a day matching either will do.
+type schedule struct {
+	spec                                   string
+	minutes, hours, days, months, weekdays map[int]bool
+	// anyDay and anyWeekday are whether the day of month or day of week are *, or a step of it
+	anyDay, anyWeekday bool
+}
+
+// parseSchedule parses a cron schedule, or one of the @ shorthands like @hourly.
+func parseSchedule(spec string) (*schedule, error) {
+	expanded := strings.TrimSpace(spec)
+	if macro, ok := scheduleMacros[strings.ToLower(expanded)]; ok {
+		expanded = macro
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != len(scheduleFields) {
+		return nil, fmt.Errorf("schedule %q has %d fields, not the five of minute, hour, day of month, month and day of week", spec, len(fields))
+	}
+
+	s := &schedule{spec: spec}
+	sets := []*map[int]bool{&s.minutes, &s.hours, &s.days, &s.months, &s.weekdays}
+	for i, field := range fields {
+		values, err := parseScheduleField(field, scheduleFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", spec, err)
+		}
+		*sets[i] = values
+	}
+	// Sunday can be either 0 or 7
+	if s.weekdays[7] {
+		s.weekdays[0] = true
+	}
+	// as in cron, */2 counts as * here
+	s.anyDay = strings.HasPrefix(fields[2], "*")
+	s.anyWeekday = strings.HasPrefix(fields[4], "*")
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", spec)
+	}
+	return s, nil
+}
+
+// parseScheduleField parses a single field of a cron schedule: a comma-separated list of
+// numbers, ranges like 1-5, or *, each optionally with a step, like */15.
+func parseScheduleField(field string, f scheduleField) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return nil, fmt.Errorf("%s step %q isn't a positive number", f.name, stepPart)
+			}
+		}
+
+		low, high := f.min, f.max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(lowPart); err != nil {
+				return nil, fmt.Errorf("%s %q isn't a number", f.name, lowPart)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highPart); err != nil {
+					return nil, fmt.Errorf("%s %q isn't a number", f.name, highPart)
+				}
+			} else if hasStep {
+				// 5/15 means every 15 from 5
+				high = f.max
+			}
+			if low < f.min || high > f.max || low > high {
+				return nil, fmt.Errorf("%s %q isn't within %d-%d", f.name, rangePart, f.min, f.max)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// next returns the first time the schedule matches after t, to the minute.
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// every schedule matches at least once in a few years, as the day of month is at most 31,
+	// which every month but February has; and February 29th comes round every four years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !s.hours[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches returns whether the schedule runs on t's day, by the day of month and day of week.
+func (s *schedule) dayMatches(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+func (s *schedule) String() string {
+	return s.spec
+}
@@ -0,0 +1,408 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+	"gopkg.in/gomail.v2"
+)
+
+// Severity is how serious an alert is. Sinks are only sent alerts at or above their minimum severity.
+type Severity int
+
+// The severities of alerts, from least to most serious. SeverityFatal is used by PanicErr.
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityFatal
+)
+
+var severityNames = []string{"info", "warning", "error", "fatal"}
+
+func (s Severity) String() string {
+	if s < SeverityInfo || s > SeverityFatal {
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// ParseSeverity turns the name of a severity, as used in config files, into a Severity.
+func ParseSeverity(name string) (Severity, error) {
+	for i, severityName := range severityNames {
+		if strings.EqualFold(strings.TrimSpace(name), severityName) {
+			return Severity(i), nil
+		}
+	}
+	return SeverityInfo, errors.New("unknown severity " + name)
+}
+
+// An Alert is a single problem being reported by a task.
+type Alert struct {
+	Severity Severity  `json:"-"`
+	Level    string    `json:"severity"`
+	Task     string    `json:"task"`
+	BotUser  string    `json:"botUser"`
+	Wiki     string    `json:"wiki,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// AlertSink is somewhere alerts can be sent.
+type AlertSink interface {
+	// Name is used to identify the sink in logs when it fails.
+	Name() string
+	Send(a Alert) error
+}
+
+// AlertSinkConfig configures a single alert sink, in the alerts list of the global config.
+// Type is one of smtp, wiki, file or webhook, and decides which of the other fields are used.
+type AlertSinkConfig struct {
+	Type        string
+	MinSeverity string
+	// smtp; From and To default to the tool's mailbox
+	Host string
+	Port int
+	From string
+	To   string
+	// wiki; new sections are added to this page for each alert
+	Page string
+	// file; alerts are appended to this file as JSON lines
+	Path string
+	// webhook; alerts are POSTed to this URL as JSON
+	URL string
+}
+
+// defaultAlertDedupe is how long an identical alert is suppressed for after it's been sent.
+const defaultAlertDedupe time.Duration = 24 * time.Hour
+
+const alertStateFilename string = "alerts-sent.json"
+
+type registeredSink struct {
+	sink        AlertSink
+	minSeverity Severity
+}
+
+// alertSinks are the sinks alerts are sent to: configured are those from the config, which are
+// set up when the first alert is sent, and added those added with AddAlertSink.
+type alertSinks struct {
+	sync.Mutex
+	configured   []registeredSink
+	added        []registeredSink
+	isConfigured bool
+}
+
+// AddAlertSink adds a sink that will be sent every alert of at least minSeverity,
+// on top of those configured in the global config.
+func (b *Bot) AddAlertSink(sink AlertSink, minSeverity Severity) {
+	b.alerts.Lock()
+	defer b.alerts.Unlock()
+	b.alerts.added = append(b.alerts.added, registeredSink{sink, minSeverity})
+}
+
+// SendAlert sends an alert of the given severity to every sink that wants it, unless an
+// identical alert has been sent recently, and carries on. It returns a description of
+// any sinks that failed, which is empty if they all succeeded.
+func (b *Bot) SendAlert(severity Severity, v ...interface{}) string {
+	a := Alert{
+		Severity: severity,
+		Level:    severity.String(),
+		Task:     b.settings.TaskName,
+		BotUser:  b.settings.BotUser,
+		Wiki:     b.currentWiki,
+		Message:  Redact(fmt.Sprint(v...)),
+		Time:     time.Now().UTC(),
+	}
+	log.Println("Alert ("+a.Level+"):", a.Message)
+
+	b.alerts.Lock()
+	defer b.alerts.Unlock()
+	b.configureAlertSinks()
+
+	if b.alertRecentlySent(a) {
+		log.Println("Identical alert sent recently, so not sending it again")
+		return ""
+	}
+
+	var failures []string
+	var sent bool
+	for _, registered := range append(b.alerts.configured[:len(b.alerts.configured):len(b.alerts.configured)], b.alerts.added...) {
+		if severity < registered.minSeverity {
+			continue
+		}
+		if err := registered.sink.Send(a); err != nil {
+			failures = append(failures, "FAILED TO SEND ALERT VIA "+registered.sink.Name()+" (ERR "+err.Error()+")")
+		} else {
+			sent = true
+		}
+	}
+	// if it didn't get anywhere, let the next one try again
+	if sent {
+		b.markAlertSent(a)
+	}
+	return Redact(strings.Join(failures, "; "))
+}
+
+// ReportErr reports a recoverable problem, at error severity, to the alert sinks and the run report,
+// and then returns so that the task can carry on. Use PanicErr for problems the task can't survive.
+func (b *Bot) ReportErr(v ...interface{}) {
+	b.reportError("", fmt.Sprint(v...))
+	if failures := b.SendAlert(SeverityError, v...); failures != "" {
+		log.Println(failures)
+	}
+}
+
+// configureAlertSinks sets up the sinks from the global config the first time it's called in a run.
+// With no sinks configured, errors go to the tool's mailbox, as they always have.
+// Callers must hold the lock on b.alerts.
+func (b *Bot) configureAlertSinks() {
+	if b.alerts.isConfigured {
+		return
+	}
+	b.alerts.isConfigured = true
+	if b.replaying {
+		// alerts about a replay would only confuse whoever gets them; they're still logged
+		return
+	}
+
+	sinkConfigs := b.config.Alerts
+	if len(sinkConfigs) == 0 {
+		sinkConfigs = []AlertSinkConfig{{Type: "smtp", MinSeverity: "error"}}
+	}
+
+	for _, sinkConfig := range sinkConfigs {
+		minSeverity := SeverityError
+		if sinkConfig.MinSeverity != "" {
+			var err error
+			minSeverity, err = ParseSeverity(sinkConfig.MinSeverity)
+			if err != nil {
+				log.Println("Alert sink has", err, "so using error")
+				minSeverity = SeverityError
+			}
+		}
+
+		var sink AlertSink
+		switch strings.ToLower(sinkConfig.Type) {
+		case "smtp":
+			sink = smtpSink{sinkConfig, b.toolMailbox()}
+		case "wiki":
+			sink = wikiSink{b, sinkConfig.Page}
+		case "file":
+			sink = fileSink{sinkConfig.Path}
+		case "webhook":
+			sink = webhookSink{sinkConfig.URL}
+		default:
+			log.Println("Unknown alert sink type", sinkConfig.Type, "so ignoring it")
+			continue
+		}
+		b.alerts.configured = append(b.alerts.configured, registeredSink{sink, minSeverity})
+	}
+}
+
+// alertKey identifies alerts that are the same as one another, for de-duplication.
+func alertKey(a Alert) string {
+	sum := sha1.Sum([]byte(a.Level + "\x00" + a.Task + "\x00" + a.Wiki + "\x00" + a.Message))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAlertState loads the times alerts were last sent, from previous runs as well as this one.
+func loadAlertState() map[string]time.Time {
+	sent := map[string]time.Time{}
+	contents, err := os.ReadFile(alertStateFilename)
+	if err == nil {
+		if err := json.Unmarshal(contents, &sent); err != nil {
+			log.Println("Alert de-duplication file is corrupt, so ignoring it. Error was", err)
+		}
+	}
+	return sent
+}
+
+// alertDedupe returns how long identical alerts are suppressed for, from alertdedupe in the global config.
+func (b *Bot) alertDedupe() time.Duration {
+	if b.config.AlertDedupe == "" {
+		return defaultAlertDedupe
+	}
+	dedupe, err := time.ParseDuration(b.config.AlertDedupe)
+	if err != nil {
+		log.Println("Invalid alertdedupe", b.config.AlertDedupe, "so using the default. Error was", err)
+		return defaultAlertDedupe
+	}
+	return dedupe
+}
+
+func (b *Bot) alertRecentlySent(a Alert) bool {
+	last, ok := loadAlertState()[alertKey(a)]
+	return ok && a.Time.Sub(last) < b.alertDedupe()
+}
+
+// markAlertSent records that the alert has been sent, forgetting any alerts old enough not to matter.
+func (b *Bot) markAlertSent(a Alert) {
+	sent := loadAlertState()
+	dedupe := b.alertDedupe()
+	for key, last := range sent {
+		if a.Time.Sub(last) >= dedupe {
+			delete(sent, key)
+		}
+	}
+	sent[alertKey(a)] = a.Time
+
+	encoded, err := json.MarshalIndent(sent, "", "\t")
+	if err == nil {
+		tmpFilename := alertStateFilename + ".tmp"
+		err = os.WriteFile(tmpFilename, encoded, 0644)
+		if err == nil {
+			err = os.Rename(tmpFilename, alertStateFilename)
+		}
+	}
+	if err != nil {
+		log.Println("Failed to save alert de-duplication file with error", err)
+	}
+}
+
+// toolMailbox is the Toolforge mailbox for the tool the task runs as.
+func (b *Bot) toolMailbox() string {
+	return "tools." + strings.ToLower(b.settings.ToolforgeAccount) + "@tools.wmflabs.org"
+}
+
+// smtpSink emails alerts, by default to the tool's mailbox through the Toolforge mail server.
+type smtpSink struct {
+	AlertSinkConfig
+	mailbox string
+}
+
+func (s smtpSink) Name() string {
+	return "smtp"
+}
+
+func (s smtpSink) Send(a Alert) error {
+	host, port, from, to := s.Host, s.Port, s.From, s.To
+	if host == "" {
+		host = "mail.tools.wmflabs.org"
+	}
+	if port == 0 {
+		port = 25
+	}
+	if from == "" {
+		from = s.mailbox
+	}
+	if to == "" {
+		to = s.mailbox
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", to)
+	if a.Severity == SeverityFatal {
+		m.SetHeader("Subject", a.BotUser+" errored in "+a.Task)
+	} else {
+		m.SetHeader("Subject", a.BotUser+" "+a.Level+" in "+a.Task)
+	}
+	m.SetBody("text/plain", a.Message)
+
+	d := gomail.Dialer{Host: host, Port: port}
+	return d.DialAndSend(m)
+}
+
+// wikiSink adds alerts as new sections on a page on the wiki, with the bot's client.
+type wikiSink struct {
+	bot  *Bot
+	page string
+}
+
+func (s wikiSink) Name() string {
+	return "wiki"
+}
+
+func (s wikiSink) Send(a Alert) error {
+	if s.bot.client == nil {
+		return errors.New("no authenticated client to post to " + s.page + " with")
+	}
+	return s.bot.client.Edit(params.Values{
+		"title":        s.page,
+		"section":      "new",
+		"sectiontitle": a.Task + " " + a.Level + " at " + a.Time.Format(time.RFC3339),
+		"text":         "<pre>" + strings.ReplaceAll(a.Message, "</pre>", "&lt;/pre>") + "</pre> ~~~~",
+		"summary":      a.Task + " " + a.Level + " alert",
+		"bot":          "true",
+	})
+}
+
+// fileSink appends alerts to a local file, one JSON object per line.
+type fileSink struct {
+	path string
+}
+
+func (s fileSink) Name() string {
+	return "file"
+}
+
+func (s fileSink) Send(a Alert) error {
+	encoded, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(encoded, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// webhookSink POSTs alerts as JSON to a URL.
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Name() string {
+	return "webhook"
+}
+
+func (s webhookSink) Send(a Alert) error {
+	encoded, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: httpTimeout}
+	resp, err := client.Post(s.url, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook returned " + resp.Status)
+	}
+	return nil
+}
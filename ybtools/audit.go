@@ -0,0 +1,259 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+)
+
+// DefaultAuditLog is where the audit log is kept unless -audit-log says otherwise.
+const DefaultAuditLog string = "audit.jsonl"
+
+// AuditRecord is a single edit in the audit log. OldRevID is zero if the edit created the page,
+// and Bytes is nil if the sizes of the revisions couldn't be looked up.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"run"`
+	Task     string    `json:"task"`
+	Wiki     string    `json:"wiki,omitempty"`
+	BotUser  string    `json:"botUser"`
+	Title    string    `json:"title"`
+	OldRevID int64     `json:"oldrevid"`
+	RevID    int64     `json:"revid"`
+	Bytes    *int64    `json:"bytes,omitempty"`
+	Summary  string    `json:"summary"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// AuditFilter picks out records from the audit log. Empty fields match everything; Task
+// is matched ignoring case, Title however it's written, as far as can be told with English
+// namespace names, and Since against the time of the edit.
+type AuditFilter struct {
+	Task  string
+	Wiki  string
+	Title string
+	RunID string
+	Since time.Time
+}
+
+// auditLog guards writes to the audit log, so that records from concurrent workers don't mix.
+var auditLog sync.Mutex
+
+// editReasons holds the reasons set with SetEditReason for the next edit to each title.
+type editReasons struct {
+	sync.Mutex
+	byTitle map[string]string
+}
+
+// RunID returns the ID of this run, as it's recorded in the audit log and the run report.
+func (b *Bot) RunID() string {
+	return b.runID
+}
+
+// SetEditReason sets the reason the next edit to title is being made, for the audit log. The
+// summary says what an edit did; the reason should say why, in enough detail to judge whether
+// it was right, like which rule matched. It's used for the next edit the wiki accepts to that
+// title, and then forgotten. SafeEdit sets it from the PageEdit's Reason.
+func (b *Bot) SetEditReason(title, reason string) {
+	b.editReasons.Lock()
+	defer b.editReasons.Unlock()
+	b.editReasons.byTitle[title] = reason
+}
+
+// takeEditReason returns the reason set for an edit to title, and forgets it.
+func (b *Bot) takeEditReason(title string) string {
+	b.editReasons.Lock()
+	defer b.editReasons.Unlock()
+	reason := b.editReasons.byTitle[title]
+	delete(b.editReasons.byTitle, title)
+	return reason
+}
+
+// newRunID makes an ID for a run of the task, from when it started and a few random bytes,
+// so that runs of the same task in the same second are still told apart.
+func (b *Bot) newRunID() string {
+	random := make([]byte, 3)
+	rand.Read(random)
+	return b.settings.TaskName + "-" + time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
+
+// auditEdit appends a record of an edit the wiki has accepted to the audit log. Edits in dry
+// runs and replays weren't really made, so they aren't logged. The difference in size is
+// looked up from the wiki through base; if it can't be, the edit is logged without it.
+// Failing to write the log is logged, but doesn't stop the task.
+func (b *Bot) auditEdit(base http.RoundTripper, edit *http.Request, p url.Values, e ReportedEdit) {
+	reason := b.takeEditReason(p.Get("title"))
+	if b.options.AuditLog == "" || b.dryRun || b.replaying || e.NoChange {
+		return
+	}
+
+	record := AuditRecord{
+		Time:     time.Now().UTC(),
+		RunID:    b.runID,
+		Task:     b.settings.TaskName,
+		Wiki:     b.currentWiki,
+		BotUser:  b.settings.BotUser,
+		Title:    e.Title,
+		OldRevID: e.OldRevID,
+		RevID:    e.RevID,
+		Summary:  e.Summary,
+		Reason:   reason,
+	}
+	if editTime, err := time.Parse(time.RFC3339, e.Timestamp); err == nil {
+		record.Time = editTime
+	}
+	if bytes, err := fetchByteDelta(base, edit, e.OldRevID, e.RevID); err != nil {
+		log.Println("Failed to look up the size of the edit to", e.Title, "for the audit log. Error was", err)
+	} else {
+		record.Bytes = &bytes
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Failed to encode audit record for", e.Title, "so not logging it. Error was", err)
+		return
+	}
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	file, err := os.OpenFile(b.options.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Failed to open audit log", b.options.AuditLog, "so not logging the edit to", e.Title, "Error was", err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(encoded, '\n')); err != nil {
+		log.Println("Failed to write to audit log", b.options.AuditLog, "Error was", err)
+	}
+}
+
+// fetchByteDelta looks up the sizes of the revisions before and after an edit, using the
+// same cookies and user agent as the edit request itself, and returns the difference.
+func fetchByteDelta(base http.RoundTripper, edit *http.Request, oldRevID, revID int64) (int64, error) {
+	revids := strconv.FormatInt(revID, 10)
+	if oldRevID != 0 {
+		revids = strconv.FormatInt(oldRevID, 10) + "|" + revids
+	}
+	query := url.Values{
+		"action":        {"query"},
+		"prop":          {"revisions"},
+		"revids":        {revids},
+		"rvprop":        {"ids|size"},
+		"format":        {"json"},
+		"formatversion": {"2"},
+	}
+
+	fetchURL := *edit.URL
+	fetchURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(edit.Context(), http.MethodGet, fetchURL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", edit.Header.Get("User-Agent"))
+	if cookie := edit.Header.Get("Cookie"); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	for _, auth := range edit.Header.Values("Authorization") {
+		req.Header.Add("Authorization", auth)
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var decoded struct {
+		Query struct {
+			Pages []struct {
+				Revisions []struct {
+					RevID int64 `json:"revid"`
+					Size  int64 `json:"size"`
+				} `json:"revisions"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return 0, err
+	}
+
+	sizes := map[int64]int64{}
+	for _, page := range decoded.Query.Pages {
+		for _, rev := range page.Revisions {
+			sizes[rev.RevID] = rev.Size
+		}
+	}
+	newSize, ok := sizes[revID]
+	if !ok {
+		return 0, fmt.Errorf("revision %d wasn't returned", revID)
+	}
+	oldSize, ok := sizes[oldRevID]
+	if !ok && oldRevID != 0 {
+		return 0, fmt.Errorf("revision %d wasn't returned", oldRevID)
+	}
+	return newSize - oldSize, nil
+}
+
+// ReadAuditLog reads the records in the audit log at path that match filter, oldest first.
+func ReadAuditLog(path string, filter AuditFilter) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func (f AuditFilter) matches(r AuditRecord) bool {
+	return (f.Task == "" || strings.EqualFold(f.Task, r.Task)) &&
+		(f.Wiki == "" || f.Wiki == r.Wiki) &&
+		(f.RunID == "" || f.RunID == r.RunID) &&
+		(f.Title == "" || title.DefaultSite().Normalise(f.Title) == title.DefaultSite().Normalise(r.Title)) &&
+		(f.Since.IsZero() || !r.Time.Before(f.Since))
+}
@@ -0,0 +1,217 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/mrjones/oauth"
+)
+
+// The types of credentials the bot can authenticate with, for type in the auth config.
+const (
+	authBotPassword string = "botpassword"
+	authOAuth1      string = "oauth1"
+	authOAuth2      string = "oauth2"
+)
+
+// AuthConfig is the auth section of the global config, choosing how the bot authenticates.
+// Type is botpassword (the default), which logs in as botusername with the bot password;
+// oauth1, an owner-only OAuth 1.0a consumer, which needs all four tokens and secrets; or
+// oauth2, an owner-only OAuth 2 client, which only needs the access token.
+type AuthConfig struct {
+	Type           string
+	ConsumerToken  string `config:"secret"`
+	ConsumerSecret string `config:"secret"`
+	AccessToken    string `config:"secret"`
+	AccessSecret   string `config:"secret"`
+}
+
+// requiredRights are the rights the bot can't do anything useful without, mapped to the grant
+// an OAuth consumer or bot password needs to be given for them.
+var requiredRights = map[string]string{
+	"edit": "Edit existing pages",
+}
+
+// recommendedRights are the rights the tasks expect to have, but can run without.
+var recommendedRights = map[string]string{
+	"createtalk":    "Create, edit, and move pages",
+	"bot":           "High-volume (bot) access",
+	"apihighlimits": "High-volume (bot) access",
+}
+
+// sessions are the clients Connect has authenticated, by sessionKey, so that later runs in
+// the same process can carry on with the session rather than logging in again.
+var sessions = map[string]*mwclient.Client{}
+var sessionsMutex sync.Mutex
+
+// sessionKey identifies the wiki and credentials a session is for, so a session is only
+// used again by a run that would have logged in to the same wiki as the same user.
+func (b *Bot) sessionKey() string {
+	return strings.Join([]string{b.config.APIEndpoint, b.authType(), b.config.BotUsername, b.config.Auth.ConsumerToken, b.config.Auth.AccessToken}, "\x00")
+}
+
+// authType returns the type of credentials configured, defaulting to a bot password.
+func (b *Bot) authType() string {
+	if b.config.Auth.Type == "" {
+		return authBotPassword
+	}
+	return strings.ToLower(b.config.Auth.Type)
+}
+
+// validateAuthConfig checks that the credentials the configured auth type needs are all set.
+// A replay doesn't talk to the wiki, so doesn't need any.
+func (b *Bot) validateAuthConfig() []string {
+	if b.replaying {
+		return nil
+	}
+	var problems []string
+	missing := func(key, value string) {
+		if value == "" {
+			problems = append(problems, key+" is required for "+b.authType()+" authentication, but isn't set in any config file or the environment")
+		}
+	}
+
+	switch b.authType() {
+	case authBotPassword:
+		missing("botusername", b.config.BotUsername)
+		if b.botPassword == "" {
+			problems = append(problems, "no bot password set, either in "+botPasswordEnv+" or a "+botPasswordFilename+" file")
+		}
+	case authOAuth1:
+		missing("auth.consumertoken", b.config.Auth.ConsumerToken)
+		missing("auth.consumersecret", b.config.Auth.ConsumerSecret)
+		missing("auth.accesstoken", b.config.Auth.AccessToken)
+		missing("auth.accesssecret", b.config.Auth.AccessSecret)
+	case authOAuth2:
+		missing("auth.accesstoken", b.config.Auth.AccessToken)
+	default:
+		problems = append(problems, "auth.type "+b.config.Auth.Type+" isn't one of "+authBotPassword+", "+authOAuth1+" or "+authOAuth2)
+	}
+	return problems
+}
+
+// authTransport returns a transport that signs every request sent through it with the
+// configured OAuth credentials, or base itself for bot passwords, which use a session instead.
+func (b *Bot) authTransport(base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	switch b.authType() {
+	case authOAuth1:
+		consumer := oauth.NewCustomHttpClientConsumer(b.config.Auth.ConsumerToken, b.config.Auth.ConsumerSecret, oauth.ServiceProvider{}, &http.Client{Transport: base})
+		rt, err := consumer.MakeRoundTripper(&oauth.AccessToken{Token: b.config.Auth.AccessToken, Secret: b.config.Auth.AccessSecret})
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up OAuth 1.0a signing: %w", err)
+		}
+		return rt, nil
+	case authOAuth2:
+		return &bearerTransport{base: base, token: b.config.Auth.AccessToken}, nil
+	}
+	return base, nil
+}
+
+// bearerTransport adds an OAuth 2 access token to every request.
+type bearerTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(authorized)
+}
+
+// authenticate logs the client in with the configured credentials, and then checks
+// that the wiki accepts them, and that they grant the rights the bot needs.
+func (b *Bot) authenticate() error {
+	if b.authType() == authBotPassword {
+		if err := b.client.Login(b.config.BotUsername, b.botPassword); err != nil {
+			return fmt.Errorf("failed to authenticate with MediaWiki with username %s: %w", b.config.BotUsername, err)
+		}
+	}
+	return b.checkRights()
+}
+
+// resumeSession checks that the wiki still accepts a session from an earlier run, logging
+// in again if it doesn't, for instance because the session has expired.
+func (b *Bot) resumeSession() error {
+	if err := b.checkRights(); err != nil {
+		log.Println("Couldn't carry on with the session from an earlier run, so authenticating again. Error was", err)
+		return b.authenticate()
+	}
+	return nil
+}
+
+// checkRights fetches the rights the bot has been granted, returning an error if any it can't do
+// without are missing and logging any others it expects. With OAuth, this is the first request made,
+// so it's also where credentials the wiki doesn't accept are found.
+func (b *Bot) checkRights() error {
+	userInfo, err := b.client.Get(params.Values{
+		"action": "query",
+		"meta":   "userinfo",
+		"uiprop": "rights",
+	})
+	if err != nil {
+		if apiErr, ok := err.(mwclient.APIError); ok && strings.HasPrefix(apiErr.Code, "mwoauth") {
+			return fmt.Errorf("the wiki didn't accept the %s credentials - check the consumer hasn't been disabled, and the tokens are right: %w", b.authType(), err)
+		}
+		return fmt.Errorf("failed to check the bot's rights after authenticating: %w", err)
+	}
+
+	if anon, err := userInfo.GetBoolean("query", "userinfo", "anon"); err == nil && anon {
+		return fmt.Errorf("authenticated with %s, but the wiki says the bot isn't logged in", b.authType())
+	}
+	name, _ := userInfo.GetString("query", "userinfo", "name")
+	rightsList, err := userInfo.GetStringArray("query", "userinfo", "rights")
+	if err != nil {
+		return fmt.Errorf("failed to read the bot's rights from the wiki: %w", err)
+	}
+	rights := map[string]bool{}
+	for _, right := range rightsList {
+		rights[right] = true
+	}
+
+	var missing []string
+	for right, grant := range requiredRights {
+		if !rights[right] {
+			missing = append(missing, right+" (grant \""+grant+"\")")
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("authenticated as %s with %s, but without the rights %s - add the grants to the consumer or bot password", name, b.authType(), strings.Join(missing, ", "))
+	}
+	for right, grant := range recommendedRights {
+		if !rights[right] {
+			log.Println("Authenticated without the", right, "right, so some things may not work - it needs the grant", "\""+grant+"\"")
+		}
+	}
+	log.Println("Authenticated as", name, "with", b.authType())
+	return nil
+}
@@ -0,0 +1,218 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+// ErrConfigChecked is returned by New when -config-check was passed, once the configuration
+// has been printed, so that the task stops rather than running. If there were problems with
+// the configuration, the error wraps it, and says how many there were.
+var ErrConfigChecked = errors.New("configuration checked")
+
+// ConfigError is returned by New when the configuration isn't valid, with every problem in it.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprint("configuration has ", len(e.Problems), " problem(s):\n - ", strings.Join(e.Problems, "\n - "))
+}
+
+// Bot is a task's handle on ybtools, made with New, through which it talks to the wiki, checks
+// whether it can edit, and reports on its run.
+//
+// Everything about a run belongs to its Bot: the client, configuration, edit limits, kill switch,
+// alert sinks and run report, so calling New again starts a new run with nothing carried over.
+// Metrics, and what's cached about each wiki, like its siteinfo, are kept for the whole process,
+// as are sessions with the wiki, so a process that runs several tasks, like the daemon, only
+// logs in once; as metrics are started afresh by New, runs in the same process should be made
+// one after another.
+type Bot struct {
+	settings BotSettings
+	options  Options
+	client   *mwclient.Client
+
+	// the configuration for the wiki the bot is on now, and what it was loaded from
+	config            configObject
+	taskEditConfig    toolConfigWithEditLimit
+	botPassword       string
+	botPasswordSource string
+	configLayers      []configLayer
+	mergedConfig      map[interface{}]interface{}
+	configProblems    []string
+
+	// the wikis the bot is running on, and the section of the config for each of them
+	wikiConfigs    map[string]map[interface{}]interface{}
+	wikis          []string
+	currentWiki    string
+	botUserSetting string
+
+	dryRun    bool
+	dryRunDir string
+	replaying bool
+	recorder  *cassetteRecorder
+	replayer  *cassetteReplayer
+	seed      cassetteSeed
+
+	runID       string
+	editReasons editReasons
+	limiter     editLimiter
+	report      runReport
+	alerts      alertSinks
+	kill        killSwitch
+	retryAfter  retryAfter
+	// noMaxlag counts the calls to NoMaxlagDo that are running
+	noMaxlag atomic.Int32
+}
+
+// New sets up a bot for a task, ready for it to connect to the wiki. It sets up the log, opens
+// any cassette being recorded or replayed, and loads the configuration, with the Options in the
+// BotSettings, returning an error listing every problem in it if it isn't valid. If the bot can't
+// be set up, a fatal alert is sent too, unless the configuration was only being checked.
+// Nothing is read from disk until New is called, so importing ybtools has no side effects.
+func New(opts BotSettings) (*Bot, error) {
+	if opts.TaskName == "" || opts.BotUser == "" {
+		return nil, errors.New("a bot needs both a TaskName and a BotUser")
+	}
+	b := &Bot{settings: opts, options: DefaultOptions(), botUserSetting: opts.BotUser}
+	if opts.Options != nil {
+		b.options = *opts.Options
+	}
+	b.editReasons.byTitle = map[string]string{}
+	// metrics are kept for the whole process, so nothing from a run before this one should carry over
+	resetMetrics()
+	b.setupLogging()
+	log.Println("Starting", b.settings.TaskName, "version", Version())
+	b.setupDryRun()
+	err := b.setupCassette()
+	if err == nil {
+		err = b.setupConfig()
+	}
+	if err != nil {
+		if !errors.Is(err, ErrConfigChecked) {
+			if failures := b.SendAlert(SeverityFatal, "Failed to start ", b.settings.TaskName, ": ", err); failures != "" {
+				log.Println(failures)
+			}
+		}
+		return nil, err
+	}
+	b.runID = b.newRunID()
+	b.setupRunReport()
+	b.setKillPage()
+	// Kill pages are checked as soon as the mwclient is first authenticated
+	return b, nil
+}
+
+// TaskName returns the name of the task the bot is running.
+func (b *Bot) TaskName() string {
+	return b.settings.TaskName
+}
+
+// Client returns the client made by Connect or handed to UseClient, or nil before either.
+func (b *Bot) Client() *mwclient.Client {
+	return b.client
+}
+
+// Connect uses the details in the configuration to make a fully-authenticated mwclient,
+// returning an error if it couldn't be made, or the wiki didn't accept the credentials.
+// If an earlier run in the same process connected to the same wiki with the same credentials,
+// its session is used again, as long as the wiki still accepts it.
+// Once the client is authenticated, the kill pages are checked, and if the task has been
+// killed, Connect panics through PanicErr, as with any other edit after the task is killed.
+func (b *Bot) Connect(maxlag mwclient.Maxlag) (*mwclient.Client, error) {
+	userAgent := b.botUserAgent()
+	key := b.sessionKey()
+	sessionsMutex.Lock()
+	client, resumed := sessions[key]
+	sessionsMutex.Unlock()
+	if resumed {
+		client.UserAgent = userAgent + " " + mwclient.DefaultUserAgent
+	} else {
+		var err error
+		client, err = mwclient.New(b.config.APIEndpoint, userAgent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create MediaWiki client: %w", err)
+		}
+	}
+
+	// This is necessary because maxlag.sleep is unexported,
+	// and is only configured correctly for production within
+	// mwclient.New. Annoying, but this is a bit of an edge case /shrug
+	client.Maxlag.On = maxlag.On
+	client.Maxlag.Retries = maxlag.Retries
+	client.Maxlag.Timeout = maxlag.Timeout
+
+	// layer the ybtools transports (e.g. dry-run) over the client's requests,
+	// with OAuth signing, if it's configured, underneath them all
+	transport, err := b.authTransport(nil)
+	if err != nil {
+		return nil, err
+	}
+	client.SetHTTPClient(b.newHTTPClient(transport))
+	b.client = client
+
+	if resumed {
+		err = b.resumeSession()
+	} else {
+		err = b.authenticate()
+	}
+	sessionsMutex.Lock()
+	if err != nil {
+		delete(sessions, key)
+	} else {
+		sessions[key] = client
+	}
+	sessionsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// runs here to make sure we have a client authenticated when we run it
+	b.killTaskIfNeeded()
+
+	return client, nil
+}
+
+// botUserAgent returns the user agent the bot identifies itself to Wikimedia with.
+func (b *Bot) botUserAgent() string {
+	return "Yapperbot-" + b.settings.TaskName + " on User:" + b.settings.BotUser + " - Golang, licensed GNU GPL"
+}
+
+// UseClient hands the bot a client that has already been created and authenticated
+// elsewhere - for instance one pointed at an mwtest server - in place of calling
+// Connect. All further ybtools calls will go through this client.
+// The ybtools transports are layered over the default HTTP transport on the client,
+// so dry-run mode and friends apply to it too.
+func (b *Bot) UseClient(client *mwclient.Client) *mwclient.Client {
+	b.client = client
+	b.client.SetHTTPClient(b.newHTTPClient(nil))
+
+	// same as Connect, check straight away that we're allowed to run
+	b.killTaskIfNeeded()
+
+	return b.client
+}
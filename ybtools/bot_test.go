@@ -0,0 +1,55 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+// testBot returns a bot connected to a fake wiki serving wiki, without reading any config.
+// No audit log is kept and alerts go nowhere. The wiki's clock moves on a second every time
+// it's read, so that every revision has a timestamp of its own.
+func testBot(t *testing.T, wiki *mwtest.Wiki) *Bot {
+	t.Helper()
+	clock := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	wiki.Now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	server := mwtest.NewServer(wiki)
+	t.Cleanup(server.Close)
+	client, err := server.NewClient("Yapperbot", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Bot{settings: BotSettings{TaskName: "Test", BotUser: "Yapperbot"}, options: DefaultOptions()}
+	b.options.AuditLog = ""
+	// caches of what's on each wiki are kept by endpoint, so each test's wiki has its own
+	b.config.APIEndpoint = server.Endpoint()
+	b.editReasons.byTitle = map[string]string{}
+	b.alerts.isConfigured = true
+	b.setKillPage()
+	b.UseClient(client)
+	return b
+}
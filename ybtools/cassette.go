@@ -0,0 +1,447 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal3d/go-slugify"
+)
+
+// cassetteVersion is the version of the cassette format, in the first line of every cassette.
+const cassetteVersion int = 1
+
+// cassetteSecretParams are request parameters whose values are never written to a cassette,
+// and which are left out when matching requests, as they're secret or different every time.
+var cassetteSecretParams = []string{"token", "lgtoken", "lgpassword", "password", "logintoken"}
+
+// cassetteEditParams are parameters of write requests that are left out when matching them,
+// so that a replayed edit with different text is still matched to the recorded one, and the
+// two can be compared.
+var cassetteEditParams = []string{"text", "appendtext", "prependtext", "summary", "sectiontitle"}
+
+// cassetteHeader is the first line of a cassette, saying what was recorded, and the seed
+// RandomSeed started from.
+type cassetteHeader struct {
+	Cassette int       `json:"cassette"`
+	Task     string    `json:"task"`
+	BotUser  string    `json:"botUser"`
+	Recorded time.Time `json:"recorded"`
+	Seed     int64     `json:"seed"`
+}
+
+// cassetteClockReading is a line in a cassette recording a time Now returned.
+type cassetteClockReading struct {
+	Now time.Time `json:"now"`
+}
+
+// cassetteInteraction is a single request and its response, one to a line in a cassette.
+// Err is set instead of the response if the request failed before the wiki answered.
+type cassetteInteraction struct {
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	Params url.Values  `json:"params"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Err    string      `json:"error,omitempty"`
+}
+
+// key identifies the request, so that a replayed request can be matched with a recorded one.
+func (i cassetteInteraction) key() string {
+	matched := url.Values{}
+	for name, values := range i.Params {
+		matched[name] = values
+	}
+	for _, name := range cassetteSecretParams {
+		matched.Del(name)
+	}
+	if isWriteRequest(i.Method, i.Params) {
+		for _, name := range cassetteEditParams {
+			matched.Del(name)
+		}
+	}
+	return i.Method + " " + i.Host + " " + matched.Encode()
+}
+
+// cassetteSeed is the seed RandomSeed next returns when recording or replaying.
+type cassetteSeed struct {
+	sync.Mutex
+	next int64
+}
+
+// Now returns the current time. Tasks should use it rather than time.Now for anything that
+// ends up in a request, like the start of a query, so that a replay sends the same requests
+// as the run it's replaying: when recording, every time it returns is written to the cassette,
+// and when replaying, they're returned again in the same order.
+func (b *Bot) Now() time.Time {
+	if b.replaying {
+		return b.replayer.now()
+	}
+	now := time.Now()
+	if b.recorder != nil {
+		if err := b.recorder.write(cassetteClockReading{now}); err != nil {
+			log.Println("Failed to record the time to the cassette with error", err)
+		}
+	}
+	return now
+}
+
+// RandomSeed returns a seed for a random number generator. Tasks should use it to seed
+// anything random, so that a replay makes the same choices as the run it's replaying.
+func (b *Bot) RandomSeed() int64 {
+	if b.recorder == nil && !b.replaying {
+		return time.Now().UnixNano()
+	}
+	b.seed.Lock()
+	defer b.seed.Unlock()
+	b.seed.next++
+	return b.seed.next
+}
+
+// Replaying returns whether ybtools is replaying a recorded run from a cassette, in which case
+// nothing is sent to the wiki at all, and edits are captured on disk.
+func (b *Bot) Replaying() bool {
+	return b.replaying
+}
+
+// setupCassette reads the record and replay flags, opening the cassette for whichever is set.
+func (b *Bot) setupCassette() error {
+	b.recorder, b.replayer, b.replaying = nil, nil, false
+	if b.options.Record != "" && b.options.Replay != "" {
+		return errors.New("can't both -record and -replay at once")
+	}
+
+	if b.options.Record != "" {
+		file, err := os.Create(b.options.Record)
+		if err != nil {
+			return fmt.Errorf("failed to create cassette %s: %w", b.options.Record, err)
+		}
+		b.recorder = &cassetteRecorder{file: file, out: bufio.NewWriter(file)}
+		b.seed.next = time.Now().UnixNano()
+		err = b.recorder.write(cassetteHeader{cassetteVersion, b.settings.TaskName, b.settings.BotUser, time.Now().UTC(), b.seed.next})
+		if err != nil {
+			return fmt.Errorf("failed to write to cassette %s: %w", b.options.Record, err)
+		}
+		log.Println("Recording every API request and response into", b.options.Record)
+	}
+
+	if b.options.Replay != "" {
+		var err error
+		b.replayer, err = b.loadCassette(b.options.Replay)
+		if err != nil {
+			return fmt.Errorf("failed to load cassette %s: %w", b.options.Replay, err)
+		}
+		b.replaying = true
+		b.replayer.dir = filepath.Join(b.options.ReplayDir, strings.ToLower(slugify.Marshal(b.settings.TaskName))+"-"+time.Now().Format("20060102-150405"))
+		log.Println("Replaying the run recorded in", b.options.Replay, "and writing the edits it makes to", b.replayer.dir)
+	}
+	return nil
+}
+
+// cassetteRecorder writes interactions to a cassette as they happen, so that the cassette is
+// complete up to the point the run stopped, however it stopped.
+type cassetteRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	out  *bufio.Writer
+}
+
+// write adds a line to the cassette, flushing it straight to disk.
+func (r *cassetteRecorder) write(line interface{}) error {
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(encoded)
+	r.out.WriteByte('\n')
+	return r.out.Flush()
+}
+
+// recordTransport records every request sent through it, and the response, into the cassette.
+// It sits underneath all of the other ybtools transports, so that what's recorded is what
+// really went to and from the wiki, but above OAuth signing, which isn't recorded.
+type recordTransport struct {
+	base     http.RoundTripper
+	recorder *cassetteRecorder
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := apiRequestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	interaction := cassetteInteraction{Method: req.Method, Host: req.URL.Host, Params: redactedParams(p)}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		interaction.Err = err.Error()
+	} else {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			return nil, readErr
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		interaction.Status = resp.StatusCode
+		interaction.Header = resp.Header.Clone()
+		// the session cookies would let anybody with the cassette act as the bot
+		interaction.Header.Del("Set-Cookie")
+		interaction.Body = string(body)
+	}
+
+	if writeErr := t.recorder.write(interaction); writeErr != nil {
+		log.Println("Failed to record", req.Method, "request to the cassette with error", writeErr)
+	}
+	return resp, err
+}
+
+// redactedParams returns a copy of p with the values of any secret parameters taken out,
+// leaving the parameters themselves, so that write requests can still be told apart by their token.
+func redactedParams(p url.Values) url.Values {
+	redacted := url.Values{}
+	for name, values := range p {
+		redacted[name] = values
+	}
+	for _, name := range cassetteSecretParams {
+		if redacted.Has(name) {
+			redacted.Set(name, "redacted")
+		}
+	}
+	return redacted
+}
+
+// cassetteReplayer answers requests from a recorded cassette.
+type cassetteReplayer struct {
+	mu sync.Mutex
+	// recorded holds the interactions for each request key, in the order they were recorded
+	recorded map[string][]cassetteInteraction
+	// served counts how many of each key's interactions have been replayed
+	served map[string]int
+	// clock holds the times Now returned, in order, and ticked how many have been returned again
+	clock  []time.Time
+	ticked int
+	// dir is where edits captured during the replay are written, and captured how many
+	dir      string
+	captured int
+}
+
+// now returns the next time Now returned while recording. Once they've all been returned,
+// the clock carries on from the last of them.
+func (r *cassetteReplayer) now() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.clock) == 0 {
+		return time.Now()
+	}
+	if r.ticked >= len(r.clock) {
+		return r.clock[len(r.clock)-1]
+	}
+	r.ticked++
+	return r.clock[r.ticked-1]
+}
+
+// loadCassette reads a cassette for replaying.
+func (b *Bot) loadCassette(path string) (*cassetteReplayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 256<<20)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+		return nil, errors.New("cassette is empty")
+	}
+	var header cassetteHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, fmt.Errorf("cassette header is invalid: %w", err)
+	}
+	if header.Cassette != cassetteVersion {
+		return nil, fmt.Errorf("cassette is format version %d, but only version %d can be replayed", header.Cassette, cassetteVersion)
+	}
+	if header.Task != b.settings.TaskName {
+		log.Println("Cassette was recorded by", header.Task, "not", b.settings.TaskName, "so it probably won't replay")
+	}
+	log.Println("Cassette was recorded by", header.Task, "at", header.Recorded)
+	b.seed.next = header.Seed
+
+	replayer := &cassetteReplayer{recorded: map[string][]cassetteInteraction{}, served: map[string]int{}}
+	for line := 2; scanner.Scan(); line++ {
+		var decoded struct {
+			cassetteInteraction
+			Now *time.Time `json:"now"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &decoded); err != nil {
+			return nil, fmt.Errorf("line %d of cassette is invalid: %w", line, err)
+		}
+		if decoded.Now != nil {
+			replayer.clock = append(replayer.clock, *decoded.Now)
+			continue
+		}
+		interaction := decoded.cassetteInteraction
+		key := interaction.key()
+		replayer.recorded[key] = append(replayer.recorded[key], interaction)
+	}
+	return replayer, scanner.Err()
+}
+
+// replayTransport answers every request from the cassette being replayed, without sending
+// anything anywhere. Requests are matched to recorded ones by their parameters, and each is
+// answered with the recorded responses in order, with the last repeated once they run out.
+// Write requests are captured on disk, compared with what was recorded.
+type replayTransport struct {
+	replayer *cassetteReplayer
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := apiRequestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	request := cassetteInteraction{Method: req.Method, Host: req.URL.Host, Params: p}
+	key := request.key()
+
+	t.replayer.mu.Lock()
+	defer t.replayer.mu.Unlock()
+
+	var recorded *cassetteInteraction
+	if interactions := t.replayer.recorded[key]; len(interactions) > 0 {
+		n := t.replayer.served[key]
+		if n >= len(interactions) {
+			n = len(interactions) - 1
+		}
+		recorded = &interactions[n]
+		t.replayer.served[key]++
+	}
+
+	write := isWriteRequest(req.Method, p)
+	if write {
+		if err := t.replayer.capture(p, recorded); err != nil {
+			return nil, fmt.Errorf("failed to capture replayed %s: %w", p.Get("action"), err)
+		}
+	}
+
+	if recorded == nil {
+		if write && p.Get("action") == "edit" {
+			// the recorded run didn't make this edit, so answer as if it had worked
+			return apiResponse(req, map[string]interface{}{"edit": map[string]interface{}{
+				"result":       "Success",
+				"title":        p.Get("title"),
+				"newrevid":     0,
+				"newtimestamp": time.Now().UTC().Format(time.RFC3339),
+			}})
+		}
+		return nil, fmt.Errorf("request isn't in the cassette, so can't be replayed: %s %s", req.Method, redactedParams(p).Encode())
+	}
+	if recorded.Err != "" {
+		return nil, errors.New(recorded.Err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprint(recorded.Status, " ", http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header.Clone(),
+		Body:          io.NopCloser(strings.NewReader(recorded.Body)),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// capture writes a replayed write request out to the replay directory, with a diff against
+// the text of the recorded request it was matched with, if there is one, so that it's easy
+// to see where the replay went differently. Callers must hold the replayer's lock.
+func (r *cassetteReplayer) capture(p url.Values, recorded *cassetteInteraction) error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	r.captured++
+
+	target := p.Get("title")
+	if target == "" {
+		target = "page ID " + p.Get("pageid")
+	}
+
+	var b strings.Builder
+	b.WriteString("Action: " + p.Get("action") + "\n")
+	b.WriteString("Title: " + target + "\n")
+	b.WriteString("Summary: " + p.Get("summary") + "\n")
+	if recorded == nil {
+		b.WriteString("Recorded: no, the recorded run didn't make this request\n\n")
+		b.WriteString(UnifiedDiff("", editedText(p), "a/"+target+" (not recorded)", "b/"+target+" (replay)"))
+	} else if recordedText := editedText(recorded.Params); recordedText == editedText(p) && recorded.Params.Get("summary") == p.Get("summary") {
+		b.WriteString("Recorded: yes, and the replay is the same\n")
+	} else {
+		b.WriteString("Recorded: yes, but the replay is different\n")
+		b.WriteString("Recorded summary: " + recorded.Params.Get("summary") + "\n\n")
+		b.WriteString(UnifiedDiff(recordedText, editedText(p), "a/"+target+" (recorded)", "b/"+target+" (replay)"))
+	}
+
+	path := filepath.Join(r.dir, fmt.Sprintf("%04d-%s.diff", r.captured, strings.ToLower(slugify.Marshal(target))))
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	log.Println("Replay: captured", p.Get("action"), "of", target, "in", path)
+	return nil
+}
+
+// editedText is the text a write request is sending, whichever parameter it's in.
+func editedText(p url.Values) string {
+	var text string
+	if sectionTitle := p.Get("sectiontitle"); sectionTitle != "" {
+		text = "== " + sectionTitle + " ==\n\n"
+	}
+	return text + p.Get("prependtext") + p.Get("text") + p.Get("appendtext")
+}
+
+// isWriteRequest returns whether a request changes something on the wiki: a POST
+// with an edit token, other than logging in or out.
+func isWriteRequest(method string, p url.Values) bool {
+	if method != http.MethodPost {
+		return false
+	}
+	switch p.Get("action") {
+	case "login", "clientlogin", "logout", "query":
+		return false
+	}
+	return p.Has("token")
+}
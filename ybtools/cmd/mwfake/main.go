@@ -0,0 +1,95 @@
+// Command mwfake serves a fake MediaWiki Action API from a fixture file, so that
+// the Yapperbot tasks can be run end to end locally. Point apiendpoint in
+// config-global.yml at the address it prints, and run the task as normal.
+package main
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:8089", "address to serve the fake API on")
+	fixture := flag.String("fixture", "", "JSON file of pages to seed the wiki with")
+	dump := flag.String("dump", "", "file to write the final state of the wiki to on exit")
+	username := flag.String("username", "", "only accept logins with this username")
+	password := flag.String("password", "", "only accept logins with this password")
+	lag := flag.Int("lag", 0, "replication lag, in seconds, to report to maxlag requests")
+	readonly := flag.Bool("readonly", false, "refuse all edits as if the wiki were read-only")
+	oauthToken := flag.String("oauth-token", "", "accept this OAuth access token, as -username or Example")
+	rights := flag.String("rights", "", "comma-separated user rights to grant, instead of the usual bot rights")
+	streamBatch := flag.Int("stream-batch", 0, "drop recentchange stream connections after this many events, to test reconnecting")
+	flag.Parse()
+
+	wiki := mwtest.NewWiki()
+	wiki.Username = *username
+	wiki.Password = *password
+	wiki.Lag = *lag
+	wiki.ReadOnly = *readonly
+	wiki.StreamBatch = *streamBatch
+	if *oauthToken != "" {
+		user := strings.SplitN(*username, "@", 2)[0]
+		if user == "" {
+			user = "Example"
+		}
+		wiki.OAuthTokens[*oauthToken] = user
+	}
+	if *rights != "" {
+		wiki.Rights = strings.Split(*rights, ",")
+	}
+	wiki.OnEdit = func(e mwtest.EditRecord) {
+		log.Printf("Edit by %s to %q (r%d -> r%d): %s\n", e.User, e.Title, e.OldRevID, e.NewRevID, e.Summary)
+	}
+
+	if *fixture != "" {
+		if err := wiki.LoadFixtureFile(*fixture); err != nil {
+			log.Fatalln("Failed to load fixture", *fixture, "with error", err)
+		}
+	}
+
+	if *dump != "" {
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt)
+		go func() {
+			<-interrupted
+			dumped, err := json.MarshalIndent(wiki.Dump(), "", "  ")
+			if err == nil {
+				err = os.WriteFile(*dump, dumped, 0644)
+			}
+			if err != nil {
+				log.Fatalln("Failed to dump wiki state with error", err)
+			}
+			log.Println("Wrote wiki state to", *dump)
+			os.Exit(0)
+		}()
+	}
+
+	log.Printf("Serving fake wiki on http://%s%s\n", *listen, mwtest.APIPath)
+	log.Printf("Serving its recentchange stream on http://%s%s\n", *listen, mwtest.StreamPath)
+	log.Fatalln(http.ListenAndServe(*listen, mwtest.Handler(wiki)))
+}
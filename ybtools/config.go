@@ -1,9 +1,17 @@
 package ybtools
 
 import (
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/metal3d/go-slugify"
 	"gopkg.in/yaml.v2"
@@ -28,73 +36,635 @@ import (
 //
 
 type configObject struct {
-	APIEndpoint string
-	BotUsername string
+	APIEndpoint      string `config:"required"`
+	BotUsername      string
+	BotUser          string
+	Auth             AuthConfig
+	Alerts           []AlertSinkConfig
+	AlertDedupe      string
+	KillSwitchTTL    string
+	Retry            RetryConfig
+	RecentChangesURL string
 }
 
 // acts like an interface for config files
-// edit limits from tool configs are unloaded into here
+// edit limits, report pages and worker counts from tool configs are unloaded into here
 type toolConfigWithEditLimit struct {
-	EditLimit int64
+	EditLimit  int64
+	EditLimits EditLimitsConfig
+	ReportPage string
+	Workers    int
+}
+
+// ConfigValidator can be implemented by a task's config object to check it for problems
+// beyond required keys being missing. Every problem it returns is reported along with
+// any others in the configuration.
+type ConfigValidator interface {
+	ValidateConfig() []string
 }
 
 const localConfigFilename string = "config.yml"
 const globalConfigFilename string = "config-global.yml"
 const botPasswordFilename string = "botpassword"
 
-var botPassword string
-var config configObject
-var taskConfigFile []byte
+// configEnvPrefix starts the names of environment variables that override config keys,
+// for instance YAPPERBOT_APIENDPOINT. Nested keys are separated with a double underscore,
+// as in YAPPERBOT_EDITLIMITS__DAY.
+const configEnvPrefix string = "YAPPERBOT_"
+const configEnvNestingSeparator string = "__"
+
+// configDirEnv names a directory to look for config files in before any of the usual places.
+const configDirEnv string = configEnvPrefix + "CONFIG_DIR"
+const botPasswordEnv string = configEnvPrefix + "BOTPASSWORD"
 
-// ParseTaskConfig takes in a pointer to a config object
-// and populates the config object with the task configuration
-func ParseTaskConfig(cobj interface{}) {
-	yaml.Unmarshal(taskConfigFile, cobj)
+const redactedConfigValue string = "[redacted]"
+
+// configDefaults is the lowest layer of the configuration, underneath the config files.
+var configDefaults = map[interface{}]interface{}{
+	"alertdedupe":      defaultAlertDedupe.String(),
+	"killswitchttl":    defaultKillSwitchTTL.String(),
+	"recentchangesurl": DefaultRecentChangesURL,
+	"retry": map[interface{}]interface{}{
+		"maxattempts":     defaultRetryMaxAttempts,
+		"basedelay":       defaultRetryBaseDelay.String(),
+		"maxdelay":        defaultRetryMaxDelay.String(),
+		"readonlytimeout": defaultRetryReadOnlyTimeout.String(),
+	},
 }
 
-func init() {
-	botConfigFile, err := os.ReadFile(findConfigFile(localConfigFilename, globalConfigFilename))
-	if err != nil {
-		PanicErr("Bot config file could not be read at detected path!")
+// yamlLineRegex matches the line numbers yaml puts at the start of its errors,
+// which are meaningless for layers that didn't come from a file.
+var yamlLineRegex = regexp.MustCompile(`^line \d+: `)
+
+// configLayer is one source of configuration, in the order they're applied.
+type configLayer struct {
+	source string
+	raw    []byte
+	// fromFile is set where the line numbers in raw mean something to the user
+	fromFile bool
+	values   map[interface{}]interface{}
+}
+
+// configTargetDefaults holds what each task config object was before any config was decoded
+// into it, by the pointer to it, so that it can be put back before decoding the config for another
+// wiki, or another run of the task in the same process. Task config objects outlive the bots
+// that decode into them, so this is kept for the whole process; the bot's own config objects
+// start out empty, so they're just emptied.
+var configTargetDefaults = struct {
+	sync.Mutex
+	values map[interface{}]reflect.Value
+}{values: map[interface{}]reflect.Value{}}
+
+// setupConfig loads the configuration, layering the defaults, the global config file, the task
+// config file, and environment variables in that order, and decodes it into the ybtools config
+// and the task's BotSettings.Config, for the first wiki the task is running on if there are several. Every problem found is returned at once,
+// in a ConfigError, unless -config-check was passed, in which case the configuration is printed and ErrConfigChecked is returned.
+func (b *Bot) setupConfig() error {
+	b.loadConfig()
+
+	if b.options.ConfigCheck {
+		b.printConfigCheck()
+		if len(b.configProblems) > 0 {
+			return fmt.Errorf("%w, and found %d problem(s)", ErrConfigChecked, len(b.configProblems))
+		}
+		return ErrConfigChecked
 	}
-	err = yaml.UnmarshalStrict(botConfigFile, &config)
-	if err != nil {
-		PanicErr("Bot config file was invalid!")
+
+	if len(b.configProblems) > 0 {
+		return &ConfigError{Problems: b.configProblems}
+	}
+
+	firstWiki := ""
+	if len(b.wikis) > 0 {
+		firstWiki = b.wikis[0]
+	}
+	b.switchWikiConfig(firstWiki)
+	return nil
+}
+
+// loadConfig reads every layer of the configuration, merges them, and decodes the result,
+// collecting any problems into b.configProblems.
+func (b *Bot) loadConfig() {
+	b.configProblems = nil
+	b.configLayers = []configLayer{{source: "defaults", values: configDefaults}}
+	searchPath := b.configSearchPath()
+
+	if globalFile := findConfigFile(searchPath, localConfigFilename, globalConfigFilename); globalFile != "" {
+		b.addConfigFileLayer(globalFile)
+	} else {
+		b.configProblems = append(b.configProblems, fmt.Sprint("couldn't find ", localConfigFilename, " or ", globalConfigFilename, " in any of ", strings.Join(searchPath, ", ")))
+	}
+
+	taskFilename := "config-" + strings.ToLower(slugify.Marshal(b.settings.TaskName)) + ".yml"
+	if taskFile := findConfigFile(searchPath, taskFilename); taskFile != "" {
+		b.addConfigFileLayer(taskFile)
+	} else {
+		log.Println("No task-specific config file found, ignoring")
+	}
+
+	b.addConfigEnvLayers()
+
+	b.mergedConfig = map[interface{}]interface{}{}
+	for _, layer := range b.configLayers {
+		mergeConfigValues(b.mergedConfig, layer.values)
+	}
+
+	targets := b.configTargets()
+	b.checkUnknownConfigKeys(targets)
+	b.checkSecretsNotInFiles(secretConfigKeys(targets))
+	for _, target := range targets {
+		b.checkConfigTypes(target)
+	}
+
+	b.selectWikis()
+	for _, wiki := range sortedKeys(b.wikiConfigs) {
+		b.checkWikiConfigSection(wiki, targets)
+	}
+	if len(b.wikis) == 0 {
+		if b.options.Wiki == "" {
+			b.decodeConfig(searchPath, "")
+		}
+		// otherwise, none of the wikis asked for exist, which has already been reported
+		return
+	}
+
+	// check every wiki's config, reporting problems they all have just the once
+	problemsBefore := b.configProblems
+	wikiProblems := map[string][]string{}
+	timesFound := map[string]int{}
+	for _, wiki := range b.wikis {
+		b.configProblems = nil
+		b.decodeConfig(searchPath, wiki)
+		wikiProblems[wiki] = b.configProblems
+		for _, problem := range b.configProblems {
+			timesFound[problem]++
+		}
+	}
+	b.configProblems = problemsBefore
+	for _, wiki := range b.wikis {
+		for _, problem := range wikiProblems[wiki] {
+			switch {
+			case timesFound[problem] < len(b.wikis):
+				b.configProblems = append(b.configProblems, "on "+wiki+", "+problem)
+			case wiki == b.wikis[0]:
+				b.configProblems = append(b.configProblems, problem)
+			}
+		}
+	}
+}
+
+// configTargets returns the config objects the configuration is decoded into: the ybtools
+// config, the edit limits and so on from the task config, and the task's own config object.
+func (b *Bot) configTargets() []interface{} {
+	targets := []interface{}{&b.config, &b.taskEditConfig}
+	if b.settings.Config != nil {
+		targets = append(targets, b.settings.Config)
 	}
+	return targets
+}
+
+// decodeConfig decodes the merged configuration into the config objects, with the section
+// for wiki from wikis on top if it isn't empty, and checks it, collecting any problems into
+// b.configProblems. Each config object starts again from what it was before any config was
+// decoded into it, so that nothing is left over from another wiki.
+func (b *Bot) decodeConfig(searchPath []string, wiki string) {
+	effective := map[interface{}]interface{}{}
+	mergeConfigValues(effective, b.mergedConfig)
+	delete(effective, wikisConfigKey)
+	if wiki != "" {
+		mergeConfigValues(effective, b.wikiConfigs[wiki])
+	}
+
+	b.loadBotPassword(searchPath, wiki)
+	b.loadSecretFiles(effective, secretConfigKeys(b.configTargets()), searchPath, wiki)
 
-	botPasswordFile, err := os.ReadFile(findConfigFile(botPasswordFilename, botPasswordFilename))
+	merged, err := yaml.Marshal(effective)
 	if err != nil {
-		PanicErr("Bot password file could not be read at detected path!")
+		b.configProblems = append(b.configProblems, "failed to combine the configuration: "+err.Error())
+		return
+	}
+	for _, target := range b.configTargets() {
+		initial := reflect.Zero(reflect.TypeOf(target).Elem())
+		if target == b.settings.Config {
+			initial = configTargetDefault(target)
+		}
+		reflect.ValueOf(target).Elem().Set(initial)
+		// type errors have already been reported against the layer they came from
+		yaml.Unmarshal(merged, target)
+		b.checkRequiredConfig(reflect.ValueOf(target).Elem())
+	}
+
+	b.validateConfig()
+	if validator, ok := b.settings.Config.(ConfigValidator); ok {
+		b.configProblems = append(b.configProblems, validator.ValidateConfig()...)
+	}
+}
+
+// configTargetDefault returns what a task config object was before any config was decoded into it,
+// remembering it the first time it's asked about.
+func configTargetDefault(target interface{}) reflect.Value {
+	configTargetDefaults.Lock()
+	defer configTargetDefaults.Unlock()
+	initial, ok := configTargetDefaults.values[target]
+	if !ok {
+		initial = reflect.New(reflect.TypeOf(target).Elem()).Elem()
+		initial.Set(reflect.ValueOf(target).Elem())
+		configTargetDefaults.values[target] = initial
+	}
+	return initial
+}
+
+// configSearchPath returns the directories config files are looked for in, in order: the directory
+// given with -config-dir, the one in YAPPERBOT_CONFIG_DIR if it's set, the current directory and the one above it, and then the
+// directory the executable is in and the one above that.
+func (b *Bot) configSearchPath() []string {
+	var dirs []string
+	if b.options.ConfigDir != "" {
+		dirs = append(dirs, b.options.ConfigDir)
+	}
+	if dir := os.Getenv(configDirEnv); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, ".", "..")
+	if executable, err := os.Executable(); err == nil {
+		executableDir := filepath.Dir(executable)
+		dirs = append(dirs, executableDir, filepath.Dir(executableDir))
+	}
+
+	var searchPath []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil || seen[absDir] {
+			continue
+		}
+		seen[absDir] = true
+		searchPath = append(searchPath, dir)
 	}
-	botPassword = strings.TrimSpace(string(botPasswordFile))
+	return searchPath
 }
 
-func setupTaskConfigFile() {
-	var err error
-	var taskConfigForEditLimit toolConfigWithEditLimit
+// findConfigFile looks through each directory in the search path in turn for any of the filenames,
+// preferring them in the order given, and returns the path of the first one it finds, or an empty
+// string if there aren't any.
+func findConfigFile(searchPath []string, filenames ...string) string {
+	for _, dir := range searchPath {
+		for _, filename := range filenames {
+			path := filepath.Join(dir, filename)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+	}
+	return ""
+}
 
-	taskConfigFile, err = os.ReadFile("config-" + strings.ToLower(slugify.Marshal(settings.TaskName)) + ".yml")
+// addConfigFileLayer reads a config file as a layer of the configuration.
+func (b *Bot) addConfigFileLayer(path string) {
+	raw, err := os.ReadFile(path)
 	if err != nil {
-		log.Println("No task-specific config file found, ignoring")
+		b.configProblems = append(b.configProblems, path+" couldn't be read: "+err.Error())
+		return
 	}
+	values := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		b.configProblems = append(b.configProblems, path+" is not valid YAML: "+err.Error())
+		return
+	}
+	b.configLayers = append(b.configLayers, configLayer{source: path, raw: raw, fromFile: true, values: values})
+}
 
-	// Immediately parse the file for an edit limit and only an edit limit
-	yaml.Unmarshal(taskConfigFile, &taskConfigForEditLimit)
-	if taskConfigForEditLimit.EditLimit > 0 {
-		setupEditLimit(taskConfigForEditLimit.EditLimit)
+// addConfigEnvLayers adds a layer for each YAPPERBOT_ environment variable, in name order.
+// Values are read as YAML, so that numbers and lists work as they would in a file.
+func (b *Bot) addConfigEnvLayers() {
+	var names []string
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, configEnvPrefix) && name != configDirEnv && name != botPasswordEnv && !strings.HasPrefix(name, botPasswordEnv+"_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(os.Getenv(name)), &value); err != nil {
+			value = os.Getenv(name)
+		}
+
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, configEnvPrefix)), configEnvNestingSeparator)
+		for i := len(path) - 1; i >= 0; i-- {
+			value = map[interface{}]interface{}{path[i]: value}
+		}
+		values := value.(map[interface{}]interface{})
+
+		raw, err := yaml.Marshal(values)
+		if err != nil {
+			b.configProblems = append(b.configProblems, "environment variable "+name+" couldn't be read: "+err.Error())
+			continue
+		}
+		b.configLayers = append(b.configLayers, configLayer{source: "environment variable " + name, raw: raw, values: values})
 	}
 }
 
-// findConfigFile takes a local filename as a string, and a global filename as a string
-// It then finds the local filename in the current directory, or if there isn't one,
-// the global filename in the parent directory, and returns the name of the file it found.
-// If it doesn't find either, it fatally errors.
-func findConfigFile(filename string, globalfilename string) string {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		if _, err := os.Stat("../" + globalfilename); os.IsNotExist(err) {
-			PanicErr("Couldn't find a config file for ", filename, " either in this directory or in the one above it!")
+// mergeConfigValues merges the values from a higher layer into dst. Maps are merged key by key,
+// and anything else replaces what was there. Keys left empty don't replace anything, so that
+// a blank key in a task config doesn't hide the value from the global one.
+func mergeConfigValues(dst, src map[interface{}]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			continue
 		}
-		return "../" + globalfilename
+		srcMap, srcIsMap := value.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[key].(map[interface{}]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfigValues(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			// copy it, so merging into it later doesn't change the layer it came from
+			copied := map[interface{}]interface{}{}
+			mergeConfigValues(copied, srcMap)
+			value = copied
+		}
+		dst[key] = value
+	}
+}
+
+// loadBotPassword reads the bot password from the environment, or failing that the botpassword file.
+// Each wiki can have its own, in YAPPERBOT_BOTPASSWORD_<WIKI> or a botpassword-<wiki> file, which
+// is used ahead of the shared one. Whether it's needed depends on the auth type, so it being
+// missing is checked by validateAuthConfig.
+func (b *Bot) loadBotPassword(searchPath []string, wiki string) {
+	b.botPassword = ""
+	b.botPasswordSource = ""
+	if wiki != "" {
+		wikiEnv := botPasswordEnv + "_" + strings.ToUpper(wiki)
+		if password, ok := os.LookupEnv(wikiEnv); ok {
+			b.botPassword = strings.TrimSpace(password)
+			b.botPasswordSource = "environment variable " + wikiEnv
+			RegisterSecret(b.botPassword)
+			return
+		}
+		if path := findConfigFile(searchPath, botPasswordFilename+"-"+wiki); path != "" {
+			b.readBotPasswordFile(path)
+			return
+		}
+	}
+
+	if password, ok := os.LookupEnv(botPasswordEnv); ok {
+		b.botPassword = strings.TrimSpace(password)
+		b.botPasswordSource = "environment variable " + botPasswordEnv
+		RegisterSecret(b.botPassword)
+	} else if path := findConfigFile(searchPath, botPasswordFilename); path != "" {
+		b.readBotPasswordFile(path)
+	}
+}
+
+// readBotPasswordFile reads the bot password from a file, which only its owner can be able to read.
+func (b *Bot) readBotPasswordFile(path string) {
+	if password, ok := b.readSecretFile(path); ok {
+		b.botPassword = password
+		b.botPasswordSource = path
+	}
+}
+
+// configKeys returns the top-level config keys that the fields of a config struct are read from.
+func configKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline := configKeyName(field)
+		if inline && field.Type.Kind() == reflect.Struct {
+			keys = append(keys, configKeys(field.Type)...)
+		} else if name != "-" {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// configKeyName returns the key yaml reads a struct field from, and whether the field is inlined.
+func configKeyName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	inline := false
+	for _, option := range tag[1:] {
+		if option == "inline" {
+			inline = true
+		}
+	}
+	if tag[0] != "" {
+		return tag[0], inline
+	}
+	return strings.ToLower(field.Name), inline
+}
+
+// knownConfigKeys returns the top-level keys used by any of the config objects.
+func knownConfigKeys(targets []interface{}) map[string]bool {
+	known := map[string]bool{wikisConfigKey: true}
+	for _, target := range targets {
+		for _, key := range configKeys(reflect.TypeOf(target).Elem()) {
+			known[key] = true
+		}
+	}
+	return known
+}
+
+// checkUnknownConfigKeys reports any top-level keys that none of the config objects use,
+// which are most likely to be typos. Those in config files are problems with the config, but
+// those from environment variables are only logged as warnings.
+func (b *Bot) checkUnknownConfigKeys(targets []interface{}) {
+	known := knownConfigKeys(targets)
+	for _, layer := range b.configLayers {
+		var unknown []string
+		for key := range layer.values {
+			if !known[fmt.Sprint(key)] {
+				unknown = append(unknown, fmt.Sprint(key))
+			}
+		}
+		sort.Strings(unknown)
+		for _, key := range unknown {
+			if !layer.fromFile {
+				// the environment is shared with everything else in the job, so a stray variable
+				// there shouldn't stop every task from running
+				log.Println("WARNING:", layer.source, "sets", key+", which isn't a config key for", b.settings.TaskName+", so ignoring it")
+				continue
+			}
+			b.configProblems = append(b.configProblems, layer.source+" sets "+key+", which isn't a config key for "+b.settings.TaskName)
+		}
+	}
+}
+
+// checkConfigTypes decodes each layer on its own into a copy of the target,
+// so that values of the wrong type are reported against where they came from.
+func (b *Bot) checkConfigTypes(target interface{}) {
+	for _, layer := range b.configLayers {
+		if layer.raw == nil {
+			continue
+		}
+		err := yaml.Unmarshal(layer.raw, reflect.New(reflect.TypeOf(target).Elem()).Interface())
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			continue
+		}
+		for _, message := range typeErr.Errors {
+			if !layer.fromFile {
+				message = yamlLineRegex.ReplaceAllString(message, "")
+			}
+			b.configProblems = append(b.configProblems, layer.source+": "+message)
+		}
+	}
+}
+
+// checkRequiredConfig reports every field tagged `config:"required"`, or `config:"required,secret"`,
+// that's been left empty.
+func (b *Bot) checkRequiredConfig(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, inline := configKeyName(field)
+		if inline && field.Type.Kind() == reflect.Struct {
+			b.checkRequiredConfig(v.Field(i))
+			continue
+		}
+		if hasConfigOption(field, "required") && v.Field(i).IsZero() {
+			if hasConfigOption(field, secretConfigOption) {
+				b.configProblems = append(b.configProblems, name+" is required, but isn't set in a "+name+" file or the environment")
+			} else {
+				b.configProblems = append(b.configProblems, name+" is required, but isn't set in any config file or the environment")
+			}
+		}
+	}
+}
+
+// validateConfig checks the values in the ybtools config that have to be in a particular form.
+func (b *Bot) validateConfig() {
+	if b.config.APIEndpoint != "" {
+		if endpoint, err := url.Parse(b.config.APIEndpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			b.configProblems = append(b.configProblems, "apiendpoint "+b.config.APIEndpoint+" isn't an http or https URL")
+		}
+	}
+	if b.config.RecentChangesURL != "" {
+		if stream, err := url.Parse(b.config.RecentChangesURL); err != nil || (stream.Scheme != "http" && stream.Scheme != "https") || stream.Host == "" {
+			b.configProblems = append(b.configProblems, "recentchangesurl "+b.config.RecentChangesURL+" isn't an http or https URL")
+		}
+	}
+
+	b.configProblems = append(b.configProblems, b.validateAuthConfig()...)
+
+	for _, duration := range [][2]string{
+		{"alertdedupe", b.config.AlertDedupe},
+		{"killswitchttl", b.config.KillSwitchTTL},
+		{"retry.basedelay", b.config.Retry.BaseDelay},
+		{"retry.maxdelay", b.config.Retry.MaxDelay},
+		{"retry.readonlytimeout", b.config.Retry.ReadOnlyTimeout},
+	} {
+		if _, err := time.ParseDuration(duration[1]); duration[1] != "" && err != nil {
+			b.configProblems = append(b.configProblems, duration[0]+" "+duration[1]+" isn't a duration, like 1m or 24h")
+		}
+	}
+
+	for i, sinkConfig := range b.config.Alerts {
+		prefix := fmt.Sprint("alerts[", i, "] ")
+		if sinkConfig.MinSeverity != "" {
+			if _, err := ParseSeverity(sinkConfig.MinSeverity); err != nil {
+				b.configProblems = append(b.configProblems, prefix+"has "+err.Error())
+			}
+		}
+		switch strings.ToLower(sinkConfig.Type) {
+		case "smtp":
+		case "wiki":
+			if sinkConfig.Page == "" {
+				b.configProblems = append(b.configProblems, prefix+"is a wiki sink, but has no page")
+			}
+		case "file":
+			if sinkConfig.Path == "" {
+				b.configProblems = append(b.configProblems, prefix+"is a file sink, but has no path")
+			}
+		case "webhook":
+			if sinkConfig.URL == "" {
+				b.configProblems = append(b.configProblems, prefix+"is a webhook sink, but has no url")
+			}
+		default:
+			b.configProblems = append(b.configProblems, prefix+"has unknown type "+sinkConfig.Type+", which should be one of smtp, wiki, file or webhook")
+		}
+	}
+
+	if b.config.Retry.MaxAttempts < 0 {
+		b.configProblems = append(b.configProblems, fmt.Sprint("retry.maxattempts is ", b.config.Retry.MaxAttempts, ", but can't be less than one"))
+	}
+
+	if b.taskEditConfig.Workers < 0 {
+		b.configProblems = append(b.configProblems, fmt.Sprint("workers is ", b.taskEditConfig.Workers, ", but can't be less than one"))
+	}
+
+	for name := range b.taskEditConfig.EditLimits.Namespaces {
+		if _, ok := b.namespaceFromName(name); !ok {
+			b.configProblems = append(b.configProblems, "editlimits has limits for unrecognised namespace "+name)
+		}
+	}
+}
+
+// isSecretConfigKey decides whether the value of a config key should be hidden when printed.
+func isSecretConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	return key == "dsn" || strings.Contains(key, "password") || strings.Contains(key, "secret") || strings.Contains(key, "token")
+}
+
+// redactConfigValues returns a copy of the config values with any secrets replaced.
+func redactConfigValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	redacted := map[interface{}]interface{}{}
+	for key, value := range values {
+		switch {
+		case isSecretConfigKey(fmt.Sprint(key)):
+			redacted[key] = redactedConfigValue
+		case reflect.TypeOf(value) == reflect.TypeOf(values):
+			redacted[key] = redactConfigValues(value.(map[interface{}]interface{}))
+		case reflect.TypeOf(value) == reflect.TypeOf([]interface{}{}):
+			var list []interface{}
+			for _, item := range value.([]interface{}) {
+				if itemMap, ok := item.(map[interface{}]interface{}); ok {
+					item = redactConfigValues(itemMap)
+				}
+				list = append(list, item)
+			}
+			redacted[key] = list
+		default:
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+// printConfigCheck prints the effective configuration, with secrets redacted,
+// followed by any problems with it, for -config-check.
+func (b *Bot) printConfigCheck() {
+	fmt.Println("# Effective configuration for", b.settings.TaskName+", from lowest to highest precedence:")
+	for _, layer := range b.configLayers {
+		fmt.Println("#  ", layer.source)
+	}
+	if len(b.wikis) > 0 {
+		fmt.Println("# running on", strings.Join(b.wikis, ", "), "with the settings for each from wikis on top")
+	} else if b.botPasswordSource != "" {
+		fmt.Println("# with the bot password from", b.botPasswordSource)
+	}
+
+	printed := redactConfigValues(b.mergedConfig)
+	if b.botPassword != "" {
+		printed[botPasswordFilename] = redactedConfigValue
+	}
+	encoded, err := yaml.Marshal(printed)
+	if err != nil {
+		fmt.Println("# Failed to print the configuration:", err)
+	} else {
+		fmt.Print(string(encoded))
+	}
+
+	if len(b.configProblems) == 0 {
+		fmt.Println("# No problems found")
+		return
+	}
+	fmt.Println("#", len(b.configProblems), "problem(s) found:")
+	for _, problem := range b.configProblems {
+		fmt.Println("#  -", problem)
 	}
-	return filename
 }
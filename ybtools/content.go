@@ -19,29 +19,11 @@ package ybtools
 //
 
 import (
-	"log"
-
 	"github.com/antonholmquist/jason"
 )
 
-// GetContentFromPage turns a *jason.Object for a Page into the main slot content,
-// and/or an applicable error.
-//
-// Yes, there is a function to do this already in the library (GetPagesByName).
-// No, I don't want to use it. Why? We've already got the page content here -
-// making another request to get it again is wasteful when we could just locally
-// parse what we already have.
-func GetContentFromPage(page *jason.Object) (content string, err error) {
-	rev, err := page.GetObjectArray("revisions")
-	if err != nil {
-		log.Println("Failed to get revisions from page, erroring GetContentFromPage. Error was ", err)
-		return "", err
-	}
-	return GetMainSlotFromRevision(rev[0])
-}
-
 // GetPagesFromQuery takes a query and returns an array of Pages.
-// Convenience wrapper for GetThingFromQuery.
+// Convenience wrapper for GetThingFromQuery. PagesFromQuery decodes them into Page objects instead.
 func GetPagesFromQuery(resp *jason.Object) []*jason.Object {
 	pages, err := GetThingFromQuery(resp, "pages")
 	if err != nil {
@@ -69,33 +51,3 @@ func GetThingFromQuery(resp *jason.Object, thing string) ([]*jason.Object, error
 	}
 	return pages, nil
 }
-
-// GetMainSlotFromRevision fetches the main slot content, given a revision object
-// formatted per the MediaWiki Action API JSON.
-func GetMainSlotFromRevision(revision *jason.Object) (string, error) {
-	content, err := revision.GetString("slots", "main", "content")
-	if err != nil {
-		log.Println("Failed to get main slot content from page, erroring GetMainSlotFromRevision. Error was", err)
-		return "", err
-	}
-	return content, nil
-}
-
-// GetCategorisationTimestampFromPage takes a page,
-// and gets the timestamp at which the page was categorised.
-// All the errors in this function are Fatal, because frankly,
-// if something's gone wrong with the timestamp reading, we're not really
-// going to be able to run the algorithm correctly anyway.
-func GetCategorisationTimestampFromPage(page *jason.Object, category string) (timestamp string) {
-	itemCategories, err := page.GetObjectArray("categories")
-	if err != nil {
-		PanicErr("Failed to get categories with error message ", err)
-	}
-	relevantCategory := itemCategories[0]
-
-	timestamp, err = relevantCategory.GetString("timestamp")
-	if err != nil {
-		PanicErr("Failed to get categorisation timestamp with error message ", err)
-	}
-	return
-}
@@ -0,0 +1,359 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each hunk in a unified diff.
+const diffContextLines int = 3
+
+// diffOpKind is the kind of a single line operation in a diff.
+type diffOpKind int8
+
+const (
+	diffEqual diffOpKind = iota
+	diffDelete
+	diffInsert
+)
+
+// diffOp is a single line of a diff, with the line numbers it has in the old and new texts.
+// aLine is meaningless for inserts, and bLine for deletes.
+type diffOp struct {
+	kind  diffOpKind
+	line  string
+	aLine int
+	bLine int
+}
+
+// splitLines splits text into lines, keeping the newline on the end of each line
+// so that a missing newline at the end of a page shows up in the diff.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines produces the line operations turning a into b, using Myers' algorithm.
+// Common prefixes and suffixes are trimmed first, as the bot's edits are usually small.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{diffEqual, a[i], i, i})
+	}
+	ops = append(ops, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for i := 0; i < suffix; i++ {
+		ai, bi := len(a)-suffix+i, len(b)-suffix+i
+		ops = append(ops, diffOp{diffEqual, a[ai], ai, bi})
+	}
+	return ops
+}
+
+// myers runs the greedy Myers diff over a and b, offsetting line numbers by aOff and bOff.
+func myers(a, b []string, aOff, bOff int) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+	var d int
+SEARCH:
+	for d = 0; d <= max; d++ {
+		snapshot := make([]int, len(v))
+		copy(snapshot, v)
+		trace = append(trace, snapshot)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				break SEARCH
+			}
+		}
+	}
+
+	// walk back through the trace to recover the edit path
+	var reversed []diffOp
+	x, y := n, m
+	for ; d > 0; d-- {
+		vPrev := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && vPrev[max+k-1] < vPrev[max+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := vPrev[max+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffOp{diffEqual, a[x], aOff + x, bOff + y})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffOp{diffInsert, b[y], aOff + x, bOff + y})
+		} else {
+			x--
+			reversed = append(reversed, diffOp{diffDelete, a[x], aOff + x, bOff + y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, diffOp{diffEqual, a[x], aOff + x, bOff + y})
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// UnifiedDiff returns a unified diff turning oldText into newText, labelled with
+// oldName and newName. It returns empty string if the texts are the same.
+func UnifiedDiff(oldText, newText, oldName, newName string) string {
+	if oldText == newText {
+		return ""
+	}
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	var b strings.Builder
+	b.WriteString("--- " + oldName + "\n")
+	b.WriteString("+++ " + newName + "\n")
+
+	for start := 0; start < len(ops); {
+		// find the next change
+		for start < len(ops) && ops[start].kind == diffEqual {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// extend the hunk until there's a run of unchanged lines long enough to split on
+		hunkStart := start - diffContextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		end := start
+		for end < len(ops) {
+			if ops[end].kind != diffEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == diffEqual {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContextLines {
+				break
+			}
+			end = run
+		}
+		hunkEnd := end + diffContextLines
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		writeHunk(&b, ops[hunkStart:hunkEnd])
+		start = hunkEnd
+	}
+	return b.String()
+}
+
+// writeHunk writes a single hunk of a unified diff to b.
+func writeHunk(b *strings.Builder, hunk []diffOp) {
+	aStart, bStart := -1, -1
+	var aCount, bCount int
+	for _, op := range hunk {
+		if op.kind != diffInsert {
+			if aStart < 0 {
+				aStart = op.aLine
+			}
+			aCount++
+		}
+		if op.kind != diffDelete {
+			if bStart < 0 {
+				bStart = op.bLine
+			}
+			bCount++
+		}
+	}
+	// unified diffs number from one, and give the line before for empty ranges
+	if aStart < 0 {
+		aStart = hunk[0].aLine - 1
+	}
+	if bStart < 0 {
+		bStart = hunk[0].bLine - 1
+	}
+	fmt.Fprintf(b, "@@ -%d,%d +%d,%d @@\n", aStart+1, aCount, bStart+1, bCount)
+
+	for _, op := range hunk {
+		switch op.kind {
+		case diffEqual:
+			b.WriteString(" ")
+		case diffDelete:
+			b.WriteString("-")
+		case diffInsert:
+			b.WriteString("+")
+		}
+		b.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// diffChange is a run of lines changed between two texts: the lines from start up to end
+// in the old text are replaced by lines. Pure insertions have start equal to end.
+type diffChange struct {
+	start, end int
+	lines      []string
+}
+
+// diffChanges groups the line operations of a diff from base into the changes it makes to base.
+func diffChanges(base, changed []string) []diffChange {
+	var changes []diffChange
+	var current *diffChange
+	pos := 0
+	for _, op := range diffLines(base, changed) {
+		switch op.kind {
+		case diffEqual:
+			if current != nil {
+				changes = append(changes, *current)
+				current = nil
+			}
+			pos++
+		case diffDelete:
+			if current == nil {
+				current = &diffChange{start: pos, end: pos}
+			}
+			pos++
+			current.end = pos
+		case diffInsert:
+			if current == nil {
+				current = &diffChange{start: pos, end: pos}
+			}
+			current.lines = append(current.lines, op.line)
+		}
+	}
+	if current != nil {
+		changes = append(changes, *current)
+	}
+	return changes
+}
+
+// sameChange returns whether two changes make exactly the same edit.
+func sameChange(a, b diffChange) bool {
+	if a.start != b.start || a.end != b.end || len(a.lines) != len(b.lines) {
+		return false
+	}
+	for i := range a.lines {
+		if a.lines[i] != b.lines[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLines does a line-based three-way merge, applying the changes made from base in
+// both ours and theirs. Changes to the same or neighbouring lines conflict unless they're
+// identical; on conflict it returns false and the text is meaningless.
+func mergeLines(base, ours, theirs string) (string, bool) {
+	baseLines := splitLines(base)
+	ourChanges := diffChanges(baseLines, splitLines(ours))
+	theirChanges := diffChanges(baseLines, splitLines(theirs))
+
+	var b strings.Builder
+	pos, i, j := 0, 0, 0
+	for i < len(ourChanges) || j < len(theirChanges) {
+		// take whichever change starts first, and check it against the next one on the other side
+		var next diffChange
+		var other *diffChange
+		if j == len(theirChanges) || (i < len(ourChanges) && ourChanges[i].start <= theirChanges[j].start) {
+			next = ourChanges[i]
+			i++
+			if j < len(theirChanges) {
+				other = &theirChanges[j]
+			}
+		} else {
+			next = theirChanges[j]
+			j++
+			if i < len(ourChanges) {
+				other = &ourChanges[i]
+			}
+		}
+
+		if other != nil && other.start <= next.end {
+			if !sameChange(next, *other) {
+				return "", false
+			}
+			// both sides made the same change, so it only needs applying once
+			if i < len(ourChanges) && other == &ourChanges[i] {
+				i++
+			} else {
+				j++
+			}
+		}
+
+		for _, line := range baseLines[pos:next.start] {
+			b.WriteString(line)
+		}
+		for _, line := range next.lines {
+			b.WriteString(line)
+		}
+		pos = next.end
+	}
+	for _, line := range baseLines[pos:] {
+		b.WriteString(line)
+	}
+	return b.String(), true
+}
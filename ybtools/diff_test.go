@@ -0,0 +1,136 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"strings"
+	"testing"
+)
+
+// letterLines returns n lines, of "a" onwards, each ending in a newline.
+func letterLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = string(rune('a'+i%26)) + "\n"
+	}
+	return lines
+}
+
+func TestMergeLines(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name   string
+		ours   string
+		theirs string
+		want   string
+		// conflict is whether the merge should fail
+		conflict bool
+	}{
+		{"nothing changed", base, base, base, false},
+		{"only ours changed", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", false},
+		{"only theirs changed", base, "a\nb\nc\nD\ne\n", "a\nb\nc\nD\ne\n", false},
+		{"different lines", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", false},
+		{"same change on both sides", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", false},
+		{"same change and a different one", "a\nB\nc\nd\nE\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\nE\n", false},
+		{"ours adds, theirs removes elsewhere", "a\nb\nnew\nc\nd\ne\n", "a\nb\nc\ne\n", "a\nb\nnew\nc\ne\n", false},
+		{"both append to different ends", "top\na\nb\nc\nd\ne\n", "a\nb\nc\nd\ne\nbottom\n", "top\na\nb\nc\nd\ne\nbottom\n", false},
+		{"theirs adds a trailing newline", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\ne\n\n", "A\nb\nc\nd\ne\n\n", false},
+		{"same line changed differently", "a\nB\nc\nd\ne\n", "a\nX\nc\nd\ne\n", "", true},
+		{"neighbouring lines changed", "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "", true},
+		{"different lines inserted in the same place", "a\nx\nb\nc\nd\ne\n", "a\ny\nb\nc\nd\ne\n", "", true},
+		{"ours changes a line theirs removes", "a\nB\nc\nd\ne\n", "a\nc\nd\ne\n", "", true},
+		{"both rewrite everything", "1\n2\n", "3\n4\n", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := mergeLines(base, test.ours, test.theirs)
+			if ok == test.conflict {
+				t.Fatalf("merged = %v, want %v", ok, !test.conflict)
+			}
+			if ok && got != test.want {
+				t.Errorf("merged to %q, want %q", got, test.want)
+			}
+
+			// which side is which shouldn't matter
+			swapped, swappedOK := mergeLines(base, test.theirs, test.ours)
+			if swappedOK != ok || swapped != got {
+				t.Errorf("merging the other way round gave %q, %v, want %q, %v", swapped, swappedOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	twenty := strings.Join(letterLines(20), "")
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{"same", "a\nb\n", "a\nb\n", ""},
+		{
+			"one line changed",
+			"a\nb\nc\n", "a\nB\nc\n",
+			"--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			"created",
+			"", "a\nb\n",
+			"--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"blanked",
+			"a\n", "",
+			"--- old\n+++ new\n@@ -1,1 +0,0 @@\n-a\n",
+		},
+		{
+			"newline added at the end",
+			"a\nb", "a\nb\n",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			"context is limited",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"nearby changes share a hunk",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "1\nB\n3\n4\n5\nF\n7\n8\n9\n10\n",
+			"--- old\n+++ new\n@@ -1,9 +1,9 @@\n 1\n-2\n+B\n 3\n 4\n 5\n-6\n+F\n 7\n 8\n 9\n",
+		},
+		{
+			"distant changes get hunks of their own",
+			twenty, "A\n" + strings.TrimPrefix(strings.TrimSuffix(twenty, "t\n"), "a\n") + "T\n",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-a\n+A\n b\n c\n d\n@@ -17,4 +17,4 @@\n q\n r\n s\n-t\n+T\n",
+		},
+		{
+			"line inserted",
+			"a\nb\n", "a\nx\nb\n",
+			"--- old\n+++ new\n@@ -1,2 +1,3 @@\n a\n+x\n b\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := UnifiedDiff(test.old, test.new, "old", "new"); got != test.want {
+				t.Errorf("UnifiedDiff gave\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal3d/go-slugify"
+)
+
+// DryRun returns whether ybtools is running in dry-run mode, in which all edits
+// are recorded as diffs on disk instead of being saved to the wiki.
+func (b *Bot) DryRun() bool {
+	return b.dryRun
+}
+
+// setupDryRun reads the dry-run flags. Each run writes into its own subdirectory,
+// so that diffs from different runs don't get mixed up.
+func (b *Bot) setupDryRun() {
+	b.dryRun = b.options.DryRun
+	if b.dryRun {
+		b.dryRunDir = filepath.Join(b.options.DryRunDir, strings.ToLower(slugify.Marshal(b.settings.TaskName))+"-"+time.Now().Format("20060102-150405"))
+		log.Println("Running in dry-run mode, edits will be written to", b.dryRunDir, "instead of being saved")
+	}
+}
+
+// dryRunPage is the state of a page as far as the dry run knows it.
+type dryRunPage struct {
+	Title        string
+	PageID       int64
+	RevID        int64
+	Content      string
+	ContentModel string
+	Exists       bool
+}
+
+// dryRunTransport intercepts edits on their way to the API, writing them out as diffs
+// and answering as the API would have done had the edit succeeded. Reads pass straight through.
+type dryRunTransport struct {
+	base http.RoundTripper
+	// dir is the directory the diffs are written into
+	dir string
+
+	mu    sync.Mutex
+	count int
+	// pending holds the content of pages that have been edited during the dry run,
+	// so that a second edit to the same page is diffed against the first.
+	pending map[string]dryRunPage
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost {
+		return t.base.RoundTrip(req)
+	}
+
+	p, err := apiRequestParams(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Get("action") {
+	case "edit":
+		return t.interceptEdit(req, p)
+	case "query", "login", "logout", "":
+		return t.base.RoundTrip(req)
+	}
+
+	if p.Get("token") != "" {
+		// some other write action that we don't know how to simulate; refuse it rather than let it through
+		return apiResponse(req, map[string]interface{}{"error": map[string]string{
+			"code": "dryrun",
+			"info": "Refusing to perform action=" + p.Get("action") + " in dry-run mode.",
+		}})
+	}
+	return t.base.RoundTrip(req)
+}
+
+// interceptEdit records an edit as a diff, and returns a response as if it had been made.
+func (t *dryRunTransport) interceptEdit(req *http.Request, p url.Values) (*http.Response, error) {
+	page, err := t.fetchCurrent(req, p)
+	if err != nil {
+		return nil, fmt.Errorf("dry run failed to fetch current content of page: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if pending, ok := t.pending[page.Title]; ok {
+		page = pending
+	}
+
+	text := p.Get("text")
+	summary := p.Get("summary")
+	var newContent string
+	switch {
+	case p.Get("section") == "new":
+		heading := p.Get("sectiontitle")
+		if summary == "" {
+			summary = "/* " + heading + " */ new section"
+		}
+		section := text
+		if heading != "" {
+			section = "== " + heading + " ==\n\n" + text
+		}
+		if page.Content == "" {
+			newContent = section
+		} else {
+			newContent = strings.TrimRight(page.Content, "\n") + "\n\n" + section
+		}
+	case p.Has("text"):
+		newContent = text
+	default:
+		newContent = p.Get("prependtext") + page.Content + p.Get("appendtext")
+	}
+
+	contentModel := page.ContentModel
+	if model := p.Get("contentmodel"); model != "" {
+		contentModel = model
+	}
+
+	if page.Exists && newContent == page.Content {
+		log.Println("Dry run: edit to", page.Title, "would not have changed the page")
+		return apiResponse(req, map[string]interface{}{"edit": map[string]interface{}{
+			"result":       "Success",
+			"pageid":       page.PageID,
+			"title":        page.Title,
+			"contentmodel": contentModel,
+			"nochange":     true,
+		}})
+	}
+
+	t.count++
+	path, err := writeDryRunDiff(t.dir, t.count, page, newContent, summary)
+	if err != nil {
+		return nil, fmt.Errorf("dry run failed to write diff: %w", err)
+	}
+	log.Println("Dry run: recorded edit to", page.Title, "in", path)
+
+	oldRevID := page.RevID
+	page.Content = newContent
+	page.ContentModel = contentModel
+	page.Exists = true
+	t.pending[page.Title] = page
+
+	result := map[string]interface{}{
+		"result":       "Success",
+		"pageid":       page.PageID,
+		"title":        page.Title,
+		"contentmodel": contentModel,
+		"oldrevid":     oldRevID,
+		"newrevid":     0,
+		"newtimestamp": time.Now().UTC().Format(time.RFC3339),
+	}
+	if oldRevID == 0 {
+		result["new"] = true
+	}
+	return apiResponse(req, map[string]interface{}{"edit": result})
+}
+
+// fetchCurrent fetches the current state of the page an edit is aimed at, using the
+// same cookies and user agent as the edit request itself.
+func (t *dryRunTransport) fetchCurrent(edit *http.Request, p url.Values) (dryRunPage, error) {
+	query := url.Values{
+		"action":        {"query"},
+		"prop":          {"revisions|info"},
+		"rvprop":        {"ids|content"},
+		"rvslots":       {"main"},
+		"format":        {"json"},
+		"formatversion": {"2"},
+	}
+	if pageID := p.Get("pageid"); pageID != "" {
+		query.Set("pageids", pageID)
+	} else {
+		query.Set("titles", p.Get("title"))
+	}
+	if p.Get("redirect") != "" {
+		query.Set("redirects", "1")
+	}
+
+	fetchURL := *edit.URL
+	fetchURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(edit.Context(), http.MethodGet, fetchURL.String(), nil)
+	if err != nil {
+		return dryRunPage{}, err
+	}
+	req.Header.Set("User-Agent", edit.Header.Get("User-Agent"))
+	if cookie := edit.Header.Get("Cookie"); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+	for _, auth := range edit.Header.Values("Authorization") {
+		req.Header.Add("Authorization", auth)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return dryRunPage{}, err
+	}
+	defer resp.Body.Close()
+
+	var decoded struct {
+		Query struct {
+			Pages []struct {
+				PageID       int64  `json:"pageid"`
+				Title        string `json:"title"`
+				Missing      bool   `json:"missing"`
+				ContentModel string `json:"contentmodel"`
+				Revisions    []struct {
+					RevID int64 `json:"revid"`
+					Slots struct {
+						Main struct {
+							Content string `json:"content"`
+						} `json:"main"`
+					} `json:"slots"`
+				} `json:"revisions"`
+			} `json:"pages"`
+		} `json:"query"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return dryRunPage{}, err
+	}
+	if len(decoded.Query.Pages) < 1 {
+		return dryRunPage{}, fmt.Errorf("no page returned for %v", query)
+	}
+
+	found := decoded.Query.Pages[0]
+	page := dryRunPage{Title: found.Title, PageID: found.PageID, ContentModel: found.ContentModel}
+	if page.Title == "" {
+		page.Title = p.Get("title")
+	}
+	if !found.Missing && len(found.Revisions) > 0 {
+		page.Exists = true
+		page.RevID = found.Revisions[0].RevID
+		page.Content = found.Revisions[0].Slots.Main.Content
+	}
+	return page, nil
+}
+
+// writeDryRunDiff writes a single intercepted edit out to the dry run directory,
+// returning the path it was written to. Files are numbered so they sort in edit order.
+func writeDryRunDiff(dir string, n int, page dryRunPage, newContent, summary string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	base := "new page"
+	if page.Exists {
+		base = "r" + strconv.FormatInt(page.RevID, 10)
+	}
+
+	var b strings.Builder
+	b.WriteString("Title: " + page.Title + "\n")
+	b.WriteString("Summary: " + summary + "\n")
+	b.WriteString("Base revision: " + base + "\n\n")
+	b.WriteString(UnifiedDiff(page.Content, newContent, "a/"+page.Title+" ("+base+")", "b/"+page.Title+" (dry run)"))
+
+	path := filepath.Join(dir, fmt.Sprintf("%04d-%s.diff", n, strings.ToLower(slugify.Marshal(page.Title))))
+	return path, os.WriteFile(path, []byte(b.String()), 0644)
+}
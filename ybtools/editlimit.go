@@ -1,11 +1,5 @@
 package ybtools
 
-import (
-	"encoding/binary"
-	"log"
-	"os"
-)
-
 //
 // Yapperbot Tools, the internal system bits for Yapperbot and co.
 // Copyright (C) 2020 Naypta
@@ -24,57 +18,409 @@ import (
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
-var currentUsedEditLimit int64
-var editLimit int64
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal3d/go-slugify"
+)
+
+// editLimitFilename is the file edit limit usage is kept in. When the task is running on
+// several wikis, each has its own, with the name of the wiki before the extension.
+const editLimitFilename string = "editlimit.json"
+
+// legacyEditLimitFilename is the varint file edit limits used to be stored in.
+// If it's there when the edit limit is set up, its count is carried over into the total.
+const legacyEditLimitFilename string = "editlimit"
+
+// allNamespacesScope is the scope under which edits to every namespace are counted.
+const allNamespacesScope string = "all"
+
+// The windows edits are counted in. Windows are fixed, in UTC; days start at midnight
+// and weeks on Monday. editWindowTotal never rolls over, and is what EditLimit in
+// the task config has always limited.
+const (
+	editWindowHour  string = "hour"
+	editWindowDay   string = "day"
+	editWindowWeek  string = "week"
+	editWindowTotal string = "total"
+)
+
+var editWindows = []string{editWindowHour, editWindowDay, editWindowWeek, editWindowTotal}
+
+// EditWindowLimits are the most edits that can be made in each window. Zero means no limit.
+type EditWindowLimits struct {
+	Hour  int64
+	Day   int64
+	Week  int64
+	Total int64
+}
+
+// EditLimitsConfig is the editlimits section of a task config. As well as limits across
+// the whole task, limits can be set per namespace, keyed by namespace name or number.
+type EditLimitsConfig struct {
+	EditWindowLimits `yaml:",inline"`
+	Namespaces       map[string]EditWindowLimits
+}
+
+// EditBudget is the usage and remaining budget of a single edit limit.
+// Scope is "all" for limits across all namespaces, or the namespace number.
+type EditBudget struct {
+	Scope     string     `json:"scope"`
+	Window    string     `json:"window"`
+	Limit     int64      `json:"limit"`
+	Used      int64      `json:"used"`
+	Remaining int64      `json:"remaining"`
+	Resets    *time.Time `json:"resets,omitempty"`
+}
+
+// editWindowUsage is the number of edits made in the window that started at Start.
+type editWindowUsage struct {
+	Start time.Time `json:"start"`
+	Used  int64     `json:"used"`
+}
+
+// editLimitState is what's persisted in the edit limit file, mapping each scope
+// to the usage of each window in that scope.
+type editLimitState struct {
+	Scopes map[string]map[string]editWindowUsage `json:"scopes"`
+}
+
+// editLimiter is the edit limits set for the wiki the task is running on, and the usage of them,
+// which is kept in the file at path.
+type editLimiter struct {
+	sync.Mutex
+	set     bool
+	limits  map[string]EditWindowLimits
+	usage   editLimitState
+	thisRun int64
+	path    string
+}
+
+func (l EditWindowLimits) limit(window string) int64 {
+	switch window {
+	case editWindowHour:
+		return l.Hour
+	case editWindowDay:
+		return l.Day
+	case editWindowWeek:
+		return l.Week
+	case editWindowTotal:
+		return l.Total
+	}
+	return 0
+}
+
+// editWindowStart returns the start of the window containing t.
+func editWindowStart(window string, t time.Time) time.Time {
+	t = t.UTC()
+	switch window {
+	case editWindowHour:
+		return t.Truncate(time.Hour)
+	case editWindowDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case editWindowWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return time.Time{}
+}
+
+// editWindowEnd returns the end of the window that started at start, or the zero time if it never ends.
+func editWindowEnd(window string, start time.Time) time.Time {
+	switch window {
+	case editWindowHour:
+		return start.Add(time.Hour)
+	case editWindowDay:
+		return start.AddDate(0, 0, 1)
+	case editWindowWeek:
+		return start.AddDate(0, 0, 7)
+	}
+	return time.Time{}
+}
+
+// windowUsage returns the usage of a window in a scope at time now, rolling it over if it has ended.
+// Callers must hold the lock on b.limiter.
+func (b *Bot) windowUsage(scope, window string, now time.Time) editWindowUsage {
+	usage := b.limiter.usage.Scopes[scope][window]
+	if start := editWindowStart(window, now); !usage.Start.Equal(start) {
+		usage = editWindowUsage{Start: start}
+	}
+	return usage
+}
+
+// scopesForTitle returns the scopes that an edit to title counts towards.
+// An empty title counts only towards the all namespaces scope.
+func (b *Bot) scopesForTitle(title string) []string {
+	scopes := []string{allNamespacesScope}
+	if title != "" {
+		ns := strconv.Itoa(b.namespaceOfTitle(title))
+		if _, ok := b.limiter.limits[ns]; ok {
+			scopes = append(scopes, ns)
+		}
+	}
+	return scopes
+}
 
 // EditLimit can be called to increment the current edit count
 // Returns true if allowed to edit or false if not
-// Remember to call SaveEditLimit at the end of the program if using this!
-func EditLimit() bool {
-	if editLimit > 0 {
-		if currentUsedEditLimit >= editLimit {
-			log.Println("edit limited, not performing edit - limit was", editLimit, "and this is", currentUsedEditLimit)
-			return false
+// It only applies the limits across all namespaces; use EditLimitTitle
+// where the page being edited is known, so that namespace limits apply too.
+func (b *Bot) EditLimit() bool {
+	return b.editLimitTitle("")
+}
+
+// EditLimitTitle checks every edit limit that applies to an edit to title, and if none
+// of them have been reached, counts the edit against them and returns true.
+// The usage is saved straight away, so that it isn't lost if the task dies.
+func (b *Bot) EditLimitTitle(title string) bool {
+	return b.editLimitTitle(title)
+}
+
+func (b *Bot) editLimitTitle(title string) bool {
+	_, ok := b.countEdit(title)
+	return ok
+}
+
+// countEdit is editLimitTitle, also returning when the edit was counted, so that it can be
+// handed back with uncountEdit if it's never saved.
+func (b *Bot) countEdit(title string) (time.Time, bool) {
+	b.limiter.Lock()
+	defer b.limiter.Unlock()
+
+	now := time.Now()
+	if !b.limiter.set {
+		return now, true
+	}
+
+	scopes := b.scopesForTitle(title)
+	for _, scope := range scopes {
+		for _, window := range editWindows {
+			limit := b.limiter.limits[scope].limit(window)
+			if limit <= 0 {
+				continue
+			}
+			if used := b.windowUsage(scope, window, now).Used; used >= limit {
+				log.Println("edit limited, not performing edit to", title, "- limit for", scope, "per", window, "was", limit, "and this is", used)
+				return now, false
+			}
 		}
+	}
 
-		currentUsedEditLimit++
-		return true
+	for _, scope := range scopes {
+		if b.limiter.usage.Scopes[scope] == nil {
+			b.limiter.usage.Scopes[scope] = map[string]editWindowUsage{}
+		}
+		for _, window := range editWindows {
+			usage := b.windowUsage(scope, window, now)
+			usage.Used++
+			b.limiter.usage.Scopes[scope][window] = usage
+		}
 	}
-	return true
+	b.limiter.thisRun++
+
+	b.saveEditLimitState()
+	return now, true
 }
 
-// SaveEditLimit saves the current edit limit to the edit limit file,
-// assuming that there is an edit limit usage to save
-// This function must be called at the end of the program for edit limiting to work
-func SaveEditLimit() {
-	if currentUsedEditLimit > 0 {
-		buf := make([]byte, binary.MaxVarintLen16)
-		binary.PutVarint(buf, currentUsedEditLimit)
-		err := os.WriteFile("editlimit", buf, 0644)
-		if err != nil {
-			PanicErr("Failed to write edit limit file with err ", err)
+// uncountEdit hands back an edit to title that was counted at counted, but was never saved.
+// Windows that have rolled over since are left alone, as the edit was never counted in them.
+func (b *Bot) uncountEdit(title string, counted time.Time) {
+	b.limiter.Lock()
+	defer b.limiter.Unlock()
+
+	if !b.limiter.set {
+		return
+	}
+	for _, scope := range b.scopesForTitle(title) {
+		for _, window := range editWindows {
+			usage, ok := b.limiter.usage.Scopes[scope][window]
+			if !ok || usage.Used <= 0 || !usage.Start.Equal(editWindowStart(window, counted)) {
+				continue
+			}
+			usage.Used--
+			b.limiter.usage.Scopes[scope][window] = usage
 		}
 	}
+	b.limiter.thisRun--
+
+	b.saveEditLimitState()
 }
 
-// SetupEditLimit takes in a limit as an int64
-// and sets that as the limit for edits for the bot,
-// as well as enabling the edit limiting functionality
-func setupEditLimit(limit int64) {
-	editLimit = limit
+// RemainingEditBudget returns the usage and remaining budget of every edit limit set for the task,
+// with the windows rolled over to the current time.
+func (b *Bot) RemainingEditBudget() []EditBudget {
+	return b.remainingEditBudget()
+}
 
-	editLimitFileContents, err := os.ReadFile("editlimit")
+func (b *Bot) remainingEditBudget() []EditBudget {
+	b.limiter.Lock()
+	defer b.limiter.Unlock()
+
+	scopes := make([]string, 0, len(b.limiter.limits))
+	for scope := range b.limiter.limits {
+		scopes = append(scopes, scope)
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		// keep all namespaces first, then namespaces in number order
+		if scopes[i] == allNamespacesScope || scopes[j] == allNamespacesScope {
+			return scopes[i] == allNamespacesScope
+		}
+		nsI, _ := strconv.Atoi(scopes[i])
+		nsJ, _ := strconv.Atoi(scopes[j])
+		return nsI < nsJ
+	})
+
+	now := time.Now()
+	var budgets []EditBudget
+	for _, scope := range scopes {
+		for _, window := range editWindows {
+			limit := b.limiter.limits[scope].limit(window)
+			if limit <= 0 {
+				continue
+			}
+			usage := b.windowUsage(scope, window, now)
+			remaining := limit - usage.Used
+			if remaining < 0 {
+				remaining = 0
+			}
+			budget := EditBudget{
+				Scope:     scope,
+				Window:    window,
+				Limit:     limit,
+				Used:      usage.Used,
+				Remaining: remaining,
+			}
+			if resets := editWindowEnd(window, usage.Start); !resets.IsZero() {
+				budget.Resets = &resets
+			}
+			budgets = append(budgets, budget)
+		}
+	}
+	return budgets
+}
+
+// SaveEditLimit saves the current edit limit usage to the edit limit file.
+// Usage is already saved after every edit, but this function should still
+// be called at the end of the program, to be sure nothing has been missed.
+// In dry-run mode, or when replaying, nothing is saved, as no edits were really made.
+func (b *Bot) SaveEditLimit() {
+	if b.dryRun || b.replaying {
+		log.Println("Dry run or replay, so not saving edit limit usage of", b.limiter.thisRun, "edits")
+		return
+	}
+	b.limiter.Lock()
+	defer b.limiter.Unlock()
+	b.saveEditLimitState()
+}
+
+// saveEditLimitState atomically writes the edit limit usage to the edit limit file,
+// by writing it to a temporary file and then renaming that over the top.
+// Callers must hold the lock on b.limiter.
+func (b *Bot) saveEditLimitState() {
+	if !b.limiter.set || b.dryRun || b.replaying {
+		return
+	}
+
+	encoded, err := json.MarshalIndent(b.limiter.usage, "", "\t")
 	if err != nil {
-		// the edit limit file doesn't exist probably, try creating it
-		err := os.WriteFile("editlimit", []uint8{0x00, 0x00, 0x00}, 0644)
+		b.PanicErr("Failed to encode edit limit usage with err ", err)
+	}
+
+	tmpFilename := b.limiter.path + ".tmp"
+	err = os.WriteFile(tmpFilename, encoded, 0644)
+	if err == nil {
+		err = os.Rename(tmpFilename, b.limiter.path)
+	}
+	if err != nil {
+		b.PanicErr("Failed to write edit limit file with err ", err)
+	}
+}
+
+// setupEditLimit takes in the lifetime edit limit and the windowed limits from the task config,
+// enabling the edit limiting functionality if any of them are set, and loading the usage so far.
+func (b *Bot) setupEditLimit(total int64, limits EditLimitsConfig) {
+	b.limiter.path = editLimitFilename
+	if b.currentWiki != "" {
+		b.limiter.path = strings.TrimSuffix(editLimitFilename, ".json") + "-" + strings.ToLower(slugify.Marshal(b.currentWiki)) + ".json"
+	}
+	b.limiter.limits = map[string]EditWindowLimits{}
+	b.limiter.usage = editLimitState{Scopes: map[string]map[string]editWindowUsage{}}
+	b.limiter.thisRun = 0
+
+	all := limits.EditWindowLimits
+	if total > 0 {
+		all.Total = total
+	}
+	b.limiter.limits[allNamespacesScope] = all
+	for name, nsLimits := range limits.Namespaces {
+		ns, ok := b.namespaceFromName(name)
+		if !ok {
+			b.PanicErr("Unrecognised namespace ", name, " in editlimits config")
+		}
+		b.limiter.limits[strconv.Itoa(ns)] = nsLimits
+	}
+
+	b.limiter.set = false
+	for _, scopeLimits := range b.limiter.limits {
+		if scopeLimits != (EditWindowLimits{}) {
+			b.limiter.set = true
+		}
+	}
+	if !b.limiter.set {
+		return
+	}
+
+	stateFileContents, err := os.ReadFile(b.limiter.path)
+	if err == nil {
+		err = json.Unmarshal(stateFileContents, &b.limiter.usage)
 		if err != nil {
-			PanicErr("Failed to create edit limit file with error ", err)
+			b.PanicErr("Edit limit file ", b.limiter.path, " is corrupt, failed to decode with error ", err)
+		}
+		if b.limiter.usage.Scopes == nil {
+			b.limiter.usage.Scopes = map[string]map[string]editWindowUsage{}
 		}
-		editLimitFileContents = []uint8{0x00, 0x00, 0x00}
+	} else if !os.IsNotExist(err) {
+		b.PanicErr("Failed to read edit limit file with error ", err)
+	} else if b.currentWiki == "" {
+		// the old file predates running on several wikis, so it can only be for a single one
+		b.migrateLegacyEditLimit()
+	}
+
+	for _, budget := range b.remainingEditBudget() {
+		log.Println("Edit limit for", budget.Scope, "per", budget.Window, "is", budget.Limit, "with", budget.Remaining, "remaining")
+	}
+}
+
+// migrateLegacyEditLimit carries the count in the old varint edit limit file, if there is one,
+// over into the total for all namespaces, then removes the old file.
+func (b *Bot) migrateLegacyEditLimit() {
+	legacyContents, err := os.ReadFile(legacyEditLimitFilename)
+	if err != nil {
+		return
+	}
+
+	used, bytesRead := binary.Varint(legacyContents)
+	if bytesRead <= 0 {
+		b.PanicErr("editlimit file is corrupt, failed to convert with bytesRead ", bytesRead)
+	}
+
+	b.limiter.usage.Scopes[allNamespacesScope] = map[string]editWindowUsage{
+		editWindowTotal: {Used: used},
+	}
+	if b.dryRun || b.replaying {
+		return
 	}
-	var bytesRead int
-	currentUsedEditLimit, bytesRead = binary.Varint(editLimitFileContents)
-	if bytesRead < 0 {
-		PanicErr("editlimit file is corrupt, failed to convert with bytesRead ", bytesRead)
+	b.saveEditLimitState()
+	if err := os.Remove(legacyEditLimitFilename); err != nil {
+		log.Println("Migrated old edit limit file, but failed to remove it with error", err)
 	}
+	log.Println("Migrated old edit limit file, with", used, "edits used, to", b.limiter.path)
 }
@@ -0,0 +1,255 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// limitedBot returns a bot with the given limits across all namespaces, and no usage yet,
+// which keeps its usage in editlimit.json in the working directory.
+func limitedBot(limits EditWindowLimits) *Bot {
+	b := &Bot{}
+	b.limiter.set = true
+	b.limiter.limits = map[string]EditWindowLimits{allNamespacesScope: limits}
+	b.limiter.usage = editLimitState{Scopes: map[string]map[string]editWindowUsage{}}
+	b.limiter.path = editLimitFilename
+	return b
+}
+
+func TestEditWindowStart(t *testing.T) {
+	tests := []struct {
+		window string
+		at     string
+		want   string
+	}{
+		{editWindowHour, "2024-03-06T14:59:59Z", "2024-03-06T14:00:00Z"},
+		{editWindowHour, "2024-03-06T15:00:00Z", "2024-03-06T15:00:00Z"},
+		{editWindowDay, "2024-03-06T23:59:59Z", "2024-03-06T00:00:00Z"},
+		{editWindowDay, "2024-03-07T00:00:00Z", "2024-03-07T00:00:00Z"},
+		// windows are in UTC, whatever the time is given in
+		{editWindowDay, "2024-03-07T01:00:00+02:00", "2024-03-06T00:00:00Z"},
+		// weeks start on Monday
+		{editWindowWeek, "2024-03-04T00:00:00Z", "2024-03-04T00:00:00Z"},
+		{editWindowWeek, "2024-03-06T12:00:00Z", "2024-03-04T00:00:00Z"},
+		{editWindowWeek, "2024-03-10T23:59:59Z", "2024-03-04T00:00:00Z"},
+		{editWindowWeek, "2024-03-11T00:00:00Z", "2024-03-11T00:00:00Z"},
+		{editWindowWeek, "2024-01-01T10:00:00Z", "2024-01-01T00:00:00Z"},
+		{editWindowWeek, "2023-12-31T10:00:00Z", "2023-12-25T00:00:00Z"},
+		{editWindowTotal, "2024-03-06T14:00:00Z", "0001-01-01T00:00:00Z"},
+	}
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		if got := editWindowStart(test.window, at).Format(time.RFC3339); got != test.want {
+			t.Errorf("editWindowStart(%s, %s) = %s, want %s", test.window, test.at, got, test.want)
+		}
+	}
+}
+
+func TestWindowUsageRollsOver(t *testing.T) {
+	now := time.Date(2024, 3, 6, 14, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window string
+		start  time.Time
+		want   int64
+	}{
+		{"same hour", editWindowHour, time.Date(2024, 3, 6, 14, 0, 0, 0, time.UTC), 5},
+		{"previous hour", editWindowHour, time.Date(2024, 3, 6, 13, 0, 0, 0, time.UTC), 0},
+		{"same day", editWindowDay, time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC), 5},
+		{"previous day", editWindowDay, time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), 0},
+		{"same week", editWindowWeek, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), 5},
+		{"previous week", editWindowWeek, time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), 0},
+		{"total never rolls over", editWindowTotal, time.Time{}, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := limitedBot(EditWindowLimits{})
+			b.limiter.usage.Scopes[allNamespacesScope] = map[string]editWindowUsage{
+				test.window: {Start: test.start, Used: 5},
+			}
+			usage := b.windowUsage(allNamespacesScope, test.window, now)
+			if usage.Used != test.want {
+				t.Errorf("used = %d, want %d", usage.Used, test.want)
+			}
+			if want := editWindowStart(test.window, now); !usage.Start.Equal(want) {
+				t.Errorf("start = %s, want %s", usage.Start, want)
+			}
+		})
+	}
+}
+
+func TestEditLimitTitle(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits EditWindowLimits
+		// used is how many edits have already been made in the current window of each kind
+		used    int64
+		allowed []bool
+	}{
+		{"no limits", EditWindowLimits{}, 0, []bool{true, true, true}},
+		{"hour", EditWindowLimits{Hour: 2}, 0, []bool{true, true, false}},
+		{"hour partly used", EditWindowLimits{Hour: 2}, 1, []bool{true, false}},
+		{"day", EditWindowLimits{Day: 1}, 0, []bool{true, false}},
+		{"week under total", EditWindowLimits{Week: 1, Total: 5}, 0, []bool{true, false}},
+		{"total under week", EditWindowLimits{Week: 5, Total: 3}, 2, []bool{true, false}},
+		{"used up", EditWindowLimits{Hour: 10, Total: 2}, 2, []bool{false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := limitedBot(test.limits)
+			b.dryRun = true
+			now := time.Now()
+			windows := map[string]editWindowUsage{}
+			for _, window := range editWindows {
+				windows[window] = editWindowUsage{Start: editWindowStart(window, now), Used: test.used}
+			}
+			b.limiter.usage.Scopes[allNamespacesScope] = windows
+
+			for i, want := range test.allowed {
+				if got := b.EditLimit(); got != want {
+					t.Fatalf("edit %d: allowed = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEditLimitAllowsEditsAgainAfterRollover(t *testing.T) {
+	b := limitedBot(EditWindowLimits{Hour: 1})
+	b.dryRun = true
+	if !b.EditLimit() {
+		t.Fatal("first edit wasn't allowed")
+	}
+	if b.EditLimit() {
+		t.Fatal("second edit in the same hour was allowed")
+	}
+
+	// as if the edit had been made an hour ago
+	usage := b.limiter.usage.Scopes[allNamespacesScope][editWindowHour]
+	usage.Start = usage.Start.Add(-time.Hour)
+	b.limiter.usage.Scopes[allNamespacesScope][editWindowHour] = usage
+	if !b.EditLimit() {
+		t.Fatal("edit in the next hour wasn't allowed")
+	}
+	if got := b.limiter.usage.Scopes[allNamespacesScope][editWindowTotal].Used; got != 2 {
+		t.Errorf("total used = %d, want 2, as the total never rolls over", got)
+	}
+	if b.limiter.thisRun != 2 {
+		t.Errorf("edits this run = %d, want 2", b.limiter.thisRun)
+	}
+}
+
+func TestUncountEdit(t *testing.T) {
+	b := limitedBot(EditWindowLimits{Hour: 5, Total: 5})
+	b.dryRun = true
+	used := func(window string) int64 {
+		return b.limiter.usage.Scopes[allNamespacesScope][window].Used
+	}
+
+	counted, ok := b.countEdit("")
+	if !ok {
+		t.Fatal("edit wasn't allowed")
+	}
+	b.uncountEdit("", counted)
+	if used(editWindowHour) != 0 || used(editWindowTotal) != 0 || b.limiter.thisRun != 0 {
+		t.Errorf("after handing the edit back, used %d this hour, %d in total and %d this run, want none",
+			used(editWindowHour), used(editWindowTotal), b.limiter.thisRun)
+	}
+
+	// an edit counted in the previous hour isn't taken off this hour's usage
+	b.countEdit("")
+	b.uncountEdit("", counted.Add(-time.Hour))
+	if used(editWindowHour) != 1 || used(editWindowTotal) != 0 {
+		t.Errorf("used %d this hour and %d in total, want 1 and 0", used(editWindowHour), used(editWindowTotal))
+	}
+}
+
+func TestMigrateLegacyEditLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		used   int64
+		dryRun bool
+	}{
+		{"none used", 0, false},
+		{"some used", 42, false},
+		{"many used", 123456, false},
+		{"dry run", 7, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			legacy := make([]byte, binary.MaxVarintLen64)
+			legacy = legacy[:binary.PutVarint(legacy, test.used)]
+			if err := os.WriteFile(legacyEditLimitFilename, legacy, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			b := limitedBot(EditWindowLimits{Total: 1000000})
+			b.dryRun = test.dryRun
+			b.migrateLegacyEditLimit()
+
+			if got := b.limiter.usage.Scopes[allNamespacesScope][editWindowTotal].Used; got != test.used {
+				t.Errorf("total used = %d, want %d", got, test.used)
+			}
+
+			_, err := os.Stat(legacyEditLimitFilename)
+			if test.dryRun {
+				// a dry run leaves everything on disk alone
+				if err != nil {
+					t.Errorf("legacy file was removed in a dry run: %v", err)
+				}
+				if _, err := os.Stat(editLimitFilename); !os.IsNotExist(err) {
+					t.Errorf("%s was written in a dry run", editLimitFilename)
+				}
+				return
+			}
+			if !os.IsNotExist(err) {
+				t.Errorf("legacy file wasn't removed: %v", err)
+			}
+			saved, err := os.ReadFile(editLimitFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state editLimitState
+			if err := json.Unmarshal(saved, &state); err != nil {
+				t.Fatal(err)
+			}
+			if got := state.Scopes[allNamespacesScope][editWindowTotal].Used; got != test.used {
+				t.Errorf("saved total used = %d, want %d", got, test.used)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyEditLimitWithoutLegacyFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	b := limitedBot(EditWindowLimits{Total: 10})
+	b.migrateLegacyEditLimit()
+	if len(b.limiter.usage.Scopes) != 0 {
+		t.Errorf("usage = %v, want none", b.limiter.usage.Scopes)
+	}
+	if _, err := os.Stat(editLimitFilename); !os.IsNotExist(err) {
+		t.Errorf("%s was written with nothing to migrate", editLimitFilename)
+	}
+}
@@ -18,28 +18,17 @@ package ybtools
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
-import (
-	"fmt"
-	"strings"
-
-	"gopkg.in/gomail.v2"
-)
-
-// PanicErr panics the program with a specified message,
-// also sending a message to the tool inbox on Toolforge explaining the issue.
-func PanicErr(v ...interface{}) {
-	strerr := fmt.Sprint(v...)
-	toolemail := "tools." + strings.ToLower(settings.ToolforgeAccount) + "@tools.wmflabs.org"
-
-	m := gomail.NewMessage()
-	m.SetHeader("From", toolemail)
-	m.SetHeader("To", toolemail)
-	m.SetHeader("Subject", settings.BotUser+" errored in "+settings.TaskName)
-	m.SetBody("text/plain", strerr)
-
-	d := gomail.Dialer{Host: "mail.tools.wmflabs.org", Port: 25}
-	if err := d.DialAndSend(m); err != nil {
-		strerr = "FAILED TO EMAIL ERROR (ERR " + err.Error() + "): " + strerr
+import "fmt"
+
+// PanicErr panics the program with a specified message, also sending
+// a fatal alert explaining the issue to the configured alert sinks (by default,
+// the tool inbox on Toolforge). Use ReportErr for problems the task can carry on from.
+// Any registered secrets in the message are redacted before it goes anywhere.
+func (b *Bot) PanicErr(v ...interface{}) {
+	strerr := Redact(fmt.Sprint(v...))
+	b.reportFailed(strerr)
+	if failures := b.SendAlert(SeverityFatal, strerr); failures != "" {
+		strerr = failures + ": " + strerr
 	}
 	panic(strerr)
 }
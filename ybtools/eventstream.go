@@ -0,0 +1,436 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+)
+
+// DefaultRecentChangesURL is the Wikimedia EventStreams recentchange stream, which has every
+// change made on every Wikimedia wiki. It's the default for recentchangesurl in the global config.
+const DefaultRecentChangesURL string = "https://stream.wikimedia.org/v2/stream/recentchange"
+
+// positionSaveInterval is the longest the position in a stream goes unsaved while changes are
+// being skipped by the filter; handled changes always have their position saved straight away.
+const positionSaveInterval time.Duration = 10 * time.Second
+
+// ErrStreamRefused is returned by Follow when the stream refuses the request outright, for
+// instance with a 404 for a stream that doesn't exist, so there's no point reconnecting.
+var ErrStreamRefused = errors.New("event stream refused the request")
+
+// RecentChange is a single change from the recentchange stream, as described by the
+// mediawiki/recentchange schema. Length and Revision are only set for edits and new pages.
+type RecentChange struct {
+	ID         int64     `json:"id"`
+	Type       string    `json:"type"`
+	Namespace  int       `json:"namespace"`
+	Title      string    `json:"title"`
+	Comment    string    `json:"comment"`
+	Timestamp  int64     `json:"timestamp"`
+	User       string    `json:"user"`
+	Bot        bool      `json:"bot"`
+	Minor      bool      `json:"minor"`
+	Patrolled  bool      `json:"patrolled"`
+	Length     OldAndNew `json:"length"`
+	Revision   OldAndNew `json:"revision"`
+	ServerURL  string    `json:"server_url"`
+	ServerName string    `json:"server_name"`
+	Wiki       string    `json:"wiki"`
+	Meta       struct {
+		ID     string `json:"id"`
+		DT     string `json:"dt"`
+		Domain string `json:"domain"`
+		Stream string `json:"stream"`
+		URI    string `json:"uri"`
+	} `json:"meta"`
+}
+
+// OldAndNew holds a value from before and after a change, like the revision IDs of an edit.
+// Old is zero for new pages.
+type OldAndNew struct {
+	Old int64 `json:"old"`
+	New int64 `json:"new"`
+}
+
+// Time returns when the change was made.
+func (c RecentChange) Time() time.Time {
+	return time.Unix(c.Timestamp, 0).UTC()
+}
+
+// RecentChangeFilter picks out the changes a task is interested in. Each field that's set has to
+// match for a change to be handled; a field left empty matches every change.
+type RecentChangeFilter struct {
+	// Wikis are matched against either the database name of the wiki, like enwiki,
+	// or its server name, like en.wikipedia.org
+	Wikis []string
+	// Namespaces are namespace IDs, like 10 for templates
+	Namespaces []int
+	// Titles are full page titles, including the namespace; underscores and a lowercase
+	// first letter are fine, as they're normalised the same way the wiki would
+	Titles []string
+	// Types are types of change, like edit, new, log and categorize
+	Types []string
+	// Site normalises Titles, and the titles of changes, as the wiki would; English Wikipedia's
+	// rules are used if it's nil. RecentChanges sets it to the bot's wiki, if it's been looked up.
+	Site *title.Site
+}
+
+// Matches returns whether a change is one the filter lets through.
+func (f RecentChangeFilter) Matches(c RecentChange) bool {
+	if len(f.Wikis) > 0 && !containsString(f.Wikis, c.Wiki) && !containsString(f.Wikis, c.ServerName) {
+		return false
+	}
+	if len(f.Types) > 0 && !containsString(f.Types, c.Type) {
+		return false
+	}
+	if len(f.Namespaces) > 0 {
+		found := false
+		for _, ns := range f.Namespaces {
+			if ns == c.Namespace {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Titles) > 0 {
+		site := f.Site
+		if site == nil {
+			site = title.DefaultSite()
+		}
+		changed := site.Normalise(c.Title)
+		found := false
+		for _, t := range f.Titles {
+			if site.Normalise(t) == changed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString returns whether s is one of list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RecentChanges follows a recentchange event stream, handing every change that passes the
+// filter to a task as it happens, so the task can react to it rather than polling the wiki.
+// Make one with the bot's RecentChanges method, or directly for a stream of your own.
+type RecentChanges struct {
+	// URL is the stream to follow, which is DefaultRecentChangesURL for Wikimedia wikis
+	URL    string
+	Filter RecentChangeFilter
+	// PositionFile, if it's set, keeps the ID of the last event dealt with between runs, so
+	// that following the stream again carries on from there, rather than from whatever is
+	// happening now. Wikimedia keeps a few days of events, so a task can be stopped for a while
+	// without missing any changes.
+	PositionFile string
+	UserAgent    string
+	// Retry sets how long to wait before reconnecting; only BaseDelay and MaxDelay are used,
+	// as the stream is reconnected to for as long as it takes, and the global defaults are
+	// used for them if they're left unset
+	Retry RetryPolicy
+	// Client is the HTTP client used to connect, which mustn't have a timeout,
+	// as the stream stays open indefinitely. http.DefaultClient is used if it's nil.
+	Client *http.Client
+
+	lastEventID  string
+	savedEventID string
+	savedAt      time.Time
+	// serverRetry is how long the stream has asked to wait before reconnecting, if it has
+	serverRetry time.Duration
+}
+
+// RecentChanges returns a follower for the recentchange stream set by recentchangesurl in the
+// global config, using the bot's user agent and retry settings. If the filter has no Wikis,
+// it's set to the wiki the bot is configured for. The position in the stream is kept in
+// <task>.recentchanges in the working directory.
+func (b *Bot) RecentChanges(filter RecentChangeFilter) *RecentChanges {
+	if len(filter.Wikis) == 0 {
+		if endpoint, err := url.Parse(b.config.APIEndpoint); err == nil && endpoint.Host != "" {
+			filter.Wikis = []string{endpoint.Host}
+		}
+	}
+	if filter.Site == nil {
+		filter.Site = b.currentSite()
+	}
+	streamURL := b.config.RecentChangesURL
+	if streamURL == "" {
+		streamURL = DefaultRecentChangesURL
+	}
+	return &RecentChanges{
+		URL:          streamURL,
+		Filter:       filter,
+		PositionFile: b.settings.TaskName + ".recentchanges",
+		UserAgent:    b.botUserAgent(),
+		Retry:        b.DefaultRetryPolicy(),
+	}
+}
+
+// Follow connects to the stream and calls handle with every change that passes the filter, in
+// the order they happened, until ctx is cancelled, when it returns nil. If the connection drops
+// or can't be made, it's made again after waiting, carrying on from the last event, so no
+// changes are missed or repeated. Follow only gives up if the stream refuses the request, with
+// an error wrapping ErrStreamRefused, or if handle returns an error, which is returned as it
+// is; the change it was handling is handled again the next time the stream is followed.
+func (r *RecentChanges) Follow(ctx context.Context, handle func(RecentChange) error) error {
+	if err := r.loadPosition(); err != nil {
+		return err
+	}
+	defer r.savePosition(true)
+	if r.Retry.BaseDelay <= 0 {
+		r.Retry.BaseDelay = defaultRetryBaseDelay
+	}
+	if r.Retry.MaxDelay <= 0 {
+		r.Retry.MaxDelay = defaultRetryMaxDelay
+	}
+
+	attempt := 0
+	for {
+		received, err := r.stream(ctx, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var handlerErr *handlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr.err
+		}
+		if errors.Is(err, ErrStreamRefused) {
+			return err
+		}
+
+		if received {
+			attempt = 0
+		}
+		attempt++
+		wait := r.Retry.backoff(attempt)
+		if r.serverRetry > wait {
+			wait = r.serverRetry
+		}
+		if err == nil {
+			err = errors.New("stream closed")
+		}
+		log.Println("Lost connection to the event stream", r.URL, "with error", err, "so reconnecting in", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// handlerError wraps an error returned by the handler given to Follow, to tell it apart from
+// errors reading the stream, which are reconnected after.
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+// stream makes a single connection to the stream and reads events from it until it's closed,
+// returning whether any events were received, and the error that ended it, if there was one.
+func (r *RecentChanges) stream(ctx context.Context, handle func(RecentChange) error) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrStreamRefused, err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+	if r.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", r.lastEventID)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("event stream %s returned HTTP %s", r.URL, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return false, fmt.Errorf("%w: %s", ErrStreamRefused, err)
+		}
+		return false, err
+	}
+
+	received := false
+	reader := bufio.NewReader(resp.Body)
+	var eventType, eventID string
+	var data strings.Builder
+	hasID := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return received, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// a blank line ends the event
+			if hasID {
+				eventID = strings.TrimSpace(eventID)
+			}
+			if data.Len() > 0 && (eventType == "" || eventType == "message") {
+				received = true
+				if err := r.dispatch(strings.TrimSuffix(data.String(), "\n"), handle); err != nil {
+					return received, err
+				}
+			}
+			if hasID {
+				r.lastEventID = eventID
+				r.savePosition(false)
+			}
+			eventType, eventID, hasID = "", "", false
+			data.Reset()
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// a comment, which the stream sends to keep the connection open
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			eventID, hasID = value, true
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				r.serverRetry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// dispatch decodes the data of an event and hands it to handle if it passes the filter.
+// Events that can't be decoded are logged and skipped, so one bad event can't stop the stream.
+func (r *RecentChanges) dispatch(data string, handle func(RecentChange) error) error {
+	var change RecentChange
+	if err := json.Unmarshal([]byte(data), &change); err != nil {
+		log.Println("Skipping event from", r.URL, "that couldn't be decoded, with error", err)
+		return nil
+	}
+	if !r.Filter.Matches(change) {
+		return nil
+	}
+	if err := handle(change); err != nil {
+		return &handlerError{err}
+	}
+	// make sure a handled change is never handled again, even if the process is killed
+	r.savedAt = time.Time{}
+	return nil
+}
+
+// loadPosition reads the last event ID from the position file, if there's one.
+func (r *RecentChanges) loadPosition() error {
+	if r.PositionFile == "" {
+		return nil
+	}
+	saved, err := os.ReadFile(r.PositionFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read event stream position from %s: %w", r.PositionFile, err)
+	}
+	r.lastEventID = strings.TrimSpace(string(saved))
+	r.savedEventID = r.lastEventID
+	r.savedAt = time.Now()
+	return nil
+}
+
+// savePosition writes the last event ID to the position file, if it has changed and either
+// force is set, the position hasn't been saved for a while, or a change was just handled.
+// Failing to save is only logged, as the worst that can happen is changes being handled twice.
+func (r *RecentChanges) savePosition(force bool) {
+	if r.PositionFile == "" || r.lastEventID == r.savedEventID {
+		return
+	}
+	if !force && time.Since(r.savedAt) < positionSaveInterval {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(r.PositionFile), filepath.Base(r.PositionFile)+".*")
+	if err == nil {
+		_, err = tmp.WriteString(r.lastEventID + "\n")
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), r.PositionFile)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Println("Failed to save event stream position to", r.PositionFile, "with error", err)
+		return
+	}
+	r.savedEventID = r.lastEventID
+	r.savedAt = time.Now()
+}
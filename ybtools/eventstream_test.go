@@ -0,0 +1,154 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+func TestRecentChangeFilterMatches(t *testing.T) {
+	change := RecentChange{Type: "edit", Namespace: 10, Title: "Template:Rfc", Wiki: "enwiki", ServerName: "en.wikipedia.org"}
+	tests := []struct {
+		name   string
+		filter RecentChangeFilter
+		want   bool
+	}{
+		{"empty", RecentChangeFilter{}, true},
+		{"wiki by name", RecentChangeFilter{Wikis: []string{"dewiki", "enwiki"}}, true},
+		{"wiki by server", RecentChangeFilter{Wikis: []string{"en.wikipedia.org"}}, true},
+		{"other wiki", RecentChangeFilter{Wikis: []string{"dewiki"}}, false},
+		{"namespace", RecentChangeFilter{Namespaces: []int{0, 10}}, true},
+		{"other namespace", RecentChangeFilter{Namespaces: []int{0}}, false},
+		{"type", RecentChangeFilter{Types: []string{"edit", "new"}}, true},
+		{"other type", RecentChangeFilter{Types: []string{"log"}}, false},
+		{"title", RecentChangeFilter{Titles: []string{"Template:Rfc"}}, true},
+		{"title written differently", RecentChangeFilter{Titles: []string{"template:rfc"}}, true},
+		{"longer title", RecentChangeFilter{Titles: []string{"Template:Rfc tag"}}, false},
+		{"other title", RecentChangeFilter{Titles: []string{"Template:Current"}}, false},
+		{"everything", RecentChangeFilter{Wikis: []string{"enwiki"}, Namespaces: []int{10}, Types: []string{"edit"}, Titles: []string{"Template:Rfc"}}, true},
+		{"everything but one", RecentChangeFilter{Wikis: []string{"enwiki"}, Namespaces: []int{10}, Types: []string{"new"}, Titles: []string{"Template:Rfc"}}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(change); got != test.want {
+			t.Errorf("%s: Matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// follow follows the stream until handle has been given want changes, returning their titles.
+// If handle fails, it's with failWith, on the change to failOn.
+func follow(t *testing.T, r *RecentChanges, want int, failOn string, failWith error) ([]string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var titles []string
+	err := r.Follow(ctx, func(change RecentChange) error {
+		if change.Title == failOn {
+			return failWith
+		}
+		titles = append(titles, change.Title)
+		if len(titles) == want {
+			cancel()
+		}
+		return nil
+	})
+	if len(titles) < want && err == nil {
+		t.Fatalf("stopped following after %v, before %d changes came", titles, want)
+	}
+	return titles, err
+}
+
+func TestRecentChangesFollow(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	wiki.Name = "testwiki"
+	// the stream is dropped after every two events, so following it has to reconnect
+	wiki.StreamBatch = 2
+	server := mwtest.NewServer(wiki)
+	defer server.Close()
+
+	for _, title := range []string{"Alpha", "Talk:Alpha", "Beta", "Gamma", "Template:Delta", "Epsilon"} {
+		wiki.AddPage(mwtest.PageSpec{Title: title, Content: "Text."})
+	}
+	// as if everything up to Alpha had already been dealt with, so there's no need to wait for new changes
+	position := filepath.Join(t.TempDir(), "Test.recentchanges")
+	if err := os.WriteFile(position, []byte(`[{"topic":"mwtest.mediawiki.recentchange","partition":0,"offset":0}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream := func() *RecentChanges {
+		return &RecentChanges{
+			URL:          server.StreamURL(),
+			Filter:       RecentChangeFilter{Wikis: []string{"testwiki"}, Namespaces: []int{0}},
+			PositionFile: position,
+			Retry:        RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+		}
+	}
+
+	titles, err := follow(t, stream(), 3, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Beta", "Gamma", "Epsilon"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("followed %v, want %v", titles, want)
+	}
+
+	// following again carries on from the saved position
+	wiki.AddPage(mwtest.PageSpec{Title: "Zeta", Content: "Text."})
+	wiki.AddPage(mwtest.PageSpec{Title: "Talk:Zeta", Content: "Text."})
+	wiki.AddPage(mwtest.PageSpec{Title: "Zeta", Content: "More text."})
+	titles, err = follow(t, stream(), 2, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Zeta", "Zeta"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("followed %v after resuming, want %v", titles, want)
+	}
+
+	// a change the handler fails on is handed over again next time
+	wiki.AddPage(mwtest.PageSpec{Title: "Eta", Content: "Text."})
+	failed := errors.New("handler failed")
+	if _, err := follow(t, stream(), 1, "Eta", failed); err != failed {
+		t.Fatalf("error = %v, want the handler's", err)
+	}
+	titles, err = follow(t, stream(), 1, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Eta"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("followed %v after the handler failed, want %v", titles, want)
+	}
+}
+
+func TestRecentChangesFollowRefused(t *testing.T) {
+	server := mwtest.NewServer(nil)
+	defer server.Close()
+
+	r := &RecentChanges{URL: server.URL + "/v2/stream/missing", Retry: RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	if err := r.Follow(context.Background(), func(RecentChange) error { return nil }); !errors.Is(err, ErrStreamRefused) {
+		t.Errorf("error = %v, want ErrStreamRefused", err)
+	}
+}
@@ -6,11 +6,9 @@ require (
 	cgt.name/pkg/go-mwclient v1.3.0
 	github.com/antonholmquist/jason v1.0.1-0.20180605105355-426ade25b261
 	github.com/metal3d/go-slugify v0.0.0-20160607203414-7ac2014b2f23
+	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require (
-	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
-	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
-)
+require gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
@@ -0,0 +1,47 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+// The levels of -verbosity.
+const (
+	verbosityQuiet    int = 0
+	verbosityNormal   int = 1
+	verbosityRequests int = 2
+)
+
+// setupLogging applies -verbosity to the log, redacting any registered secrets from it.
+func (b *Bot) setupLogging() {
+	switch {
+	case b.options.Verbosity <= verbosityQuiet:
+		log.SetOutput(io.Discard)
+	default:
+		log.SetOutput(redactingWriter{out: os.Stderr})
+	}
+}
+
+// logRequests returns whether every API request should be logged.
+func (b *Bot) logRequests() bool {
+	return b.options.Verbosity >= verbosityRequests
+}
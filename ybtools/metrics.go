@@ -0,0 +1,418 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metal3d/go-slugify"
+)
+
+// metricsTaskLabel is the label every metric is written with, naming the task, so that
+// the metrics from each task's file don't clash once the node exporter has read them all.
+// metricsWikiLabel is added too, naming the wiki, when the task is running on several.
+const metricsTaskLabel string = "task"
+const metricsWikiLabel string = "wiki"
+
+// apiDurationBuckets are the histogram buckets, in seconds, for how long API requests take.
+var apiDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// The metrics every task has. Their names are part of what the dashboards rely on, so
+// they mustn't be changed; add new metrics instead.
+var (
+	// yapperbot_api_requests_total counts the requests sent to the API, by their action parameter.
+	// Edits a dry run only pretends to make aren't sent, so aren't counted.
+	apiRequestsMetric = NewCounter("yapperbot_api_requests_total", "API requests sent, by action.", "action")
+
+	// yapperbot_api_request_duration_seconds is how long API requests took, by their action parameter.
+	apiRequestDurationMetric = NewHistogram("yapperbot_api_request_duration_seconds", "How long API requests took, by action.", apiDurationBuckets, "action")
+
+	// yapperbot_edits_total counts the edits the bot tried to make, by outcome: saved, nochange
+	// (accepted, but the page was already the same) or failed (refused by the wiki, or never got there).
+	editsMetric = NewCounter("yapperbot_edits_total", "Edits attempted, by outcome: saved, nochange or failed.", "outcome")
+
+	// yapperbot_maxlag_waits_total counts the times the wiki asked the bot to wait because of
+	// replication lag, and yapperbot_maxlag_wait_seconds_total is how long it asked it to wait for.
+	maxlagWaitsMetric       = NewCounter("yapperbot_maxlag_waits_total", "Times the wiki asked for a wait because of replication lag.")
+	maxlagWaitSecondsMetric = NewCounter("yapperbot_maxlag_wait_seconds_total", "Seconds the wiki asked to wait for because of replication lag.")
+
+	// yapperbot_retries_total counts the calls retried by Do, by why: error for retryable
+	// errors, and readonly for waiting for a read-only wiki.
+	retriesMetric = NewCounter("yapperbot_retries_total", "Calls retried, by reason: error or readonly.", "reason")
+
+	// yapperbot_run_duration_seconds is how long the run took, from New to SaveRunReport.
+	runDurationMetric = NewGauge("yapperbot_run_duration_seconds", "How long the run took.")
+
+	// yapperbot_run_finished_timestamp_seconds is when the run finished, as a Unix timestamp,
+	// so that alerts can fire when a task hasn't run for too long.
+	runFinishedMetric = NewGauge("yapperbot_run_finished_timestamp_seconds", "When the run finished, as a Unix timestamp.")
+
+	// yapperbot_run_status is 1 for the status the run finished with, one of the run report
+	// statuses (succeeded, paused or failed), and 0 for the others.
+	runStatusMetric = NewGauge("yapperbot_run_status", "1 for the status the run finished with: succeeded, paused or failed.", "status")
+
+	// yapperbot_pages_scanned is how many pages the run looked at.
+	pagesScannedMetric = NewGauge("yapperbot_pages_scanned", "Pages looked at during the run.")
+)
+
+// metricsRegistry holds every metric that's been made, to be written out at the end of the run.
+var metricsRegistry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: map[string]metric{}}
+
+// metric is a counter, gauge or histogram, which can write its series out in textfile format,
+// with the labels every series has (task, and maybe wiki) already formatted in common.
+type metric interface {
+	write(b *strings.Builder, common string)
+	reset()
+}
+
+// metricFamily is everything metrics of every type have: a name, help text,
+// label names, and a lock over the series with each set of label values.
+type metricFamily struct {
+	sync.Mutex
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+// seriesKey turns label values into a key for the map of series, checking that the
+// right number have been given.
+func (f *metricFamily) seriesKey(labelValues []string) string {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprint("metric ", f.name, " has labels ", f.labelNames, " but was given values ", labelValues))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// labels formats the labels for a series, with the common labels first, and extra
+// (for instance le, for histogram buckets) last.
+func (f *metricFamily) labels(common, key string, extra ...string) string {
+	pairs := []string{common}
+	if len(f.labelNames) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, f.labelNames[i]+`="`+escapeLabelValue(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *metricFamily) writeHeader(b *strings.Builder) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, strings.ReplaceAll(f.help, "\n", " "), f.name, f.kind)
+}
+
+// registerMetric adds a metric to the registry, panicking if its name is already taken,
+// as that can only be a mistake in the code.
+func registerMetric(name string, m metric) {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	if _, ok := metricsRegistry.metrics[name]; ok {
+		panic("metric " + name + " has already been registered")
+	}
+	metricsRegistry.metrics[name] = m
+}
+
+// Counter is a metric that only goes up, like the number of edits made.
+type Counter struct {
+	metricFamily
+	values map[string]float64
+}
+
+// NewCounter makes and registers a counter. Its name should end in _total, and it
+// needs a value for each of labelNames whenever it's added to.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{metricFamily{name: name, help: help, kind: "counter", labelNames: labelNames}, map[string]float64{}}
+	registerMetric(name, c)
+	return c
+}
+
+// Add adds n to the counter for the given label values.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	key := c.seriesKey(labelValues)
+	c.Lock()
+	defer c.Unlock()
+	c.values[key] += n
+}
+
+// Inc adds one to the counter for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.values = map[string]float64{}
+}
+
+func (c *Counter) write(b *strings.Builder, common string) {
+	c.Lock()
+	defer c.Unlock()
+	writeSeries(b, &c.metricFamily, c.values, func(key string) string { return c.labels(common, key) })
+}
+
+// Gauge is a metric that's set to a value, like how long the run took.
+type Gauge struct {
+	metricFamily
+	values map[string]float64
+}
+
+// NewGauge makes and registers a gauge, which needs a value for each of labelNames whenever it's set.
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{metricFamily{name: name, help: help, kind: "gauge", labelNames: labelNames}, map[string]float64{}}
+	registerMetric(name, g)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.seriesKey(labelValues)
+	g.Lock()
+	defer g.Unlock()
+	g.values[key] = value
+}
+
+func (g *Gauge) reset() {
+	g.Lock()
+	defer g.Unlock()
+	g.values = map[string]float64{}
+}
+
+func (g *Gauge) write(b *strings.Builder, common string) {
+	g.Lock()
+	defer g.Unlock()
+	writeSeries(b, &g.metricFamily, g.values, func(key string) string { return g.labels(common, key) })
+}
+
+// writeSeries writes out the series of a counter or gauge in order. Metrics without labels
+// are always written, even if nothing has been recorded, so that they show as zero; metrics
+// with labels are left out until they have a series, as the yapperbot binary has every task's
+// metrics registered, and each task's file should only have its own.
+func writeSeries(b *strings.Builder, f *metricFamily, values map[string]float64, labels func(string) string) {
+	if len(values) == 0 {
+		if len(f.labelNames) > 0 {
+			return
+		}
+		values = map[string]float64{"": 0}
+	}
+	f.writeHeader(b)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s%s %s\n", f.name, labels(key), formatMetricValue(values[key]))
+	}
+}
+
+// Histogram is a metric that counts observations into buckets, like how long requests take.
+type Histogram struct {
+	metricFamily
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram makes and registers a histogram with the given bucket upper bounds, in
+// increasing order, which needs a value for each of labelNames whenever it's observed.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{metricFamily{name: name, help: help, kind: "histogram", labelNames: labelNames}, buckets, map[string]*histogramSeries{}}
+	registerMetric(name, h)
+	return h
+}
+
+// Observe records a value in the histogram for the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.seriesKey(labelValues)
+	h.Lock()
+	defer h.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *Histogram) reset() {
+	h.Lock()
+	defer h.Unlock()
+	h.series = map[string]*histogramSeries{}
+}
+
+func (h *Histogram) write(b *strings.Builder, common string) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.series) == 0 {
+		return
+	}
+	h.writeHeader(b)
+	for _, key := range sortedKeys(h.series) {
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.labels(common, key, "le", formatMetricValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.labels(common, key, "le", "+Inf"), series.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, h.labels(common, key), formatMetricValue(series.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, h.labels(common, key), series.count)
+	}
+}
+
+// sortedKeys returns the keys of a map of series in order, so that the output is stable.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// escapeLabelValue escapes a label value as the textfile format needs.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// saveMetrics records how the run went, and writes every metric to a .prom file in dir,
+// the -metrics-dir directory, if there is one and this isn't a dry run or a replay. The file
+// is written under a temporary name and then renamed, so the node exporter never reads
+// half of it. Failing to write it is logged,
+// but doesn't stop the task.
+func saveMetrics(dir string, finished RunReport) {
+	runDurationMetric.Set(finished.Finished.Sub(finished.Started).Seconds())
+	runFinishedMetric.Set(float64(finished.Finished.Unix()))
+	for _, status := range []string{"succeeded", "paused", "failed"} {
+		value := 0.0
+		if finished.Status == status {
+			value = 1
+		}
+		runStatusMetric.Set(value, status)
+	}
+	pagesScannedMetric.Set(float64(finished.PagesScanned))
+
+	if dir == "" {
+		return
+	}
+	if finished.DryRun || finished.Replay != "" {
+		// the edits weren't really made, so they mustn't end up on the graphs
+		log.Println("Dry run or replay, so not writing metrics")
+		return
+	}
+
+	common := metricsTaskLabel + `="` + escapeLabelValue(finished.Task) + `"`
+	filename := "yapperbot_" + strings.ToLower(slugify.Marshal(finished.Task))
+	if finished.Wiki != "" {
+		common += "," + metricsWikiLabel + `="` + escapeLabelValue(finished.Wiki) + `"`
+		filename += "_" + strings.ToLower(slugify.Marshal(finished.Wiki))
+	}
+
+	metricsRegistry.Lock()
+	names := sortedKeys(metricsRegistry.metrics)
+	var b strings.Builder
+	for _, name := range names {
+		metricsRegistry.metrics[name].write(&b, common)
+	}
+	metricsRegistry.Unlock()
+
+	path := filepath.Join(dir, filename+".prom")
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(path+".tmp", []byte(b.String()), 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Println("Failed to write metrics to", path, "with error", err)
+	} else {
+		log.Println("Wrote metrics to", path)
+	}
+}
+
+// metricsTransport counts and times every request sent to the API, and counts the
+// times the wiki asks for a wait because of lag. It sits right over the network, so
+// only requests that are really sent are counted.
+type metricsTransport struct {
+	base http.RoundTripper
+	// logRequests is whether every request is logged as well, with -verbosity 2
+	logRequests bool
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := apiRequestParams(req)
+	if err != nil {
+		return nil, err
+	}
+	action := p.Get("action")
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	took := time.Since(start)
+	apiRequestsMetric.Inc(action)
+	apiRequestDurationMetric.Observe(took.Seconds(), action)
+	if t.logRequests {
+		if err != nil {
+			log.Println("API", req.Method, "action="+action, "failed after", took, "with error", err)
+		} else {
+			log.Println("API", req.Method, "action="+action, "returned", resp.Status, "in", took)
+		}
+	}
+
+	if err == nil && resp.Header.Get("X-Database-Lag") != "" {
+		maxlagWaitsMetric.Inc()
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			maxlagWaitSecondsMetric.Add(float64(seconds))
+		}
+	}
+	return resp, err
+}
+
+// resetMetrics clears every metric, so that a run on another wiki starts from nothing.
+func resetMetrics() {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	for _, m := range metricsRegistry.metrics {
+		m.reset()
+	}
+}
@@ -0,0 +1,160 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/antonholmquist/jason"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+)
+
+// mainSlot is the name of the slot that holds a page's content, as opposed to any extra slots.
+const mainSlot string = "main"
+
+// ErrNoRevisions is returned when the content of a page is asked for, but no revisions
+// were fetched for it, either because the page is missing or because prop=revisions wasn't used.
+var ErrNoRevisions = errors.New("no revisions were returned for the page")
+
+// ErrNoMainSlot is returned when the content of a revision is asked for, but its main slot
+// wasn't fetched, for instance because rvslots=main or rvprop=content wasn't used.
+var ErrNoMainSlot = errors.New("no main slot content was returned for the revision")
+
+// Page is a page from a query response. Which of the fields are filled in depends on the props
+// the query asked for: Revisions needs prop=revisions, Categories needs prop=categories, and
+// ContentModel and LastRevID need prop=info.
+type Page struct {
+	PageID       int64                `json:"pageid"`
+	Namespace    int                  `json:"ns"`
+	Title        string               `json:"title"`
+	Missing      bool                 `json:"missing"`
+	Invalid      bool                 `json:"invalid"`
+	Redirect     bool                 `json:"redirect"`
+	ContentModel string               `json:"contentmodel"`
+	LastRevID    int64                `json:"lastrevid"`
+	Revisions    []Revision           `json:"revisions"`
+	Categories   []CategoryMembership `json:"categories"`
+}
+
+// Revision is a single revision of a page, from prop=revisions. Timestamp is zero
+// unless rvprop included timestamp, and Slots is empty unless it included content.
+type Revision struct {
+	RevID     int64                   `json:"revid"`
+	ParentID  int64                   `json:"parentid"`
+	User      string                  `json:"user"`
+	Timestamp time.Time               `json:"timestamp"`
+	Comment   string                  `json:"comment"`
+	Slots     map[string]RevisionSlot `json:"slots"`
+}
+
+// RevisionSlot is the content of one slot of a revision.
+type RevisionSlot struct {
+	ContentModel  string `json:"contentmodel"`
+	ContentFormat string `json:"contentformat"`
+	Content       string `json:"content"`
+}
+
+// CategoryMembership is a page's membership of a category, from prop=categories.
+// Timestamp, the time the page was added to the category, needs clprop=timestamp.
+type CategoryMembership struct {
+	Namespace     int       `json:"ns"`
+	Title         string    `json:"title"`
+	Timestamp     time.Time `json:"timestamp"`
+	SortKeyPrefix string    `json:"sortkeyprefix"`
+	Hidden        bool      `json:"hidden"`
+}
+
+// PagesFromQuery decodes the pages in a query response. A response with no query in it has no pages.
+func PagesFromQuery(resp *jason.Object) ([]Page, error) {
+	encoded, err := resp.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var decoded struct {
+		Query struct {
+			Pages []Page `json:"pages"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded.Query.Pages, nil
+}
+
+// LatestRevision returns the first revision fetched for the page, which is the latest
+// unless the query asked for revisions in a different order.
+func (p Page) LatestRevision() (Revision, error) {
+	if len(p.Revisions) == 0 {
+		return Revision{}, ErrNoRevisions
+	}
+	return p.Revisions[0], nil
+}
+
+// Content returns the main slot content of the latest revision of the page.
+func (p Page) Content() (string, error) {
+	rev, err := p.LatestRevision()
+	if err != nil {
+		return "", err
+	}
+	return rev.Content()
+}
+
+// Category returns the page's membership of the named category, which can be given with
+// or without the Category: prefix, as the site names it; English names are used if site is nil.
+// The second return is false if the page isn't in it, or the query didn't ask for it with prop=categories.
+func (p Page) Category(site *title.Site, name string) (CategoryMembership, bool) {
+	if site == nil {
+		site = title.DefaultSite()
+	}
+	name = normaliseCategoryName(site, name)
+	for _, category := range p.Categories {
+		if normaliseCategoryName(site, category.Title) == name {
+			return category, true
+		}
+	}
+	return CategoryMembership{}, false
+}
+
+// MainSlot returns the main slot of the revision.
+func (r Revision) MainSlot() (RevisionSlot, error) {
+	slot, ok := r.Slots[mainSlot]
+	if !ok {
+		return RevisionSlot{}, ErrNoMainSlot
+	}
+	return slot, nil
+}
+
+// Content returns the main slot content of the revision.
+func (r Revision) Content() (string, error) {
+	slot, err := r.MainSlot()
+	return slot.Content, err
+}
+
+// normaliseCategoryName strips the namespace from a category name, and normalises its
+// spacing and first letter, so that names written different ways can be compared.
+func normaliseCategoryName(site *title.Site, name string) string {
+	category, err := site.ParseIn(name, title.NamespaceCategory)
+	if err != nil {
+		return strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " ")
+	}
+	return category.Text
+}
@@ -0,0 +1,897 @@
+package mwtest
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loginToken and csrfToken are the fixed tokens handed out by the fake wiki.
+// The csrf token has the same +\ suffix as real ones, so clients that check for it are happy.
+const loginToken string = "mwtestlogintoken+\\"
+const csrfToken string = "mwtestcsrftoken+\\"
+
+// sessionCookie is the name of the cookie used to track logged-in clients.
+const sessionCookie string = "mwtest_session"
+
+// anonUser is the name recorded against edits from clients that haven't logged in.
+const anonUser string = "127.0.0.1"
+
+// maxLimit is what a module limit of "max" resolves to.
+const maxLimit int = 500
+
+// linkRegex matches the target of every wikilink in some content.
+var linkRegex = regexp.MustCompile(`\[\[\s*:?([^\]|#]+)`)
+
+// apiError is an error response from the fake API, in the same shape as a real one.
+type apiError struct {
+	Code string `json:"code"`
+	Info string `json:"info"`
+}
+
+// listModule describes a list module (which can also be used as a generator).
+// prefix is the module's parameter prefix, e.g. "ei" for embeddedin.
+type listModule struct {
+	prefix string
+	run    func(w *Wiki, p moduleParams) ([]*Page, *apiError)
+}
+
+// moduleParams gives a module access to its own prefixed parameters.
+type moduleParams struct {
+	prefix string
+	values url.Values
+}
+
+func (m moduleParams) get(name string) string {
+	return m.values.Get(m.prefix + name)
+}
+
+var listModules = map[string]listModule{
+	"embeddedin":      {prefix: "ei", run: (*Wiki).embeddedIn},
+	"categorymembers": {prefix: "cm", run: (*Wiki).categoryMembers},
+	"backlinks":       {prefix: "bl", run: (*Wiki).backlinks},
+	"linkshere":       {prefix: "lh", run: (*Wiki).linksHere},
+}
+
+// defaultRights are the user rights granted to logged-in clients.
+var defaultRights = []string{"read", "edit", "createpage", "createtalk", "writeapi", "bot", "apihighlimits", "noratelimit"}
+
+// ServeHTTP serves a single Action API request against the fake wiki.
+func (w *Wiki) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeJSON(rw, errorResponse(&apiError{"badrequest", err.Error()}))
+		return
+	}
+	p := r.Form
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if maxlag := p.Get("maxlag"); maxlag != "" {
+		if allowed, err := strconv.Atoi(maxlag); err == nil && w.Lag > allowed {
+			rw.Header().Set("X-Database-Lag", strconv.Itoa(w.Lag))
+			rw.Header().Set("Retry-After", "1")
+			writeJSON(rw, errorResponse(&apiError{"maxlag", fmt.Sprintf("Waiting for a database server: %d seconds lagged.", w.Lag)}))
+			return
+		}
+	}
+
+	user, err := w.requestUser(r)
+	if err != nil {
+		writeJSON(rw, errorResponse(err))
+		return
+	}
+	if assert := p.Get("assert"); assert != "" && user == anonUser {
+		writeJSON(rw, errorResponse(&apiError{"assert" + assert + "failed", "You are no longer logged in, so the action could not be completed."}))
+		return
+	}
+
+	var resp map[string]interface{}
+	switch p.Get("action") {
+	case "query":
+		resp = w.query(p, user)
+	case "login":
+		resp = w.login(rw, p)
+	case "logout":
+		resp = map[string]interface{}{}
+	case "edit":
+		resp = w.edit(p, user)
+	default:
+		resp = errorResponse(&apiError{"badvalue", fmt.Sprintf(`Unrecognized value for parameter "action": %s.`, p.Get("action"))})
+	}
+	writeJSON(rw, resp)
+}
+
+// oauthTokenRegex finds the access token in an OAuth 1.0a Authorization header.
+var oauthTokenRegex = regexp.MustCompile(`oauth_token="([^"]*)"`)
+
+// requestUser returns the username the request is made as, from its OAuth authorization if
+// it has one, or its session if not. w.mu must be held.
+func (w *Wiki) requestUser(r *http.Request) (string, *apiError) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return w.sessionUser(r), nil
+	}
+
+	var token string
+	if strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	} else if match := oauthTokenRegex.FindStringSubmatch(authorization); match != nil {
+		token = match[1]
+	}
+	if user, ok := w.OAuthTokens[token]; ok {
+		return user, nil
+	}
+	return "", &apiError{"mwoauth-invalid-authorization", "The authorization headers in your request are not valid: Invalid access token"}
+}
+
+// sessionUser returns the username logged in on the request, or anonUser. w.mu must be held.
+func (w *Wiki) sessionUser(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := w.sessions[cookie.Value]; ok {
+			return user
+		}
+	}
+	return anonUser
+}
+
+// login handles action=login. w.mu must be held.
+func (w *Wiki) login(rw http.ResponseWriter, p url.Values) map[string]interface{} {
+	if p.Get("lgtoken") != loginToken {
+		return map[string]interface{}{"login": map[string]interface{}{"result": "WrongToken"}}
+	}
+	name, password := p.Get("lgname"), p.Get("lgpassword")
+	if w.Username != "" && (name != w.Username || password != w.Password) {
+		return map[string]interface{}{"login": map[string]interface{}{
+			"result": "Failed",
+			"reason": "Incorrect username or password entered. Please try again.",
+		}}
+	}
+
+	// bot passwords log in as User@appid, but act as User
+	user := strings.SplitN(name, "@", 2)[0]
+	w.sessionID++
+	id := strconv.FormatInt(w.sessionID, 10)
+	w.sessions[id] = user
+	http.SetCookie(rw, &http.Cookie{Name: sessionCookie, Value: id, Path: "/"})
+
+	return map[string]interface{}{"login": map[string]interface{}{
+		"result":     "Success",
+		"lguserid":   w.sessionID,
+		"lgusername": user,
+	}}
+}
+
+// query handles action=query. w.mu must be held.
+func (w *Wiki) query(p url.Values, user string) map[string]interface{} {
+	resp := map[string]interface{}{"batchcomplete": true}
+	query := map[string]interface{}{}
+
+	if p.Get("curtimestamp") != "" {
+		resp["curtimestamp"] = w.Now().Format(timestampFormat)
+	}
+
+	for _, meta := range splitMulti(p.Get("meta")) {
+		switch meta {
+		case "tokens":
+			tokens := map[string]interface{}{}
+			for _, t := range splitMulti(p.Get("type")) {
+				switch t {
+				case "login":
+					tokens["logintoken"] = loginToken
+				default:
+					tokens[t+"token"] = csrfToken
+				}
+			}
+			if len(tokens) == 0 {
+				tokens["csrftoken"] = csrfToken
+			}
+			query["tokens"] = tokens
+		case "siteinfo":
+			for key, value := range siteinfo(splitMulti(p.Get("siprop"))) {
+				query[key] = value
+			}
+		case "userinfo":
+			if user == anonUser {
+				query["userinfo"] = map[string]interface{}{"id": 0, "name": anonUser, "anon": true}
+			} else {
+				rights := defaultRights
+				if w.Rights != nil {
+					rights = w.Rights
+				}
+				query["userinfo"] = map[string]interface{}{
+					"id":     1,
+					"name":   user,
+					"groups": []string{"*", "user", "bot"},
+					"rights": rights,
+				}
+			}
+		}
+	}
+
+	for _, list := range splitMulti(p.Get("list")) {
+		module, ok := listModules[list]
+		if !ok {
+			return errorResponse(&apiError{"badvalue", fmt.Sprintf(`Unrecognized value for parameter "list": %s.`, list)})
+		}
+		mp := moduleParams{prefix: module.prefix, values: p}
+		pages, err := module.run(w, mp)
+		if err != nil {
+			return errorResponse(err)
+		}
+		pages, cont := w.paginate(pages, mp)
+		entries := make([]map[string]interface{}, 0, len(pages))
+		for _, page := range pages {
+			entries = append(entries, map[string]interface{}{"pageid": page.ID, "ns": page.Namespace, "title": page.Title})
+		}
+		query[list] = entries
+		if cont != "" {
+			resp["continue"] = map[string]interface{}{module.prefix + "continue": cont, "continue": "-||"}
+			delete(resp, "batchcomplete")
+		}
+	}
+
+	var entries []map[string]interface{}
+	var pages []*Page
+	if generator := p.Get("generator"); generator != "" {
+		module, ok := listModules[generator]
+		if !ok {
+			return errorResponse(&apiError{"badvalue", fmt.Sprintf(`Unrecognized value for parameter "generator": %s.`, generator)})
+		}
+		mp := moduleParams{prefix: "g" + module.prefix, values: p}
+		found, err := module.run(w, mp)
+		if err != nil {
+			return errorResponse(err)
+		}
+		var cont string
+		pages, cont = w.paginate(found, mp)
+		if cont != "" {
+			resp["continue"] = map[string]interface{}{mp.prefix + "continue": cont, "continue": mp.prefix + "continue||"}
+			delete(resp, "batchcomplete")
+		}
+		// Real generators don't promise any ordering; page ID order is as good as any
+		sort.Slice(pages, func(i, j int) bool { return pages[i].ID < pages[j].ID })
+	} else {
+		var normalized []map[string]interface{}
+		for _, title := range splitMulti(p.Get("titles")) {
+			_, norm := NormaliseTitle(title)
+			if norm != title {
+				normalized = append(normalized, map[string]interface{}{"from": title, "to": norm})
+			}
+			if page := w.pageByTitle(norm); page != nil {
+				pages = append(pages, page)
+			} else if norm == "" {
+				entries = append(entries, map[string]interface{}{"title": title, "invalid": true})
+			} else {
+				ns, _ := NormaliseTitle(norm)
+				entries = append(entries, map[string]interface{}{"ns": ns, "title": norm, "missing": true})
+			}
+		}
+		for _, id := range splitMulti(p.Get("pageids")) {
+			pageID, _ := strconv.ParseInt(id, 10, 64)
+			if page, ok := w.pages[pageID]; ok {
+				pages = append(pages, page)
+			} else {
+				entries = append(entries, map[string]interface{}{"pageid": pageID, "missing": true})
+			}
+		}
+		for _, id := range splitMulti(p.Get("revids")) {
+			revID, _ := strconv.ParseInt(id, 10, 64)
+			if page := w.pageByRevision(revID); page != nil {
+				pages = append(pages, page)
+			}
+		}
+		if normalized != nil {
+			query["normalized"] = normalized
+		}
+	}
+
+	if p.Get("redirects") != "" {
+		var redirects []map[string]interface{}
+		for i, page := range pages {
+			if target := page.redirectTarget(); target != "" {
+				redirects = append(redirects, map[string]interface{}{"from": page.Title, "to": target})
+				if targetPage := w.pageByTitle(target); targetPage != nil {
+					pages[i] = targetPage
+				}
+			}
+		}
+		if redirects != nil {
+			query["redirects"] = redirects
+		}
+	}
+
+	for _, page := range pages {
+		entries = append(entries, w.renderPage(page, p))
+	}
+	if entries != nil {
+		query["pages"] = entries
+	}
+
+	if len(query) > 0 {
+		resp["query"] = query
+	}
+	return resp
+}
+
+// paginate splits the results of a module into the batch requested by the continuation
+// parameter, returning the batch and the continuation for the next one (or empty string).
+func (w *Wiki) paginate(pages []*Page, p moduleParams) ([]*Page, string) {
+	limit := w.BatchSize
+	if l := p.get("limit"); l == "max" {
+		limit = maxLimit
+	} else if n, err := strconv.Atoi(l); err == nil && n > 0 {
+		limit = n
+	}
+
+	offset, _ := strconv.Atoi(p.get("continue"))
+	if offset > len(pages) {
+		offset = len(pages)
+	}
+	end := offset + limit
+	if end >= len(pages) {
+		return pages[offset:], ""
+	}
+	return pages[offset:end], strconv.Itoa(end)
+}
+
+// renderPage renders a page for a query response, including any requested props. w.mu must be held.
+func (w *Wiki) renderPage(page *Page, p url.Values) map[string]interface{} {
+	entry := map[string]interface{}{"pageid": page.ID, "ns": page.Namespace, "title": page.Title}
+	props := splitMulti(p.Get("prop"))
+	for _, prop := range props {
+		switch prop {
+		case "revisions":
+			entry["revisions"] = w.renderRevisions(page, p)
+		case "categories":
+			if categories := renderCategories(page, p); len(categories) > 0 {
+				entry["categories"] = categories
+			}
+		case "info":
+			latest := page.latest()
+			entry["contentmodel"] = latest.ContentModel
+			entry["lastrevid"] = latest.ID
+			entry["touched"] = latest.Timestamp.Format(timestampFormat)
+			entry["length"] = len(latest.Content)
+			if page.redirectTarget() != "" {
+				entry["redirect"] = true
+			}
+		}
+	}
+	return entry
+}
+
+// renderRevisions renders the revisions of a page per the rv* parameters.
+func (w *Wiki) renderRevisions(page *Page, p url.Values) []map[string]interface{} {
+	rvprop := p.Get("rvprop")
+	if rvprop == "" {
+		rvprop = "ids|timestamp|flags|comment|user"
+	}
+	want := map[string]bool{}
+	for _, prop := range splitMulti(rvprop) {
+		want[prop] = true
+	}
+
+	var revs []Revision
+	if revids := splitMulti(p.Get("revids")); len(revids) > 0 {
+		for _, id := range revids {
+			revID, _ := strconv.ParseInt(id, 10, 64)
+			for _, rev := range page.Revisions {
+				if rev.ID == revID {
+					revs = append(revs, rev)
+				}
+			}
+		}
+	} else {
+		limit := 1
+		if l, err := strconv.Atoi(p.Get("rvlimit")); err == nil && l > 0 {
+			limit = l
+		} else if p.Get("rvlimit") == "max" {
+			limit = maxLimit
+		}
+		for i := len(page.Revisions) - 1; i >= 0 && len(revs) < limit; i-- {
+			revs = append(revs, page.Revisions[i])
+		}
+	}
+
+	rendered := make([]map[string]interface{}, 0, len(revs))
+	for _, rev := range revs {
+		r := map[string]interface{}{}
+		if want["ids"] {
+			r["revid"] = rev.ID
+			r["parentid"] = rev.ParentID
+		}
+		if want["timestamp"] {
+			r["timestamp"] = rev.Timestamp.Format(timestampFormat)
+		}
+		if want["user"] {
+			r["user"] = rev.User
+		}
+		if want["comment"] {
+			r["comment"] = rev.Comment
+		}
+		if want["size"] {
+			r["size"] = len(rev.Content)
+		}
+		if want["sha1"] {
+			r["sha1"] = fmt.Sprintf("%x", md5.Sum([]byte(rev.Content)))
+		}
+
+		slot := map[string]interface{}{}
+		if want["contentmodel"] || want["content"] {
+			slot["contentmodel"] = rev.ContentModel
+			slot["contentformat"] = contentFormat(rev.ContentModel)
+		}
+		if want["content"] {
+			slot["content"] = rev.Content
+		}
+		if len(slot) > 0 {
+			if p.Get("rvslots") != "" {
+				r["slots"] = map[string]interface{}{"main": slot}
+			} else {
+				for k, v := range slot {
+					r[k] = v
+				}
+			}
+		}
+		rendered = append(rendered, r)
+	}
+	return rendered
+}
+
+// renderCategories renders the categories of a page per the cl* parameters.
+func renderCategories(page *Page, p url.Values) []map[string]interface{} {
+	var filter map[string]bool
+	if cl := p.Get("clcategories"); cl != "" {
+		filter = map[string]bool{}
+		for _, category := range splitMulti(cl) {
+			_, title := NormaliseTitle(category)
+			filter[title] = true
+		}
+	}
+	withTimestamp := strings.Contains(p.Get("clprop"), "timestamp")
+
+	categories := page.categories()
+	titles := make([]string, 0, len(categories))
+	for title := range categories {
+		if filter == nil || filter[title] {
+			titles = append(titles, title)
+		}
+	}
+	sort.Strings(titles)
+
+	rendered := make([]map[string]interface{}, 0, len(titles))
+	for _, title := range titles {
+		c := map[string]interface{}{"ns": namespaces["Category"], "title": title}
+		if withTimestamp {
+			c["timestamp"] = categories[title].Format(timestampFormat)
+		}
+		rendered = append(rendered, c)
+	}
+	return rendered
+}
+
+// embeddedIn implements list=embeddedin, including transclusions through template redirects.
+func (w *Wiki) embeddedIn(p moduleParams) ([]*Page, *apiError) {
+	_, target := NormaliseTitle(p.get("title"))
+	if target == "" {
+		return nil, &apiError{"missingparam", fmt.Sprintf(`The "%stitle" parameter must be set.`, p.prefix)}
+	}
+
+	// anything redirecting to the target counts as the target
+	names := map[string]bool{target: true}
+	for _, page := range w.pages {
+		if page.redirectTarget() == target {
+			names[page.Title] = true
+		}
+	}
+
+	var found []*Page
+	for _, page := range w.sortedPages() {
+		if !matchesNamespace(page, p.get("namespace")) || !matchesRedirFilter(page, p.get("filterredir")) {
+			continue
+		}
+		for transcluded := range page.transclusions() {
+			if names[transcluded] {
+				found = append(found, page)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+// categoryMembers implements list=categorymembers, including timestamp sorting and ranges.
+func (w *Wiki) categoryMembers(p moduleParams) ([]*Page, *apiError) {
+	_, category := NormaliseTitle(p.get("title"))
+	if category == "" {
+		return nil, &apiError{"missingparam", fmt.Sprintf(`The "%stitle" parameter must be set.`, p.prefix)}
+	}
+
+	type member struct {
+		page  *Page
+		added time.Time
+	}
+	var members []member
+	for _, page := range w.sortedPages() {
+		if !matchesNamespace(page, p.get("namespace")) {
+			continue
+		}
+		if added, ok := page.categories()[category]; ok {
+			members = append(members, member{page, added})
+		}
+	}
+
+	descending := false
+	switch p.get("dir") {
+	case "desc", "descending", "older":
+		descending = true
+	}
+
+	if p.get("sort") == "timestamp" {
+		sort.SliceStable(members, func(i, j int) bool {
+			if descending {
+				return members[i].added.After(members[j].added)
+			}
+			return members[i].added.Before(members[j].added)
+		})
+
+		start, _ := time.Parse(time.RFC3339, p.get("start"))
+		end, _ := time.Parse(time.RFC3339, p.get("end"))
+		filtered := members[:0]
+		for _, m := range members {
+			if descending {
+				if (!start.IsZero() && m.added.After(start)) || (!end.IsZero() && m.added.Before(end)) {
+					continue
+				}
+			} else {
+				if (!start.IsZero() && m.added.Before(start)) || (!end.IsZero() && m.added.After(end)) {
+					continue
+				}
+			}
+			filtered = append(filtered, m)
+		}
+		members = filtered
+	} else {
+		sort.SliceStable(members, func(i, j int) bool {
+			if descending {
+				return members[i].page.Title > members[j].page.Title
+			}
+			return members[i].page.Title < members[j].page.Title
+		})
+	}
+
+	found := make([]*Page, 0, len(members))
+	for _, m := range members {
+		found = append(found, m.page)
+	}
+	return found, nil
+}
+
+// backlinks implements list=backlinks.
+func (w *Wiki) backlinks(p moduleParams) ([]*Page, *apiError) {
+	_, target := NormaliseTitle(p.get("title"))
+	if target == "" {
+		return nil, &apiError{"missingparam", fmt.Sprintf(`The "%stitle" parameter must be set.`, p.prefix)}
+	}
+	return w.pagesLinkingTo(target, p.get("namespace"), p.get("filterredir")), nil
+}
+
+// linksHere implements prop=linkshere, used as a generator over the titles parameter.
+func (w *Wiki) linksHere(p moduleParams) ([]*Page, *apiError) {
+	filter := ""
+	switch p.get("show") {
+	case "redirect":
+		filter = "redirects"
+	case "!redirect":
+		filter = "nonredirects"
+	}
+
+	var found []*Page
+	seen := map[int64]bool{}
+	for _, title := range splitMulti(p.values.Get("titles")) {
+		_, target := NormaliseTitle(title)
+		for _, page := range w.pagesLinkingTo(target, p.get("namespace"), filter) {
+			if !seen[page.ID] {
+				seen[page.ID] = true
+				found = append(found, page)
+			}
+		}
+	}
+	return found, nil
+}
+
+// pagesLinkingTo finds every page linking to (or redirecting to) the target. w.mu must be held.
+func (w *Wiki) pagesLinkingTo(target, namespace, filterRedir string) []*Page {
+	var found []*Page
+	for _, page := range w.sortedPages() {
+		if !matchesNamespace(page, namespace) || !matchesRedirFilter(page, filterRedir) {
+			continue
+		}
+		for _, match := range linkRegex.FindAllStringSubmatch(page.latest().Content, -1) {
+			if _, linked := NormaliseTitle(match[1]); linked == target {
+				found = append(found, page)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// pageByRevision finds the page holding a revision, or nil. w.mu must be held.
+func (w *Wiki) pageByRevision(revID int64) *Page {
+	for _, page := range w.pages {
+		for _, rev := range page.Revisions {
+			if rev.ID == revID {
+				return page
+			}
+		}
+	}
+	return nil
+}
+
+// edit handles action=edit. w.mu must be held.
+func (w *Wiki) edit(p url.Values, user string) map[string]interface{} {
+	if p.Get("token") == "" {
+		return errorResponse(&apiError{"missingparam", `The "token" parameter must be set.`})
+	}
+	if p.Get("token") != csrfToken {
+		return errorResponse(&apiError{"badtoken", "Invalid CSRF token."})
+	}
+	if w.ReadOnly {
+		return errorResponse(&apiError{"readonly", "The wiki is currently in read-only mode."})
+	}
+
+	var page *Page
+	var title string
+	if id := p.Get("pageid"); id != "" {
+		pageID, _ := strconv.ParseInt(id, 10, 64)
+		var ok bool
+		if page, ok = w.pages[pageID]; !ok {
+			return errorResponse(&apiError{"nosuchpageid", fmt.Sprintf("There is no page with ID %s.", id)})
+		}
+		title = page.Title
+	} else {
+		_, title = NormaliseTitle(p.Get("title"))
+		if title == "" {
+			return errorResponse(&apiError{"missingparam", `One of the parameters "title" and "pageid" is required.`})
+		}
+		page = w.pageByTitle(title)
+	}
+
+	if page != nil && p.Get("redirect") != "" {
+		if target := page.redirectTarget(); target != "" {
+			title = target
+			page = w.pageByTitle(target)
+		}
+	}
+
+	if page == nil && p.Get("nocreate") != "" {
+		return errorResponse(&apiError{"missingtitle", "The page you specified doesn't exist."})
+	}
+	if page != nil && p.Get("createonly") != "" {
+		return errorResponse(&apiError{"articleexists", "The article you tried to create has been created already."})
+	}
+
+	var oldContent, contentModel string
+	var oldRevID int64
+	if page != nil {
+		latest := page.latest()
+		oldContent, contentModel, oldRevID = latest.Content, latest.ContentModel, latest.ID
+
+		if base := p.Get("basetimestamp"); base != "" && base != latest.Timestamp.Format(timestampFormat) {
+			return errorResponse(&apiError{"editconflict", "Edit conflict."})
+		}
+	} else if p.Get("basetimestamp") != "" && p.Get("section") != "new" {
+		return errorResponse(&apiError{"pagedeleted", "The page has been deleted since you fetched its timestamp."})
+	}
+	if model := p.Get("contentmodel"); model != "" {
+		contentModel = model
+	}
+
+	text := p.Get("text")
+	if sum := p.Get("md5"); sum != "" && sum != fmt.Sprintf("%x", md5.Sum([]byte(text))) {
+		return errorResponse(&apiError{"badmd5", "The supplied MD5 hash was incorrect."})
+	}
+
+	summary := p.Get("summary")
+	var newContent string
+	switch {
+	case p.Get("section") == "new":
+		heading := p.Get("sectiontitle")
+		if summary == "" {
+			summary = "/* " + heading + " */ new section"
+		}
+		section := text
+		if heading != "" {
+			section = "== " + heading + " ==\n\n" + text
+		}
+		if oldContent == "" {
+			newContent = section
+		} else {
+			newContent = strings.TrimRight(oldContent, "\n") + "\n\n" + section
+		}
+	case p.Has("text"):
+		newContent = text
+	default:
+		newContent = p.Get("prependtext") + oldContent + p.Get("appendtext")
+	}
+
+	if contentModel == "json" || (contentModel == "" && defaultContentModel(title) == "json") {
+		if !json.Valid([]byte(newContent)) {
+			return errorResponse(&apiError{"invalid-content-data", "Invalid content data"})
+		}
+	}
+
+	if page != nil && newContent == oldContent {
+		return map[string]interface{}{"edit": map[string]interface{}{
+			"result":       "Success",
+			"pageid":       page.ID,
+			"title":        page.Title,
+			"contentmodel": contentModel,
+			"nochange":     true,
+		}}
+	}
+
+	now := w.Now()
+	saved := w.savePage(title, newContent, contentModel, user, summary, now)
+	latest := saved.latest()
+	record := EditRecord{
+		PageID:    saved.ID,
+		Title:     saved.Title,
+		User:      user,
+		Summary:   summary,
+		OldRevID:  oldRevID,
+		NewRevID:  latest.ID,
+		Content:   newContent,
+		Timestamp: now,
+	}
+	w.edits = append(w.edits, record)
+	w.recordChange(saved, p.Get("bot") != "", p.Get("minor") != "")
+	if w.OnEdit != nil {
+		w.OnEdit(record)
+	}
+
+	result := map[string]interface{}{
+		"result":       "Success",
+		"pageid":       saved.ID,
+		"title":        saved.Title,
+		"contentmodel": latest.ContentModel,
+		"oldrevid":     oldRevID,
+		"newrevid":     latest.ID,
+		"newtimestamp": now.Format(timestampFormat),
+	}
+	if page == nil {
+		result["new"] = true
+	}
+	return map[string]interface{}{"edit": result}
+}
+
+// matchesNamespace checks a page against a pipe-separated namespace filter, which may be empty.
+func matchesNamespace(page *Page, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, ns := range splitMulti(filter) {
+		if n, err := strconv.Atoi(ns); err == nil && n == page.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRedirFilter checks a page against a filterredir value (all, redirects or nonredirects).
+func matchesRedirFilter(page *Page, filter string) bool {
+	switch filter {
+	case "redirects":
+		return page.redirectTarget() != ""
+	case "nonredirects":
+		return page.redirectTarget() == ""
+	}
+	return true
+}
+
+// contentFormat gives the default serialisation format for a content model.
+func contentFormat(model string) string {
+	switch model {
+	case "json", "MassMessageListContent":
+		return "application/json"
+	case "javascript":
+		return "text/javascript"
+	case "css":
+		return "text/css"
+	}
+	return "text/x-wiki"
+}
+
+// siteinfo returns the parts of the siteinfo of the fake wiki asked for in siprop,
+// keyed by the name they're given in the query.
+func siteinfo(props []string) map[string]interface{} {
+	info := map[string]interface{}{}
+	for _, prop := range props {
+		switch prop {
+		case "general":
+			info["general"] = map[string]interface{}{
+				"sitename": "mwtest",
+				"lang":     "en",
+				"case":     "first-letter",
+			}
+		case "namespaces":
+			namespaceInfo := map[string]interface{}{}
+			for name, id := range namespaces {
+				canonical := name
+				if c, ok := canonicalNamespaceNames[name]; ok {
+					canonical = c
+				}
+				ns := map[string]interface{}{
+					"id":       id,
+					"case":     "first-letter",
+					"name":     name,
+					"subpages": id != 0,
+					"content":  id == 0,
+				}
+				if id != 0 {
+					ns["canonical"] = canonical
+				}
+				namespaceInfo[strconv.Itoa(id)] = ns
+			}
+			info["namespaces"] = namespaceInfo
+		case "namespacealiases":
+			aliases := []map[string]interface{}{}
+			for alias, name := range namespaceAliases {
+				aliases = append(aliases, map[string]interface{}{"id": namespaces[name], "alias": upperFirst(alias)})
+			}
+			sort.Slice(aliases, func(i, j int) bool { return aliases[i]["alias"].(string) < aliases[j]["alias"].(string) })
+			info["namespacealiases"] = aliases
+		}
+	}
+	return info
+}
+
+// splitMulti splits a multi-value API parameter on pipes, ignoring empty values.
+func splitMulti(v string) []string {
+	if v == "" {
+		return nil
+	}
+	var values []string
+	for _, s := range strings.Split(v, "|") {
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+func errorResponse(err *apiError) map[string]interface{} {
+	return map[string]interface{}{"error": err}
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,77 @@
+package mwtest
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+// APIPath is the path the fake wiki serves the Action API on, matching Wikimedia wikis.
+const APIPath string = "/w/api.php"
+
+// Server is a fake wiki being served over HTTP on a local port.
+type Server struct {
+	*httptest.Server
+	Wiki *Wiki
+}
+
+// NewServer starts serving the given wiki on a random local port.
+// If wiki is nil, a new empty wiki is created. Remember to Close the server when done.
+func NewServer(wiki *Wiki) *Server {
+	if wiki == nil {
+		wiki = NewWiki()
+	}
+	return &Server{Server: httptest.NewServer(Handler(wiki)), Wiki: wiki}
+}
+
+// Handler returns an http.Handler serving the wiki's Action API at APIPath,
+// and its recentchange event stream at StreamPath.
+func Handler(wiki *Wiki) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(APIPath, wiki)
+	mux.HandleFunc(StreamPath, wiki.serveRecentChanges)
+	return mux
+}
+
+// Endpoint returns the Action API URL of the server, suitable for an apiendpoint config value.
+func (s *Server) Endpoint() string {
+	return s.URL + APIPath
+}
+
+// StreamURL returns the URL of the server's recentchange event stream,
+// suitable for a recentchangesurl config value.
+func (s *Server) StreamURL() string {
+	return s.URL + StreamPath
+}
+
+// NewClient returns an mwclient pointed at the server, logged in with the given credentials.
+// This can be handed straight to the UseClient method of a ybtools.Bot.
+func (s *Server) NewClient(username, password string) (*mwclient.Client, error) {
+	w, err := mwclient.New(s.Endpoint(), "Yapperbot-mwtest")
+	if err != nil {
+		return nil, err
+	}
+	if err = w.Login(username, password); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,183 @@
+package mwtest
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StreamPath is the path the fake wiki serves its recentchange event stream on,
+// matching Wikimedia EventStreams.
+const StreamPath string = "/v2/stream/recentchange"
+
+// streamTopic is the topic given in the IDs of events on the stream, which Wikimedia uses
+// to say where in its Kafka topics an event came from.
+const streamTopic string = "mwtest.mediawiki.recentchange"
+
+// streamHeartbeat is how often a comment is sent down an idle stream, as EventStreams does.
+const streamHeartbeat time.Duration = 15 * time.Second
+
+// recentChange is a change on the fake wiki, as it's sent on the event stream. The fields
+// that depend on the address the wiki is being served on are filled in as it's sent.
+type recentChange struct {
+	ID         int64            `json:"id"`
+	Type       string           `json:"type"`
+	Namespace  int              `json:"namespace"`
+	Title      string           `json:"title"`
+	Comment    string           `json:"comment"`
+	Timestamp  int64            `json:"timestamp"`
+	User       string           `json:"user"`
+	Bot        bool             `json:"bot"`
+	Minor      bool             `json:"minor"`
+	Length     oldAndNew        `json:"length"`
+	Revision   oldAndNew        `json:"revision"`
+	ServerURL  string           `json:"server_url"`
+	ServerName string           `json:"server_name"`
+	Wiki       string           `json:"wiki"`
+	Meta       recentChangeMeta `json:"meta"`
+}
+
+type oldAndNew struct {
+	Old int64 `json:"old,omitempty"`
+	New int64 `json:"new"`
+}
+
+type recentChangeMeta struct {
+	ID     string `json:"id"`
+	DT     string `json:"dt"`
+	Domain string `json:"domain"`
+	Stream string `json:"stream"`
+	URI    string `json:"uri"`
+}
+
+// streamPosition is a single entry of the JSON array EventStreams uses for event IDs.
+type streamPosition struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int    `json:"offset"`
+}
+
+// recordChange adds a change for the latest revision of a page to the event stream,
+// waking up any streams waiting for one. w.mu must be held.
+func (w *Wiki) recordChange(page *Page, bot, minor bool) {
+	latest := page.latest()
+	change := recentChange{
+		ID:        int64(len(w.changes) + 1),
+		Type:      "edit",
+		Namespace: page.Namespace,
+		Title:     page.Title,
+		Comment:   latest.Comment,
+		Timestamp: latest.Timestamp.Unix(),
+		User:      latest.User,
+		Bot:       bot,
+		Minor:     minor,
+		Length:    oldAndNew{New: int64(len(latest.Content))},
+		Revision:  oldAndNew{Old: latest.ParentID, New: latest.ID},
+		Wiki:      w.Name,
+		Meta: recentChangeMeta{
+			ID:     fmt.Sprintf("mwtest-%d", len(w.changes)+1),
+			DT:     latest.Timestamp.UTC().Format(time.RFC3339),
+			Stream: "mediawiki.recentchange",
+		},
+	}
+	if len(page.Revisions) > 1 {
+		change.Length.Old = int64(len(page.Revisions[len(page.Revisions)-2].Content))
+	} else {
+		change.Type = "new"
+	}
+	w.changes = append(w.changes, change)
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// serveRecentChanges serves every change made to the wiki as a stream of Server-Sent Events,
+// like Wikimedia's recentchange stream. As there, a client without a Last-Event-ID only gets
+// changes made after it connected, and one with the ID of an event gets every change after it.
+func (w *Wiki) serveRecentChanges(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.mu.Lock()
+	next := len(w.changes)
+	batch := w.StreamBatch
+	w.mu.Unlock()
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		var positions []streamPosition
+		if err := json.Unmarshal([]byte(lastID), &positions); err != nil || len(positions) != 1 || positions[0].Topic != streamTopic {
+			http.Error(rw, "Last-Event-ID "+lastID+" isn't an event ID from this stream", http.StatusBadRequest)
+			return
+		}
+		if positions[0].Offset >= 0 {
+			next = positions[0].Offset + 1
+		}
+	}
+
+	serverURL := "http://" + r.Host
+	rw.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprint(rw, ":ok\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	sent := 0
+	for {
+		w.mu.Lock()
+		var pending []recentChange
+		if next < len(w.changes) {
+			pending = append(pending, w.changes[next:]...)
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		for _, change := range pending {
+			change.ServerURL = serverURL
+			change.ServerName = r.Host
+			change.Meta.Domain = r.Host
+			change.Meta.URI = serverURL + "/wiki/" + strings.ReplaceAll(change.Title, " ", "_")
+			data, _ := json.Marshal(change)
+			id, _ := json.Marshal([]streamPosition{{Topic: streamTopic, Offset: next}})
+			fmt.Fprintf(rw, "event: message\nid: %s\ndata: %s\n\n", id, data)
+			flusher.Flush()
+			next++
+			sent++
+			if batch > 0 && sent >= batch {
+				// drop the connection, so clients have to reconnect and carry on from here
+				return
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-heartbeat.C:
+			fmt.Fprint(rw, ":\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,489 @@
+// Package mwtest provides an in-process fake of the parts of the MediaWiki
+// Action API that the Yapperbot tasks use, so that they can be run end to end
+// without touching a real wiki.
+package mwtest
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// timestampFormat is the ISO 8601 format the Action API uses for all timestamps.
+const timestampFormat string = "2006-01-02T15:04:05Z"
+
+// defaultBatchSize is the number of results returned per generator or list
+// batch before a continuation is issued, unless a smaller limit is requested.
+const defaultBatchSize int = 10
+
+// namespaces maps the canonical namespace names the fake wiki knows about to their IDs.
+var namespaces = map[string]int{
+	"":               0,
+	"Talk":           1,
+	"User":           2,
+	"User talk":      3,
+	"Wikipedia":      4,
+	"Wikipedia talk": 5,
+	"File":           6,
+	"File talk":      7,
+	"MediaWiki":      8,
+	"MediaWiki talk": 9,
+	"Template":       10,
+	"Template talk":  11,
+	"Help":           12,
+	"Help talk":      13,
+	"Category":       14,
+	"Category talk":  15,
+}
+
+// canonicalNamespaceNames maps namespace names the fake wiki uses onto the canonical names
+// every MediaWiki wiki recognises, where they're different.
+var canonicalNamespaceNames = map[string]string{
+	"Wikipedia":      "Project",
+	"Wikipedia talk": "Project talk",
+}
+
+// namespaceAliases maps lowercased aliases onto canonical namespace names.
+var namespaceAliases = map[string]string{
+	"wp":      "Wikipedia",
+	"project": "Wikipedia",
+	"image":   "File",
+	"t":       "Template",
+	"u":       "User",
+}
+
+// redirectRegex matches a redirect at the start of a page, capturing the target.
+var redirectRegex = regexp.MustCompile(`(?i)^\s*#REDIRECT\s*\[\[([^\]|#]+)`)
+
+// transclusionRegex matches the name of every template-like transclusion in some content.
+var transclusionRegex = regexp.MustCompile(`{{\s*([^{}|\n#]+?)\s*(?:\||}})`)
+
+// categoryLinkRegex matches every category link in some content.
+var categoryLinkRegex = regexp.MustCompile(`(?i)\[\[\s*category\s*:\s*([^\]|]+?)\s*(?:\|[^\]]*)?]]`)
+
+// Revision is a single stored revision of a page on the fake wiki.
+type Revision struct {
+	ID           int64
+	ParentID     int64
+	Timestamp    time.Time
+	User         string
+	Comment      string
+	Content      string
+	ContentModel string
+}
+
+// Page is a page on the fake wiki, along with its full revision history.
+type Page struct {
+	ID        int64
+	Title     string
+	Namespace int
+	Revisions []Revision
+	// Categories holds category memberships that aren't expressed in the content
+	// (for instance those added by templates), mapped to the time they were added.
+	Categories map[string]time.Time
+}
+
+// PageSpec describes a page to be seeded into a Wiki, either from Go or from a fixture file.
+type PageSpec struct {
+	Title        string               `json:"title"`
+	Content      string               `json:"content"`
+	ContentModel string               `json:"contentmodel,omitempty"`
+	Timestamp    time.Time            `json:"timestamp,omitempty"`
+	User         string               `json:"user,omitempty"`
+	Categories   map[string]time.Time `json:"categories,omitempty"`
+}
+
+// EditRecord is a log entry for an edit the fake wiki accepted.
+type EditRecord struct {
+	PageID    int64
+	Title     string
+	User      string
+	Summary   string
+	OldRevID  int64
+	NewRevID  int64
+	Content   string
+	Timestamp time.Time
+}
+
+// Wiki is the state of a fake wiki. It implements http.Handler, serving the
+// Action API at whatever path it's mounted on. It's safe for concurrent use.
+type Wiki struct {
+	mu sync.Mutex
+
+	pages     map[int64]*Page
+	pageIDs   map[string]int64
+	nextPage  int64
+	nextRev   int64
+	edits     []EditRecord
+	sessions  map[string]string
+	sessionID int64
+	changes   []recentChange
+	// changed is closed and replaced whenever a change is recorded, to wake up event streams
+	changed chan struct{}
+
+	// Name is the database name of the wiki, given as the wiki of every event on its
+	// recentchange stream.
+	Name string
+
+	// Username and Password, if set, are the only credentials accepted by action=login.
+	// If they're left empty, any login succeeds.
+	Username string
+	Password string
+
+	// OAuthTokens maps OAuth access tokens to the users they act as. Requests carrying
+	// one, either as an OAuth 2 bearer token or as the oauth_token of an OAuth 1.0a
+	// header, are made as that user. Signatures aren't checked.
+	OAuthTokens map[string]string
+
+	// Rights, if set, replaces the user rights granted to logged-in clients,
+	// for instance to act like a consumer with missing grants.
+	Rights []string
+
+	// BatchSize is the maximum number of results returned per generator or list batch.
+	BatchSize int
+
+	// Lag is the replication lag, in seconds, the wiki reports against maxlag requests.
+	Lag int
+
+	// ReadOnly makes every edit fail with the readonly error code.
+	ReadOnly bool
+
+	// Now returns the current time on the wiki; it can be replaced for deterministic runs.
+	Now func() time.Time
+
+	// OnEdit, if set, is called with every edit the wiki accepts, while the wiki is locked.
+	OnEdit func(EditRecord)
+
+	// StreamBatch, if set, is how many events are sent on the recentchange stream before
+	// the connection is dropped, to test that clients reconnect and carry on where they were.
+	StreamBatch int
+}
+
+// NewWiki returns an empty fake wiki.
+func NewWiki() *Wiki {
+	return &Wiki{
+		pages:       map[int64]*Page{},
+		pageIDs:     map[string]int64{},
+		nextPage:    1,
+		nextRev:     1,
+		sessions:    map[string]string{},
+		changed:     make(chan struct{}),
+		Name:        "mwtestwiki",
+		OAuthTokens: map[string]string{},
+		BatchSize:   defaultBatchSize,
+		Now:         func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// AddPage seeds a page into the wiki, creating a new revision if the page already exists.
+// It returns the page ID of the page.
+func (w *Wiki) AddPage(spec PageSpec) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ts := spec.Timestamp
+	if ts.IsZero() {
+		ts = w.Now()
+	}
+	user := spec.User
+	if user == "" {
+		user = "Example"
+	}
+
+	page := w.savePage(spec.Title, spec.Content, spec.ContentModel, user, "Seeded by mwtest", ts)
+	w.recordChange(page, false, false)
+	for category, added := range spec.Categories {
+		_, title := NormaliseTitle(category)
+		if !strings.HasPrefix(title, "Category:") {
+			title = "Category:" + title
+		}
+		if added.IsZero() {
+			added = ts
+		}
+		page.Categories[title] = added
+	}
+	return page.ID
+}
+
+// LoadFixture reads a JSON array of PageSpecs from r, and seeds each of them into the wiki.
+func (w *Wiki) LoadFixture(r io.Reader) error {
+	var specs []PageSpec
+	if err := json.NewDecoder(r).Decode(&specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		w.AddPage(spec)
+	}
+	return nil
+}
+
+// LoadFixtureFile is a convenience wrapper around LoadFixture for a file on disk.
+func (w *Wiki) LoadFixtureFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.LoadFixture(f)
+}
+
+// Dump returns the latest state of every page on the wiki as PageSpecs,
+// ordered by page ID, in a form suitable for writing back out as a fixture.
+func (w *Wiki) Dump() []PageSpec {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	specs := make([]PageSpec, 0, len(w.pages))
+	for _, page := range w.sortedPages() {
+		latest := page.latest()
+		spec := PageSpec{
+			Title:        page.Title,
+			Content:      latest.Content,
+			ContentModel: latest.ContentModel,
+			Timestamp:    latest.Timestamp,
+			User:         latest.User,
+		}
+		if len(page.Categories) > 0 {
+			spec.Categories = map[string]time.Time{}
+			for category, added := range page.Categories {
+				spec.Categories[category] = added
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// Page returns a copy of the page with the given title, and whether it exists.
+func (w *Wiki) Page(title string) (Page, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	page := w.pageByTitle(title)
+	if page == nil {
+		return Page{}, false
+	}
+	cp := *page
+	cp.Revisions = append([]Revision(nil), page.Revisions...)
+	cp.Categories = map[string]time.Time{}
+	for category, added := range page.Categories {
+		cp.Categories[category] = added
+	}
+	return cp, true
+}
+
+// Content returns the latest content of the page with the given title, and whether it exists.
+func (w *Wiki) Content(title string) (string, bool) {
+	page, ok := w.Page(title)
+	if !ok {
+		return "", false
+	}
+	return page.latest().Content, true
+}
+
+// Edits returns every edit made through the API so far, in the order they were made.
+func (w *Wiki) Edits() []EditRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]EditRecord(nil), w.edits...)
+}
+
+// NormaliseTitle turns a title into the canonical form the wiki stores it in,
+// returning the namespace ID alongside it.
+func NormaliseTitle(title string) (int, string) {
+	title = strings.Join(strings.Fields(strings.ReplaceAll(title, "_", " ")), " ")
+	ns := 0
+	if i := strings.Index(title, ":"); i > 0 {
+		prefix := strings.TrimSpace(title[:i])
+		canonical, known := canonicalNamespace(prefix)
+		if known {
+			ns = namespaces[canonical]
+			rest := upperFirst(strings.TrimSpace(title[i+1:]))
+			if canonical == "" {
+				return 0, rest
+			}
+			return ns, canonical + ":" + rest
+		}
+	}
+	return ns, upperFirst(title)
+}
+
+// canonicalNamespace returns the canonical name for a namespace prefix, and whether it's known.
+func canonicalNamespace(prefix string) (string, bool) {
+	lower := strings.ToLower(prefix)
+	if alias, ok := namespaceAliases[lower]; ok {
+		return alias, true
+	}
+	for name := range namespaces {
+		if name != "" && strings.ToLower(name) == lower {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// upperFirst uppercases the first rune of s, as MediaWiki does with first-letter case sensitivity.
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// savePage stores a new revision of a page, creating the page if needed. w.mu must be held.
+func (w *Wiki) savePage(title, content, contentModel, user, comment string, ts time.Time) *Page {
+	ns, title := NormaliseTitle(title)
+	page := w.pageByTitle(title)
+	if page == nil {
+		page = &Page{ID: w.nextPage, Title: title, Namespace: ns, Categories: map[string]time.Time{}}
+		w.nextPage++
+		w.pages[page.ID] = page
+		w.pageIDs[title] = page.ID
+	}
+
+	var parent int64
+	if len(page.Revisions) > 0 {
+		latest := page.latest()
+		parent = latest.ID
+		if contentModel == "" {
+			contentModel = latest.ContentModel
+		}
+	}
+	if contentModel == "" {
+		contentModel = defaultContentModel(title)
+	}
+
+	page.Revisions = append(page.Revisions, Revision{
+		ID:           w.nextRev,
+		ParentID:     parent,
+		Timestamp:    ts,
+		User:         user,
+		Comment:      comment,
+		Content:      content,
+		ContentModel: contentModel,
+	})
+	w.nextRev++
+	return page
+}
+
+// defaultContentModel picks the content model MediaWiki would give a new page with this title.
+func defaultContentModel(title string) string {
+	switch {
+	case strings.HasSuffix(title, ".json"):
+		return "json"
+	case strings.HasSuffix(title, ".js"):
+		return "javascript"
+	case strings.HasSuffix(title, ".css"):
+		return "css"
+	}
+	return "wikitext"
+}
+
+// pageByTitle finds a page by title, or returns nil. w.mu must be held.
+func (w *Wiki) pageByTitle(title string) *Page {
+	_, title = NormaliseTitle(title)
+	if id, ok := w.pageIDs[title]; ok {
+		return w.pages[id]
+	}
+	return nil
+}
+
+// sortedPages returns every page on the wiki in page ID order. w.mu must be held.
+func (w *Wiki) sortedPages() []*Page {
+	pages := make([]*Page, 0, len(w.pages))
+	for _, page := range w.pages {
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].ID < pages[j].ID })
+	return pages
+}
+
+// latest returns the latest revision of the page.
+func (p *Page) latest() Revision {
+	return p.Revisions[len(p.Revisions)-1]
+}
+
+// redirectTarget returns the normalised title the page redirects to, or empty string.
+func (p *Page) redirectTarget() string {
+	match := redirectRegex.FindStringSubmatch(p.latest().Content)
+	if match == nil {
+		return ""
+	}
+	_, title := NormaliseTitle(match[1])
+	return title
+}
+
+// transclusions returns the set of page titles directly transcluded by the page.
+func (p *Page) transclusions() map[string]bool {
+	found := map[string]bool{}
+	for _, match := range transclusionRegex.FindAllStringSubmatch(p.latest().Content, -1) {
+		name := match[1]
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "subst:") || strings.HasPrefix(lower, "safesubst:") {
+			continue
+		}
+		if strings.HasPrefix(name, ":") {
+			_, title := NormaliseTitle(name[1:])
+			found[title] = true
+			continue
+		}
+		ns, title := NormaliseTitle(name)
+		if ns == 0 {
+			title = "Template:" + title
+		}
+		found[title] = true
+	}
+	return found
+}
+
+// categories returns every category the page is in, mapped to the time it was added.
+// Categories linked in the content are dated from the earliest revision after which
+// every revision has contained the link.
+func (p *Page) categories() map[string]time.Time {
+	found := map[string]time.Time{}
+	for category, added := range p.Categories {
+		found[category] = added
+	}
+	for _, match := range categoryLinkRegex.FindAllStringSubmatch(p.latest().Content, -1) {
+		_, name := NormaliseTitle(match[1])
+		title := "Category:" + name
+		if _, ok := found[title]; ok {
+			continue
+		}
+		added := p.latest().Timestamp
+		for i := len(p.Revisions) - 1; i >= 0; i-- {
+			if !strings.Contains(p.Revisions[i].Content, match[0]) {
+				break
+			}
+			added = p.Revisions[i].Timestamp
+		}
+		found[title] = added
+	}
+	return found
+}
@@ -0,0 +1,52 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+)
+
+// mainNamespaceNames are the names the main namespace can be given by in the config,
+// as it has no name of its own.
+var mainNamespaceNames = map[string]bool{"": true, "main": true, "(main)": true, "article": true}
+
+// namespaceFromName takes either a namespace's number or its name, and returns its number.
+// The second return is false if the namespace isn't recognised.
+func (b *Bot) namespaceFromName(name string) (int, bool) {
+	if number, err := strconv.Atoi(strings.TrimSpace(name)); err == nil {
+		return number, true
+	}
+	if mainNamespaceNames[strings.ToLower(strings.TrimSpace(name))] {
+		return title.NamespaceMain, true
+	}
+	return b.currentSite().NamespaceID(name)
+}
+
+// namespaceOfTitle returns the number of the namespace that the page title is in,
+// treating anything with an unrecognised prefix as being in mainspace, as MediaWiki does.
+func (b *Bot) namespaceOfTitle(raw string) int {
+	parsed, err := b.currentSite().Parse(raw)
+	if err != nil {
+		return title.NamespaceMain
+	}
+	return parsed.Namespace
+}
@@ -19,43 +19,215 @@ package ybtools
 //
 
 import (
-	"fmt"
-	"regexp"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/wikitext"
 )
 
-var botBanRegex *regexp.Regexp
-var botWhitelistRegex *regexp.Regexp
-var botAllowThisBotRegex *regexp.Regexp
+const botsTemplate string = "Bots"
+const nobotsTemplate string = "Nobots"
+
+// exclusionTemplatesTTL is how long the redirects to the templates are kept for once they've been
+// looked up, so that a process that runs the tasks again and again, like the daemon, doesn't
+// look them up for every run.
+const exclusionTemplatesTTL time.Duration = 24 * time.Hour
 
-const botBanRegexTemplate string = `{{nobots}}|{{bots\|deny=(?:[^,|}]*,)*%[1]s`
-const botWhitelistRegexTemplate string = `{{bots\|allow=`
-const botAllowRegexTemplate string = `{{bots\|allow=(?:[^}|]*,)*%[1]s[},|]`
+// exclusionTemplates maps the API endpoint of each wiki to the normalised names of Template:Bots,
+// Template:Nobots, and all their redirects on it, mapped to which of the two they are.
+var exclusionTemplates = map[string]cachedExclusionTemplates{}
+var exclusionTemplatesMutex sync.Mutex
 
-func init() {
-	botWhitelistRegex = regexp.MustCompile(botWhitelistRegexTemplate)
+type cachedExclusionTemplates struct {
+	names   map[string]string
+	fetched time.Time
+}
+
+// exclusionTemplate is a single {{bots}} or {{nobots}} found on a page.
+type exclusionTemplate struct {
+	// kind is botsTemplate or nobotsTemplate, whatever redirect was actually used
+	kind   string
+	params map[string]string
 }
 
 // BotAllowed take a page content and determines if the botUser is allowed
 // to edit the page per the applicable templates.
-func BotAllowed(pageContent string) bool {
-	if settings.BotUser == "" {
-		panic("BotAllowed called with no botUser set!")
+// Use MessageAllowed instead when the edit is leaving a message, so that optouts are respected.
+func (b *Bot) BotAllowed(pageContent string) bool {
+	allowed, reason := b.ExclusionCheck(pageContent, false)
+	if !allowed {
+		log.Println("Bot not allowed to edit page:", reason)
 	}
+	return allowed
+}
 
-	// this mess below is only necessary because Go doesn't support regex lookaheads
-	// which I know is because there are problems in terms of time guarantees for them
-	// but ugh.
-	if botWhitelistRegex.MatchString(pageContent) {
-		// the page contains a whitelist, we need to check if we're on it
-		return botAllowThisBotRegex.MatchString(pageContent)
+// MessageAllowed is BotAllowed for edits which leave a message for a user, and so
+// can also be opted out of with {{bots|optout=}} naming any of the task's OptOut types.
+func (b *Bot) MessageAllowed(pageContent string) bool {
+	allowed, reason := b.ExclusionCheck(pageContent, true)
+	if !allowed {
+		log.Println("Bot not allowed to leave message:", reason)
+	}
+	return allowed
+}
+
+// ExclusionCheck implements the {{bots}} and {{nobots}} exclusion compliance standard,
+// returning whether the bot is allowed to edit a page with the given content, and if not,
+// the reason why. If message is true, the edit is treated as leaving a message of the task's
+// OptOut types, and optout= is checked too. Redirects to the templates are recognised.
+func (b *Bot) ExclusionCheck(pageContent string, message bool) (allowed bool, reason string) {
+	if b.settings.BotUser == "" {
+		panic("ExclusionCheck called with no botUser set!")
 	}
 
-	// the page doesn't contain a whitelist, return true if we're not blacklisted or nobotted
-	return !botBanRegex.MatchString(pageContent)
+	// until the bot has connected, the templates are recognised by their English names
+	site, err := b.Site()
+	if err != nil {
+		site = title.DefaultSite()
+	}
+
+	botName := normaliseExclusionName(b.settings.BotUser)
+	for _, template := range b.findExclusionTemplates(site, pageContent) {
+		if template.kind == nobotsTemplate && len(template.params) == 0 {
+			return false, "page has {{nobots}}"
+		}
+
+		if allow, ok := template.params["allow"]; ok {
+			bots := splitExclusionList(allow)
+			if !containsAny(bots, "all", botName) {
+				return false, "{{bots|allow=" + allow + "}} does not include " + b.settings.BotUser
+			}
+		}
+
+		if deny, ok := template.params["deny"]; ok {
+			bots := splitExclusionList(deny)
+			if containsAny(bots, "all", botName) {
+				return false, "{{bots|deny=" + deny + "}} includes " + b.settings.BotUser
+			}
+		}
+
+		if optout, ok := template.params["optout"]; ok && message {
+			optedOut := splitExclusionList(optout)
+			if containsAny(optedOut, "all") {
+				return false, "{{bots|optout=" + optout + "}} opts out of all messages"
+			}
+			for _, messageType := range b.settings.OptOut {
+				if containsAny(optedOut, normaliseExclusionName(messageType)) {
+					return false, "{{bots|optout=" + optout + "}} opts out of " + messageType + " messages"
+				}
+			}
+		}
+	}
+	return true, ""
 }
 
-// setupNobotsBot sets the bot name, ready for future calls to BotAllowed.
-func setupNobotsBot() {
-	botBanRegex = regexp.MustCompile(fmt.Sprintf(botBanRegexTemplate, settings.BotUser))
-	botAllowThisBotRegex = regexp.MustCompile(fmt.Sprintf(botAllowRegexTemplate, settings.BotUser))
+// findExclusionTemplates finds every {{bots}} and {{nobots}} in the page content,
+// including those nested inside other templates, with their names normalised by the site.
+func (b *Bot) findExclusionTemplates(site *title.Site, pageContent string) []exclusionTemplate {
+	names := b.loadExclusionTemplates(site)
+
+	var found []exclusionTemplate
+	for _, t := range wikitext.Parse(pageContent).Templates() {
+		kind, ok := names[t.NameBy(site.TemplateName)]
+		if !ok {
+			continue
+		}
+		template := exclusionTemplate{kind: kind, params: map[string]string{}}
+		for _, param := range t.Params() {
+			if !param.Positional() {
+				template.params[strings.ToLower(param.Name())] = param.Value()
+			}
+		}
+		found = append(found, template)
+	}
+	return found
+}
+
+// normaliseExclusionName normalises a bot name or message type for comparison with a {{bots}} list.
+func normaliseExclusionName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " "))
+}
+
+// splitExclusionList splits the comma-separated list in a {{bots}} parameter into its normalised items.
+func splitExclusionList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = normaliseExclusionName(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func containsAny(list []string, wanted ...string) bool {
+	for _, item := range list {
+		for _, want := range wanted {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadExclusionTemplates returns the exclusion templates for the wiki, looking up the redirects
+// to the templates from the wiki the first time it's called after the client is authenticated,
+// and again once they're older than exclusionTemplatesTTL. Before the client is authenticated,
+// only the templates' own names are recognised. Names are normalised by the site, so that they're
+// found however the wiki names the Template namespace. As with Site, the redirects are looked up
+// without holding the cache's lock.
+func (b *Bot) loadExclusionTemplates(site *title.Site) map[string]string {
+	exclusionTemplatesMutex.Lock()
+	cached, ok := exclusionTemplates[b.config.APIEndpoint]
+	exclusionTemplatesMutex.Unlock()
+
+	if ok && time.Since(cached.fetched) < exclusionTemplatesTTL {
+		return cached.names
+	}
+
+	names := map[string]string{botsTemplate: botsTemplate, nobotsTemplate: nobotsTemplate}
+	if b.client == nil {
+		return names
+	}
+
+	for _, kind := range []string{botsTemplate, nobotsTemplate} {
+		query := b.client.NewQuery(params.Values{
+			"action":       "query",
+			"generator":    "linkshere",
+			"titles":       site.NewTitle(title.NamespaceTemplate, kind).String(),
+			"glhprop":      "title",
+			"glhnamespace": "10",
+			"glhshow":      "redirect",
+		})
+		for query.Next() {
+			pages, err := PagesFromQuery(query.Resp())
+			if err != nil {
+				b.PanicErr("Failed to decode redirects to Template:", kind, " with error ", err)
+			}
+			for _, page := range pages {
+				if page.Title == "" {
+					log.Println("Failed to get title from redirect page for template, so skipping it")
+					continue
+				}
+				redirect, err := site.ParseIn(page.Title, title.NamespaceTemplate)
+				if err != nil {
+					log.Println("Redirect", page.Title, "to the template isn't a valid title, so skipping it")
+					continue
+				}
+				names[site.TemplateName(redirect.String())] = kind
+			}
+		}
+		if query.Err() != nil {
+			b.PanicErr("Failed to fetch redirects to Template:", kind, " with error ", query.Err())
+		}
+	}
+
+	exclusionTemplatesMutex.Lock()
+	exclusionTemplates[b.config.APIEndpoint] = cachedExclusionTemplates{names, time.Now()}
+	exclusionTemplatesMutex.Unlock()
+	return names
 }
@@ -0,0 +1,72 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import "flag"
+
+// Options are the options every task shares, which are usually set on the command line.
+// Importing ybtools doesn't register any flags; programs register the options on a flag set
+// of their own with RegisterFlags, and pass them to New in BotSettings.
+type Options struct {
+	// ConfigDir is a directory to look for config files in before any of the usual places
+	ConfigDir string
+	// ConfigCheck makes New print the effective configuration and return ErrConfigChecked
+	ConfigCheck bool
+	// Wiki is a comma-separated list of the wikis from wikis in the config to run on
+	Wiki string
+
+	DryRun    bool
+	DryRunDir string
+
+	Record    string
+	Replay    string
+	ReplayDir string
+
+	ReportDir  string
+	MetricsDir string
+	AuditLog   string
+	Verbosity  int
+}
+
+// DefaultOptions returns the options a task runs with if none of them are changed.
+func DefaultOptions() Options {
+	return Options{
+		DryRunDir: "dry-run",
+		ReplayDir: "replay",
+		ReportDir: "reports",
+		AuditLog:  DefaultAuditLog,
+		Verbosity: verbosityNormal,
+	}
+}
+
+// RegisterFlags registers a flag on fs for each of the options, defaulting to what they're set to now.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.ConfigDir, "config-dir", o.ConfigDir, "directory to look for config files in before any of the usual places, ahead of "+configDirEnv)
+	fs.BoolVar(&o.ConfigCheck, "config-check", o.ConfigCheck, "print the effective configuration, with secrets redacted, and any problems with it, then exit")
+	fs.StringVar(&o.Wiki, "wiki", o.Wiki, "comma-separated names of the wikis from wikis in the config to run on; every one of them if empty")
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, "record intended edits as diffs in -dry-run-dir instead of saving them")
+	fs.StringVar(&o.DryRunDir, "dry-run-dir", o.DryRunDir, "directory to write dry-run diffs into")
+	fs.StringVar(&o.Record, "record", o.Record, "cassette file to record every API request and response of the run into")
+	fs.StringVar(&o.Replay, "replay", o.Replay, "cassette file to replay the run from, offline, capturing edits into -replay-dir instead of sending them")
+	fs.StringVar(&o.ReplayDir, "replay-dir", o.ReplayDir, "directory to write edits captured during a replay into")
+	fs.StringVar(&o.ReportDir, "report-dir", o.ReportDir, "directory to write the JSON run report into; empty to not write one")
+	fs.StringVar(&o.MetricsDir, "metrics-dir", o.MetricsDir, "directory to write Prometheus textfile metrics into at the end of the run, for the node exporter's textfile collector; empty to not write them")
+	fs.StringVar(&o.AuditLog, "audit-log", o.AuditLog, "JSON lines file to append a record of every edit to; empty to not keep one")
+	fs.IntVar(&o.Verbosity, "verbosity", o.Verbosity, "how much to log: 0 for nothing (alerts and the run report are still sent), 1 for the usual, 2 to also log every API request")
+}
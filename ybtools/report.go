@@ -0,0 +1,314 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/metal3d/go-slugify"
+)
+
+// RunReport is the structured record of a single run of a task, written out
+// as JSON at the end of the run by SaveRunReport.
+type RunReport struct {
+	Task         string            `json:"task"`
+	RunID        string            `json:"run"`
+	BotUser      string            `json:"botUser"`
+	Version      string            `json:"version"`
+	Wiki         string            `json:"wiki,omitempty"`
+	DryRun       bool              `json:"dryRun"`
+	Replay       string            `json:"replay,omitempty"`
+	Started      time.Time         `json:"started"`
+	Finished     time.Time         `json:"finished"`
+	Status       string            `json:"status"`
+	PagesScanned int               `json:"pagesScanned"`
+	Edits        []ReportedEdit    `json:"edits"`
+	Skipped      []ReportedPage    `json:"skipped"`
+	Errors       []ReportedPage    `json:"errors"`
+	Counts       map[string]int    `json:"counts"`
+	EditLimit    ReportedEditLimit `json:"editLimit"`
+}
+
+// ReportedEdit is a single edit made (or, in a dry run, that would have been made) during a run.
+type ReportedEdit struct {
+	Title     string `json:"title"`
+	Summary   string `json:"summary"`
+	RevID     int64  `json:"revid"`
+	OldRevID  int64  `json:"oldrevid"`
+	Timestamp string `json:"timestamp,omitempty"`
+	NoChange  bool   `json:"nochange,omitempty"`
+}
+
+// ReportedPage is a page that was skipped, or errored, along with the reason why.
+// Title is empty where the problem wasn't with any particular page.
+type ReportedPage struct {
+	Title  string `json:"title"`
+	Reason string `json:"reason"`
+}
+
+// ReportedEditLimit is the edit limit usage at the end of a run.
+// Budgets is empty if the task isn't edit limited.
+type ReportedEditLimit struct {
+	UsedThisRun int64        `json:"usedThisRun"`
+	Budgets     []EditBudget `json:"budgets"`
+}
+
+// runReport is the report on a bot's run so far, along with the on-wiki page it's also
+// saved to, from reportpage in the task config.
+type runReport struct {
+	sync.Mutex
+	RunReport
+	page string
+}
+
+// setupRunReport starts the report for this run.
+func (b *Bot) setupRunReport() {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.RunReport = RunReport{
+		Task:    b.settings.TaskName,
+		RunID:   b.runID,
+		BotUser: b.settings.BotUser,
+		Version: Version(),
+		Wiki:    b.currentWiki,
+		DryRun:  b.dryRun,
+		Replay:  b.options.Replay,
+		Started: time.Now().UTC(),
+		Status:  "running",
+		Edits:   []ReportedEdit{},
+		Skipped: []ReportedPage{},
+		Errors:  []ReportedPage{},
+		Counts:  map[string]int{},
+	}
+}
+
+// ReportScanned records that a page has been looked at during the run.
+// ForPageInQuery does this itself for every page in the query.
+func (b *Bot) ReportScanned() {
+	b.reportScanned()
+}
+
+// ReportSkipped records that a page was deliberately not edited, and why.
+func (b *Bot) ReportSkipped(title, reason string) {
+	b.reportSkipped(title, reason)
+}
+
+// ReportError records a recoverable error on a page. Unrecoverable errors
+// go through PanicErr, which records them itself.
+func (b *Bot) ReportError(title, message string) {
+	b.reportError(title, message)
+}
+
+func (b *Bot) reportScanned() {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.PagesScanned++
+}
+
+func (b *Bot) reportSkipped(title, reason string) {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.Skipped = append(b.report.Skipped, ReportedPage{Title: title, Reason: Redact(reason)})
+}
+
+func (b *Bot) reportError(title, message string) {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.Errors = append(b.report.Errors, ReportedPage{Title: title, Reason: Redact(message)})
+}
+
+// ReportCount adds n to the task-specific count called name, for instance
+// the number of users pruned from lists.
+func (b *Bot) ReportCount(name string, n int) {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.Counts[name] += n
+}
+
+// reportEdit records an edit that the API has accepted.
+func (b *Bot) reportEdit(e ReportedEdit) {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.Edits = append(b.report.Edits, e)
+}
+
+// reportFailed marks the run as failed, with the message it failed with.
+func (b *Bot) reportFailed(message string) {
+	b.report.Lock()
+	defer b.report.Unlock()
+	b.report.Status = "failed"
+	b.report.Errors = append(b.report.Errors, ReportedPage{Reason: Redact(message)})
+}
+
+// SaveRunReport finishes the run report, writing it to a JSON file in the
+// -report-dir directory, and to the reportpage in the task config if there is one,
+// and writes the run's metrics to the -metrics-dir directory. Defer it straight
+// after New; it runs on panics too, when the report shows the run as failed.
+// Failing to save the report is logged, but doesn't stop the task.
+func (b *Bot) SaveRunReport() {
+	b.kill.Lock()
+	paused := b.kill.paused
+	b.kill.Unlock()
+
+	b.report.Lock()
+	if b.report.Task == "" {
+		// New was never called, so there's nothing to report
+		b.report.Unlock()
+		return
+	}
+	b.report.Finished = time.Now().UTC()
+	if b.report.Status == "running" {
+		b.report.Status = "succeeded"
+		if paused {
+			b.report.Status = "paused"
+		}
+	}
+	b.report.EditLimit = ReportedEditLimit{
+		UsedThisRun: b.limiter.thisRun,
+		Budgets:     b.remainingEditBudget(),
+	}
+	if b.report.EditLimit.Budgets == nil {
+		b.report.EditLimit.Budgets = []EditBudget{}
+	}
+	encoded, err := json.MarshalIndent(b.report.RunReport, "", "\t")
+	finished := b.report.RunReport
+	b.report.Unlock()
+
+	saveMetrics(b.options.MetricsDir, finished)
+
+	if err != nil {
+		log.Println("Failed to encode run report with error", err)
+		return
+	}
+
+	if b.options.ReportDir != "" {
+		name := strings.ToLower(slugify.Marshal(b.settings.TaskName))
+		if finished.Wiki != "" {
+			name += "-" + strings.ToLower(slugify.Marshal(finished.Wiki))
+		}
+		path := filepath.Join(b.options.ReportDir, name+"-"+finished.Started.Format("20060102-150405")+".json")
+		err := os.MkdirAll(b.options.ReportDir, 0755)
+		if err == nil {
+			err = os.WriteFile(path, encoded, 0644)
+		}
+		if err != nil {
+			log.Println("Failed to write run report to", path, "with error", err)
+		} else {
+			log.Println("Wrote run report to", path)
+		}
+	}
+
+	if b.report.page != "" && b.client != nil {
+		// the report page is in the bot's own userspace, so it isn't subject to CanEdit
+		err := b.client.Edit(params.Values{
+			"title":        b.report.page,
+			"text":         string(encoded),
+			"contentmodel": "json",
+			"summary":      "Updating run report for " + b.settings.TaskName,
+			"bot":          "true",
+		})
+		if err != nil {
+			log.Println("Failed to save run report to", b.report.page, "with error", err)
+		}
+	}
+}
+
+// reportTransport records every edit the API accepts in the run report,
+// along with the revision ID it was given, and appends it to the audit log. Edits the API refuses are left
+// for the task to report, as only the task knows whether they're errors.
+type reportTransport struct {
+	base http.RoundTripper
+	bot  *Bot
+}
+
+func (t *reportTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost {
+		return t.base.RoundTrip(req)
+	}
+
+	p, err := apiRequestParams(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if p.Get("action") != "edit" {
+		return resp, err
+	}
+	if err != nil {
+		editsMetric.Inc("failed")
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var decoded struct {
+		Edit struct {
+			Result       string `json:"result"`
+			Title        string `json:"title"`
+			NewRevID     int64  `json:"newrevid"`
+			OldRevID     int64  `json:"oldrevid"`
+			NewTimestamp string `json:"newtimestamp"`
+			NoChange     bool   `json:"nochange"`
+		} `json:"edit"`
+	}
+	if json.Unmarshal(body, &decoded) != nil {
+		// not for us to deal with; mwclient will complain about it
+		editsMetric.Inc("failed")
+		return resp, nil
+	}
+
+	// failed edits are left to the task, which knows whether they matter
+	switch {
+	case decoded.Edit.Result != "Success":
+		editsMetric.Inc("failed")
+	case decoded.Edit.NoChange:
+		editsMetric.Inc("nochange")
+	default:
+		editsMetric.Inc("saved")
+	}
+	if decoded.Edit.Result == "Success" {
+		edit := ReportedEdit{
+			Title:     decoded.Edit.Title,
+			Summary:   p.Get("summary"),
+			RevID:     decoded.Edit.NewRevID,
+			OldRevID:  decoded.Edit.OldRevID,
+			Timestamp: decoded.Edit.NewTimestamp,
+			NoChange:  decoded.Edit.NoChange,
+		}
+		t.bot.reportEdit(edit)
+		t.bot.auditEdit(t.base, req, p, edit)
+	}
+	return resp, nil
+}
@@ -0,0 +1,323 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+// The defaults for the retry section of the global config.
+const (
+	defaultRetryMaxAttempts     int           = 5
+	defaultRetryBaseDelay       time.Duration = 2 * time.Second
+	defaultRetryMaxDelay        time.Duration = 2 * time.Minute
+	defaultRetryReadOnlyTimeout time.Duration = 30 * time.Minute
+)
+
+// readOnlyPollInterval is the longest wait between calls while the wiki is read-only.
+const readOnlyPollInterval time.Duration = time.Minute
+
+// mwclientHTTPErrorPrefix starts every error mwclient returns when the HTTP request itself
+// failed, rather than the API returning an error; mwclient doesn't wrap the underlying error,
+// so this is the only way to tell. (The spelling is mwclient's.)
+const mwclientHTTPErrorPrefix string = "error occured during HTTP request"
+
+// ErrorClass is what a RetryPolicy does about an error.
+type ErrorClass int8
+
+const (
+	// ErrorSkippable errors only affect the call that made them, like an edit conflict or a
+	// protected page; they're returned straight away, so the task can skip the page and carry on.
+	ErrorSkippable ErrorClass = iota
+	// ErrorRetryable errors are passing, like being rate limited, the wiki being read-only, or a
+	// network timeout; the call is made again after waiting.
+	ErrorRetryable
+	// ErrorFatal errors mean the bot can't carry on at all, like being blocked, so the run is stopped.
+	ErrorFatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorRetryable:
+		return "retryable"
+	case ErrorFatal:
+		return "fatal"
+	}
+	return "skippable"
+}
+
+// RetryConfig is the retry section of the global config, setting the default RetryPolicy.
+type RetryConfig struct {
+	MaxAttempts     int
+	BaseDelay       string
+	MaxDelay        string
+	ReadOnlyTimeout string
+}
+
+// RetryPolicy says how Do retries a call that fails.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a call is made before a retryable error is given up on
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, which doubles with every retry after, up to MaxDelay.
+	// If the wiki has sent a Retry-After header, at least that long is waited instead.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// ReadOnlyTimeout is how long to keep waiting for a read-only wiki to become writable again
+	// before giving up; the wait doesn't count towards MaxAttempts.
+	ReadOnlyTimeout time.Duration
+	// Classify decides what to do about an error; ClassifyError is used if it's nil.
+	Classify func(error) ErrorClass
+}
+
+// retryAfter records the latest time the wiki has asked, with a Retry-After header, for requests
+// to be held off until. It applies to every retry, whichever request it came from.
+type retryAfter struct {
+	sync.Mutex
+	until time.Time
+}
+
+// DefaultRetryPolicy returns the retry policy set by retry in the global config.
+func (b *Bot) DefaultRetryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:     b.config.Retry.MaxAttempts,
+		BaseDelay:       retryDuration("basedelay", b.config.Retry.BaseDelay, defaultRetryBaseDelay),
+		MaxDelay:        retryDuration("maxdelay", b.config.Retry.MaxDelay, defaultRetryMaxDelay),
+		ReadOnlyTimeout: retryDuration("readonlytimeout", b.config.Retry.ReadOnlyTimeout, defaultRetryReadOnlyTimeout),
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = defaultRetryMaxAttempts
+	}
+	return policy
+}
+
+// Do calls f with the default retry policy. See DoWithPolicy.
+func (b *Bot) Do(f func() error) error {
+	return b.DoWithPolicy(context.Background(), b.DefaultRetryPolicy(), f)
+}
+
+// DoContext calls f with the default retry policy, giving up waiting if ctx is cancelled.
+// See DoWithPolicy.
+func (b *Bot) DoContext(ctx context.Context, f func() error) error {
+	return b.DoWithPolicy(ctx, b.DefaultRetryPolicy(), f)
+}
+
+// DoUnrepeatable calls f with the default retry policy, but only retries errors where the wiki
+// clearly refused the call, using ClassifyRefusedError. Use it for calls that can't safely be
+// made twice, like posting a new section with section=new, which would post it again if the
+// first one was saved but its response never arrived.
+func (b *Bot) DoUnrepeatable(f func() error) error {
+	policy := b.DefaultRetryPolicy()
+	policy.Classify = ClassifyRefusedError
+	return b.DoWithPolicy(context.Background(), policy, f)
+}
+
+// DoWithPolicy calls f, which is usually a single API call, until it succeeds. Retryable errors
+// are waited out and f is called again, until the policy gives up on them, when the last error
+// is returned. Skippable errors are returned as they are, so that callers can still check for
+// particular API error codes. Fatal errors stop the run with PanicErr. If ctx is cancelled while
+// waiting, the last error is returned. Retries wait at least as long as any Retry-After the wiki
+// has sent the bot. As f may be called more than once, it shouldn't do
+// anything that can't safely be repeated if it turns out to have worked the first time;
+// calls like that should be classified with ClassifyRefusedError, as DoUnrepeatable does.
+func (b *Bot) DoWithPolicy(ctx context.Context, p RetryPolicy, f func() error) error {
+	classify := p.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+
+	var readOnlySince time.Time
+	attempt, readOnlyAttempt := 1, 1
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+
+		switch classify(err) {
+		case ErrorFatal:
+			b.PanicErr("Fatal error from the wiki, so stopping: ", err)
+		case ErrorSkippable:
+			return err
+		}
+
+		var wait time.Duration
+		if isReadOnlyError(err) {
+			if readOnlySince.IsZero() {
+				readOnlySince = time.Now()
+			}
+			if time.Since(readOnlySince) >= p.ReadOnlyTimeout {
+				log.Println("The wiki has been read-only for longer than", p.ReadOnlyTimeout, "so giving up. Error was", err)
+				return err
+			}
+			wait = p.backoff(readOnlyAttempt)
+			if wait > readOnlyPollInterval {
+				wait = readOnlyPollInterval
+			}
+			wait = b.retryAfter.atLeast(wait)
+			readOnlyAttempt++
+			retriesMetric.Inc("readonly")
+			log.Println("The wiki is read-only, so waiting", wait, "to try again. Error was", err)
+		} else {
+			if attempt >= p.MaxAttempts {
+				log.Println("Giving up after", attempt, "attempts. Error was", err)
+				return err
+			}
+			wait = b.retryAfter.atLeast(p.backoff(attempt))
+			attempt++
+			retriesMetric.Inc("error")
+			log.Println("Retryable error, so waiting", wait, "to try again. Error was", err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns how long to wait after the given attempt failed.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.BaseDelay
+	for i := 1; i < attempt && wait < p.MaxDelay; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxDelay {
+		wait = p.MaxDelay
+	}
+	return wait
+}
+
+// atLeast returns wait, or how long is left until the wiki asked to be retried if that's longer.
+func (r *retryAfter) atLeast(wait time.Duration) time.Duration {
+	r.Lock()
+	defer r.Unlock()
+	if asked := time.Until(r.until); asked > wait {
+		wait = asked
+	}
+	return wait
+}
+
+// ClassifyError is the default way errors are classified: blocks and lost sessions are fatal;
+// rate limits, read-only wikis, lag, database errors and failed HTTP requests are retryable;
+// and everything else, like edit conflicts, protected pages and missing pages, is skippable.
+func ClassifyError(err error) ErrorClass {
+	if apiErr, ok := err.(mwclient.APIError); ok {
+		switch {
+		case apiErr.Code == "blocked", apiErr.Code == "autoblocked", apiErr.Code == "globalblocking-blockedtext",
+			apiErr.Code == "noedit", apiErr.Code == "writeapidenied", apiErr.Code == "readapidenied",
+			apiErr.Code == "assertuserfailed", apiErr.Code == "assertbotfailed",
+			strings.HasPrefix(apiErr.Code, "mwoauth"):
+			return ErrorFatal
+		case apiErr.Code == "ratelimited", apiErr.Code == "readonly", apiErr.Code == "maxlag",
+			strings.HasPrefix(apiErr.Code, "internal_api_error_DB"):
+			return ErrorRetryable
+		}
+		return ErrorSkippable
+	}
+	if err == mwclient.ErrAPIBusy || strings.HasPrefix(err.Error(), mwclientHTTPErrorPrefix) {
+		return ErrorRetryable
+	}
+	return ErrorSkippable
+}
+
+// ClassifyRefusedError classifies errors for calls that can't safely be repeated. Fatal errors
+// are the same as for ClassifyError, but only rate limits, read-only wikis and lag, where the
+// wiki refused the call before doing anything, are retryable. Failed HTTP requests and server
+// errors are skippable, as the call may have worked even though no answer came back.
+func ClassifyRefusedError(err error) ErrorClass {
+	if ClassifyError(err) == ErrorFatal {
+		return ErrorFatal
+	}
+	if apiErr, ok := err.(mwclient.APIError); ok {
+		switch apiErr.Code {
+		case "ratelimited", "readonly", "maxlag":
+			return ErrorRetryable
+		}
+		return ErrorSkippable
+	}
+	if err == mwclient.ErrAPIBusy {
+		return ErrorRetryable
+	}
+	return ErrorSkippable
+}
+
+// isReadOnlyError returns whether err is the wiki saying it's read-only.
+func isReadOnlyError(err error) bool {
+	apiErr, ok := err.(mwclient.APIError)
+	return ok && apiErr.Code == "readonly"
+}
+
+// retryDuration parses a duration from the retry config, falling back to the default.
+func retryDuration(key, value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Invalid retry", key, value, "so using the default. Error was", err)
+		return fallback
+	}
+	return duration
+}
+
+// retryAfterTransport turns responses saying the wiki is overloaded or rate limiting us into
+// errors, so they're retried, and records any Retry-After the wiki sends with them.
+type retryAfterTransport struct {
+	base http.RoundTripper
+	bot  *Bot
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	statusErr := fmt.Errorf("the wiki returned HTTP %s", resp.Status)
+	if header := resp.Header.Get("Retry-After"); header != "" {
+		var after time.Duration
+		if seconds, err := strconv.Atoi(header); err == nil {
+			after = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(header); err == nil {
+			after = time.Until(at)
+		}
+		if after > 0 {
+			t.bot.retryAfter.Lock()
+			if until := time.Now().Add(after); until.After(t.bot.retryAfter.until) {
+				t.bot.retryAfter.until = until
+			}
+			t.bot.retryAfter.Unlock()
+			statusErr = fmt.Errorf("%w, asking to retry after %s", statusErr, after)
+		}
+	}
+	return nil, statusErr
+}
@@ -0,0 +1,234 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err     error
+		want    ErrorClass
+		refused ErrorClass
+	}{
+		{mwclient.APIError{Code: "blocked"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "autoblocked"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "globalblocking-blockedtext"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "assertbotfailed"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "assertuserfailed"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "writeapidenied"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "mwoauth-invalid-authorization"}, ErrorFatal, ErrorFatal},
+		{mwclient.APIError{Code: "ratelimited"}, ErrorRetryable, ErrorRetryable},
+		{mwclient.APIError{Code: "readonly"}, ErrorRetryable, ErrorRetryable},
+		{mwclient.APIError{Code: "maxlag"}, ErrorRetryable, ErrorRetryable},
+		{mwclient.ErrAPIBusy, ErrorRetryable, ErrorRetryable},
+		// these may have happened after the wiki did what was asked
+		{mwclient.APIError{Code: "internal_api_error_DBQueryError"}, ErrorRetryable, ErrorSkippable},
+		{errors.New(mwclientHTTPErrorPrefix + ": connection reset by peer"), ErrorRetryable, ErrorSkippable},
+		{mwclient.APIError{Code: "editconflict"}, ErrorSkippable, ErrorSkippable},
+		{mwclient.APIError{Code: "protectedpage"}, ErrorSkippable, ErrorSkippable},
+		{mwclient.APIError{Code: "missingtitle"}, ErrorSkippable, ErrorSkippable},
+		{mwclient.ErrPageNotFound, ErrorSkippable, ErrorSkippable},
+		{errors.New("something else went wrong"), ErrorSkippable, ErrorSkippable},
+	}
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.want {
+			t.Errorf("ClassifyError(%v) = %s, want %s", test.err, got, test.want)
+		}
+		if got := ClassifyRefusedError(test.err); got != test.refused {
+			t.Errorf("ClassifyRefusedError(%v) = %s, want %s", test.err, got, test.refused)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 2 * time.Second, MaxDelay: 30 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 16 * time.Second},
+		{5, 30 * time.Second},
+		{6, 30 * time.Second},
+		// doubling stops at the cap, so it never overflows
+		{1000, 30 * time.Second},
+	}
+	for _, test := range tests {
+		if got := policy.backoff(test.attempt); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempt, got, test.want)
+		}
+	}
+
+	if got := (RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second}).backoff(1); got != time.Second {
+		t.Errorf("backoff with a base delay over the max = %s, want %s", got, time.Second)
+	}
+}
+
+func TestRetryAfterAtLeast(t *testing.T) {
+	tests := []struct {
+		name  string
+		until time.Duration
+		wait  time.Duration
+		// min and max bound the result, as time passes while the test runs
+		min, max time.Duration
+	}{
+		{"nothing asked", 0, time.Second, time.Second, time.Second},
+		{"asked for less", 500 * time.Millisecond, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+		{"asked for more", time.Minute, time.Second, 59 * time.Second, time.Minute},
+		{"asked in the past", -time.Minute, time.Second, time.Second, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var r retryAfter
+			if test.until != 0 {
+				r.until = time.Now().Add(test.until)
+			}
+			if got := r.atLeast(test.wait); got < test.min || got > test.max {
+				t.Errorf("atLeast(%s) = %s, want between %s and %s", test.wait, got, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestRetryDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Hour},
+		{"90s", 90 * time.Second},
+		{"2m", 2 * time.Minute},
+		{"soon", time.Hour},
+	}
+	for _, test := range tests {
+		if got := retryDuration("test", test.value, time.Hour); got != test.want {
+			t.Errorf("retryDuration(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestDoWithPolicy(t *testing.T) {
+	retryable := mwclient.APIError{Code: "ratelimited"}
+	skippable := mwclient.APIError{Code: "editconflict"}
+	httpFailed := errors.New(mwclientHTTPErrorPrefix + ": connection reset by peer")
+	tests := []struct {
+		name string
+		// errs are what each call returns in turn; calls after them succeed
+		errs      []error
+		classify  func(error) ErrorClass
+		wantCalls int
+		wantErr   error
+	}{
+		{"succeeds first time", nil, nil, 1, nil},
+		{"succeeds after retrying", []error{retryable, retryable}, nil, 3, nil},
+		{"gives up after max attempts", []error{retryable, retryable, retryable, retryable}, nil, 3, retryable},
+		{"skippable isn't retried", []error{skippable}, nil, 1, skippable},
+		{"retryable then skippable", []error{retryable, skippable}, nil, 2, skippable},
+		{"HTTP failure is retried", []error{httpFailed}, nil, 2, nil},
+		{"unrepeatable HTTP failure isn't retried", []error{httpFailed}, ClassifyRefusedError, 1, httpFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := &Bot{}
+			policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Classify: test.classify}
+			calls := 0
+			err := b.DoWithPolicy(context.Background(), policy, func() error {
+				calls++
+				if calls <= len(test.errs) {
+					return test.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != test.wantCalls {
+				t.Errorf("called %d times, want %d", calls, test.wantCalls)
+			}
+			if err != test.wantErr {
+				t.Errorf("error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoWithPolicyStopsWaitingWhenCancelled(t *testing.T) {
+	b := &Bot{}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	retryable := mwclient.APIError{Code: "ratelimited"}
+	err := b.DoWithPolicy(ctx, policy, func() error { return retryable })
+	if err != retryable {
+		t.Errorf("error = %v, want %v", err, retryable)
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		wantErr    bool
+		// wantWait is roughly how long retries should now wait at least
+		wantWait time.Duration
+	}{
+		{"ok", http.StatusOK, "", false, 0},
+		{"not found", http.StatusNotFound, "", false, 0},
+		{"rate limited", http.StatusTooManyRequests, "", true, 0},
+		{"rate limited with seconds", http.StatusTooManyRequests, "120", true, 2 * time.Minute},
+		{"unavailable with a date", http.StatusServiceUnavailable, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), true, time.Hour},
+		{"server error with nonsense", http.StatusInternalServerError, "whenever", true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			b := &Bot{}
+			client := &http.Client{Transport: &retryAfterTransport{base: http.DefaultTransport, bot: b}}
+			resp, err := client.Get(server.URL)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want one: %v", err, test.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			wait := b.retryAfter.atLeast(0)
+			if wait > test.wantWait || wait < test.wantWait-5*time.Second {
+				t.Errorf("retries wait %s, want about %s", wait, test.wantWait)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"log"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+)
+
+// safeEditAttempts is how many times SafeEdit will try to save a page, merging or
+// transforming it again after each edit conflict, before giving up.
+const safeEditAttempts int = 3
+
+// ErrEditNotAllowed is returned by SafeEdit when the task has been paused or edit limited.
+// The page has already been reported as skipped, with the reason why.
+var ErrEditNotAllowed = errors.New("edit not allowed")
+
+// ErrEditConflict is returned by SafeEdit when the page was still being edited by somebody
+// else after every attempt, or straight away with GiveUpOnConflict.
+var ErrEditConflict = errors.New("page was edited by somebody else")
+
+// PageEdit describes an edit SafeEdit makes to a page.
+type PageEdit struct {
+	Title   string
+	Summary string
+	// Reason is why the edit is being made, for the audit log; see SetEditReason.
+	Reason string
+	// Params are any other parameters for the edit, like "notminor"; the text, the guards
+	// against conflicts, and "bot" are set by SafeEdit.
+	Params params.Values
+
+	// Content is the page's text, if it's already been fetched, for instance by ForPageInQuery;
+	// RevTimestamp and CurTimestamp are then the timestamps it was fetched with. If they're not
+	// all set, SafeEdit fetches the page itself.
+	Content      string
+	RevTimestamp string
+	CurTimestamp string
+
+	// GiveUpOnConflict makes SafeEdit return ErrEditConflict on the first edit conflict, rather
+	// than merging, for edits that shouldn't be made at all if somebody else is editing the page.
+	GiveUpOnConflict bool
+}
+
+// EditTransform turns the text of a page into what it should be after the edit. It can set
+// the Summary and Reason of the PageEdit it's for, if they depend on what it changed. It may be
+// called more than once, on newer text each time, if the page is edited in the mean time.
+type EditTransform func(text string) (string, error)
+
+// SafeEdit edits a page by running its text through transform, and saving the result, guarded
+// so that nobody else's edit is overwritten. The page is fetched, unless it already has been,
+// and the edit is only made if the transform changes it and CanEditTitle allows it. The edit is
+// saved with its MD5 hash, and the timestamps of the revision and of when it was fetched, so
+// that the wiki refuses it if somebody else has edited or deleted the page in the mean time.
+//
+// On an edit conflict, the latest version of the page is fetched, and SafeEdit tries a line-based
+// three-way merge of the transformed text with it; if the two changed different lines, the merge
+// is saved. If they touched the same lines, transform is run again on the latest version instead.
+//
+// Only pages that already exist are edited; if the page is missing, or is deleted during the
+// edit, the error says so. If the transform didn't change anything, or the wiki says the edit
+// didn't change the page, the error is mwclient.ErrEditNoChange. Errors from transform are
+// returned as they are.
+//
+// The edit is counted against the edit limits while it's being made, so that workers editing at
+// the same time can't go over them, but it's handed back if it's known not to have been saved:
+// when nothing changed, or when SafeEdit gives up on edit conflicts.
+func (b *Bot) SafeEdit(page *PageEdit, transform EditTransform) error {
+	// however the edit turns out, its reason mustn't be left for the next edit to the page
+	defer b.takeEditReason(page.Title)
+
+	base, revTS, curTS := page.Content, page.RevTimestamp, page.CurTimestamp
+	if base == "" || revTS == "" || curTS == "" {
+		var err error
+		if base, revTS, curTS, err = b.fetchWikitextFrom("titles", page.Title); err != nil {
+			return err
+		}
+	}
+
+	text, err := transform(base)
+	if err != nil {
+		return err
+	}
+	if text == base {
+		return mwclient.ErrEditNoChange
+	}
+	counted, ok := b.canEditTitle(page.Title)
+	if !ok {
+		return ErrEditNotAllowed
+	}
+	// the edit is handed back to the edit limits unless it was, or might have been, saved
+	unsaved := true
+	defer func() {
+		if unsaved {
+			b.uncountEdit(page.Title, counted)
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		err = b.Do(func() error {
+			if page.Reason != "" {
+				b.SetEditReason(page.Title, page.Reason)
+			}
+			return b.client.Edit(safeEditParams(page, text, revTS, curTS))
+		})
+		if err == nil || !isEditConflict(err) {
+			// after errors other than the wiki saying nothing changed, the edit may still have been saved
+			unsaved = err == mwclient.ErrEditNoChange
+			return err
+		}
+		if page.GiveUpOnConflict {
+			return fmt.Errorf("%w: %s", ErrEditConflict, page.Title)
+		}
+		if attempt >= safeEditAttempts {
+			return fmt.Errorf("%w: %s still conflicted after %d attempts", ErrEditConflict, page.Title, attempt)
+		}
+
+		latest, latestRevTS, latestCurTS, err := b.fetchWikitextFrom("titles", page.Title)
+		if err != nil {
+			return err
+		}
+		if merged, ok := mergeLines(base, text, latest); ok {
+			log.Println("Edit conflict on", page.Title, "so merging with the latest version and trying again")
+			text = merged
+		} else {
+			log.Println("Edit conflict on", page.Title, "that couldn't be merged, so redoing the edit on the latest version")
+			if text, err = transform(latest); err != nil {
+				return err
+			}
+		}
+		if text == latest {
+			return mwclient.ErrEditNoChange
+		}
+		base, revTS, curTS = latest, latestRevTS, latestCurTS
+	}
+}
+
+// safeEditParams returns the parameters for saving text to the page, guarded by the timestamps
+// of the revision it's based on and of when that was fetched.
+func safeEditParams(page *PageEdit, text, revTS, curTS string) params.Values {
+	p := params.Values{}
+	for key, value := range page.Params {
+		p[key] = value
+	}
+	p["title"] = page.Title
+	p["text"] = text
+	p["md5"] = fmt.Sprintf("%x", md5.Sum([]byte(text)))
+	p["summary"] = page.Summary
+	p["bot"] = "true"
+	p["basetimestamp"] = revTS
+	p["starttimestamp"] = curTS
+	p["nocreate"] = "true"
+	return p
+}
+
+// isEditConflict returns whether an error from saving a page means somebody else edited it first.
+func isEditConflict(err error) bool {
+	apiErr, ok := err.(mwclient.APIError)
+	return ok && apiErr.Code == "editconflict"
+}
@@ -0,0 +1,158 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cgt.name/pkg/go-mwclient"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+func TestSafeEditOnConflict(t *testing.T) {
+	const base string = "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name string
+		// theirs is saved by somebody else after the bot has fetched the page
+		theirs   string
+		giveUp   bool
+		want     string
+		wantErr  error
+		wantRuns int
+		// wantUsed is how much of the edit limit is used afterwards; edits that aren't saved don't count
+		wantUsed int64
+	}{
+		{"no conflict", "", false, "a\nB\nc\nd\ne\n", nil, 1, 1},
+		{"clean merge", "a\nb\nc\nd\nE\n", false, "a\nB\nc\nd\nE\n", nil, 1, 1},
+		// the transform is run again on their text, rather than the texts being merged
+		{"conflicting merge", "a\nb!\nc\nd\ne\n", false, "a\nB!\nc\nd\ne\n", nil, 2, 1},
+		{"same edit made already", "a\nB\nc\nd\ne\n", false, "a\nB\nc\nd\ne\n", mwclient.ErrEditNoChange, 1, 0},
+		{"giving up", "a\nb\nc\nd\nE\n", true, "a\nb\nc\nd\nE\n", ErrEditConflict, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const title string = "Example"
+			wiki := mwtest.NewWiki()
+			wiki.AddPage(mwtest.PageSpec{Title: title, Content: base})
+			b := testBot(t, wiki)
+			b.limiter.set = true
+			b.limiter.limits = map[string]EditWindowLimits{allNamespacesScope: {Total: 10}}
+			b.limiter.usage = editLimitState{Scopes: map[string]map[string]editWindowUsage{}}
+			b.limiter.path = filepath.Join(t.TempDir(), editLimitFilename)
+
+			runs := 0
+			err := b.SafeEdit(&PageEdit{Title: title, Summary: "Capitalising b", GiveUpOnConflict: test.giveUp}, func(text string) (string, error) {
+				runs++
+				if runs == 1 && test.theirs != "" {
+					wiki.AddPage(mwtest.PageSpec{Title: title, Content: test.theirs})
+				}
+				return strings.Replace(text, "b", "B", 1), nil
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if runs != test.wantRuns {
+				t.Errorf("transform ran %d times, want %d", runs, test.wantRuns)
+			}
+			if got, _ := wiki.Content(title); got != test.want {
+				t.Errorf("page is %q, want %q", got, test.want)
+			}
+			if got := b.limiter.usage.Scopes[allNamespacesScope][editWindowTotal].Used; got != test.wantUsed {
+				t.Errorf("edit limit used = %d, want %d", got, test.wantUsed)
+			}
+			if b.limiter.thisRun != test.wantUsed {
+				t.Errorf("edits this run = %d, want %d", b.limiter.thisRun, test.wantUsed)
+			}
+		})
+	}
+}
+
+func TestSafeEditWithoutChanges(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: "Example", Content: "a\n"})
+	b := testBot(t, wiki)
+
+	err := b.SafeEdit(&PageEdit{Title: "Example"}, func(text string) (string, error) { return text, nil })
+	if err != mwclient.ErrEditNoChange {
+		t.Errorf("error = %v, want ErrEditNoChange", err)
+	}
+	if edits := wiki.Edits(); len(edits) != 0 {
+		t.Errorf("%d edits made, want none", len(edits))
+	}
+}
+
+func TestSafeEditForgetsReason(t *testing.T) {
+	const title string = "Example"
+	upper := func(text string) (string, error) { return strings.ToUpper(text), nil }
+	tests := []struct {
+		name      string
+		page      PageEdit
+		transform EditTransform
+		// limited is whether the edit limit has already been used up
+		limited bool
+		wantErr error
+	}{
+		{"saved", PageEdit{Title: title}, upper, false, nil},
+		{"page missing", PageEdit{Title: "Missing"}, upper, false, mwclient.ErrPageNotFound},
+		{"transform failed", PageEdit{Title: title}, func(string) (string, error) { return "", errTransform }, false, errTransform},
+		{"nothing changed", PageEdit{Title: title}, func(text string) (string, error) { return text, nil }, false, mwclient.ErrEditNoChange},
+		{"edit limited", PageEdit{Title: title}, upper, true, ErrEditNotAllowed},
+		// fetched already, so the wiki only finds out it's gone when the edit is made
+		{"edit refused", PageEdit{Title: "Missing", Content: "a\n", RevTimestamp: "2024-03-06T12:00:00Z", CurTimestamp: "2024-03-06T12:00:00Z"}, upper, false, mwclient.APIError{Code: "missingtitle"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wiki := mwtest.NewWiki()
+			wiki.AddPage(mwtest.PageSpec{Title: title, Content: "a\n"})
+			b := testBot(t, wiki)
+			if test.limited {
+				b.limiter.set = true
+				b.limiter.limits = map[string]EditWindowLimits{allNamespacesScope: {Total: 1}}
+				b.limiter.usage = editLimitState{Scopes: map[string]map[string]editWindowUsage{
+					allNamespacesScope: {editWindowTotal: {Used: 1}},
+				}}
+				b.limiter.path = filepath.Join(t.TempDir(), editLimitFilename)
+			}
+
+			// a reason set before SafeEdit, which it would otherwise have used, is forgotten too
+			b.SetEditReason(test.page.Title, "set beforehand")
+			page := test.page
+			page.Reason = "testing"
+			err := b.SafeEdit(&page, test.transform)
+			// the wiki's errors come with info text, so only their codes are compared
+			apiErr, isAPIErr := err.(mwclient.APIError)
+			wantAPIErr, wantsAPIErr := test.wantErr.(mwclient.APIError)
+			if isAPIErr && wantsAPIErr {
+				if apiErr.Code != wantAPIErr.Code {
+					t.Fatalf("error code = %s, want %s", apiErr.Code, wantAPIErr.Code)
+				}
+			} else if !errors.Is(err, test.wantErr) {
+				t.Fatalf("error = %v, want %v", err, test.wantErr)
+			}
+			if reason, ok := b.editReasons.byTitle[page.Title]; ok {
+				t.Errorf("reason %q was left for the next edit to %s", reason, page.Title)
+			}
+		})
+	}
+}
+
+var errTransform = errors.New("transform failed")
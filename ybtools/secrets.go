@@ -0,0 +1,272 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minRedactedSecretLength is the shortest secret that's redacted; anything shorter would
+// take out parts of ordinary words, and is too short to be much of a secret anyway.
+const minRedactedSecretLength int = 6
+
+// secretFilePermissions are the permission bits a secret file mustn't have: any access at all
+// by the group or other users.
+const secretFilePermissions os.FileMode = 0077
+
+// secretConfigOption is the option in a field's config tag marking its key as a secret,
+// as in `config:"required,secret"`.
+const secretConfigOption string = "secret"
+
+// secrets holds every secret value registered for redaction, and a replacer for all of them.
+var secrets struct {
+	sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// RegisterSecret adds a value that must never be written anywhere, so that it's redacted from
+// the log, alerts and run reports from then on. The bot password and every config key tagged as
+// a secret are registered as they're loaded; tasks should register anything else secret they
+// come across, like the password inside a DSN. A value too short to redact is only warned about.
+func RegisterSecret(value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	if len(value) < minRedactedSecretLength {
+		// the value itself can't be logged, as it won't be redacted
+		log.Println("WARNING: a secret is shorter than", minRedactedSecretLength, "characters, so it won't be redacted")
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	if secrets.values == nil {
+		secrets.values = map[string]bool{}
+	}
+	secrets.values[value] = true
+	// it might turn up URL-encoded too, for instance in a logged request
+	secrets.values[url.QueryEscape(value)] = true
+
+	// longest first, so that a secret containing another is redacted whole
+	values := make([]string, 0, len(secrets.values))
+	for v := range secrets.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, redactedConfigValue)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact returns s with every registered secret in it replaced by [redacted].
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// redactingWriter redacts secrets from everything written through it, for the log.
+// The log writes each line in a single Write, so secrets are never split between writes.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.out, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// secretConfigKeys returns the paths of every config key tagged as a secret in the config
+// objects, like dsn or auth.accesstoken.
+func secretConfigKeys(targets []interface{}) [][]string {
+	var keys [][]string
+	for _, target := range targets {
+		keys = append(keys, secretConfigKeysOf(reflect.TypeOf(target).Elem(), nil)...)
+	}
+	return keys
+}
+
+func secretConfigKeysOf(t reflect.Type, parent []string) [][]string {
+	var keys [][]string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline := configKeyName(field)
+		if name == "-" {
+			continue
+		}
+		path := append(append([]string(nil), parent...), name)
+		if inline {
+			path = parent
+		}
+		switch {
+		case hasConfigOption(field, secretConfigOption):
+			keys = append(keys, path)
+		case field.Type.Kind() == reflect.Struct:
+			keys = append(keys, secretConfigKeysOf(field.Type, path)...)
+		}
+	}
+	return keys
+}
+
+// hasConfigOption returns whether a struct field's config tag has the given option.
+func hasConfigOption(field reflect.StructField, option string) bool {
+	for _, o := range strings.Split(field.Tag.Get("config"), ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// secretFilename returns the name of the file a secret config key is read from: the key itself,
+// with dots between nested keys, like dsn or auth.accesstoken.
+func secretFilename(key []string) string {
+	return strings.Join(key, ".")
+}
+
+// secretEnv returns the environment variable a secret config key can be set with instead,
+// which is the same one as for any other key.
+func secretEnv(key []string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Join(key, configEnvNestingSeparator))
+}
+
+// checkSecretsNotInFiles reports every secret config key that's been set in a config file,
+// where anyone who can read the file, or sees it copied around, can see it.
+func (b *Bot) checkSecretsNotInFiles(keys [][]string) {
+	for _, layer := range b.configLayers {
+		if !layer.fromFile {
+			continue
+		}
+		for _, key := range keys {
+			if _, set := configValueAt(layer.values, key); set {
+				b.configProblems = append(b.configProblems, fmt.Sprint(layer.source, " sets ", strings.Join(key, "."), ", which is a secret, so has to be in the ",
+					secretFilename(key), " file or ", secretEnv(key), " instead"))
+			}
+			if wikiSections, ok := layer.values[wikisConfigKey].(map[interface{}]interface{}); ok {
+				for wiki, section := range wikiSections {
+					if sectionValues, ok := section.(map[interface{}]interface{}); ok {
+						if _, set := configValueAt(sectionValues, key); set {
+							b.configProblems = append(b.configProblems, fmt.Sprint(layer.source, " sets ", strings.Join(key, "."), " for ", wiki, ", which is a secret, so has to be in the ",
+								secretFilename(key), "-", wiki, " file instead"))
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// loadSecretFiles sets every secret config key that isn't already set, by the environment, from
+// its file, preferring one for the wiki, like dsn-enwiki, to the shared one, and registers every
+// secret's value for redaction.
+func (b *Bot) loadSecretFiles(effective map[interface{}]interface{}, keys [][]string, searchPath []string, wiki string) {
+	for _, key := range keys {
+		if _, set := configValueAt(effective, key); !set {
+			filenames := []string{secretFilename(key)}
+			if wiki != "" {
+				filenames = []string{secretFilename(key) + "-" + wiki, secretFilename(key)}
+			}
+			for _, filename := range filenames {
+				if path := findConfigFile(searchPath, filename); path != "" {
+					if value, ok := b.readSecretFile(path); ok {
+						setConfigValueAt(effective, key, value)
+					}
+					break
+				}
+			}
+		}
+		if value, set := configValueAt(effective, key); set {
+			RegisterSecret(fmt.Sprint(value))
+		}
+	}
+}
+
+// readSecretFile reads a secret from a file, as long as only its owner can read it, reporting
+// a problem and returning false if it can't be read or other users could read it too.
+func (b *Bot) readSecretFile(path string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		b.configProblems = append(b.configProblems, path+" couldn't be read: "+err.Error())
+		return "", false
+	}
+	if perm := info.Mode().Perm(); perm&secretFilePermissions != 0 {
+		b.configProblems = append(b.configProblems, fmt.Sprintf("%s holds a secret, but other users can read it (its mode is %#o), so make it private with chmod 600", path, perm))
+		return "", false
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		b.configProblems = append(b.configProblems, path+" couldn't be read: "+err.Error())
+		return "", false
+	}
+	value := strings.TrimSpace(string(contents))
+	RegisterSecret(value)
+	return value, true
+}
+
+// configValueAt returns the value at a key path in some config values, and whether it's set.
+func configValueAt(values map[interface{}]interface{}, key []string) (interface{}, bool) {
+	for i, part := range key {
+		value, ok := values[part]
+		if !ok || value == nil {
+			return nil, false
+		}
+		if i == len(key)-1 {
+			return value, true
+		}
+		if values, ok = value.(map[interface{}]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setConfigValueAt sets the value at a key path in some config values, making any maps it needs to.
+func setConfigValueAt(values map[interface{}]interface{}, key []string, value interface{}) {
+	for _, part := range key[:len(key)-1] {
+		next, ok := values[part].(map[interface{}]interface{})
+		if !ok {
+			next = map[interface{}]interface{}{}
+			values[part] = next
+		}
+		values = next
+	}
+	values[key[len(key)-1]] = value
+}
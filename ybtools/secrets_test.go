@@ -0,0 +1,183 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	// secrets stay registered for the rest of the tests, so these are ones nothing else uses
+	RegisterSecret("hunter2hunter2")
+	RegisterSecret("  padded-secret\n")
+	RegisterSecret("p@ss w&rd")
+	RegisterSecret("abc")
+	RegisterSecret("hunter2hunter2-and-more")
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"nothing secret", "nothing to see here", "nothing to see here"},
+		{"empty", "", ""},
+		{"whole", "hunter2hunter2", "[redacted]"},
+		{"inside text", "password=hunter2hunter2&user=x", "password=[redacted]&user=x"},
+		{"more than once", "hunter2hunter2 hunter2hunter2", "[redacted] [redacted]"},
+		{"whitespace around it isn't part of it", "key: padded-secret", "key: [redacted]"},
+		{"URL-encoded", "lgpassword=p%40ss+w%26rd", "lgpassword=[redacted]"},
+		{"as it is", "p@ss w&rd", "[redacted]"},
+		{"too short to be registered", "abc abcdef", "abc abcdef"},
+		// the longer secret is redacted whole, rather than leaving the end of it behind
+		{"containing another", "hunter2hunter2-and-more", "[redacted]"},
+		{"part of one", "hunter2hunter", "hunter2hunter"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Redact(test.in); got != test.want {
+				t.Errorf("Redact(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterShortSecret(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	RegisterSecret("")
+	if out.Len() != 0 {
+		t.Errorf("registering nothing logged %q, want nothing", out.String())
+	}
+	RegisterSecret("xyzzy")
+	if !strings.Contains(out.String(), "won't be redacted") {
+		t.Errorf("registering a short secret logged %q, want a warning", out.String())
+	}
+	if strings.Contains(out.String(), "xyzzy") {
+		t.Errorf("the warning %q gave the secret away", out.String())
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	RegisterSecret("written-secret")
+	var out bytes.Buffer
+	line := []byte("logging in with written-secret\n")
+	n, err := redactingWriter{&out}.Write(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the whole line has to seem written, even though less was, or the log reports an error
+	if n != len(line) {
+		t.Errorf("wrote %d bytes, want %d", n, len(line))
+	}
+	if got, want := out.String(), "logging in with [redacted]\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestSecretConfigKeys(t *testing.T) {
+	type nested struct {
+		AccessToken string `config:"secret"`
+		Consumer    string
+	}
+	type taskConfig struct {
+		DSN    string `config:"required,secret"`
+		Name   string `config:"required"`
+		Auth   nested
+		Hidden string `config:"-"`
+	}
+	got := secretConfigKeys([]interface{}{&taskConfig{}})
+	want := [][]string{{"dsn"}, {"auth", "accesstoken"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("secret keys = %v, want %v", got, want)
+	}
+	if got := secretFilename(want[1]); got != "auth.accesstoken" {
+		t.Errorf("secret filename = %q, want auth.accesstoken", got)
+	}
+}
+
+func TestReadSecretFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+		want     string
+		ok       bool
+	}{
+		{"private", 0600, "a-secret-value\n", "a-secret-value", true},
+		{"read only", 0400, "  spaced-secret  ", "spaced-secret", true},
+		{"group readable", 0640, "group-secret", "", false},
+		{"world readable", 0604, "world-secret", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dsn")
+			if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, test.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			b := &Bot{}
+			value, ok := b.readSecretFile(path)
+			if ok != test.ok || value != test.want {
+				t.Errorf("read %q, %v, want %q, %v", value, ok, test.want, test.ok)
+			}
+			if test.ok {
+				if len(b.configProblems) != 0 {
+					t.Errorf("problems = %v, want none", b.configProblems)
+				}
+				if got := Redact(test.want); got != redactedConfigValue {
+					t.Errorf("secret read from a file wasn't registered: Redact gave %q", got)
+				}
+			} else if len(b.configProblems) != 1 {
+				t.Errorf("problems = %v, want one about the permissions", b.configProblems)
+			}
+		})
+	}
+}
+
+func TestRedactConfigValues(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"dsn":  "user:password@/db",
+		"name": "Example",
+		"auth": map[interface{}]interface{}{"accesstoken": "token-value", "consumer": "key"},
+		"list": []interface{}{map[interface{}]interface{}{"password": "x"}, "item"},
+	}
+	want := map[interface{}]interface{}{
+		"dsn":  redactedConfigValue,
+		"name": "Example",
+		"auth": map[interface{}]interface{}{"accesstoken": redactedConfigValue, "consumer": "key"},
+		"list": []interface{}{map[interface{}]interface{}{"password": redactedConfigValue}, "item"},
+	}
+	if got := redactConfigValues(values); !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted to %v, want %v", got, want)
+	}
+	if values["dsn"] != "user:password@/db" {
+		t.Error("the values given were changed")
+	}
+}
@@ -18,31 +18,60 @@ package ybtools
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
+import "time"
+
 // BotSettings is a struct storing all the information about the bot
 // needed to make the tools library work.
 type BotSettings struct {
-	TaskName         string
+	TaskName string
+	// BotUser is the bot's username, unless botuser is set in the config, for instance
+	// because it has a different name on another wiki
 	BotUser          string
 	ToolforgeAccount string
+	// OptOut are the types of message the task leaves, which users can opt out of
+	// with {{bots|optout=}}. They only apply to edits checked with MessageAllowed.
+	OptOut []string
+	// Config is a pointer to the task's config object, which is filled in from the
+	// task config file on top of the global one, with environment variables on top of both.
+	// Fields tagged `config:"required"` must be set, and if it implements ConfigValidator,
+	// it's checked with that too. Leave it nil if the task has no config of its own.
+	Config interface{}
+	// Options are the options the task runs with, usually from the command line; DefaultOptions
+	// is used if it's nil.
+	Options *Options
 }
 
-var settings BotSettings
-
-// SetupBot sets the bot name, ready for future calls to BotAllowed.
-func SetupBot(s BotSettings) {
-	settings = s
-	setupNobotsBot()
-	setupTaskConfigFile()
-	setKillPage()
-	// Kill pages are checked as soon as the mwclient is first authenticated
-}
+// settings are those the bot was made with, in New.
 
-// CanEdit checks if the task has been killed, and then checks if the
+// CanEdit checks if the task has been killed or paused, and then checks if the
 // bot is edit limited. This *must* be used for all edits apart from
 // those which only affect the bot's own userspace, or those which must
 // run even if the task is killed (e.g. updating JSON files which describe
 // the run which was just done).
-func CanEdit() bool {
-	killTaskIfNeeded()
-	return EditLimit()
+// In dry-run mode, CanEdit still applies; the edits it allows are then
+// intercepted on their way to the wiki and written to disk.
+func (b *Bot) CanEdit() bool {
+	return b.CanEditTitle("")
+}
+
+// CanEditTitle is CanEdit for an edit to a known page, so that
+// any edit limits for the page's namespace are applied as well.
+// If the edit isn't allowed, the page is reported as skipped, with the reason why.
+func (b *Bot) CanEditTitle(title string) bool {
+	_, ok := b.canEditTitle(title)
+	return ok
+}
+
+// canEditTitle is CanEditTitle, also returning when the edit was counted against the edit limits.
+func (b *Bot) canEditTitle(title string) (time.Time, bool) {
+	if b.Paused() {
+		b.reportSkipped(title, "task paused")
+		return time.Time{}, false
+	}
+	counted, ok := b.countEdit(title)
+	if !ok {
+		b.reportSkipped(title, "edit limited")
+		return time.Time{}, false
+	}
+	return counted, true
 }
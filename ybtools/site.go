@@ -0,0 +1,99 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/title"
+)
+
+// siteTTL is how long a wiki's namespaces are kept for once they've been looked up, as they
+// hardly ever change, so that a process running the tasks again and again, like the daemon,
+// doesn't look them up for every run.
+const siteTTL time.Duration = 24 * time.Hour
+
+// sites maps the API endpoint of each wiki to its namespaces, as looked up from its siteinfo.
+var sites = map[string]cachedSite{}
+var sitesMutex sync.Mutex
+
+type cachedSite struct {
+	site    *title.Site
+	fetched time.Time
+}
+
+// Site returns the namespaces of the wiki the bot is connected to, and the rules for its titles,
+// from the wiki's siteinfo, for parsing, normalising and comparing titles and usernames the way
+// the wiki does. They're looked up once for each wiki, and kept for a day. Until the bot is
+// connected, it returns an error. The siteinfo is fetched without holding the cache's lock, so
+// that other goroutines aren't held up by it; if several fetch it at once, the last one is kept.
+func (b *Bot) Site() (*title.Site, error) {
+	sitesMutex.Lock()
+	cached, ok := sites[b.config.APIEndpoint]
+	sitesMutex.Unlock()
+
+	if ok && time.Since(cached.fetched) < siteTTL {
+		return cached.site, nil
+	}
+	if b.client == nil {
+		return nil, errors.New("can't look up the wiki's namespaces before connecting to it")
+	}
+
+	resp, err := b.client.Get(params.Values{
+		"action": "query",
+		"meta":   "siteinfo",
+		"siprop": title.SiteinfoProps,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch siteinfo: %w", err)
+	}
+	encoded, err := resp.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	site, err := title.FromSiteinfo(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode siteinfo: %w", err)
+	}
+	sitesMutex.Lock()
+	sites[b.config.APIEndpoint] = cachedSite{site: site, fetched: time.Now()}
+	sitesMutex.Unlock()
+	return site, nil
+}
+
+// currentSite returns the namespaces of the wiki the bot is set up for if they've been looked
+// up by Site, or English Wikipedia's otherwise, for handling titles without asking the wiki.
+func (b *Bot) currentSite() *title.Site {
+	sitesMutex.Lock()
+	defer sitesMutex.Unlock()
+	if cached, ok := sites[b.config.APIEndpoint]; ok {
+		return cached.site
+	}
+	return title.DefaultSite()
+}
+
+// normaliseTitle normalises a title as far as can be done without asking the wiki, so that
+// titles written with underscores, a lowercase first letter or a namespace alias still match.
+func (b *Bot) normaliseTitle(raw string) string {
+	return b.currentSite().Normalise(raw)
+}
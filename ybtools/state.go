@@ -0,0 +1,337 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+)
+
+// stateContentModel is the content model state pages have to have, so that the wiki
+// refuses anything that isn't valid JSON, whoever's editing them.
+const stateContentModel string = "json"
+
+// stateNoticeKey and stateVersionKey are the keys in a state document that hold the notice
+// to anybody editing the page and the schema version, alongside the task's own fields.
+const stateNoticeKey string = "DO NOT TOUCH THIS PAGE"
+const stateVersionKey string = "schemaversion"
+
+// stateSaveAttempts is how many times a state page will be saved, merging it with the
+// latest version in between, before giving up on edit conflicts.
+const stateSaveAttempts int = 3
+
+// ErrStateConflict is returned when a state page has been edited by somebody else since it was
+// loaded, and the store either has no Merge function or still conflicts after merging.
+var ErrStateConflict = errors.New("state page was edited since it was loaded")
+
+// ErrStateContentModel is returned when a state page doesn't have the JSON content model.
+var ErrStateContentModel = errors.New("state page doesn't have the " + stateContentModel + " content model")
+
+// StateMigration upgrades a state document from one schema version to the next, by changing
+// its top-level fields in place.
+type StateMigration func(document map[string]json.RawMessage) error
+
+// StateStore keeps a task's state between runs as a JSON document on a wiki page, given by
+// either Title or PageID. The document is T's fields, alongside Notice, if it's set, warning
+// people not to edit the page, and the schema version.
+//
+// Version is the schema version T is for; documents at an older version are upgraded with the
+// Migrations registered from each version to the next before they're decoded, and documents
+// at a newer version are refused, so that an old task can't overwrite them. Documents from
+// before the state store, with no version on them, are version 0.
+//
+// Merge, if it's set, is used when somebody else has edited the page since it was loaded. It's
+// given the state as it was loaded, the state being saved, and the state now on the page, and
+// returns the state to save instead.
+type StateStore[T any] struct {
+	Title      string
+	PageID     string
+	Notice     string
+	Version    int
+	Migrations map[int]StateMigration
+	Merge      func(base, ours, theirs T) T
+}
+
+// State is a task's state as loaded from a StateStore, along with the revision of the
+// page it was loaded from, which is zero if the page doesn't exist yet. After saving,
+// Revision only has the ID and timestamp of the revision that was saved.
+type State[T any] struct {
+	Data     T
+	Revision Revision
+
+	// base is the document as it was loaded, after migrating, so that it can be decoded
+	// afresh for merging, whatever has been done to Data since
+	base []byte
+}
+
+// Exists returns whether the state was loaded from, or has been saved to, a page that exists.
+func (s *State[T]) Exists() bool {
+	return !s.Revision.Timestamp.IsZero()
+}
+
+// Load fetches the state page from the bot's wiki and decodes its document. If the page is given by title and
+// doesn't exist, the State is empty, and the page is created when it's saved.
+func (s *StateStore[T]) Load(b *Bot) (*State[T], error) {
+	identifierName, identifier := s.identifier("titles", "pageids")
+	resp, err := b.client.Get(params.Values{
+		"action":       "query",
+		identifierName: identifier,
+		"prop":         "revisions",
+		"rvprop":       "ids|timestamp|content|contentmodel",
+		"rvslots":      "main",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := PagesFromQuery(resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) < 1 || pages[0].Invalid {
+		return nil, fmt.Errorf("state page %s isn't a valid page", s)
+	}
+	if pages[0].Missing {
+		if s.PageID != "" {
+			return nil, fmt.Errorf("state page %s doesn't exist: %w", s, mwclient.ErrPageNotFound)
+		}
+		return &State[T]{}, nil
+	}
+
+	rev, err := pages[0].LatestRevision()
+	if err != nil {
+		return nil, err
+	}
+	slot, err := rev.MainSlot()
+	if err != nil {
+		return nil, err
+	}
+	if slot.ContentModel != stateContentModel {
+		return nil, fmt.Errorf("%w: %s is %s", ErrStateContentModel, s, slot.ContentModel)
+	}
+
+	document, err := s.migrate(slot.Content)
+	if err != nil {
+		return nil, err
+	}
+	state := &State[T]{Revision: rev}
+	if state.base, err = json.Marshal(document); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(state.base, &state.Data); err != nil {
+		return nil, fmt.Errorf("state page %s doesn't match schema version %d: %w", s, s.Version, err)
+	}
+	return state, nil
+}
+
+// Save saves state.Data to the state page, as long as the page hasn't been edited since the
+// state was loaded. If it has, the latest version is loaded and merged with state.Data, and
+// saving is tried again. Once it's saved, state is left as what was saved, so it can be
+// changed and saved again. If the page didn't change, the error is mwclient.ErrEditNoChange.
+// Saves aren't counted for edit limiting, and don't check the kill switch, as state has
+// to be kept right however the run ends.
+func (s *StateStore[T]) Save(b *Bot, state *State[T], summary string) error {
+	for attempt := 1; ; attempt++ {
+		text, err := s.encode(state.Data)
+		if err != nil {
+			return err
+		}
+
+		identifierName, identifier := s.identifier("title", "pageid")
+		editParams := params.Values{
+			identifierName:  identifier,
+			"summary":       summary,
+			"bot":           "true",
+			"text":          text,
+			"contentmodel":  stateContentModel,
+			"contentformat": "application/json",
+		}
+		if state.Exists() {
+			editParams["basetimestamp"] = state.Revision.Timestamp.Format(time.RFC3339)
+			editParams["nocreate"] = "true"
+		} else {
+			editParams["createonly"] = "true"
+		}
+
+		saved, err := b.postStateEdit(editParams)
+		if err == nil || err == mwclient.ErrEditNoChange {
+			if err == nil {
+				state.Revision = saved
+			}
+			state.base, _ = s.taskFields(state.Data)
+			return err
+		}
+		if !isStateConflict(err) {
+			return err
+		}
+		if s.Merge == nil {
+			return fmt.Errorf("%w: %s", ErrStateConflict, s)
+		}
+		if attempt >= stateSaveAttempts {
+			return fmt.Errorf("%w: %s still conflicted after merging %d times", ErrStateConflict, s, attempt-1)
+		}
+
+		log.Println("Edit conflict saving state page", s, "so merging with the latest version and trying again")
+		latest, err := s.Load(b)
+		if err != nil {
+			return err
+		}
+		var base T
+		if state.base != nil {
+			if err = json.Unmarshal(state.base, &base); err != nil {
+				return err
+			}
+		}
+		latest.Data = s.Merge(base, state.Data, latest.Data)
+		*state = *latest
+	}
+}
+
+func (s *StateStore[T]) String() string {
+	if s.PageID != "" {
+		return "ID " + s.PageID
+	}
+	return s.Title
+}
+
+// identifier returns the parameter name and value identifying the state page,
+// given the names to use for a title and for a page ID.
+func (s *StateStore[T]) identifier(titleName, pageIDName string) (string, string) {
+	if s.PageID != "" {
+		return pageIDName, s.PageID
+	}
+	return titleName, s.Title
+}
+
+// migrate decodes a state document, and upgrades it to the store's schema version,
+// returning just the task's fields.
+func (s *StateStore[T]) migrate(content string) (map[string]json.RawMessage, error) {
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &document); err != nil {
+		return nil, fmt.Errorf("JSON on state page %s is invalid: %w", s, err)
+	}
+	if document == nil {
+		return nil, fmt.Errorf("JSON on state page %s isn't an object", s)
+	}
+
+	version := 0
+	if encodedVersion, ok := document[stateVersionKey]; ok {
+		if err := json.Unmarshal(encodedVersion, &version); err != nil {
+			return nil, fmt.Errorf("state page %s has an invalid %s: %w", s, stateVersionKey, err)
+		}
+	}
+	if version > s.Version {
+		return nil, fmt.Errorf("state page %s is at schema version %d, newer than the %d this task understands, so it won't be touched", s, version, s.Version)
+	}
+	for ; version < s.Version; version++ {
+		migration, ok := s.Migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("state page %s is at schema version %d, and there's no migration from it", s, version)
+		}
+		if err := migration(document); err != nil {
+			return nil, fmt.Errorf("failed to migrate state page %s from schema version %d: %w", s, version, err)
+		}
+		log.Println("Migrated state page", s, "from schema version", version, "to", version+1)
+	}
+
+	delete(document, stateNoticeKey)
+	delete(document, stateVersionKey)
+	return document, nil
+}
+
+// taskFields encodes data as the task's fields of a state document, as they are in State.base.
+func (s *StateStore[T]) taskFields(data T) ([]byte, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]json.RawMessage
+	if err = json.Unmarshal(encoded, &document); err != nil || document == nil {
+		return nil, fmt.Errorf("state for %s has to encode to a JSON object, not %s", s, encoded)
+	}
+	return json.Marshal(document)
+}
+
+// encode turns data into a state document at the store's schema version.
+func (s *StateStore[T]) encode(data T) (string, error) {
+	fields, err := s.taskFields(data)
+	if err != nil {
+		return "", err
+	}
+	var document map[string]json.RawMessage
+	if err = json.Unmarshal(fields, &document); err != nil {
+		return "", err
+	}
+
+	if s.Notice != "" {
+		document[stateNoticeKey], _ = json.Marshal(s.Notice)
+	}
+	document[stateVersionKey], _ = json.Marshal(s.Version)
+	encoded, err := json.Marshal(document)
+	return string(encoded), err
+}
+
+// postStateEdit makes an edit like mwclient's Edit does, but returns the revision it made, so
+// that the state can be saved again on top of it. If the edit didn't change the page, the
+// error is mwclient.ErrEditNoChange.
+func (b *Bot) postStateEdit(p params.Values) (Revision, error) {
+	token, err := b.client.GetToken(mwclient.CSRFToken)
+	if err != nil {
+		return Revision{}, fmt.Errorf("unable to obtain csrf token: %w", err)
+	}
+	p["token"] = token
+	p["action"] = "edit"
+
+	resp, err := b.client.Post(p)
+	if err != nil {
+		return Revision{}, err
+	}
+	if result, _ := resp.GetString("edit", "result"); result != "Success" {
+		edit, _ := resp.GetValue("edit")
+		return Revision{}, fmt.Errorf("unrecognized response: %v", edit)
+	}
+	if nochange, err := resp.GetBoolean("edit", "nochange"); err == nil && nochange {
+		return Revision{}, mwclient.ErrEditNoChange
+	}
+
+	var saved Revision
+	saved.RevID, _ = resp.GetInt64("edit", "newrevid")
+	if newTimestamp, err := resp.GetString("edit", "newtimestamp"); err == nil {
+		saved.Timestamp, _ = time.Parse(time.RFC3339, newTimestamp)
+	}
+	return saved, nil
+}
+
+// isStateConflict returns whether an error from saving a state page means
+// the page changed after it was loaded.
+func isStateConflict(err error) bool {
+	if apiErr, ok := err.(mwclient.APIError); ok {
+		switch apiErr.Code {
+		case "editconflict", "articleexists", "pagedeleted":
+			return true
+		}
+	}
+	return false
+}
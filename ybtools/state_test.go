@@ -0,0 +1,307 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+const testStatePage string = "User:Yapperbot/state.json"
+
+// testState is the state the tests keep, counting something for each name.
+type testState struct {
+	Counts map[string]int `json:"counts"`
+}
+
+// mergeTestStates adds up what each side has counted since base.
+func mergeTestStates(base, ours, theirs testState) testState {
+	merged := testState{Counts: map[string]int{}}
+	for name, count := range theirs.Counts {
+		merged.Counts[name] = count
+	}
+	for name, count := range ours.Counts {
+		merged.Counts[name] += count - base.Counts[name]
+	}
+	return merged
+}
+
+// testMigrations take version 0 documents, which kept the counts as "sent", to version 1,
+// and version 1 documents, which kept them as a list of pairs, to version 2.
+var testMigrations = map[int]StateMigration{
+	0: func(document map[string]json.RawMessage) error {
+		document["pairs"] = document["sent"]
+		delete(document, "sent")
+		return nil
+	},
+	1: func(document map[string]json.RawMessage) error {
+		var pairs [][2]interface{}
+		if err := json.Unmarshal(document["pairs"], &pairs); err != nil {
+			return err
+		}
+		counts := map[string]int{}
+		for _, pair := range pairs {
+			name, ok := pair[0].(string)
+			count, isNumber := pair[1].(float64)
+			if !ok || !isNumber {
+				return errors.New("pair isn't a name and a count")
+			}
+			counts[name] = int(count)
+		}
+		document["counts"], _ = json.Marshal(counts)
+		delete(document, "pairs")
+		return nil
+	},
+}
+
+func testStore() *StateStore[testState] {
+	return &StateStore[testState]{
+		Title:      testStatePage,
+		Notice:     "Don't edit this page",
+		Version:    2,
+		Migrations: testMigrations,
+		Merge:      mergeTestStates,
+	}
+}
+
+func TestStateStoreMigrate(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     map[string]int
+		// err is part of the error wanted, if any
+		err string
+	}{
+		{"current version", `{"schemaversion": 2, "counts": {"a": 1}}`, map[string]int{"a": 1}, ""},
+		{"notice is dropped", `{"DO NOT TOUCH THIS PAGE": "hands off", "schemaversion": 2, "counts": {"a": 1}}`, map[string]int{"a": 1}, ""},
+		{"one version behind", `{"schemaversion": 1, "pairs": [["a", 2], ["b", 3]]}`, map[string]int{"a": 2, "b": 3}, ""},
+		{"no version is version 0", `{"sent": [["a", 4]]}`, map[string]int{"a": 4}, ""},
+		{"explicit version 0", `{"schemaversion": 0, "sent": []}`, map[string]int{}, ""},
+		{"newer version", `{"schemaversion": 3, "counts": {}}`, nil, "newer than the 2"},
+		{"invalid version", `{"schemaversion": "two"}`, nil, "invalid schemaversion"},
+		{"migration fails", `{"schemaversion": 1, "pairs": [[1, 2]]}`, nil, "failed to migrate"},
+		{"not an object", `[1, 2]`, nil, "is invalid"},
+		{"null", `null`, nil, "isn't an object"},
+		{"invalid JSON", `{"counts":`, nil, "is invalid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := testStore().migrate(test.document)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := document[stateNoticeKey]; ok {
+				t.Error("notice was left in the task's fields")
+			}
+			if _, ok := document[stateVersionKey]; ok {
+				t.Error("schema version was left in the task's fields")
+			}
+			var counts map[string]int
+			if err := json.Unmarshal(document["counts"], &counts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(counts, test.want) {
+				t.Errorf("counts = %v, want %v", counts, test.want)
+			}
+		})
+	}
+}
+
+func TestStateStoreMigrateWithoutMigration(t *testing.T) {
+	store := testStore()
+	store.Migrations = map[int]StateMigration{1: testMigrations[1]}
+	if _, err := store.migrate(`{"sent": []}`); err == nil || !strings.Contains(err.Error(), "no migration from it") {
+		t.Errorf("error = %v, want one saying there's no migration", err)
+	}
+}
+
+func TestStateStoreLoadMigratesAndSavesAtCurrentVersion(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: testStatePage, Content: `{"sent": [["a", 1]]}`, ContentModel: "json"})
+	b := testBot(t, wiki)
+
+	state, err := testStore().Load(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Exists() {
+		t.Error("state loaded from a page that exists says it doesn't")
+	}
+	if state.Data.Counts["a"] != 1 {
+		t.Fatalf("counts = %v, want a: 1", state.Data.Counts)
+	}
+
+	state.Data.Counts["a"]++
+	if err := testStore().Save(b, state, "Updating"); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := wiki.Content(testStatePage)
+	var saved map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &saved); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		stateNoticeKey:  "Don't edit this page",
+		stateVersionKey: float64(2),
+		"counts":        map[string]interface{}{"a": float64(2)},
+	}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+}
+
+func TestStateStoreLoadRefusesOtherContentModels(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: testStatePage, Content: `{"counts": {}}`, ContentModel: "wikitext"})
+	b := testBot(t, wiki)
+
+	if _, err := testStore().Load(b); !errors.Is(err, ErrStateContentModel) {
+		t.Errorf("error = %v, want ErrStateContentModel", err)
+	}
+}
+
+func TestStateStoreCreatesMissingPage(t *testing.T) {
+	wiki := mwtest.NewWiki()
+	b := testBot(t, wiki)
+
+	state, err := testStore().Load(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Exists() {
+		t.Fatal("state of a missing page says it exists")
+	}
+	state.Data.Counts = map[string]int{"a": 1}
+	if err := testStore().Save(b, state, "Creating"); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Exists() {
+		t.Error("state doesn't exist after being saved")
+	}
+
+	// saving again goes on top of the revision that was just made
+	state.Data.Counts["a"] = 2
+	if err := testStore().Save(b, state, "Updating"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := testStore().Load(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Data.Counts["a"] != 2 {
+		t.Errorf("counts = %v, want a: 2", loaded.Data.Counts)
+	}
+}
+
+func TestStateStoreMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		loaded string
+		// theirs is what somebody else saves after the state is loaded, if anything
+		theirs string
+		ours   map[string]int
+		merge  bool
+		want   map[string]int
+		err    error
+	}{
+		{
+			name:   "no conflict",
+			loaded: `{"schemaversion": 2, "counts": {"a": 1}}`,
+			ours:   map[string]int{"a": 2},
+			merge:  true,
+			want:   map[string]int{"a": 2},
+		},
+		{
+			name:   "both counted the same name",
+			loaded: `{"schemaversion": 2, "counts": {"a": 1}}`,
+			theirs: `{"schemaversion": 2, "counts": {"a": 3}}`,
+			ours:   map[string]int{"a": 2},
+			merge:  true,
+			want:   map[string]int{"a": 4},
+		},
+		{
+			name:   "each counted a different name",
+			loaded: `{"schemaversion": 2, "counts": {"a": 1}}`,
+			theirs: `{"schemaversion": 2, "counts": {"a": 1, "b": 5}}`,
+			ours:   map[string]int{"a": 1, "c": 2},
+			merge:  true,
+			want:   map[string]int{"a": 1, "b": 5, "c": 2},
+		},
+		{
+			name:   "theirs is at an older version",
+			loaded: `{"schemaversion": 2, "counts": {"a": 1}}`,
+			theirs: `{"schemaversion": 1, "pairs": [["a", 1], ["b", 1]]}`,
+			ours:   map[string]int{"a": 2},
+			merge:  true,
+			want:   map[string]int{"a": 2, "b": 1},
+		},
+		{
+			name:   "no merge function",
+			loaded: `{"schemaversion": 2, "counts": {"a": 1}}`,
+			theirs: `{"schemaversion": 2, "counts": {"a": 3}}`,
+			ours:   map[string]int{"a": 2},
+			merge:  false,
+			want:   map[string]int{"a": 3},
+			err:    ErrStateConflict,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wiki := mwtest.NewWiki()
+			wiki.AddPage(mwtest.PageSpec{Title: testStatePage, Content: test.loaded, ContentModel: "json"})
+			b := testBot(t, wiki)
+			store := testStore()
+			if !test.merge {
+				store.Merge = nil
+			}
+
+			state, err := store.Load(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.theirs != "" {
+				wiki.AddPage(mwtest.PageSpec{Title: testStatePage, Content: test.theirs, ContentModel: "json"})
+			}
+			state.Data.Counts = test.ours
+
+			err = store.Save(b, state, "Updating")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			loaded, err := store.Load(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded.Data.Counts, test.want) {
+				t.Errorf("counts on the page = %v, want %v", loaded.Data.Counts, test.want)
+			}
+		})
+	}
+}
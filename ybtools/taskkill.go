@@ -1,9 +1,5 @@
 package ybtools
 
-import (
-	"cgt.name/pkg/go-mwclient"
-)
-
 //
 // Yapperbot Tools, the internal system bits for Yapperbot and co.
 // Copyright (C) 2020 Naypta
@@ -22,27 +18,165 @@ import (
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+)
+
 const killPageNamespace string = "User:"
 const killPagePrefix string = "/kill/"
+const botKillPageSuffix string = "/kill"
+
+// pauseKeyword is what a kill page has to start with to pause, rather than kill, the task.
+const pauseKeyword string = "pause"
+
+// defaultKillSwitchTTL is how long the state of the kill pages is cached for.
+const defaultKillSwitchTTL time.Duration = time.Minute
+
+// killSwitch is the kill pages, and their cached state: page stops just this task, and
+// botPage every task the bot runs.
+type killSwitch struct {
+	sync.Mutex
+	page    string
+	botPage string
+	checked time.Time
+	paused  bool
+	// pausedBy describes the kill page that paused the task, for the logs
+	pausedBy string
+}
 
-var killPage string
+// killPageState is what a single kill page says.
+type killPageState struct {
+	title     string
+	content   string
+	user      string
+	timestamp string
+}
+
+func (s killPageState) String() string {
+	return s.title + " (last edited by " + s.user + " at " + s.timestamp + "): " + strings.TrimSpace(s.content)
+}
 
-func setKillPage() {
-	killPage = killPageNamespace + settings.BotUser + killPagePrefix + settings.TaskName
+func (b *Bot) setKillPage() {
+	b.kill.page = killPageNamespace + b.settings.BotUser + killPagePrefix + b.settings.TaskName
+	b.kill.botPage = killPageNamespace + b.settings.BotUser + botKillPageSuffix
+
+	b.kill.Lock()
+	defer b.kill.Unlock()
+	b.kill.checked = time.Time{}
+	b.kill.paused = false
 }
 
-// killTaskIfNeeded checks the killPage for the bot task, and
-func killTaskIfNeeded() {
-	wt, err := FetchWikitextFromTitle(killPage)
+// killTaskIfNeeded checks the kill pages for the bot and the task, using the cached state if
+// it was checked recently. If either page has any content, the task is killed with PanicErr, unless
+// the content starts with "pause", in which case the task is paused: CanEdit returns false, but the
+// task carries on otherwise, so that it can save its state. Kill pages take precedence over pauses.
+func (b *Bot) killTaskIfNeeded() {
+	b.kill.Lock()
+	defer b.kill.Unlock()
+
+	if !b.kill.checked.IsZero() && time.Since(b.kill.checked) < b.killSwitchTTL() {
+		return
+	}
+
+	states, err := b.fetchKillPages()
 	if err != nil {
-		// don't panic if the page is just missing - all that means is that nobody has created it
-		if typedErr, ok := err.(mwclient.APIError); ok && typedErr.Code != "missingtitle" {
-			// do the panic - something is deeply wrong
-			PanicErr("Killed - task kill page couldn't be fetched at ", killPage, " with error ", typedErr.Info)
+		if b.kill.checked.IsZero() {
+			// do the panic - we've never managed to check, so we can't know we're allowed to run
+			b.PanicErr("Killed - kill pages couldn't be fetched at ", b.kill.page, " and ", b.kill.botPage, " with error ", err)
 		}
+		log.Println("Failed to refresh kill pages, so using the state from", b.kill.checked, "- error was", err)
+		return
 	}
-	if wt != "" {
-		// page not empty, kill it!
-		PanicErr("Killed - task kill page not empty at ", killPage)
+	b.kill.checked = time.Now()
+
+	var pausedBy string
+	for _, state := range states {
+		if strings.TrimSpace(state.content) == "" {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(state.content)), pauseKeyword) {
+			// page not empty, kill it!
+			b.PanicErr("Killed - kill page not empty at ", state)
+		}
+		if pausedBy == "" {
+			pausedBy = state.String()
+		}
+	}
+
+	switch {
+	case pausedBy != "" && !b.kill.paused:
+		log.Println("Paused - no more edits will be made, as kill page says to pause at", pausedBy)
+	case pausedBy == "" && b.kill.paused:
+		log.Println("Unpaused - kill page no longer says to pause, was", b.kill.pausedBy)
+	}
+	b.kill.paused = pausedBy != ""
+	b.kill.pausedBy = pausedBy
+}
+
+// Paused checks the kill pages, and returns whether the task is paused. While paused,
+// CanEdit always returns false, but edits that must be made anyway (like saving state
+// in the bot's own userspace) can still be made.
+func (b *Bot) Paused() bool {
+	b.killTaskIfNeeded()
+	b.kill.Lock()
+	defer b.kill.Unlock()
+	return b.kill.paused
+}
+
+// killSwitchTTL returns how long kill page states are cached for, from killswitchttl in the global config.
+func (b *Bot) killSwitchTTL() time.Duration {
+	if b.config.KillSwitchTTL == "" {
+		return defaultKillSwitchTTL
+	}
+	ttl, err := time.ParseDuration(b.config.KillSwitchTTL)
+	if err != nil {
+		log.Println("Invalid killswitchttl", b.config.KillSwitchTTL, "so using the default. Error was", err)
+		return defaultKillSwitchTTL
+	}
+	return ttl
+}
+
+// fetchKillPages fetches the task and bot-wide kill pages in a single request,
+// along with who last edited them. Missing pages are returned as empty.
+func (b *Bot) fetchKillPages() ([]killPageState, error) {
+	queryResult, err := b.client.Get(params.Values{
+		"action":  "query",
+		"titles":  b.kill.page + "|" + b.kill.botPage,
+		"prop":    "revisions",
+		"rvprop":  "content|user|timestamp",
+		"rvslots": "main",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := PagesFromQuery(queryResult)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []killPageState
+	for _, page := range pages {
+		state := killPageState{title: page.Title}
+		if page.Missing || len(page.Revisions) < 1 {
+			// nobody has created it - that's fine
+			states = append(states, state)
+			continue
+		}
+
+		rev := page.Revisions[0]
+		state.content, err = rev.Content()
+		if err != nil {
+			return nil, err
+		}
+		state.user = rev.User
+		state.timestamp = rev.Timestamp.Format(time.RFC3339)
+		states = append(states, state)
 	}
+	return states, nil
 }
@@ -0,0 +1,130 @@
+package title
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// SiteinfoProps is the siprop to ask for in a meta=siteinfo query, for everything FromSiteinfo needs.
+const SiteinfoProps string = "general|namespaces|namespacealiases"
+
+// firstLetterCase is the case siteinfo gives for namespaces whose titles have an uppercase first letter.
+const firstLetterCase string = "first-letter"
+
+// ErrNoNamespaces is returned by FromSiteinfo when the response has no namespaces in it,
+// most likely because they weren't asked for.
+var ErrNoNamespaces = errors.New("siteinfo has no namespaces; ask for siprop=" + SiteinfoProps)
+
+// FromSiteinfo makes a Site from the JSON response to an action=query&meta=siteinfo request
+// with siprop set to SiteinfoProps, in formatversion 2, as mwclient always asks for.
+func FromSiteinfo(response []byte) (*Site, error) {
+	var decoded struct {
+		Query struct {
+			Namespaces map[string]struct {
+				ID        int    `json:"id"`
+				Case      string `json:"case"`
+				Name      string `json:"name"`
+				Canonical string `json:"canonical"`
+				Subpages  bool   `json:"subpages"`
+			} `json:"namespaces"`
+			NamespaceAliases []struct {
+				ID    int    `json:"id"`
+				Alias string `json:"alias"`
+			} `json:"namespacealiases"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal(response, &decoded); err != nil {
+		return nil, err
+	}
+	if len(decoded.Query.Namespaces) == 0 {
+		return nil, ErrNoNamespaces
+	}
+
+	aliases := map[int][]string{}
+	for _, alias := range decoded.Query.NamespaceAliases {
+		aliases[alias.ID] = append(aliases[alias.ID], alias.Alias)
+	}
+	namespaces := make([]Namespace, 0, len(decoded.Query.Namespaces))
+	for _, ns := range decoded.Query.Namespaces {
+		namespaces = append(namespaces, Namespace{
+			ID:          ns.ID,
+			Name:        ns.Name,
+			Canonical:   ns.Canonical,
+			Aliases:     aliases[ns.ID],
+			FirstLetter: ns.Case == firstLetterCase,
+			Subpages:    ns.Subpages,
+		})
+	}
+	return NewSite(namespaces), nil
+}
+
+var defaultSite *Site
+var defaultSiteOnce sync.Once
+
+// DefaultSite returns a Site with English Wikipedia's namespaces and their usual aliases, for
+// handling titles before the wiki has been asked for its own, or where it can't be asked.
+func DefaultSite() *Site {
+	defaultSiteOnce.Do(func() {
+		var namespaces []Namespace
+		add := func(id int, name, canonical string, subpages bool, aliases ...string) {
+			if canonical == "" {
+				canonical = name
+			}
+			namespaces = append(namespaces, Namespace{
+				ID:          id,
+				Name:        name,
+				Canonical:   canonical,
+				Aliases:     aliases,
+				FirstLetter: true,
+				Subpages:    subpages,
+			})
+		}
+		add(NamespaceMedia, "Media", "", false)
+		add(NamespaceSpecial, "Special", "", false)
+		add(NamespaceMain, "", "", false)
+		add(NamespaceTalk, "Talk", "", true)
+		add(NamespaceUser, "User", "", true)
+		add(NamespaceUserTalk, "User talk", "", true)
+		add(NamespaceProject, "Wikipedia", "Project", true, "WP")
+		add(NamespaceProjectTalk, "Wikipedia talk", "Project talk", true, "WT")
+		add(NamespaceFile, "File", "", false, "Image")
+		add(NamespaceFileTalk, "File talk", "", true, "Image talk")
+		add(NamespaceMediaWiki, "MediaWiki", "", false)
+		add(NamespaceMediaWikiTalk, "MediaWiki talk", "", true)
+		add(NamespaceTemplate, "Template", "", true)
+		add(NamespaceTemplateTalk, "Template talk", "", true)
+		add(NamespaceHelp, "Help", "", true)
+		add(NamespaceHelpTalk, "Help talk", "", true)
+		add(NamespaceCategory, "Category", "", false)
+		add(NamespaceCategoryTalk, "Category talk", "", true)
+		add(100, "Portal", "", true)
+		add(101, "Portal talk", "", true)
+		add(118, "Draft", "", true)
+		add(119, "Draft talk", "", true)
+		add(710, "TimedText", "", false)
+		add(711, "TimedText talk", "", true)
+		add(828, "Module", "", true)
+		add(829, "Module talk", "", true)
+		defaultSite = NewSite(namespaces)
+	})
+	return defaultSite
+}
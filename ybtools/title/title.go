@@ -0,0 +1,289 @@
+// Package title parses, normalises and compares page titles and usernames the way a particular
+// wiki does, using the namespaces, namespace aliases and case rules from the wiki's siteinfo.
+// A Site can be made from a siteinfo response with FromSiteinfo, or DefaultSite can be used
+// where the wiki can't be asked, which knows English Wikipedia's namespaces.
+package title
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The IDs of the namespaces every MediaWiki wiki has, whatever they're called there.
+const (
+	NamespaceMedia         int = -2
+	NamespaceSpecial       int = -1
+	NamespaceMain          int = 0
+	NamespaceTalk          int = 1
+	NamespaceUser          int = 2
+	NamespaceUserTalk      int = 3
+	NamespaceProject       int = 4
+	NamespaceProjectTalk   int = 5
+	NamespaceFile          int = 6
+	NamespaceFileTalk      int = 7
+	NamespaceMediaWiki     int = 8
+	NamespaceMediaWikiTalk int = 9
+	NamespaceTemplate      int = 10
+	NamespaceTemplateTalk  int = 11
+	NamespaceHelp          int = 12
+	NamespaceHelpTalk      int = 13
+	NamespaceCategory      int = 14
+	NamespaceCategoryTalk  int = 15
+)
+
+// ErrEmpty is returned when a title has nothing in it once it's been normalised,
+// or nothing but a namespace.
+var ErrEmpty = errors.New("title is empty")
+
+// ErrInvalid is returned when a title has characters in it that MediaWiki doesn't allow in titles.
+var ErrInvalid = errors.New("title has characters that aren't allowed in titles")
+
+// invalidTitleChars are the characters that can never be in a title, as they mean something in links.
+const invalidTitleChars string = "<>[]{}|"
+
+// Namespace is one of a wiki's namespaces.
+type Namespace struct {
+	ID int
+	// Name is what the namespace is called on the wiki, which is empty for the main namespace
+	Name string
+	// Canonical is the English name every wiki also recognises, like Project for Wikipedia
+	Canonical string
+	Aliases   []string
+	// FirstLetter is whether the first letter of titles in the namespace is always uppercase,
+	// as it is on almost every wiki, rather than titles being case-sensitive throughout
+	FirstLetter bool
+	Subpages    bool
+}
+
+// Site is the set of namespaces a wiki has, along with what they're called, which is what it
+// takes to handle titles the way the wiki does. It's safe for concurrent use.
+type Site struct {
+	namespaces map[int]Namespace
+	// byName maps every lowercased name, canonical name and alias of each namespace to its ID
+	byName map[string]int
+}
+
+// NewSite returns a Site with the given namespaces.
+func NewSite(namespaces []Namespace) *Site {
+	s := &Site{namespaces: map[int]Namespace{}, byName: map[string]int{}}
+	for _, ns := range namespaces {
+		s.namespaces[ns.ID] = ns
+		for _, name := range append([]string{ns.Name, ns.Canonical}, ns.Aliases...) {
+			if name = strings.ToLower(clean(name)); name != "" {
+				s.byName[name] = ns.ID
+			}
+		}
+	}
+	return s
+}
+
+// Namespace returns the namespace with the given ID, and whether the wiki has it.
+func (s *Site) Namespace(id int) (Namespace, bool) {
+	ns, ok := s.namespaces[id]
+	return ns, ok
+}
+
+// NamespaceID returns the ID of the namespace with the given name, canonical name or alias,
+// in any case, and whether the wiki has it.
+func (s *Site) NamespaceID(name string) (int, bool) {
+	id, ok := s.byName[strings.ToLower(clean(name))]
+	return id, ok
+}
+
+// Title is a page title, parsed and normalised by a Site.
+type Title struct {
+	Namespace int
+	// Text is the title without its namespace, with spaces rather than underscores
+	Text string
+	// Fragment is whatever came after a # in the title, which isn't part of the page's title
+	Fragment string
+
+	site *Site
+}
+
+// String returns the full title of the page, with its namespace as the wiki names it,
+// but without the fragment.
+func (t Title) String() string {
+	if t.site != nil {
+		if ns, ok := t.site.namespaces[t.Namespace]; ok && ns.Name != "" {
+			return ns.Name + ":" + t.Text
+		}
+	}
+	return t.Text
+}
+
+// DBKey returns the full title with underscores in place of spaces, as it's kept in the database.
+func (t Title) DBKey() string {
+	return strings.ReplaceAll(t.String(), " ", "_")
+}
+
+// Root returns the title without its namespace, up to the first slash if the namespace has
+// subpages, which is the page the title is a subpage of, or the title itself if it isn't one.
+func (t Title) Root() string {
+	if t.site != nil {
+		if ns, ok := t.site.namespaces[t.Namespace]; ok && !ns.Subpages {
+			return t.Text
+		}
+	}
+	root, _, _ := strings.Cut(t.Text, "/")
+	return root
+}
+
+// Username returns the user the title belongs to, if it's a user page, a user talk page
+// or a subpage of either.
+func (t Title) Username() (string, bool) {
+	if t.Namespace != NamespaceUser && t.Namespace != NamespaceUserTalk {
+		return "", false
+	}
+	return t.Root(), true
+}
+
+// Equal returns whether two titles are of the same page.
+func (t Title) Equal(other Title) bool {
+	return t.Namespace == other.Namespace && t.Text == other.Text
+}
+
+// Parse parses a title, which is in the main namespace unless it starts with the name of
+// another namespace.
+func (s *Site) Parse(raw string) (Title, error) {
+	return s.ParseIn(raw, NamespaceMain)
+}
+
+// ParseIn parses a title, which is in defaultNamespace unless it starts with the name of
+// another namespace, as with a template's name in a transclusion. A title starting with a
+// colon is always in the main namespace. Underscores and runs of whitespace become single
+// spaces, and the first letter is uppercased if the namespace's titles are first-letter.
+// Interwiki prefixes aren't recognised, so they're taken as part of a main namespace title.
+func (s *Site) ParseIn(raw string, defaultNamespace int) (Title, error) {
+	text := clean(raw)
+	t := Title{Namespace: defaultNamespace, site: s}
+	if strings.HasPrefix(text, ":") {
+		text = strings.TrimSpace(text[1:])
+		t.Namespace = NamespaceMain
+	}
+	text, fragment, _ := strings.Cut(text, "#")
+	t.Fragment = strings.TrimSpace(fragment)
+	text = strings.TrimSpace(text)
+
+	if prefix, rest, found := strings.Cut(text, ":"); found {
+		if id, ok := s.NamespaceID(prefix); ok {
+			t.Namespace = id
+			text = strings.TrimSpace(rest)
+		}
+	}
+
+	if text == "" {
+		return Title{}, fmt.Errorf("%w: %q", ErrEmpty, raw)
+	}
+	if strings.ContainsAny(text, invalidTitleChars) || strings.IndexFunc(text, unicode.IsControl) >= 0 {
+		return Title{}, fmt.Errorf("%w: %q", ErrInvalid, raw)
+	}
+
+	if ns, ok := s.namespaces[t.Namespace]; !ok || ns.FirstLetter {
+		text = UpperFirst(text)
+	}
+	t.Text = text
+	return t, nil
+}
+
+// NewTitle returns the title of the page with the given text in the given namespace, with
+// the text normalised as ParseIn would, but never taken to have a namespace of its own.
+func (s *Site) NewTitle(namespace int, text string) Title {
+	text = clean(text)
+	if ns, ok := s.namespaces[namespace]; !ok || ns.FirstLetter {
+		text = UpperFirst(text)
+	}
+	return Title{Namespace: namespace, Text: text, site: s}
+}
+
+// Normalise returns the full title as the wiki would have it. Titles that can't be parsed
+// are returned with only their spacing normalised, so that they can still be compared.
+func (s *Site) Normalise(raw string) string {
+	t, err := s.Parse(raw)
+	if err != nil {
+		return clean(raw)
+	}
+	return t.String()
+}
+
+// TemplateName normalises the name of a template, as written in a transclusion or as the title
+// of its page, for comparing with other template names. Templates are given without the Template
+// namespace, which is recognised by any of its names on the wiki, like Vorlage: on German wikis;
+// those from other namespaces keep theirs, and those from the main namespace start with a colon.
+// Names that can't be parsed are returned with only their spacing normalised.
+func (s *Site) TemplateName(raw string) string {
+	t, err := s.ParseIn(raw, NamespaceTemplate)
+	switch {
+	case err != nil:
+		return clean(raw)
+	case t.Namespace == NamespaceTemplate:
+		return t.Text
+	case t.Namespace == NamespaceMain:
+		return ":" + t.Text
+	}
+	return t.String()
+}
+
+// Equal returns whether two titles are of the same page, however they're written.
+func (s *Site) Equal(a, b string) bool {
+	return s.Normalise(a) == s.Normalise(b)
+}
+
+// Username normalises a username, which can be given with or without a User: or User talk:
+// prefix in any of the ways the wiki names those namespaces, or as a subpage of either.
+func (s *Site) Username(raw string) string {
+	t, err := s.ParseIn(raw, NamespaceUser)
+	if err != nil {
+		return UpperFirst(clean(raw))
+	}
+	if name, ok := t.Username(); ok {
+		return name
+	}
+	// a username that happens to start with the name of another namespace
+	return UpperFirst(clean(raw))
+}
+
+// UserFromTitle returns the user a page belongs to, if it's a user page, a user talk page
+// or a subpage of either.
+func (s *Site) UserFromTitle(raw string) (string, bool) {
+	t, err := s.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	return t.Username()
+}
+
+// clean turns underscores and runs of whitespace into single spaces, trims them from the ends,
+// and drops the left-to-right and right-to-left marks MediaWiki strips from titles.
+func clean(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '_':
+			return ' '
+		case '\u200e', '\u200f':
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
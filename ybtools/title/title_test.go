@@ -0,0 +1,244 @@
+package title
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"errors"
+	"testing"
+)
+
+// localisedSiteinfo is a siteinfo response from a German wiki, whose main namespace,
+// unlike most, is case-sensitive.
+const localisedSiteinfo string = `{"batchcomplete": true, "query": {
+	"namespaces": {
+		"0": {"id": 0, "case": "case-sensitive", "name": "", "content": true},
+		"1": {"id": 1, "case": "first-letter", "name": "Diskussion", "canonical": "Talk", "subpages": true},
+		"2": {"id": 2, "case": "first-letter", "name": "Benutzer", "canonical": "User", "subpages": true},
+		"3": {"id": 3, "case": "first-letter", "name": "Benutzer Diskussion", "canonical": "User talk", "subpages": true},
+		"4": {"id": 4, "case": "first-letter", "name": "Wikipedia", "canonical": "Project", "subpages": true},
+		"10": {"id": 10, "case": "first-letter", "name": "Vorlage", "canonical": "Template", "subpages": true}
+	},
+	"namespacealiases": [
+		{"id": 2, "alias": "Benutzerin"},
+		{"id": 4, "alias": "WP"}
+	]
+}}`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw       string
+		namespace int
+		want      string
+		fragment  string
+		err       error
+	}{
+		{"Example", NamespaceMain, "Example", "", nil},
+		{"example", NamespaceMain, "Example", "", nil},
+		{"éclair", NamespaceMain, "Éclair", "", nil},
+		{"Example_page", NamespaceMain, "Example page", "", nil},
+		{"  Example__page  ", NamespaceMain, "Example page", "", nil},
+		{"Example\u200e page", NamespaceMain, "Example page", "", nil},
+		{"talk:example", NamespaceTalk, "Talk:Example", "", nil},
+		{"User_talk:example", NamespaceUserTalk, "User talk:Example", "", nil},
+		{"user talk : example", NamespaceUserTalk, "User talk:Example", "", nil},
+		{"Wikipedia:Village pump", NamespaceProject, "Wikipedia:Village pump", "", nil},
+		{"WP:AN", NamespaceProject, "Wikipedia:AN", "", nil},
+		{"wt:AN", NamespaceProjectTalk, "Wikipedia talk:AN", "", nil},
+		{"Project:About", NamespaceProject, "Wikipedia:About", "", nil},
+		{"Project_talk:About", NamespaceProjectTalk, "Wikipedia talk:About", "", nil},
+		{"Image:Example.jpg", NamespaceFile, "File:Example.jpg", "", nil},
+		{"image talk:example.jpg", NamespaceFileTalk, "File talk:Example.jpg", "", nil},
+		{":Template:Example", NamespaceTemplate, "Template:Example", "", nil},
+		{":Example", NamespaceMain, "Example", "", nil},
+		{"Example#History", NamespaceMain, "Example", "History", nil},
+		{"Not a namespace:example", NamespaceMain, "Not a namespace:example", "", nil},
+		{"", 0, "", "", ErrEmpty},
+		{"Talk:", 0, "", "", ErrEmpty},
+		{"#History", 0, "", "", ErrEmpty},
+		{"Example[1]", 0, "", "", ErrInvalid},
+		{"Template:{{Example}}", 0, "", "", ErrInvalid},
+	}
+	site := DefaultSite()
+	for _, test := range tests {
+		got, err := site.Parse(test.raw)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Parse(%q) error = %v, want %v", test.raw, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Namespace != test.namespace || got.String() != test.want || got.Fragment != test.fragment {
+			t.Errorf("Parse(%q) = %d %q #%q, want %d %q #%q", test.raw, got.Namespace, got.String(), got.Fragment, test.namespace, test.want, test.fragment)
+		}
+	}
+}
+
+func TestParseIn(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"example", "Template:Example"},
+		{"Template:example", "Template:Example"},
+		{"User:Example/sandbox", "User:Example/sandbox"},
+		{":Example", "Example"},
+	}
+	site := DefaultSite()
+	for _, test := range tests {
+		got, err := site.ParseIn(test.raw, NamespaceTemplate)
+		if err != nil {
+			t.Errorf("ParseIn(%q) error = %v", test.raw, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("ParseIn(%q) = %q, want %q", test.raw, got.String(), test.want)
+		}
+	}
+}
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"example_page", "Example page"},
+		{"WP:Bots/Requests_for_approval", "Wikipedia:Bots/Requests for approval"},
+		{"Image:example.jpg", "File:Example.jpg"},
+		// titles that can't be parsed only have their spacing normalised
+		{"example_[page]", "example [page]"},
+		{"  ", ""},
+	}
+	site := DefaultSite()
+	for _, test := range tests {
+		if got := site.Normalise(test.raw); got != test.want {
+			t.Errorf("Normalise(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+
+	if !site.Equal("wp:AN", "Wikipedia:AN") {
+		t.Error("wp:AN and Wikipedia:AN aren't equal")
+	}
+	if site.Equal("Example", "Talk:Example") {
+		t.Error("Example and Talk:Example are equal")
+	}
+}
+
+func TestUsername(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"Example", "Example"},
+		{"example_user", "Example user"},
+		{"User:Example", "Example"},
+		{"user_talk:example", "Example"},
+		{"User:Example/sandbox", "Example"},
+		{"User talk:Example/Archive 1", "Example"},
+		// names given without a prefix can have colons in them
+		{"Example:Bot", "Example:Bot"},
+		{"User:Example:Bot/sandbox", "Example:Bot"},
+		// or even start with the name of a namespace that isn't a user one
+		{"Talk:Example", "Talk:Example"},
+		{"wp:example", "Wp:example"},
+	}
+	site := DefaultSite()
+	for _, test := range tests {
+		if got := site.Username(test.raw); got != test.want {
+			t.Errorf("Username(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+
+	if user, ok := site.UserFromTitle("User talk:Example:Bot/Archive"); !ok || user != "Example:Bot" {
+		t.Errorf("UserFromTitle = %q, %v, want Example:Bot", user, ok)
+	}
+	if _, ok := site.UserFromTitle("Wikipedia:Example/User"); ok {
+		t.Error("UserFromTitle found a user for a project page")
+	}
+}
+
+func TestTemplateName(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"Example", "Example"},
+		{"example_template", "Example template"},
+		{"Template:example", "Example"},
+		{" template : Example ", "Example"},
+		{"User:Example/template", "User:Example/template"},
+		{"WP:Example", "Wikipedia:Example"},
+		{":Example", ":Example"},
+		{"Example{{", "Example{{"},
+	}
+	site := DefaultSite()
+	for _, test := range tests {
+		if got := site.TemplateName(test.raw); got != test.want {
+			t.Errorf("TemplateName(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestFromSiteinfo(t *testing.T) {
+	site, err := FromSiteinfo([]byte(localisedSiteinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"vorlage:beispiel", "Vorlage:Beispiel"},
+		{"Template:beispiel", "Vorlage:Beispiel"},
+		{"benutzerin:beispiel", "Benutzer:Beispiel"},
+		{"User_talk:beispiel", "Benutzer Diskussion:Beispiel"},
+		{"WP:Fragen", "Wikipedia:Fragen"},
+		{"Project:Fragen", "Wikipedia:Fragen"},
+		// the main namespace is case-sensitive here
+		{"iPhone", "iPhone"},
+		{"diskussion:iPhone", "Diskussion:IPhone"},
+		// English names are only known for namespaces the wiki gave a canonical name for
+		{"File:Beispiel.jpg", "File:Beispiel.jpg"},
+	}
+	for _, test := range tests {
+		if got := site.Normalise(test.raw); got != test.want {
+			t.Errorf("Normalise(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+
+	if got := site.TemplateName("Vorlage:beispiel"); got != "Beispiel" {
+		t.Errorf("TemplateName = %q, want Beispiel", got)
+	}
+	if got := site.Username("Benutzerin:beispiel/Archiv"); got != "Beispiel" {
+		t.Errorf("Username = %q, want Beispiel", got)
+	}
+	if ns, ok := site.Namespace(NamespaceTemplate); !ok || ns.Name != "Vorlage" || ns.Canonical != "Template" || !ns.Subpages {
+		t.Errorf("template namespace = %+v, %v", ns, ok)
+	}
+}
+
+func TestFromSiteinfoErrors(t *testing.T) {
+	if _, err := FromSiteinfo([]byte(`{"query": {"general": {}}}`)); !errors.Is(err, ErrNoNamespaces) {
+		t.Errorf("error = %v, want ErrNoNamespaces", err)
+	}
+	if _, err := FromSiteinfo([]byte(`{"query":`)); err == nil {
+		t.Error("invalid JSON gave no error")
+	}
+}
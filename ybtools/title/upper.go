@@ -1,7 +1,7 @@
-package main
+package title
 
 //
-// Yapperbot-Pruner, the user pruning bot for Wikipedia
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
 // Copyright (C) 2020 Naypta
 
 // This program is free software: you can redistribute it and/or modify
@@ -18,9 +18,14 @@ package main
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 //
 
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
 //
 // Note that this map is taken from https://github.com/wikimedia/operations-mediawiki-config/blob/master/wmf-config/Php72ToUpper.php
-// It is necessary here to ensure that usernames are normalised in the same way as they are on Wikipedia
+// It is necessary here to ensure that titles and usernames are normalised in the same way as they are on Wikipedia
 //
 
 var charReplaceUpcase = map[rune]rune{
@@ -596,3 +601,20 @@ var charReplaceUpcase = map[rune]rune{
 	'𞥂': '𞥂',
 	'𞥃': '𞥃',
 }
+
+// UpperFirst uppercases the first letter of s the way Wikimedia wikis do for first-letter
+// namespaces, which isn't always the same as Go's unicode.ToUpper.
+func UpperFirst(s string) string {
+	first, size := utf8.DecodeRuneInString(s)
+	if first == utf8.RuneError && size <= 1 {
+		return s
+	}
+	upper, ok := charReplaceUpcase[first]
+	if !ok {
+		upper = unicode.ToUpper(first)
+	}
+	if upper == first {
+		return s
+	}
+	return string(upper) + s[size:]
+}
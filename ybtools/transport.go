@@ -0,0 +1,95 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// httpTimeout matches the timeout mwclient gives its own HTTP clients.
+const httpTimeout time.Duration = 30 * time.Second
+
+// newHTTPClient returns the http.Client ybtools installs on every mwclient it hands out,
+// with all of the ybtools transports (dry-run, and so on) layered over base. When replaying
+// a cassette, base is replaced by the replay, so nothing is sent to the wiki at all.
+func (b *Bot) newHTTPClient(base http.RoundTripper) *http.Client {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if b.replaying {
+		base = &replayTransport{replayer: b.replayer}
+	} else if b.recorder != nil {
+		base = &recordTransport{base: base, recorder: b.recorder}
+	}
+	base = &noMaxlagTransport{base: base, bot: b}
+	var rt http.RoundTripper = &retryAfterTransport{base: &metricsTransport{base: base, logRequests: b.logRequests()}, bot: b}
+	if b.dryRun {
+		rt = &dryRunTransport{base: rt, dir: b.dryRunDir, pending: map[string]dryRunPage{}}
+	}
+	// outside the dry run, so that dry-run edits are reported as they would have been made
+	rt = &reportTransport{base: rt, bot: b}
+	return &http.Client{Transport: rt, Timeout: httpTimeout}
+}
+
+// apiRequestParams reads the Action API parameters out of an outgoing request, whether they're
+// in the query string, a urlencoded body or a multipart body. The request body is left intact
+// so that the request can still be sent on afterwards.
+func apiRequestParams(req *http.Request) (url.Values, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.URL.Query(), nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	parsed := req.Clone(req.Context())
+	parsed.Body = io.NopCloser(bytes.NewReader(body))
+	if err := parsed.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	return parsed.Form, nil
+}
+
+// apiResponse builds a synthetic JSON response to req, as if it had come from the API.
+func apiResponse(req *http.Request, body interface{}) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json; charset=utf-8"}},
+		Body:          io.NopCloser(bytes.NewReader(encoded)),
+		ContentLength: int64(len(encoded)),
+		Request:       req,
+	}, nil
+}
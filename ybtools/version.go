@@ -0,0 +1,67 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// unknownVersion is the version of a binary built without any version information.
+const unknownVersion string = "unknown"
+
+var version struct {
+	sync.Once
+	value string
+}
+
+// Version returns the version of the running binary: the git commit it was built from,
+// with "-modified" after it if there were uncommitted changes, or the module version if
+// it was installed with go install. It's recorded in every run report, so that it's clear
+// which version of the code made an edit.
+func Version() string {
+	version.Do(func() {
+		version.value = unknownVersion
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version.value = info.Main.Version
+		}
+
+		var revision string
+		var modified bool
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if revision != "" {
+			version.value = revision
+			if modified {
+				version.value += "-modified"
+			}
+		}
+	})
+	return version.value
+}
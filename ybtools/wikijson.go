@@ -2,8 +2,7 @@ package ybtools
 
 import (
 	"encoding/json"
-
-	"github.com/antonholmquist/jason"
+	"fmt"
 )
 
 //
@@ -25,38 +24,40 @@ import (
 //
 
 // SerializeToJSON takes in any serializable object and returns the serialized JSON string
-func SerializeToJSON(serializable interface{}) string {
+func (b *Bot) SerializeToJSON(serializable interface{}) string {
 	serialized, err := json.Marshal(serializable)
 	if err != nil {
-		PanicErr("Failed to serialize object, dumping what I was trying to serialize: ", serializable)
+		b.PanicErr("Failed to serialize object, dumping what I was trying to serialize: ", serializable)
 	}
 	return string(serialized)
 }
 
-// LoadJSONFromPageID takes a pageID, then loads and deserializes the contained JSON.
-// It returns the deserialised JSON in a jason.Object pointer.
-func LoadJSONFromPageID(pageID string) *jason.Object {
-	storedJSON, err := FetchWikitext(pageID)
+// LoadJSONFromPage fetches the page with the given title, and decodes the JSON on it into a T.
+// If the page doesn't exist, the error is mwclient.ErrPageNotFound. Being generic, it can't be
+// a method of Bot, so it takes the bot to fetch the page with, like StateStore does.
+func LoadJSONFromPage[T any](b *Bot, pageTitle string) (T, error) {
+	storedJSON, _, _, err := b.fetchWikitextFrom("titles", pageTitle)
 	if err != nil {
-		PanicErr("Failed to fetch JSON page with ID ", pageID, " with error ", err)
+		var empty T
+		return empty, err
 	}
-	return parseJSON(storedJSON, "Failed to parse JSON on page ID "+pageID+" with error ")
+	return decodeJSON[T](storedJSON, "page "+pageTitle)
 }
 
-// LoadJSONFromPageTitle takes a title string, then loads and deserializes the contained JSON.
-// It returns the deserialised JSON in a jason.Object pointer.
-func LoadJSONFromPageTitle(pageTitle string) *jason.Object {
-	storedJSON, err := FetchWikitextFromTitle(pageTitle)
+// LoadJSONFromPageID is LoadJSONFromPage for a page ID.
+func LoadJSONFromPageID[T any](b *Bot, pageID string) (T, error) {
+	storedJSON, _, _, err := b.fetchWikitextFrom("pageids", pageID)
 	if err != nil {
-		PanicErr("Failed to fetch JSON page with title ", pageTitle, " with error ", err)
+		var empty T
+		return empty, err
 	}
-	return parseJSON(storedJSON, "Failed to parse JSON on page "+pageTitle+" with error ")
+	return decodeJSON[T](storedJSON, "page ID "+pageID)
 }
 
-func parseJSON(contentToParse string, errorMsg string) *jason.Object {
-	parsedJSON, err := jason.NewObjectFromBytes([]byte(contentToParse))
-	if err != nil {
-		PanicErr(errorMsg, err)
+func decodeJSON[T any](contentToDecode string, describePage string) (T, error) {
+	var decoded T
+	if err := json.Unmarshal([]byte(contentToDecode), &decoded); err != nil {
+		return decoded, fmt.Errorf("JSON on %s is invalid: %w", describePage, err)
 	}
-	return parsedJSON
+	return decoded, nil
 }
@@ -19,7 +19,12 @@ package ybtools
 //
 
 import (
+	"errors"
+	"io"
 	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	"cgt.name/pkg/go-mwclient"
 	"cgt.name/pkg/go-mwclient/params"
@@ -32,8 +37,6 @@ type NoMaxlagFunction func() error
 // PageInQueryCallback is a function used as a callback for ForPageInQuery.
 type PageInQueryCallback func(pageTitle, pageContent, pageContentModel, revTS, curTS string)
 
-var w *mwclient.Client
-
 // DefaultMaxlag is a Maxlag representing sensible defaults for any non-urgent
 // task being run by a Yapperbot.
 var DefaultMaxlag mwclient.Maxlag = mwclient.Maxlag{
@@ -49,132 +52,178 @@ var NoMaxlag mwclient.Maxlag = mwclient.Maxlag{
 	Retries: 3,
 }
 
-// CreateAndAuthenticateClient uses the details already passed into ybtools
-// in setup.go to return a fully-authenticated mwclient
-func CreateAndAuthenticateClient(maxlag mwclient.Maxlag) *mwclient.Client {
-	if settings.TaskName == "" || settings.BotUser == "" {
-		PanicErr("Call ybtools.SetupBot first!")
-	}
+// NoMaxlagDo takes a function which returns an error (or nil),
+// and executes that function with no maxlag on the bot's requests.
+// It returns the same return as the NoMaxlagFunction it's passed.
+// The client's maxlag setting is left alone, as other goroutines may be using the client;
+// instead, maxlag is taken off every request the bot makes until f returns, which can include
+// requests from those goroutines too. That only means they don't wait for lag while f runs.
+func (b *Bot) NoMaxlagDo(f NoMaxlagFunction) error {
+	b.noMaxlag.Add(1)
+	defer b.noMaxlag.Add(-1)
+	return f()
+}
 
-	var err error
+// noMaxlagTransport takes the maxlag parameter off requests made during NoMaxlagDo.
+type noMaxlagTransport struct {
+	base http.RoundTripper
+	bot  *Bot
+}
 
-	w, err = mwclient.New(config.APIEndpoint, "Yapperbot-"+settings.TaskName+" on User:"+settings.BotUser+" - Golang, licensed GNU GPL")
-	if err != nil {
-		PanicErr("Failed to create MediaWiki client with error ", err)
+func (t *noMaxlagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.bot.noMaxlag.Load() == 0 {
+		return t.base.RoundTrip(req)
 	}
 
-	// This is necessary because maxlag.sleep is unexported,
-	// and is only configured correctly for production within
-	// mwclient.New. Annoying, but this is a bit of an edge case /shrug
-	w.Maxlag.On = maxlag.On
-	w.Maxlag.Retries = maxlag.Retries
-	w.Maxlag.Timeout = maxlag.Timeout
+	if req.Method != http.MethodPost {
+		query := req.URL.Query()
+		if query.Get("maxlag") == "" {
+			return t.base.RoundTrip(req)
+		}
+		query.Del("maxlag")
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = query.Encode()
+		return t.base.RoundTrip(req)
+	}
 
-	err = w.Login(config.BotUsername, botPassword)
+	p, err := apiRequestParams(req)
 	if err != nil {
-		PanicErr("Failed to authenticate with MediaWiki with username ", config.BotUsername, " - error was ", err)
+		return nil, err
+	}
+	if p.Get("maxlag") == "" {
+		return t.base.RoundTrip(req)
+	}
+	// encoded the same way as mwclient encodes it, which only ever sends one value for each parameter
+	values := params.Values{}
+	for key := range p {
+		if key != "maxlag" {
+			values[key] = p.Get(key)
+		}
+	}
+	var body string
+	contentType := req.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "multipart/form-data") {
+		if body, contentType, err = values.EncodeMultipart(); err != nil {
+			return nil, err
+		}
+	} else {
+		body = values.Encode()
 	}
 
-	// runs here to make sure we have a client authenticated when we run it
-	killTaskIfNeeded()
-
-	return w
-}
-
-// NoMaxlagDo takes a function which returns an error (or nil),
-// and an mwclient pointer, than executes that function with no maxlag.
-// It returns the same return as the NoMaxlagFunction it's passed.
-func NoMaxlagDo(f NoMaxlagFunction, w *mwclient.Client) error {
-	w.Maxlag.On = false
-	err := f()
-	w.Maxlag.On = true
-	return err
+	req = req.Clone(req.Context())
+	req.Header.Set("Content-Type", contentType)
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(body)), nil
+	}
+	return t.base.RoundTrip(req)
 }
 
 // FetchWikitext takes a pageId and gets the wikitext of that page.
 // The default functionality in the library does not work for this in
 // my experience; it just returns an empty string for some reason. So we're rolling our own!
-func FetchWikitext(pageID string) (content string, err error) {
-	content, _, _, err = fetchWikitextFrom("pageids", pageID)
+func (b *Bot) FetchWikitext(pageID string) (content string, err error) {
+	content, _, _, err = b.fetchWikitextFrom("pageids", pageID)
 	return
 }
 
 // FetchWikitextWithTimestamps takes a pageId and gets the wikitext of that page,
 // also returning the revision timestamp and the current timestamp.
-func FetchWikitextWithTimestamps(pageID string) (content string, revtimestamp string, curtimestamp string, err error) {
-	return fetchWikitextFrom("pageids", pageID)
+func (b *Bot) FetchWikitextWithTimestamps(pageID string) (content string, revtimestamp string, curtimestamp string, err error) {
+	return b.fetchWikitextFrom("pageids", pageID)
 }
 
 // FetchWikitextFromTitle takes a title and gets the wikitext of that page.
-func FetchWikitextFromTitle(pageTitle string) (content string, err error) {
-	content, _, _, err = fetchWikitextFrom("titles", pageTitle)
+func (b *Bot) FetchWikitextFromTitle(pageTitle string) (content string, err error) {
+	content, _, _, err = b.fetchWikitextFrom("titles", pageTitle)
 	return
 }
 
 // FetchWikitextFromTitleWithTimestamps takes a title and gets the wikitext of that page,
 // also returning the revision timestamp and the current timestamp.
-func FetchWikitextFromTitleWithTimestamps(pageTitle string) (content string, revtimestamp string, curtimestamp string, err error) {
-	return fetchWikitextFrom("titles", pageTitle)
+func (b *Bot) FetchWikitextFromTitleWithTimestamps(pageTitle string) (content string, revtimestamp string, curtimestamp string, err error) {
+	return b.fetchWikitextFrom("titles", pageTitle)
 }
 
 // ForPageInQuery takes parameters and a callback function. It then queries using the parameters it is given,
-// and calls the callback function for every page in the query response.
-func ForPageInQuery(parameters params.Values, callback PageInQueryCallback) {
-	query := w.NewQuery(parameters)
+// and calls the callback function for every page in the query response. Every page is counted as scanned
+// in the run report, and pages that can't be handed to the callback are reported as skipped or errored.
+// Pages are handled one at a time, in the order the query returns them; ForPageInQueryConcurrently
+// handles several at once.
+func (b *Bot) ForPageInQuery(parameters params.Values, callback PageInQueryCallback) {
+	query := b.client.NewQuery(parameters)
 	for query.Next() {
-		pages := GetPagesFromQuery(query.Resp())
-
 		curTS, err := query.Resp().GetString("curtimestamp")
 		if err != nil {
-			PanicErr("Failed to get current timestamp! Error was", err)
+			b.PanicErr("Failed to get current timestamp! Error was", err)
 		}
 
-		if len(pages) > 0 {
-			for _, page := range pages {
-				pageTitle, err := page.GetString("title")
-				if err != nil {
-					log.Println("Failed to get title from page, so skipping it. Error was", err)
-					continue
-				}
-
-				if _, err := page.GetValue("missing"); err == nil {
-					log.Printf("Page `%s` is missing, so skipping it: probably deleted. Error was %s\n", pageTitle, err)
-					continue
-				}
-
-				pageRevisions, err := page.GetObjectArray("revisions")
-				if err != nil {
-					log.Printf("Failed to get revisions array from page `%s`, so skipping it. Error was %s\n", pageTitle, err)
-					continue
-				}
-
-				pageContent, err := GetMainSlotFromRevision(pageRevisions[0])
-				if err != nil {
-					log.Printf("Failed to get content from page `%s`, so skipping it. Error was %s\n", pageTitle, err)
-					continue
-				}
-
-				lastTimestamp, err := pageRevisions[0].GetString("timestamp")
-				if err != nil {
-					log.Printf("Failed to get timestamp from revision on page `%s`, so skipping it. Error was %s\n", pageTitle, err)
-					continue
-				}
-
-				pageContentModel, err := pageRevisions[0].GetString("slots", "main", "contentmodel")
-				if err != nil {
-					log.Printf("Failed to get contentmodel from revision on page `%s` so skipping it. Error was %s\n", pageTitle, err)
-				}
-
-				callback(pageTitle, pageContent, pageContentModel, lastTimestamp, curTS)
+		pages, err := PagesFromQuery(query.Resp())
+		if err != nil {
+			b.PanicErr("Failed to decode pages from query with error ", err)
+		}
+		for _, page := range pages {
+			if p, ok := b.queriedPageFrom(page, curTS); ok {
+				callback(p.title, p.content, p.contentModel, p.revTS, p.curTS)
 			}
 		}
 	}
 }
 
+// queriedPage is a page from a query, ready to be handed to a callback.
+type queriedPage struct {
+	title, content, contentModel, revTS, curTS string
+}
+
+// queriedPageFrom takes a page from a query response, counting it as scanned, and pulls out
+// everything callbacks are given about it. If it can't, it reports why, and returns false.
+func (b *Bot) queriedPageFrom(page Page, curTS string) (queriedPage, bool) {
+	b.reportScanned()
+
+	if page.Title == "" {
+		log.Println("Failed to get title from page ID", page.PageID, "so skipping it")
+		b.reportError("", "failed to get title from page")
+		return queriedPage{}, false
+	}
+
+	if page.Missing {
+		log.Printf("Page `%s` is missing, so skipping it: probably deleted\n", page.Title)
+		b.reportSkipped(page.Title, "page is missing")
+		return queriedPage{}, false
+	}
+
+	rev, err := page.LatestRevision()
+	if err != nil {
+		log.Printf("Failed to get revisions from page `%s`, so skipping it. Error was %s\n", page.Title, err)
+		b.reportError(page.Title, "failed to get revisions: "+err.Error())
+		return queriedPage{}, false
+	}
+
+	slot, err := rev.MainSlot()
+	if err != nil {
+		log.Printf("Failed to get content from page `%s`, so skipping it. Error was %s\n", page.Title, err)
+		b.reportError(page.Title, "failed to get content: "+err.Error())
+		return queriedPage{}, false
+	}
+
+	if rev.Timestamp.IsZero() {
+		log.Printf("Failed to get timestamp from revision on page `%s`, so skipping it\n", page.Title)
+		b.reportError(page.Title, "failed to get revision timestamp")
+		return queriedPage{}, false
+	}
+
+	if slot.ContentModel == "" {
+		log.Printf("Failed to get contentmodel from revision on page `%s`\n", page.Title)
+	}
+
+	return queriedPage{page.Title, slot.Content, slot.ContentModel, rev.Timestamp.Format(time.RFC3339), curTS}, true
+}
+
 // fetchWikitextFrom takes an identifier name (i.e. pageids or titles), and one of those identifiers,
 // and then returns the wikitext, the revision timestamp, the current timestamp, and an error.
-func fetchWikitextFrom(identifierName string, identifier string) (string, string, string, error) {
-	queryResult, err := w.Get(params.Values{
+func (b *Bot) fetchWikitextFrom(identifierName string, identifier string) (string, string, string, error) {
+	queryResult, err := b.client.Get(params.Values{
 		"action":       "query",
 		identifierName: identifier,
 		"prop":         "revisions",
@@ -191,21 +240,22 @@ func fetchWikitextFrom(identifierName string, identifier string) (string, string
 		return "", "", "", err
 	}
 
-	pages := GetPagesFromQuery(queryResult)
-	if len(pages) < 1 {
-		return "", "", "", mwclient.ErrPageNotFound
-	}
-
-	rev, err := pages[0].GetObjectArray("revisions")
+	pages, err := PagesFromQuery(queryResult)
 	if err != nil {
 		return "", "", "", err
 	}
+	if len(pages) < 1 || pages[0].Missing {
+		return "", "", "", mwclient.ErrPageNotFound
+	}
 
-	revtimestamp, err := rev[0].GetString("timestamp")
+	rev, err := pages[0].LatestRevision()
 	if err != nil {
 		return "", "", "", err
 	}
+	if rev.Timestamp.IsZero() {
+		return "", "", "", errors.New("no timestamp was returned for the revision")
+	}
 
-	text, err := GetMainSlotFromRevision(rev[0])
-	return text, revtimestamp, curtimestamp, err
+	text, err := rev.Content()
+	return text, rev.Timestamp.Format(time.RFC3339), curtimestamp, err
 }
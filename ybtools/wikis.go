@@ -0,0 +1,177 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// wikisConfigKey is the config key mapping the name of each wiki the task can run on to
+// the config for that wiki, which goes on top of everything else.
+const wikisConfigKey string = "wikis"
+
+// runWideConfigKeys are the config keys that apply to the whole run, rather than each wiki,
+// so can't be set in wikis.
+var runWideConfigKeys = map[string]bool{"alerts": true, "alertdedupe": true}
+
+// Wiki returns the name of the wiki the task is running on now, from wikis in the config,
+// or an empty string if there are no wikis in the config, so it's running on apiendpoint.
+func (b *Bot) Wiki() string {
+	return b.currentWiki
+}
+
+// Wikis returns the names of the wikis the task is running on, in order: those given with
+// -wiki, or else all of those in the config. It's empty if there are no wikis in the config.
+func (b *Bot) Wikis() []string {
+	return append([]string(nil), b.wikis...)
+}
+
+// ForEachWiki calls f for each of the wikis the task is running on in turn, first switching
+// all of ybtools over to that wiki: its config (including the task's, and its endpoint, bot
+// user and credentials), edit limits, kill pages, exclusion templates, run report and metrics.
+// f should do everything main would do for a single wiki, from connecting the client to
+// deferring SaveRunReport and SaveEditLimit, and the task has to reset any state of its own.
+// If f panics, for instance through PanicErr, the panic is logged and the next wiki is run;
+// once they all have been, ForEachWiki panics if any of them did. With no wikis in the
+// config, f is just called once, with an empty name, for the wiki in apiendpoint.
+func (b *Bot) ForEachWiki(f func(wiki string)) {
+	if len(b.wikis) == 0 {
+		f("")
+		return
+	}
+
+	var failed []string
+	for _, wiki := range b.wikis {
+		b.useWiki(wiki)
+		log.Println("Running on", wiki)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Println("Run on", wiki, "failed with", r)
+					failed = append(failed, wiki)
+				}
+			}()
+			f(wiki)
+		}()
+	}
+	if len(failed) > 0 {
+		panic(fmt.Sprint("Run failed on ", strings.Join(failed, ", ")))
+	}
+}
+
+// useWiki switches ybtools over to a wiki, starting afresh everything that's kept per wiki.
+func (b *Bot) useWiki(wiki string) {
+	b.switchWikiConfig(wiki)
+	b.setupRunReport()
+	b.setKillPage()
+	resetMetrics()
+}
+
+// switchWikiConfig decodes the config for a wiki, and sets up the bot user, edit limits and
+// report page from it. The config for every wiki has already been checked by setupConfig.
+func (b *Bot) switchWikiConfig(wiki string) {
+	if wiki != b.currentWiki {
+		b.currentWiki = wiki
+		b.configProblems = nil
+		b.decodeConfig(b.configSearchPath(), wiki)
+	}
+
+	b.settings.BotUser = b.botUserSetting
+	if b.config.BotUser != "" {
+		b.settings.BotUser = b.config.BotUser
+	}
+	b.setupEditLimit(b.taskEditConfig.EditLimit, b.taskEditConfig.EditLimits)
+	b.report.page = b.taskEditConfig.ReportPage
+}
+
+// selectWikis reads the wikis from the config, and works out which the task is running on.
+func (b *Bot) selectWikis() {
+	b.wikis = nil
+	b.currentWiki = ""
+	b.wikiConfigs = map[string]map[interface{}]interface{}{}
+
+	if configured, ok := b.mergedConfig[wikisConfigKey]; ok && configured != nil {
+		sections, ok := configured.(map[interface{}]interface{})
+		if !ok {
+			b.configProblems = append(b.configProblems, wikisConfigKey+" has to map the name of each wiki to its config")
+		}
+		for name, section := range sections {
+			sectionMap, ok := section.(map[interface{}]interface{})
+			if !ok && section != nil {
+				b.configProblems = append(b.configProblems, fmt.Sprint(wikisConfigKey, ".", name, " has to be a map of config keys"))
+				continue
+			}
+			b.wikiConfigs[fmt.Sprint(name)] = sectionMap
+		}
+	}
+
+	if b.options.Wiki == "" {
+		b.wikis = sortedKeys(b.wikiConfigs)
+		return
+	}
+	for _, name := range strings.Split(b.options.Wiki, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := b.wikiConfigs[name]; !ok {
+			b.configProblems = append(b.configProblems, "-wiki names "+name+", which isn't in "+wikisConfigKey+" in the config")
+			continue
+		}
+		b.wikis = append(b.wikis, name)
+	}
+}
+
+// checkWikiConfigSection reports keys in a wiki's section of the config that aren't config keys
+// or can't be set per wiki, and values of the wrong type.
+func (b *Bot) checkWikiConfigSection(wiki string, targets []interface{}) {
+	prefix := wikisConfigKey + "." + wiki
+	section := b.wikiConfigs[wiki]
+	known := knownConfigKeys(targets)
+	var keys []string
+	for key := range section {
+		keys = append(keys, fmt.Sprint(key))
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch {
+		case key == wikisConfigKey || runWideConfigKeys[key]:
+			b.configProblems = append(b.configProblems, prefix+" sets "+key+", which can only be set for every wiki")
+		case !known[key]:
+			b.configProblems = append(b.configProblems, prefix+" sets "+key+", which isn't a config key for "+b.settings.TaskName)
+		}
+	}
+
+	raw, err := yaml.Marshal(section)
+	if err != nil {
+		b.configProblems = append(b.configProblems, prefix+" couldn't be read: "+err.Error())
+		return
+	}
+	for _, target := range targets {
+		err := yaml.Unmarshal(raw, reflect.New(reflect.TypeOf(target).Elem()).Interface())
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, message := range typeErr.Errors {
+				b.configProblems = append(b.configProblems, prefix+": "+yamlLineRegex.ReplaceAllString(message, ""))
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package wikitext
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"regexp"
+	"strings"
+)
+
+// unparsedTags are the tags whose contents aren't parsed for templates or links.
+var unparsedTags = []string{"nowiki", "pre", "source", "syntaxhighlight", "math"}
+
+// closingTags match the closing tag of each of unparsedTags.
+var closingTags = map[string]*regexp.Regexp{}
+
+func init() {
+	for _, name := range unparsedTags {
+		closingTags[name] = regexp.MustCompile(`(?i)</` + name + `\s*>`)
+	}
+}
+
+// context is what's being parsed, which decides what ends a run of wikitext.
+type context int8
+
+const (
+	// inPage is the top level of the text, which only ends with the text
+	inPage context = iota
+	// inTemplate is a template's name or one of its parameters, ended by | or }}
+	inTemplate
+	// inArgumentName is the name of an argument, ended by | or }}}
+	inArgumentName
+	// inArgumentDefault is the default of an argument, ended by }}}
+	inArgumentDefault
+	// inLinkTarget is the target of a link, ended by | or ]]
+	inLinkTarget
+	// inLinkText is the text of a link, ended by ]]
+	inLinkText
+)
+
+// parser parses a single piece of text.
+type parser struct {
+	text string
+	// detached is set when parsing text to be added by an edit, which has no Spans
+	detached bool
+	// depth is how many templates and arguments the parser is inside
+	depth int
+	// parsed remembers the node started at each offset, or nil if none could be, so that text
+	// with a lot of unclosed braces or brackets doesn't take forever to parse
+	parsed map[parsedKey]parsedNode
+	// lastClosing is the offset of the last of each closing }}, }}} and ]] in the text, so that
+	// openings after it can be given up on without reading the rest of the text
+	lastClosing map[string]int
+	// unclosedTags is, for each of unparsedTags, the offset after which it has no closing tag,
+	// once that's been found
+	unclosedTags map[string]int
+}
+
+// parsedKey is a node that's been parsed: its opening, {{, {{{ or [[, and the offset it started
+// at. Links also depend on whether they're inside a template, as they can't cross its end.
+type parsedKey struct {
+	opening string
+	start   int
+	nested  bool
+}
+
+type parsedNode struct {
+	node Node
+	end  int
+}
+
+// Parse parses text as wikitext. It never fails: anything that doesn't parse, like a template
+// that's never closed, is kept as Text, and String always returns text as it was.
+func Parse(text string) *Wikitext {
+	return newParser(text, false).parse()
+}
+
+// parseFragment parses text that's being added to wikitext by an edit.
+func parseFragment(text string) *Wikitext {
+	return newParser(text, true).parse()
+}
+
+func newParser(text string, detached bool) *parser {
+	p := &parser{text: text, detached: detached, parsed: map[parsedKey]parsedNode{}, lastClosing: map[string]int{}, unclosedTags: map[string]int{}}
+	for _, closing := range []string{"}}", "}}}", "]]"} {
+		p.lastClosing[closing] = strings.LastIndex(text, closing)
+	}
+	return p
+}
+
+func (p *parser) parse() *Wikitext {
+	w, _, _, _ := p.run(0, inPage)
+	return w
+}
+
+// unclosed returns whether there's no closing after the opening at start, so it can't be closed.
+func (p *parser) unclosed(start int, opening, closing string) bool {
+	return p.lastClosing[closing] < start+len(opening)
+}
+
+func (p *parser) spanned(start, end int) spanned {
+	if p.detached {
+		return spanned{noSpan}
+	}
+	return spanned{Span{start, end}}
+}
+
+// run parses a run of wikitext from start, until whatever ends it in the given context, which
+// is returned as stop, along with the offset it's at. If the run can't be parsed in the context,
+// for instance because the text ends before the run does, ok is false.
+func (p *parser) run(start int, ctx context) (w *Wikitext, end int, stop string, ok bool) {
+	w = &Wikitext{}
+	text := p.text
+	pos, textStart := start, start
+	flush := func() {
+		if pos > textStart {
+			w.Nodes = append(w.Nodes, &Text{Value: text[textStart:pos], spanned: p.spanned(textStart, pos)})
+		}
+	}
+	add := func(node Node, end int) {
+		flush()
+		w.Nodes = append(w.Nodes, node)
+		pos, textStart = end, end
+	}
+
+	for pos < len(text) {
+		rest := text[pos:]
+		if stop, fails := ctx.ends(rest, p.depth); stop != "" || fails {
+			if fails {
+				return nil, pos, "", false
+			}
+			flush()
+			w.spanned = p.spanned(start, pos)
+			return w, pos, stop, true
+		}
+
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := strings.Index(rest[4:], "-->")
+			if end < 0 {
+				end = len(text)
+			} else {
+				end += pos + 4 + 3
+			}
+			add(&Comment{Value: text[pos:end], spanned: p.spanned(pos, end)}, end)
+		case rest[0] == '<':
+			if tag, end, ok := p.tag(pos); ok {
+				add(tag, end)
+			} else {
+				pos++
+			}
+		case strings.HasPrefix(rest, "{{{"):
+			if argument, end, ok := p.argument(pos); ok {
+				add(argument, end)
+			} else if template, end, ok := p.template(pos); ok {
+				template.parent = w
+				add(template, end)
+			} else {
+				pos += 3
+			}
+		case strings.HasPrefix(rest, "{{"):
+			if template, end, ok := p.template(pos); ok {
+				template.parent = w
+				add(template, end)
+			} else {
+				pos += 2
+			}
+		case strings.HasPrefix(rest, "[["):
+			if link, end, ok := p.link(pos); ok {
+				add(link, end)
+			} else {
+				pos += 2
+			}
+		default:
+			pos++
+		}
+	}
+
+	if ctx != inPage {
+		return nil, pos, "", false
+	}
+	flush()
+	w.spanned = p.spanned(start, pos)
+	return w, pos, "", true
+}
+
+// ends returns what ends a run in the context, if rest starts with it, or whether the run
+// can't carry on at all. Links can't span lines or the end of the template they're in.
+func (ctx context) ends(rest string, depth int) (stop string, fails bool) {
+	switch ctx {
+	case inTemplate:
+		for _, stop := range []string{"|", "}}"} {
+			if strings.HasPrefix(rest, stop) {
+				return stop, false
+			}
+		}
+	case inArgumentName:
+		for _, stop := range []string{"|", "}}}"} {
+			if strings.HasPrefix(rest, stop) {
+				return stop, false
+			}
+		}
+	case inArgumentDefault:
+		if strings.HasPrefix(rest, "}}}") {
+			return "}}}", false
+		}
+	case inLinkTarget:
+		for _, stop := range []string{"|", "]]"} {
+			if strings.HasPrefix(rest, stop) {
+				return stop, false
+			}
+		}
+		return "", rest[0] == '\n' || (depth > 0 && strings.HasPrefix(rest, "}}"))
+	case inLinkText:
+		if strings.HasPrefix(rest, "]]") {
+			return "]]", false
+		}
+		return "", depth > 0 && strings.HasPrefix(rest, "}}")
+	}
+	return "", false
+}
+
+// template parses the template starting with the {{ at start, returning it and the offset just
+// after it, or false if it isn't closed.
+func (p *parser) template(start int) (*Template, int, bool) {
+	key := parsedKey{"{{", start, true}
+	if parsed, ok := p.parsed[key]; ok {
+		t, _ := parsed.node.(*Template)
+		return t, parsed.end, t != nil
+	}
+	if p.unclosed(start, "{{", "}}") {
+		return nil, 0, false
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	t := &Template{}
+	name, pos, stop, ok := p.run(start+2, inTemplate)
+	if !ok {
+		p.parsed[key] = parsedNode{}
+		return nil, 0, false
+	}
+	t.name = name
+
+	for stop == "|" {
+		var value *Wikitext
+		value, pos, stop, ok = p.run(pos+1, inTemplate)
+		if !ok {
+			p.parsed[key] = parsedNode{}
+			return nil, 0, false
+		}
+		t.params = append(t.params, p.param(value))
+	}
+	t.renumber()
+
+	end := pos + len("}}")
+	t.spanned = p.spanned(start, end)
+	p.parsed[key] = parsedNode{t, end}
+	return t, end, true
+}
+
+// param turns a parameter of a template into a Param, splitting it into the name and value at
+// the first = that isn't inside anything else, like a nested template or {{=}}.
+func (p *parser) param(part *Wikitext) *Param {
+	param := &Param{value: part, spanned: part.spanned}
+	for i, node := range part.Nodes {
+		text, ok := node.(*Text)
+		if !ok {
+			continue
+		}
+		equals := strings.IndexByte(text.Value, '=')
+		if equals < 0 {
+			continue
+		}
+
+		name := &Wikitext{Nodes: append([]Node{}, part.Nodes[:i]...)}
+		value := &Wikitext{}
+		nameEnd, valueStart := text.span.Start+equals, text.span.Start+equals+1
+		if equals > 0 {
+			name.Nodes = append(name.Nodes, &Text{Value: text.Value[:equals], spanned: p.spanned(text.span.Start, nameEnd)})
+		}
+		if equals < len(text.Value)-1 {
+			value.Nodes = append(value.Nodes, &Text{Value: text.Value[equals+1:], spanned: p.spanned(valueStart, text.span.End)})
+		}
+		value.Nodes = append(value.Nodes, part.Nodes[i+1:]...)
+		name.spanned = p.spanned(part.span.Start, nameEnd)
+		value.spanned = p.spanned(valueStart, part.span.End)
+
+		param.name, param.value = name, value
+		reparent(part, name)
+		reparent(part, value)
+		return param
+	}
+	return param
+}
+
+// reparent points the templates moved from one Wikitext to another at their new parent.
+func reparent(from, to *Wikitext) {
+	for _, node := range to.Nodes {
+		if t, ok := node.(*Template); ok && t.parent == from {
+			t.parent = to
+		}
+	}
+}
+
+// argument parses the argument starting with the {{{ at start, returning it and the offset just
+// after it, or false if it isn't closed.
+func (p *parser) argument(start int) (*Argument, int, bool) {
+	key := parsedKey{"{{{", start, true}
+	if parsed, ok := p.parsed[key]; ok {
+		a, _ := parsed.node.(*Argument)
+		return a, parsed.end, a != nil
+	}
+	if p.unclosed(start, "{{{", "}}}") {
+		return nil, 0, false
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+
+	a := &Argument{}
+	name, pos, stop, ok := p.run(start+3, inArgumentName)
+	if ok && stop == "|" {
+		a.Default, pos, _, ok = p.run(pos+1, inArgumentDefault)
+	}
+	if !ok {
+		p.parsed[key] = parsedNode{}
+		return nil, 0, false
+	}
+	a.Name = name
+
+	end := pos + len("}}}")
+	a.spanned = p.spanned(start, end)
+	p.parsed[key] = parsedNode{a, end}
+	return a, end, true
+}
+
+// link parses the link starting with the [[ at start, returning it and the offset just after
+// it, or false if it isn't closed.
+func (p *parser) link(start int) (*Link, int, bool) {
+	key := parsedKey{"[[", start, p.depth > 0}
+	if parsed, ok := p.parsed[key]; ok {
+		l, _ := parsed.node.(*Link)
+		return l, parsed.end, l != nil
+	}
+	if p.unclosed(start, "[[", "]]") {
+		return nil, 0, false
+	}
+
+	l := &Link{}
+	target, pos, stop, ok := p.run(start+2, inLinkTarget)
+	if ok && stop == "|" {
+		l.Text, pos, _, ok = p.run(pos+1, inLinkText)
+	}
+	if !ok {
+		p.parsed[key] = parsedNode{}
+		return nil, 0, false
+	}
+	l.Target = target
+
+	end := pos + len("]]")
+	l.spanned = p.spanned(start, end)
+	p.parsed[key] = parsedNode{l, end}
+	return l, end, true
+}
+
+// tag parses the unparsed tag, like <nowiki>, starting with the < at start, returning it and
+// the offset just after its closing tag, or false if it isn't one, or is never closed.
+func (p *parser) tag(start int) (*Tag, int, bool) {
+	rest := p.text[start+1:]
+	for _, name := range unparsedTags {
+		if len(rest) <= len(name) || !strings.EqualFold(rest[:len(name)], name) || !strings.ContainsRune(" \t\n/>", rune(rest[len(name)])) {
+			continue
+		}
+		openEnd := strings.IndexByte(rest, '>')
+		if openEnd < 0 {
+			return nil, 0, false
+		}
+		end := start + 1 + openEnd + 1
+		if rest[openEnd-1] != '/' {
+			if after, ok := p.unclosedTags[name]; ok && end >= after {
+				return nil, 0, false
+			}
+			closing := closingTags[name].FindStringIndex(p.text[end:])
+			if closing == nil {
+				p.unclosedTags[name] = end
+				return nil, 0, false
+			}
+			end += closing[1]
+		}
+		return &Tag{Name: name, Value: p.text[start:end], spanned: p.spanned(start, end)}, end, true
+	}
+	return nil, 0, false
+}
@@ -0,0 +1,434 @@
+// Package wikitext parses the parts of wikitext that bots need to find and change templates:
+// templates, template arguments, links, comments, and tags like nowiki whose contents aren't
+// parsed. Everything else is kept as plain text, so that a parsed page always turns back into
+// exactly the text it was parsed from, and edits to it only change what they touch.
+package wikitext
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Span is where something was in the text it was parsed from, as byte offsets, with End just
+// after it. Spans aren't updated by edits, so they're always offsets into the original text;
+// anything added by an edit has a Span of -1 to -1.
+type Span struct {
+	Start, End int
+}
+
+// noSpan is the Span of anything that wasn't in the parsed text.
+var noSpan = Span{-1, -1}
+
+// spanned is embedded in everything with a Span.
+type spanned struct {
+	span Span
+}
+
+// Span returns where this was in the parsed text.
+func (s spanned) Span() Span {
+	return s.span
+}
+
+// Node is a single piece of wikitext: a Text, Comment, Tag, Template, Argument or Link.
+type Node interface {
+	// String returns the node as wikitext, including any edits made to it.
+	String() string
+	Span() Span
+}
+
+// Wikitext is a run of wikitext: a whole page, or part of a node, like a template's name or the
+// value of one of its parameters.
+type Wikitext struct {
+	Nodes []Node
+	spanned
+}
+
+// Text is wikitext that isn't any of the other kinds of node.
+type Text struct {
+	Value string
+	spanned
+}
+
+// Comment is an HTML comment, <!-- like this -->. Value includes the <!-- and -->, unless the
+// comment was never closed, in which case it carries on to the end of the text.
+type Comment struct {
+	Value string
+	spanned
+}
+
+// Tag is a tag whose contents aren't parsed, like <nowiki>, <pre> or <syntaxhighlight>. Name is
+// in lower case, and Value is the whole of the tag, from the opening tag to the closing one.
+type Tag struct {
+	Name  string
+	Value string
+	spanned
+}
+
+// Link is an internal link, [[Target|Text]]. Text is nil if there's no pipe.
+type Link struct {
+	Target *Wikitext
+	Text   *Wikitext
+	spanned
+}
+
+// Argument is one of a template's own parameters, {{{Name|Default}}}, as used on a template's
+// page. Default is nil if there's no pipe.
+type Argument struct {
+	Name    *Wikitext
+	Default *Wikitext
+	spanned
+}
+
+// Template is a transclusion of a template, or anything else written the same way, like a
+// parser function or a magic word: {{Name|Params}}. {{=}} is a template called "=".
+type Template struct {
+	name   *Wikitext
+	params []*Param
+	// parent is the Wikitext the template is in, so that it can be removed from it
+	parent *Wikitext
+	spanned
+}
+
+// Param is a single parameter of a Template, either named, name=value, or positional. Its Span
+// doesn't include the pipe before it.
+type Param struct {
+	name  *Wikitext
+	value *Wikitext
+	// index is the number of a positional parameter, counting from 1, or 0 for a named one
+	index int
+	spanned
+}
+
+func (w *Wikitext) String() string {
+	var b strings.Builder
+	for _, node := range w.Nodes {
+		b.WriteString(node.String())
+	}
+	return b.String()
+}
+
+// withoutComments returns the wikitext with any comments left out, as templates see it.
+func (w *Wikitext) withoutComments() string {
+	var b strings.Builder
+	for _, node := range w.Nodes {
+		if _, ok := node.(*Comment); !ok {
+			b.WriteString(node.String())
+		}
+	}
+	return b.String()
+}
+
+// Templates returns every template in the wikitext, in the order they start, including those
+// nested inside other templates, arguments and links. Templates inside comments and tags
+// like nowiki aren't templates at all, and aren't included.
+func (w *Wikitext) Templates() []*Template {
+	var templates []*Template
+	w.walk(func(t *Template) {
+		templates = append(templates, t)
+	})
+	return templates
+}
+
+// TemplatesNamed returns the templates in the wikitext called any of names, which are compared
+// as NormaliseTemplateName does, so the names can be given with or without the namespace.
+func (w *Wikitext) TemplatesNamed(names ...string) []*Template {
+	return w.TemplatesNamedBy(NormaliseTemplateName, names...)
+}
+
+// TemplatesNamedBy is TemplatesNamed with the names compared as normalise does, rather than
+// NormaliseTemplateName, so that a wiki's own names for the Template namespace can be recognised,
+// as they are by the TemplateName method of a title.Site.
+func (w *Wikitext) TemplatesNamedBy(normalise func(name string) string, names ...string) []*Template {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[normalise(name)] = true
+	}
+	var templates []*Template
+	w.walk(func(t *Template) {
+		if wanted[t.NameBy(normalise)] {
+			templates = append(templates, t)
+		}
+	})
+	return templates
+}
+
+// walk calls f for every template in the wikitext, in the order they start.
+func (w *Wikitext) walk(f func(t *Template)) {
+	if w == nil {
+		return
+	}
+	for _, node := range w.Nodes {
+		switch n := node.(type) {
+		case *Template:
+			f(n)
+			n.name.walk(f)
+			for _, param := range n.params {
+				param.name.walk(f)
+				param.value.walk(f)
+			}
+		case *Argument:
+			n.Name.walk(f)
+			n.Default.walk(f)
+		case *Link:
+			n.Target.walk(f)
+			n.Text.walk(f)
+		}
+	}
+}
+
+func (t *Text) String() string {
+	return t.Value
+}
+
+func (c *Comment) String() string {
+	return c.Value
+}
+
+func (t *Tag) String() string {
+	return t.Value
+}
+
+func (l *Link) String() string {
+	if l.Text == nil {
+		return "[[" + l.Target.String() + "]]"
+	}
+	return "[[" + l.Target.String() + "|" + l.Text.String() + "]]"
+}
+
+func (a *Argument) String() string {
+	if a.Default == nil {
+		return "{{{" + a.Name.String() + "}}}"
+	}
+	return "{{{" + a.Name.String() + "|" + a.Default.String() + "}}}"
+}
+
+func (t *Template) String() string {
+	var b strings.Builder
+	b.WriteString("{{")
+	b.WriteString(t.name.String())
+	for _, param := range t.params {
+		b.WriteString("|")
+		b.WriteString(param.String())
+	}
+	b.WriteString("}}")
+	return b.String()
+}
+
+// Name returns the template's name, normalised by NormaliseTemplateName, and with any comments
+// in it left out.
+func (t *Template) Name() string {
+	return t.NameBy(NormaliseTemplateName)
+}
+
+// NameBy returns the template's name, without any comments in it, normalised by normalise.
+func (t *Template) NameBy(normalise func(name string) string) string {
+	return normalise(t.name.withoutComments())
+}
+
+// RawName returns the template's name as it's written, with any whitespace and comments around it.
+func (t *Template) RawName() *Wikitext {
+	return t.name
+}
+
+// Params returns the template's parameters, in the order they're written.
+func (t *Template) Params() []*Param {
+	return t.params
+}
+
+// Param returns the parameter with the given name, or nil if there isn't one. Positional
+// parameters are named by their number, so Param("1") is the first of them, unless there's
+// also a 1= parameter after it. If a parameter is given more than once, the last one is
+// returned, as that's the one the template sees.
+func (t *Template) Param(name string) *Param {
+	name = strings.TrimSpace(name)
+	var found *Param
+	for _, param := range t.params {
+		if param.Name() == name {
+			found = param
+		}
+	}
+	return found
+}
+
+// SetParam sets the value of the named parameter, keeping the whitespace around the old value.
+// If the template doesn't have the parameter yet, it's added on the end, as a named parameter
+// laid out like the last named parameter before it, so that it fits in with the others.
+func (t *Template) SetParam(name, value string) {
+	if param := t.Param(name); param != nil {
+		param.SetValue(value)
+		return
+	}
+
+	// copy the spacing of the last named parameter, whether it's {{t|a=b}} or {{t\n| a = b\n}}
+	var nameLeading, nameTrailing, valueLeading, valueTrailing string
+	for i := len(t.params) - 1; i >= 0; i-- {
+		if last := t.params[i]; last.name != nil {
+			nameLeading, _, nameTrailing = splitSpace(last.name.String())
+			valueLeading, _, valueTrailing = splitSpace(last.value.String())
+			break
+		}
+	}
+	if len(t.params) == 0 && strings.HasSuffix(t.name.String(), "\n") {
+		valueTrailing = "\n"
+	}
+
+	t.params = append(t.params, &Param{
+		name:    parseFragment(nameLeading + strings.TrimSpace(name) + nameTrailing),
+		value:   parseFragment(valueLeading + value + valueTrailing),
+		spanned: spanned{noSpan},
+	})
+}
+
+// RemoveParam removes every parameter with the given name, returning whether there were any.
+// Removing a positional parameter moves those after it up by one.
+func (t *Template) RemoveParam(name string) bool {
+	name = strings.TrimSpace(name)
+	kept := t.params[:0]
+	for _, param := range t.params {
+		if param.Name() != name {
+			kept = append(kept, param)
+		}
+	}
+	removed := len(kept) < len(t.params)
+	t.params = kept
+	t.renumber()
+	return removed
+}
+
+// renumber numbers the positional parameters again, after some have been removed.
+func (t *Template) renumber() {
+	index := 0
+	for _, param := range t.params {
+		if param.name == nil {
+			index++
+			param.index = index
+		}
+	}
+}
+
+// Remove takes the template out of the wikitext it's in. If it was on a line of its own, the
+// line break after it goes too, so that no blank line is left behind.
+func (t *Template) Remove() {
+	if t.parent == nil {
+		return
+	}
+	nodes := t.parent.Nodes
+	for i, node := range nodes {
+		if node != Node(t) {
+			continue
+		}
+
+		lineStart := i == 0
+		if i > 0 {
+			previous, ok := nodes[i-1].(*Text)
+			lineStart = ok && strings.HasSuffix(previous.Value, "\n")
+		}
+		if i+1 < len(nodes) && lineStart {
+			if next, ok := nodes[i+1].(*Text); ok {
+				next.Value = strings.TrimPrefix(next.Value, "\n")
+			}
+		}
+
+		t.parent.Nodes = append(nodes[:i:i], nodes[i+1:]...)
+		t.parent = nil
+		return
+	}
+}
+
+func (p *Param) String() string {
+	if p.name == nil {
+		return p.value.String()
+	}
+	return p.name.String() + "=" + p.value.String()
+}
+
+// Positional returns whether the parameter is positional, rather than named.
+func (p *Param) Positional() bool {
+	return p.name == nil
+}
+
+// Name returns the name of a named parameter, without the whitespace around it, or the
+// number of a positional parameter, counting from 1.
+func (p *Param) Name() string {
+	if p.name == nil {
+		return strconv.Itoa(p.index)
+	}
+	return strings.TrimSpace(p.name.withoutComments())
+}
+
+// Value returns the value of the parameter as the template sees it: without comments, and, for
+// named parameters, without the whitespace around it. Positional parameters keep their
+// whitespace, just as they do in MediaWiki.
+func (p *Param) Value() string {
+	if p.name == nil {
+		return p.value.withoutComments()
+	}
+	return strings.TrimSpace(p.value.withoutComments())
+}
+
+// RawName returns the name of a named parameter as it's written, with any whitespace around
+// it, or nil for a positional parameter.
+func (p *Param) RawName() *Wikitext {
+	return p.name
+}
+
+// RawValue returns the value of the parameter as it's written, with any whitespace and
+// comments around it.
+func (p *Param) RawValue() *Wikitext {
+	return p.value
+}
+
+// SetValue sets the value of the parameter. For named parameters, the whitespace around the
+// old value is kept, so that the layout of the template doesn't change.
+func (p *Param) SetValue(value string) {
+	if p.name == nil {
+		p.value = parseFragment(value)
+		return
+	}
+	leading, _, trailing := splitSpace(p.value.String())
+	p.value = parseFragment(leading + value + trailing)
+}
+
+// splitSpace splits s into the whitespace at its start, the rest, and the whitespace at its end.
+func splitSpace(s string) (leading, middle, trailing string) {
+	middle = strings.TrimLeftFunc(s, unicode.IsSpace)
+	leading = s[:len(s)-len(middle)]
+	trimmed := strings.TrimRightFunc(middle, unicode.IsSpace)
+	return leading, trimmed, middle[len(trimmed):]
+}
+
+// NormaliseTemplateName turns the name of a template, as written in a transclusion or as the
+// title of its page, into a form that can be compared: without the Template: namespace, with
+// spaces rather than underscores, and with the first letter in upper case. Templates from other
+// namespaces, like User:Example/template, keep their namespace.
+func NormaliseTemplateName(name string) string {
+	name = strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " ")
+	if prefix, rest, found := strings.Cut(name, ":"); found && strings.EqualFold(strings.TrimSpace(prefix), "template") {
+		name = strings.TrimSpace(rest)
+	}
+	first, size := utf8.DecodeRuneInString(name)
+	if size == 0 {
+		return name
+	}
+	return string(unicode.ToUpper(first)) + name[size:]
+}
@@ -0,0 +1,270 @@
+package wikitext
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"plain text, with no markup at all",
+		"{{Template}}",
+		"{{Template|positional|named=value| spaced = value \n}}",
+		"{{Outer|{{Inner|a=b}}|c={{Inner}}}}",
+		"{{{{Name from a template}}|param}}",
+		"{{{argument}}} and {{{argument|default}}} and {{{a|{{{b|}}}}}}",
+		"{{{{{argument}}}}}",
+		"[[Link]] and [[Link|with text]] and [[Link|{{Template}}]]",
+		"[[File:Example.png|thumb|A caption with [[a link]] in it]]",
+		"{{Template|[[Link|with a pipe]]|after}}",
+		"{{#if: {{{1|}}} | yes | no }}",
+		"{{=}} and {{Template|a{{=}}b}}",
+		"<!-- {{Commented out}} --> {{Template|<!-- a comment -->value}}",
+		"<!-- a comment that's never closed {{Template}}",
+		"<nowiki>{{Not a template}}</nowiki> <pre>{{Nor this}}</pre> <NoWiki>{{Nor this}}</nowiki >",
+		"<nowiki>{{Never closed",
+		"{{Never closed",
+		"{{Never closed|{{Closed}}",
+		"Closing }} with nothing open ]] }}}",
+		"{{Template|[[Never closed link}}",
+		"[[Link|{{Never closed template]]",
+		"{{a|b=c=d|e}}",
+		"{{Ünïcödé|ñame=välue}} 日本語",
+		"{{a\n|b\n|c\n}}\n\n== Heading ==\n{{d}}\n",
+	}
+	for _, text := range tests {
+		if got := Parse(text).String(); got != text {
+			t.Errorf("Parse(%q).String() = %q", text, got)
+		}
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	text := "Before {{Template|a=[[Link]]}} <!-- comment --> {{{arg}}} after"
+	for _, node := range Parse(text).Nodes {
+		span := node.Span()
+		if got := text[span.Start:span.End]; got != node.String() {
+			t.Errorf("node %q has span %v, which is %q", node.String(), span, got)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"No templates here", nil},
+		{"{{a}} {{b|{{c}}}} {{d|e={{f}}}}", []string{"A", "B", "C", "D", "F"}},
+		{"{{template:Foo_bar}} {{ Template : foo  bar }}", []string{"Foo bar", "Foo bar"}},
+		{"{{User:Example/template}}", []string{"User:Example/template"}},
+		{"[[Link|{{a}}]] {{{arg|{{b}}}}}", []string{"A", "B"}},
+		{"{{a<!-- comment -->|b}}", []string{"A"}},
+		{"<!-- {{a}} --> <nowiki>{{b}}</nowiki> {{c", nil},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, template := range Parse(test.text).Templates() {
+			names = append(names, template.Name())
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("templates in %q = %v, want %v", test.text, names, test.want)
+		}
+	}
+}
+
+func TestTemplatesNamed(t *testing.T) {
+	w := Parse("{{Nobots}} {{bots|deny=all}} {{Template:Bots}} {{Other}}")
+	if got := len(w.TemplatesNamed("Template:Bots", "nobots")); got != 3 {
+		t.Errorf("found %d templates, want 3", got)
+	}
+	if got := len(w.TemplatesNamed("Missing")); got != 0 {
+		t.Errorf("found %d templates, want none", got)
+	}
+}
+
+func TestParam(t *testing.T) {
+	template := Parse("{{t| a | b = c <!-- comment --> |1=x|d|e=1|e=2}}").Templates()[0]
+	tests := []struct {
+		name string
+		// value is the parameter's value, or nil if it shouldn't be found
+		value interface{}
+	}{
+		// a named 1= after the first positional parameter replaces it
+		{"1", "x"},
+		{"2", "d"},
+		{"b", "c"},
+		{" b ", "c"},
+		{"e", "2"},
+		{"3", nil},
+		{"missing", nil},
+	}
+	for _, test := range tests {
+		param := template.Param(test.name)
+		if param == nil {
+			if test.value != nil {
+				t.Errorf("Param(%q) wasn't found", test.name)
+			}
+			continue
+		}
+		if test.value == nil {
+			t.Errorf("Param(%q) = %q, want it not to be found", test.name, param.Value())
+		} else if param.Value() != test.value {
+			t.Errorf("Param(%q) = %q, want %q", test.name, param.Value(), test.value)
+		}
+	}
+
+	params := template.Params()
+	if !params[0].Positional() || params[0].Name() != "1" || params[0].Value() != " a " {
+		t.Errorf("first parameter is %q named %q, want positional 1 with its spaces kept", params[0].Value(), params[0].Name())
+	}
+}
+
+func TestSetParam(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		param string
+		value string
+		want  string
+	}{
+		{"named", "{{t|a=b}}", "a", "c", "{{t|a=c}}"},
+		{"keeps spacing", "{{t\n| a = b\n| c = d\n}}", "a", "x", "{{t\n| a = x\n| c = d\n}}"},
+		{"keeps spacing of the last", "{{t\n| a = b\n| c = d\n}}", "c", "x", "{{t\n| a = b\n| c = x\n}}"},
+		{"positional", "{{t| a |b}}", "1", "x", "{{t|x|b}}"},
+		{"comments go", "{{t|a=b<!-- old -->}}", "a", "c", "{{t|a=c}}"},
+		{"added inline", "{{t|a=b}}", "c", "d", "{{t|a=b|c=d}}"},
+		{"added to a block", "{{t\n| a = b\n}}", "c", "d", "{{t\n| a = b\n| c = d\n}}"},
+		{"added after positional", "{{t|x|a=b|y}}", "c", "d", "{{t|x|a=b|y|c=d}}"},
+		{"added to nothing", "{{t}}", "a", "b", "{{t|a=b}}"},
+		{"added to nothing in a block", "{{t\n}}", "a", "b", "{{t\n|a=b\n}}"},
+		{"value with a template", "{{t|a=b}}", "a", "{{u|v}}", "{{t|a={{u|v}}}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := Parse(test.text)
+			template := w.Templates()[0]
+			template.SetParam(test.param, test.value)
+			if got := w.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if got := template.Param(test.param).Value(); got != test.value {
+				t.Errorf("value is %q, want %q", got, test.value)
+			}
+			// anything added can be found again once it's been saved and parsed
+			if got := Parse(w.String()).Templates()[0].Param(test.param).Value(); got != test.value {
+				t.Errorf("value parsed again is %q, want %q", got, test.value)
+			}
+		})
+	}
+
+	w := Parse("{{t|a=b}}")
+	w.Templates()[0].SetParam("a", "{{u}}")
+	if got := len(w.Templates()); got != 2 {
+		t.Errorf("found %d templates after adding one as a value, want 2", got)
+	}
+}
+
+func TestRemoveParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		param   string
+		want    string
+		removed bool
+	}{
+		{"named", "{{t|a=b|c=d}}", "a", "{{t|c=d}}", true},
+		{"every copy", "{{t|a=b|c=d|a=e}}", "a", "{{t|c=d}}", true},
+		{"missing", "{{t|a=b}}", "c", "{{t|a=b}}", false},
+		{"positional", "{{t|x|y|z}}", "2", "{{t|x|z}}", true},
+		{"last", "{{t\n| a = b\n}}", "a", "{{t\n}}", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := Parse(test.text)
+			if removed := w.Templates()[0].RemoveParam(test.param); removed != test.removed {
+				t.Errorf("removed = %v, want %v", removed, test.removed)
+			}
+			if got := w.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// the positional parameters after one that's removed move up
+	template := Parse("{{t|x|y|z}}").Templates()[0]
+	template.RemoveParam("1")
+	if got := template.Param("1").Value(); got != "y" {
+		t.Errorf("first parameter after removing one is %q, want y", got)
+	}
+	if template.Param("3") != nil {
+		t.Error("third parameter is still there after removing one")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"own line", "a\n{{t}}\nb", "a\nb"},
+		{"first line", "{{t}}\nb", "b"},
+		{"inline", "a {{t}} b", "a  b"},
+		{"end of line", "a {{t}}\nb", "a \nb"},
+		{"nested", "{{u|{{t}}|c}}", "{{u||c}}"},
+		{"in a named parameter", "{{u|a={{t}}}}", "{{u|a=}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := Parse(test.text)
+			templates := w.TemplatesNamed("t")
+			if len(templates) != 1 {
+				t.Fatalf("found %d templates called t, want 1", len(templates))
+			}
+			templates[0].Remove()
+			if got := w.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormaliseTemplateName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"foo", "Foo"},
+		{"Template:foo", "Foo"},
+		{" template : foo_bar ", "Foo bar"},
+		{"TEMPLATE:Foo", "Foo"},
+		{"User:Example/foo", "User:Example/foo"},
+		{"ébauche", "Ébauche"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := NormaliseTemplateName(test.name); got != test.want {
+			t.Errorf("NormaliseTemplateName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
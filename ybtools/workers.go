@@ -0,0 +1,180 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+
+	"cgt.name/pkg/go-mwclient"
+	"cgt.name/pkg/go-mwclient/params"
+)
+
+// PageInQueryContextCallback is a function used as a callback for ForPageInQueryConcurrently.
+// ctx is cancelled if the run is stopping, and any error returned is collected and reported
+// against the page, without stopping any of the others.
+type PageInQueryContextCallback func(ctx context.Context, pageTitle, pageContent, pageContentModel, revTS, curTS string) error
+
+// PageError is an error returned by a ForPageInQueryConcurrently callback for a page.
+type PageError struct {
+	// Index is the position of the page in the query, from zero, so that errors can be put in order
+	Index int
+	Title string
+	Err   error
+}
+
+func (e PageError) Error() string {
+	return e.Title + " (page " + strconv.Itoa(e.Index) + " in query): " + e.Err.Error()
+}
+
+// Workers returns how many pages tasks should process at once, from workers in the task config.
+// It's one unless set otherwise, so that tasks run single-threaded by default.
+func (b *Bot) Workers() int {
+	if b.taskEditConfig.Workers < 1 {
+		return 1
+	}
+	return b.taskEditConfig.Workers
+}
+
+// ForPageInQueryConcurrently is ForPageInQuery with a pool of workers calling the callback, so
+// that up to workers pages are processed at once; if workers is less than one, Workers() is used.
+// With one worker, pages are processed in order on the calling goroutine, as with ForPageInQuery.
+//
+// Once ctx is cancelled, no more pages are started, and those in progress are left to finish.
+// Errors from the callback are reported in the run report, and returned in query order. If a
+// callback or the query panics (for instance through PanicErr, when the kill switch is hit), the
+// workers are stopped, and the panic carries on in the calling goroutine once they've finished,
+// so that deferred functions like SaveRunReport still run. The edit limiter, kill switch and run
+// report are all safe to use from the callback, but anything else it shares has to be made safe
+// by the task.
+func (b *Bot) ForPageInQueryConcurrently(ctx context.Context, parameters params.Values, workers int, callback PageInQueryContextCallback) []PageError {
+	if workers < 1 {
+		workers = b.Workers()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		index int
+		page  queriedPage
+	}
+
+	var errorsMutex sync.Mutex
+	var pageErrors []PageError
+	var panicked interface{}
+	var panickedOnce sync.Once
+
+	runJob := func(j job) {
+		defer func() {
+			if r := recover(); r != nil {
+				panickedOnce.Do(func() { panicked = r })
+				cancel()
+			}
+		}()
+		if err := callback(ctx, j.page.title, j.page.content, j.page.contentModel, j.page.revTS, j.page.curTS); err != nil {
+			errorsMutex.Lock()
+			pageErrors = append(pageErrors, PageError{Index: j.index, Title: j.page.title, Err: err})
+			errorsMutex.Unlock()
+		}
+	}
+
+	jobs := make(chan job, workers)
+	var wg sync.WaitGroup
+	stopWorkers := sync.OnceFunc(func() {
+		close(jobs)
+		wg.Wait()
+	})
+	// if the query itself panics, the workers are stopped before the panic carries on, so none are left behind
+	defer func() {
+		cancel()
+		stopWorkers()
+	}()
+	if workers > 1 {
+		// mwclient caches tokens in a map that isn't safe for concurrent use, so make sure
+		// the edit token is already there before any of the workers go looking for it
+		if _, err := b.client.GetToken(mwclient.CSRFToken); err != nil {
+			log.Println("Failed to fetch an edit token before starting workers, so edits may fail. Error was", err)
+		}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range jobs {
+					if ctx.Err() == nil {
+						runJob(j)
+					}
+				}
+			}()
+		}
+	}
+
+	index := 0
+	query := b.client.NewQuery(parameters)
+QUERYLOOP:
+	for ctx.Err() == nil && query.Next() {
+		curTS, err := query.Resp().GetString("curtimestamp")
+		if err != nil {
+			b.PanicErr("Failed to get current timestamp! Error was", err)
+		}
+
+		pages, err := PagesFromQuery(query.Resp())
+		if err != nil {
+			b.PanicErr("Failed to decode pages from query with error ", err)
+		}
+		for _, page := range pages {
+			p, ok := b.queriedPageFrom(page, curTS)
+			if !ok {
+				continue
+			}
+			j := job{index, p}
+			index++
+
+			if workers == 1 {
+				runJob(j)
+				if ctx.Err() != nil {
+					break QUERYLOOP
+				}
+				continue
+			}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				break QUERYLOOP
+			}
+		}
+	}
+	stopWorkers()
+
+	if panicked != nil {
+		panic(panicked)
+	}
+	if query.Err() != nil {
+		b.ReportErr("Query stopped early, after ", index, " pages, with error ", query.Err())
+	}
+
+	sort.Slice(pageErrors, func(i, j int) bool { return pageErrors[i].Index < pageErrors[j].Index })
+	for _, pageErr := range pageErrors {
+		log.Println("Error processing page", pageErr)
+		b.reportError(pageErr.Title, pageErr.Err.Error())
+	}
+	return pageErrors
+}
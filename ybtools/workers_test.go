@@ -0,0 +1,178 @@
+package ybtools
+
+//
+// Yapperbot Tools, the internal system bits for Yapperbot and co.
+// Copyright (C) 2020 Naypta
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cgt.name/pkg/go-mwclient/params"
+	"github.com/sohomdatta1/yapperbot-services/ybtools/mwtest"
+)
+
+// testPages is how many pages transclude the template the worker tests query for.
+const testPages int = 20
+
+// workersBot returns a bot connected to a wiki with testPages pages, Page 1 onwards,
+// all transcluding the template queried for by workerQuery.
+func workersBot(t *testing.T) *Bot {
+	t.Helper()
+	wiki := mwtest.NewWiki()
+	wiki.AddPage(mwtest.PageSpec{Title: "Template:Queued", Content: "Queued for a worker."})
+	for i := 1; i <= testPages; i++ {
+		wiki.AddPage(mwtest.PageSpec{Title: fmt.Sprintf("Page %d", i), Content: "{{Queued}}"})
+	}
+	return testBot(t, wiki)
+}
+
+// workerQuery fetches the pages a few at a time, so that the query goes on while workers are busy.
+func workerQuery() params.Values {
+	return params.Values{
+		"action":       "query",
+		"prop":         "revisions",
+		"generator":    "embeddedin",
+		"geititle":     "Template:Queued",
+		"geilimit":     "3",
+		"rvprop":       "timestamp|content|contentmodel",
+		"rvslots":      "main",
+		"curtimestamp": "1",
+	}
+}
+
+// workersRunning returns whether any of ForPageInQueryConcurrently's workers are still running.
+func workersRunning() bool {
+	stacks := make([]byte, 1<<20)
+	stacks = stacks[:runtime.Stack(stacks, true)]
+	return strings.Contains(string(stacks), "ForPageInQueryConcurrently.func")
+}
+
+func TestForPageInQueryConcurrentlyErrorsInOrder(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			b := workersBot(t)
+			var calls atomic.Int32
+			errs := b.ForPageInQueryConcurrently(context.Background(), workerQuery(), workers, func(ctx context.Context, pageTitle, pageContent, pageContentModel, revTS, curTS string) error {
+				calls.Add(1)
+				var n int
+				fmt.Sscanf(pageTitle, "Page %d", &n)
+				// later pages finish first, so errors come back out of order
+				time.Sleep(time.Duration(testPages-n) * time.Millisecond)
+				if n%3 == 0 {
+					return errors.New("not a multiple of three")
+				}
+				return nil
+			})
+
+			if got := int(calls.Load()); got != testPages {
+				t.Errorf("callback ran %d times, want %d", got, testPages)
+			}
+			var titles []string
+			for i, pageErr := range errs {
+				titles = append(titles, pageErr.Title)
+				if i > 0 && errs[i-1].Index >= pageErr.Index {
+					t.Errorf("errors aren't in query order: %v", errs)
+				}
+			}
+			want := []string{"Page 3", "Page 6", "Page 9", "Page 12", "Page 15", "Page 18"}
+			if strings.Join(titles, ", ") != strings.Join(want, ", ") {
+				t.Errorf("errors for %v, want %v", titles, want)
+			}
+			if got := len(b.report.Errors); got != len(want) {
+				t.Errorf("%d errors reported, want %d", got, len(want))
+			}
+		})
+	}
+}
+
+func TestForPageInQueryConcurrentlyStopsWhenCancelled(t *testing.T) {
+	const workers int = 2
+	b := workersBot(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	b.ForPageInQueryConcurrently(ctx, workerQuery(), workers, func(ctx context.Context, pageTitle, pageContent, pageContentModel, revTS, curTS string) error {
+		if calls.Add(1) == 3 {
+			cancel()
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	// pages already handed to a worker when ctx is cancelled can still be started
+	if got := int(calls.Load()); got < 3 || got > 3+2*workers {
+		t.Errorf("callback ran %d times after cancelling on the third, want no more than %d", got, 3+2*workers)
+	}
+	if workersRunning() {
+		t.Error("workers are still running")
+	}
+}
+
+func TestForPageInQueryConcurrentlyPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		// query is changed before it's run, to make the query itself panic
+		query func(params.Values)
+		// panicOn is the page the callback panics on, if any
+		panicOn string
+		want    string
+	}{
+		{"callback", nil, "Page 5", "killed on Page 5"},
+		{"query", func(p params.Values) { delete(p, "curtimestamp") }, "", "Failed to get current timestamp"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := workersBot(t)
+			query := workerQuery()
+			if test.query != nil {
+				test.query(query)
+			}
+
+			var running atomic.Int32
+			defer func() {
+				r := recover()
+				if r == nil || !strings.Contains(fmt.Sprint(r), test.want) {
+					t.Fatalf("panicked with %v, want %q", r, test.want)
+				}
+				if got := running.Load(); got != 0 {
+					t.Errorf("panic carried on with %d callbacks still running", got)
+				}
+				if workersRunning() {
+					t.Error("panic carried on with workers left running")
+				}
+			}()
+			b.ForPageInQueryConcurrently(context.Background(), query, 4, func(ctx context.Context, pageTitle, pageContent, pageContentModel, revTS, curTS string) error {
+				running.Add(1)
+				defer running.Add(-1)
+				if pageTitle == test.panicOn {
+					panic("killed on " + pageTitle)
+				}
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+			t.Fatal("ForPageInQueryConcurrently returned without panicking")
+		})
+	}
+}